@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ---------- Access log ----------
+
+// Every HTTP request is logged, once it is done, to logs/access/YYYY-MM-DD.log
+// (local days, kept logRetention days like the main log) as
+//
+//	ACCESS method=GET path=/api/status status=200 ms=3 bytes=5120 ip=1.2.3.4 user=admin token=
+//
+// token is the access token presented (X-Token / ?token=), masked; the query
+// string is left out so tokens never land in the file. WS and SSE connections
+// are logged when they close, with their whole duration. With accessLog.sample
+// below 1 only that fraction of successful requests is kept; errors (status
+// 400 and up) always are. GET /api/logs?kind=access reads the file back.
+
+const accessLogDir = "logs/access"
+
+type AccessLogConfig struct {
+	Disabled bool    `json:"disabled,omitempty"`
+	Sample   float64 `json:"sample,omitempty"` // 0 or 1 = every request
+}
+
+type accessLogFile struct {
+	mu   sync.Mutex
+	date string
+	f    *os.File
+	l    *log.Logger
+}
+
+var accessLog = &accessLogFile{}
+
+func (a *accessLogFile) printf(format string, args ...any) {
+	date := time.Now().Format("2006-01-02")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil || a.date != date {
+		if a.f != nil {
+			_ = a.f.Close()
+			a.f = nil
+		}
+		f, err := os.OpenFile(filepath.Join(accessLogDir, date+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			logger.Printf("ACCESS_LOG_OPEN_ERROR: %v", err)
+			return
+		}
+		a.f, a.date = f, date
+		a.l = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+		pruneDayFiles(accessLogDir, logRetention)
+	}
+	a.l.Printf(format, args...)
+}
+
+// statusWriter records what the handler sent.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	if s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		cfgMu.RLock()
+		ac := cfg.AccessLog
+		cfgMu.RUnlock()
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if ac.Disabled || (status < 400 && ac.Sample > 0 && ac.Sample < 1 && rand.Float64() >= ac.Sample) {
+			return
+		}
+		tok, _ := tokenOK(r)
+		accessLog.printf("ACCESS method=%s path=%s status=%d ms=%d bytes=%d ip=%s user=%s token=%s",
+			r.Method, r.URL.EscapedPath(), status, time.Since(start).Milliseconds(), sw.bytes, remoteIP(r), requestUser(r), maskToken(tok))
+	})
+}
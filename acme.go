@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------- ACME (Let's Encrypt) ----------
+
+// With server.acmeDomains set (and no tlsCert/tlsKey) the server gets its own
+// certificate from an ACME CA, Let's Encrypt by default, and renews it acmeRenew
+// before it expires. This is a minimal RFC 8555 client: one ES256 account, the
+// http-01 challenge only, so the domains must resolve to this host and port 80
+// must reach it; the plain HTTP listener (httpRedirect, default ":80") answers
+// the challenges and redirects everything else to HTTPS. The account key, the
+// certificate and its key live in data/acme, so restarts reuse them. Until the
+// first certificate is issued HTTPS handshakes fail; a failed renewal raises an
+// ACME_FAILED incident and is retried every acmeRetry.
+
+const (
+	acmeDir          = "data/acme"
+	acmeLetsEncrypt  = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeRenew        = 30 * 24 * time.Hour // renew when less than this is left
+	acmeCheck        = 12 * time.Hour
+	acmeRetry        = time.Hour
+	acmePollInterval = 2 * time.Second
+	acmePollTimeout  = 2 * time.Minute
+)
+
+var (
+	acmeCert atomic.Pointer[tls.Certificate]
+
+	acmeTokensMu sync.Mutex
+	acmeTokens   = map[string]string{} // http-01 token -> key authorization
+)
+
+func acmeEnabled() bool {
+	return len(acmeDomains) > 0
+}
+
+// acmeGetCertificate is tls.Config.GetCertificate in ACME mode.
+func acmeGetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := acmeCert.Load(); c != nil {
+		return c, nil
+	}
+	return nil, errors.New("acme: no certificate yet")
+}
+
+// acmeChallenge answers http-01 challenges and hands everything else to next.
+func acmeChallenge(next http.Handler) http.Handler {
+	const prefix = "/.well-known/acme-challenge/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			acmeTokensMu.Lock()
+			ka, ok := acmeTokens[token]
+			acmeTokensMu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = io.WriteString(w, ka)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acmeLoop keeps a valid certificate for acmeDomains loaded, obtaining or
+// renewing it when needed.
+func acmeLoop() {
+	if c, err := loadACMECert(); err == nil {
+		acmeCert.Store(c)
+		logger.Printf("ACME_CERT_LOADED domains=%s notAfter=%s", strings.Join(acmeDomains, ","), c.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	for {
+		wait := acmeCheck
+		if c := acmeCert.Load(); c == nil || time.Until(c.Leaf.NotAfter) < acmeRenew {
+			if err := acmeObtain(); err != nil {
+				logger.Printf("ACME_ERROR: %v", err)
+				raiseIncident("ACME_FAILED", err.Error())
+				wait = acmeRetry
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+func acmePath(name string) string {
+	return filepath.Join(acmeDir, name)
+}
+
+// loadACMECert loads the stored certificate if it covers exactly acmeDomains.
+func loadACMECert() (*tls.Certificate, error) {
+	c, err := tls.LoadX509KeyPair(acmePath("cert.pem"), acmePath("key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	have := slices.Clone(leaf.DNSNames)
+	want := slices.Clone(acmeDomains)
+	slices.Sort(have)
+	slices.Sort(want)
+	if !slices.Equal(have, want) {
+		return nil, fmt.Errorf("stored certificate is for %v", leaf.DNSNames)
+	}
+	c.Leaf = leaf
+	return &c, nil
+}
+
+// acmeObtain runs one order for acmeDomains and installs the result.
+func acmeObtain() error {
+	key, err := acmeAccountKey()
+	if err != nil {
+		return err
+	}
+	a := &acmeClient{key: key, http: &http.Client{Timeout: 30 * time.Second}}
+	if err := a.init(acmeDirectoryURL); err != nil {
+		return err
+	}
+	contact := []string{}
+	if acmeEmail != "" {
+		contact = append(contact, "mailto:"+acmeEmail)
+	}
+	_, h, err := a.post(a.dir.NewAccount, map[string]any{"termsOfServiceAgreed": true, "contact": contact}, nil)
+	if err != nil {
+		return fmt.Errorf("account: %w", err)
+	}
+	a.kid = h.Get("Location")
+
+	ids := []map[string]string{}
+	for _, d := range acmeDomains {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	var order acmeOrder
+	_, h, err = a.post(a.dir.NewOrder, map[string]any{"identifiers": ids}, &order)
+	if err != nil {
+		return fmt.Errorf("order: %w", err)
+	}
+	orderURL := h.Get("Location")
+	for _, az := range order.Authorizations {
+		if err := a.authorize(az); err != nil {
+			return err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: acmeDomains[0]},
+		DNSNames: acmeDomains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	if _, _, err := a.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	deadline := time.Now().Add(acmePollTimeout)
+	for order.Status != "valid" {
+		if order.Status == "invalid" || time.Now().After(deadline) {
+			return fmt.Errorf("order %s", order.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := a.post(orderURL, nil, &order); err != nil {
+			return fmt.Errorf("order: %w", err)
+		}
+	}
+	chain, _, err := a.post(order.Certificate, nil, nil)
+	if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	c, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(acmePath("key.pem"), keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(acmePath("cert.pem"), chain, 0o644); err != nil {
+		return err
+	}
+	acmeCert.Store(&c)
+	logger.Printf("ACME_CERT_ISSUED domains=%s notAfter=%s", strings.Join(acmeDomains, ","), c.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// acmeAccountKey loads the account key, creating it on first use.
+func acmeAccountKey() (*ecdsa.PrivateKey, error) {
+	path := acmePath("account.key")
+	if b, err := os.ReadFile(path); err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(blk.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthz struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallengeObj `json:"challenges"`
+}
+
+type acmeChallengeObj struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+type acmeClient struct {
+	key   *ecdsa.PrivateKey
+	kid   string // account URL; empty until the account exists
+	nonce string
+	http  *http.Client
+	dir   struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+func (a *acmeClient) init(directory string) error {
+	resp, err := a.http.Get(directory)
+	if err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("directory: HTTP %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(&a.dir)
+}
+
+func (a *acmeClient) jwk() map[string]string {
+	p := a.key.PublicKey
+	return map[string]string{ // members in lexicographic order, as the thumbprint needs
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(p.X.FillBytes(make([]byte, 32))),
+		"y":   b64(p.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// keyAuthorization is token "." base64url(SHA-256 of the JWK), RFC 8555 8.1.
+func (a *acmeClient) keyAuthorization(token string) string {
+	j := a.jwk()
+	thumb := sha256.Sum256([]byte(`{"crv":"` + j["crv"] + `","kty":"` + j["kty"] + `","x":"` + j["x"] + `","y":"` + j["y"] + `"}`))
+	return token + "." + b64(thumb[:])
+}
+
+func (a *acmeClient) newNonce() error {
+	resp, err := a.http.Head(a.dir.NewNonce)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	a.nonce = resp.Header.Get("Replay-Nonce")
+	if a.nonce == "" {
+		return errors.New("no nonce")
+	}
+	return nil
+}
+
+// post sends a JWS-signed request; payload nil is POST-as-GET. A JSON reply is
+// decoded into out when given; the raw body and headers are returned as well.
+func (a *acmeClient) post(url string, payload, out any) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		body, h, status, err := a.postOnce(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if status >= 400 {
+			var prob struct {
+				Type   string `json:"type"`
+				Detail string `json:"detail"`
+			}
+			_ = json.Unmarshal(body, &prob)
+			if prob.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("HTTP %d: %s %s", status, prob.Type, prob.Detail)
+		}
+		if out != nil {
+			if err := json.Unmarshal(body, out); err != nil {
+				return nil, nil, err
+			}
+		}
+		return body, h, nil
+	}
+}
+
+func (a *acmeClient) postOnce(url string, payload any) ([]byte, http.Header, int, error) {
+	if a.nonce == "" {
+		if err := a.newNonce(); err != nil {
+			return nil, nil, 0, fmt.Errorf("nonce: %w", err)
+		}
+	}
+	prot := map[string]any{"alg": "ES256", "nonce": a.nonce, "url": url}
+	if a.kid != "" {
+		prot["kid"] = a.kid
+	} else {
+		prot["jwk"] = a.jwk()
+	}
+	pb, err := json.Marshal(prot)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pl := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		pl = b64(b)
+	}
+	signing := b64(pb) + "." + pl
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	jws, err := json.Marshal(map[string]string{"protected": b64(pb), "payload": pl, "signature": b64(sig)})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	resp, err := a.http.Post(url, "application/jose+json", bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	a.nonce = resp.Header.Get("Replay-Nonce")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return body, resp.Header, resp.StatusCode, nil
+}
+
+// authorize completes the http-01 challenge of one authorization.
+func (a *acmeClient) authorize(url string) error {
+	var az acmeAuthz
+	if _, _, err := a.post(url, nil, &az); err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if az.Status == "valid" {
+		return nil
+	}
+	i := slices.IndexFunc(az.Challenges, func(c acmeChallengeObj) bool { return c.Type == "http-01" })
+	if i < 0 {
+		return fmt.Errorf("%s: CA offers no http-01 challenge", az.Identifier.Value)
+	}
+	ch := az.Challenges[i]
+	acmeTokensMu.Lock()
+	acmeTokens[ch.Token] = a.keyAuthorization(ch.Token)
+	acmeTokensMu.Unlock()
+	defer func() {
+		acmeTokensMu.Lock()
+		delete(acmeTokens, ch.Token)
+		acmeTokensMu.Unlock()
+	}()
+
+	if _, _, err := a.post(ch.URL, map[string]any{}, nil); err != nil {
+		return fmt.Errorf("%s: challenge: %w", az.Identifier.Value, err)
+	}
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		time.Sleep(acmePollInterval)
+		if _, _, err := a.post(url, nil, &az); err != nil {
+			return fmt.Errorf("authorization: %w", err)
+		}
+		switch {
+		case az.Status == "valid":
+			return nil
+		case az.Status != "pending" || time.Now().After(deadline):
+			return fmt.Errorf("%s: authorization %s", az.Identifier.Value, az.Status)
+		}
+	}
+}
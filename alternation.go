@@ -0,0 +1,41 @@
+package main
+
+// ---------- Alternation trigger ----------
+
+// Rules.Alternation is the mirror image of the streak thresholds: it fires an ALT
+// signal once Length judged blocks in a row alternated strictly (ON,OFF,ON,...).
+// Like the sequence trigger it ignores the reverse gate, obeys schedule and trigger
+// caps, and arms the HIT check. A trigger starts the run over. The run is part of
+// machineState (RuntimeState.AltLast/AltRun).
+
+type AlternationRule struct {
+	Enabled bool `json:"enabled"`
+	Length  int  `json:"length,omitempty"` // blocks in the alternating run, 2-20
+}
+
+func (a *AlternationRule) sanitize() {
+	if !a.Enabled && a.Length == 0 {
+		return
+	}
+	a.Length = clamp(a.Length, 2, 20)
+}
+
+// pushAlt extends or restarts the alternating run with a judged ON/OFF state and
+// reports whether it reached the configured length.
+func (s *RuntimeState) pushAlt(state string, r AlternationRule) bool {
+	if !r.Enabled {
+		s.AltLast, s.AltRun = "", 0
+		return false
+	}
+	if state == s.AltLast {
+		s.AltRun = 1
+	} else {
+		s.AltRun++
+	}
+	s.AltLast = state
+	if s.AltRun < clamp(r.Length, 2, 20) {
+		return false
+	}
+	s.AltLast, s.AltRun = "", 0
+	return true
+}
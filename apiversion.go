@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---------- API versioning ----------
+
+// Every /api/<path> endpoint is also served as /api/v1/<path>, the stable name for
+// integrations: a future change to a response shape ships under /api/v2 while v1
+// keeps its meaning. The unversioned paths stay as aliases of v1 for existing
+// clients and the web UI.
+
+const apiVersion = "v1"
+
+// apiV1 re-dispatches /api/v1/... to the /api/... handler on mux.
+func apiV1(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/api/" + strings.TrimPrefix(r.URL.Path, "/api/"+apiVersion+"/")
+		r2.URL.RawPath = ""
+		w.Header().Set("X-API-Version", apiVersion)
+		mux.ServeHTTP(w, r2)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// ---------- Argon2id (standard library only) ----------
+
+// Argon2id (RFC 9106, version 0x13) with the BLAKE2b it is built on (RFC 7693),
+// for hashing the web accounts' passwords. Lanes are computed one after the
+// other; the result is the same as a parallel implementation's.
+
+const (
+	argon2Version    = 0x13
+	argon2idType     = 2
+	argon2SyncPoints = 4
+	argon2BlockWords = 128 // 1 KiB blocks
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+// argon2id derives keyLen bytes from password and salt using memory KiB, time
+// passes and threads lanes.
+func argon2id(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	return argon2idKey(password, salt, nil, nil, time, memory, threads, keyLen)
+}
+
+// argon2idKey is argon2id with the optional secret and associated data.
+func argon2idKey(password, salt, secret, data []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	if time < 1 || threads < 1 {
+		panic("argon2: time and threads must be at least 1")
+	}
+	p := uint32(threads)
+
+	h0in := make([]byte, 0, 40+len(password)+len(salt)+len(secret)+len(data))
+	for _, v := range []uint32{p, keyLen, memory, time, argon2Version, argon2idType} {
+		h0in = binary.LittleEndian.AppendUint32(h0in, v)
+	}
+	for _, b := range [][]byte{password, salt, secret, data} {
+		h0in = binary.LittleEndian.AppendUint32(h0in, uint32(len(b)))
+		h0in = append(h0in, b...)
+	}
+	h0 := blake2bSum(h0in, 64)
+
+	if memory < 2*argon2SyncPoints*p {
+		memory = 2 * argon2SyncPoints * p
+	}
+	memory = memory / (argon2SyncPoints * p) * (argon2SyncPoints * p)
+	laneLen := memory / p
+	segLen := laneLen / argon2SyncPoints
+
+	B := make([]argon2Block, memory)
+	seed := append(h0, make([]byte, 8)...)
+	var buf [1024]byte
+	for lane := uint32(0); lane < p; lane++ {
+		binary.LittleEndian.PutUint32(seed[68:], lane)
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(seed[64:], i)
+			blake2bLong(buf[:], seed)
+			for w := range B[lane*laneLen+i] {
+				B[lane*laneLen+i][w] = binary.LittleEndian.Uint64(buf[w*8:])
+			}
+		}
+	}
+
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			for lane := uint32(0); lane < p; lane++ {
+				argon2Segment(B, pass, slice, lane, p, laneLen, segLen, memory, time)
+			}
+		}
+	}
+
+	final := B[laneLen-1]
+	for lane := uint32(1); lane < p; lane++ {
+		for w := range final {
+			final[w] ^= B[lane*laneLen+laneLen-1][w]
+		}
+	}
+	for w, v := range final {
+		binary.LittleEndian.PutUint64(buf[w*8:], v)
+	}
+	out := make([]byte, keyLen)
+	blake2bLong(out, buf[:])
+	return out
+}
+
+func argon2Segment(B []argon2Block, pass, slice, lane, lanes, laneLen, segLen, memory, time uint32) {
+	// the first half of the first pass picks references independently of the
+	// password (argon2i), the rest from the previous block (argon2d)
+	dataIndependent := pass == 0 && slice < argon2SyncPoints/2
+	var addresses, input, zero argon2Block
+	if dataIndependent {
+		input[0], input[1], input[2] = uint64(pass), uint64(lane), uint64(slice)
+		input[3], input[4], input[5] = uint64(memory), uint64(time), argon2idType
+	}
+	index := uint32(0)
+	if pass == 0 && slice == 0 {
+		index = 2 // the first two blocks come from H0
+		if dataIndependent {
+			input[6]++
+			argon2Compress(&addresses, &input, &zero, false)
+			argon2Compress(&addresses, &addresses, &zero, false)
+		}
+	}
+	offset := lane*laneLen + slice*segLen + index
+	for ; index < segLen; index, offset = index+1, offset+1 {
+		prev := offset - 1
+		if index == 0 && slice == 0 {
+			prev += laneLen // wrap to the lane's last block
+		}
+		var random uint64
+		if dataIndependent {
+			if index%argon2BlockWords == 0 {
+				input[6]++
+				argon2Compress(&addresses, &input, &zero, false)
+				argon2Compress(&addresses, &addresses, &zero, false)
+			}
+			random = addresses[index%argon2BlockWords]
+		} else {
+			random = B[prev][0]
+		}
+		ref := argon2RefIndex(random, laneLen, segLen, lanes, pass, slice, lane, index)
+		argon2Compress(&B[offset], &B[prev], &B[ref], pass > 0)
+	}
+}
+
+// argon2RefIndex maps random to the block the current one is mixed with.
+func argon2RefIndex(random uint64, laneLen, segLen, lanes, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % lanes
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+	m, s := 3*segLen, ((slice+1)%argon2SyncPoints)*segLen
+	if lane == refLane {
+		m += index
+	}
+	if pass == 0 {
+		m, s = slice*segLen, 0
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		m--
+	}
+	x := random & 0xFFFFFFFF
+	x = x * x >> 32
+	x = x * uint64(m) >> 32
+	return refLane*laneLen + uint32((uint64(s)+uint64(m)-(x+1))%uint64(laneLen))
+}
+
+// argon2Compress sets (or with xor, XORs into) out the compression G(x, y).
+func argon2Compress(out, x, y *argon2Block, xor bool) {
+	var r, q argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	q = r
+	for i := 0; i < argon2BlockWords; i += 16 {
+		blamka(&q[i], &q[i+1], &q[i+2], &q[i+3], &q[i+4], &q[i+5], &q[i+6], &q[i+7],
+			&q[i+8], &q[i+9], &q[i+10], &q[i+11], &q[i+12], &q[i+13], &q[i+14], &q[i+15])
+	}
+	for i := 0; i < 16; i += 2 {
+		blamka(&q[i], &q[i+1], &q[i+16], &q[i+17], &q[i+32], &q[i+33], &q[i+48], &q[i+49],
+			&q[i+64], &q[i+65], &q[i+80], &q[i+81], &q[i+96], &q[i+97], &q[i+112], &q[i+113])
+	}
+	for i := range out {
+		if xor {
+			out[i] ^= r[i] ^ q[i]
+		} else {
+			out[i] = r[i] ^ q[i]
+		}
+	}
+}
+
+// blamka is the BLAKE2b round without message, with multiplications.
+func blamka(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 *uint64) {
+	gb(v0, v4, v8, v12)
+	gb(v1, v5, v9, v13)
+	gb(v2, v6, v10, v14)
+	gb(v3, v7, v11, v15)
+	gb(v0, v5, v10, v15)
+	gb(v1, v6, v11, v12)
+	gb(v2, v7, v8, v13)
+	gb(v3, v4, v9, v14)
+}
+
+func gb(a, b, c, d *uint64) {
+	const lo = 0xFFFFFFFF
+	*a += *b + 2*(*a&lo)*(*b&lo)
+	*d = bits.RotateLeft64(*d^*a, -32)
+	*c += *d + 2*(*c&lo)*(*d&lo)
+	*b = bits.RotateLeft64(*b^*c, -24)
+	*a += *b + 2*(*a&lo)*(*b&lo)
+	*d = bits.RotateLeft64(*d^*a, -16)
+	*c += *d + 2*(*c&lo)*(*d&lo)
+	*b = bits.RotateLeft64(*b^*c, -63)
+}
+
+// blake2bLong is Argon2's variable-length hash H' into out.
+func blake2bLong(out, in []byte) {
+	pre := binary.LittleEndian.AppendUint32(nil, uint32(len(out)))
+	if len(out) <= 64 {
+		copy(out, blake2bSum(append(pre, in...), len(out)))
+		return
+	}
+	v := blake2bSum(append(pre, in...), 64)
+	for len(out) > 64 {
+		copy(out, v[:32])
+		out = out[32:]
+		if len(out) > 64 {
+			v = blake2bSum(v, 64)
+		}
+	}
+	copy(out, blake2bSum(v, len(out)))
+}
+
+// ---------- BLAKE2b ----------
+
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [12][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+}
+
+// blake2bSum is the unkeyed BLAKE2b hash of in, size bytes long (1-64).
+func blake2bSum(in []byte, size int) []byte {
+	h := blake2bIV
+	h[0] ^= 0x01010000 ^ uint64(size)
+	var block [128]byte
+	var t uint64
+	for len(in) > 128 {
+		t += 128
+		blake2bCompress(&h, in[:128], t, false)
+		in = in[128:]
+	}
+	t += uint64(len(in))
+	copy(block[:], in)
+	blake2bCompress(&h, block[:], t, true)
+
+	out := make([]byte, 64)
+	for i, v := range h {
+		binary.LittleEndian.PutUint64(out[i*8:], v)
+	}
+	return out[:size]
+}
+
+func blake2bCompress(h *[8]uint64, block []byte, t uint64, last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= t // inputs stay far below 2^64 bytes, so the high word is 0
+	if last {
+		v[14] = ^v[14]
+	}
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+	for _, s := range blake2bSigma {
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Auth abuse guard ----------
+
+// Login and setup (POST /api/login, /api/setup, or their /api/v1 aliases) take
+// at most authAttemptsRPM attempts per minute from one IP, and every 401 an IP
+// collects (bad passwords, unknown tokens, unauthenticated WS/SSE) counts
+// against it: authMaxFailures within authFailWindow bans the IP from the whole
+// server for authBanFor, with an AUTH_BANNED incident. A successful login clears the IP's failures. Behind a
+// reverse proxy every client shares the proxy's address, so the ban hits them
+// all; keep the proxy's own limits in front in that case.
+
+const (
+	authAttemptsRPM = 10
+	authFailWindow  = 15 * time.Minute
+	authMaxFailures = 10
+	authBanFor      = 30 * time.Minute
+)
+
+type authIPState struct {
+	fails       []time.Time // within authFailWindow, oldest first
+	bannedUntil time.Time
+}
+
+var authGuard = struct {
+	mu    sync.Mutex
+	ips   map[string]*authIPState
+	swept time.Time
+}{ips: map[string]*authIPState{}}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// authBanned returns how long ip is still banned.
+func authBanned(ip string, now time.Time) time.Duration {
+	authGuard.mu.Lock()
+	defer authGuard.mu.Unlock()
+	if st := authGuard.ips[ip]; st != nil && now.Before(st.bannedUntil) {
+		return st.bannedUntil.Sub(now)
+	}
+	return 0
+}
+
+// authFailed books a 401 for ip and bans it once it has too many.
+func authFailed(ip string, now time.Time) {
+	authGuard.mu.Lock()
+	if now.Sub(authGuard.swept) > authFailWindow {
+		for k, st := range authGuard.ips {
+			if now.After(st.bannedUntil) && (len(st.fails) == 0 || now.Sub(st.fails[len(st.fails)-1]) > authFailWindow) {
+				delete(authGuard.ips, k)
+			}
+		}
+		authGuard.swept = now
+	}
+	st := authGuard.ips[ip]
+	if st == nil {
+		st = &authIPState{}
+		authGuard.ips[ip] = st
+	}
+	i := 0
+	for i < len(st.fails) && now.Sub(st.fails[i]) > authFailWindow {
+		i++
+	}
+	st.fails = append(st.fails[i:], now)
+	n := len(st.fails)
+	banned := n >= authMaxFailures && !now.Before(st.bannedUntil)
+	if banned {
+		st.bannedUntil = now.Add(authBanFor)
+		st.fails = nil
+	}
+	authGuard.mu.Unlock()
+
+	if banned {
+		raiseIncident("AUTH_BANNED", fmt.Sprintf("ip=%s banned for %s after %d failed auth attempts within %s", ip, authBanFor, n, authFailWindow))
+	}
+}
+
+func authSucceeded(ip string) {
+	authGuard.mu.Lock()
+	defer authGuard.mu.Unlock()
+	if st := authGuard.ips[ip]; st != nil {
+		st.fails = nil
+	}
+}
+
+func withAuthGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		now := time.Now()
+		if left := authBanned(ip, now); left > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+			http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+			return
+		}
+		// the /api/v1 alias is only rewritten inside the mux
+		path := r.URL.Path
+		if rest, ok := strings.CutPrefix(path, "/api/"+apiVersion+"/"); ok {
+			path = "/api/" + rest
+		}
+		login := r.Method == "POST" && (path == "/api/login" || path == "/api/setup")
+		if login {
+			if ok, wait := rateTake("auth:"+ip, authAttemptsRPM, now); !ok {
+				logger.Printf("AUTH_THROTTLED ip=%s path=%s", ip, r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		switch {
+		case sw.status == http.StatusUnauthorized:
+			logger.Printf("AUTH_FAILED ip=%s path=%s", ip, r.URL.Path)
+			authFailed(ip, now)
+		case login && path == "/api/login" && sw.status == http.StatusFound:
+			authSucceeded(ip)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---------- Backtest ----------
+
+// A backtest re-judges stored blocks (see history.go) and drives a fresh, quiet state
+// machine with the given rules. Nothing is broadcast and live state is untouched.
+
+const backtestMaxRange = historyRetention * 24 * time.Hour
+
+type BacktestRequest struct {
+	From  string `json:"from"`  // RFC3339 or YYYY-MM-DD; default 24h before To
+	To    string `json:"to"`    // RFC3339 or YYYY-MM-DD (exclusive); default now
+	Rules *Rules `json:"rules"` // nil = current rules; empty judge = current judge
+}
+
+type BacktestResult struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Blocks      int    `json:"blocks"`
+	Neutral     int    `json:"neutral"`
+	Unjudged    int    `json:"unjudged"`
+	FirstHeight int64  `json:"firstHeight"`
+	LastHeight  int64  `json:"lastHeight"`
+
+	OnSignals  int     `json:"onSignals"`
+	OffSignals int     `json:"offSignals"`
+	SeqSignals int     `json:"seqSignals"`
+	AltSignals int     `json:"altSignals"`
+	Hits       int     `json:"hits"`
+	Misses     int     `json:"misses"`
+	HitRate    float64 `json:"hitRate"` // hits / (hits+misses), 0 when no HIT was checked
+
+	LongestHitStreak  int `json:"longestHitStreak"`
+	LongestMissStreak int `json:"longestMissStreak"`
+	LongestOnRun      int `json:"longestOnRun"` // consecutive ON blocks
+	LongestOffRun     int `json:"longestOffRun"`
+
+	Rules Rules `json:"rules"`
+}
+
+// parseBacktestTime accepts RFC3339 or a bare UTC date.
+func parseBacktestTime(s string, def time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func runBacktest(blocks []BlockInfo, rules Rules) BacktestResult {
+	res := BacktestResult{Blocks: len(blocks), Rules: rules}
+	m := RuntimeState{WaitingReverse: true, Quiet: true}
+
+	var hitStreak, missStreak, run int
+	var runState string
+	for _, b := range blocks {
+		if res.FirstHeight == 0 {
+			res.FirstHeight = b.Height
+		}
+		res.LastHeight = b.Height
+
+		blk := b.block()
+		t := blk.Time
+		state, ok := judgeBlock(rules.Judge, blk)
+		if !ok {
+			res.Unjudged++
+			continue
+		}
+		if state == stateNeutral {
+			res.Neutral++
+		}
+
+		if state == runState {
+			run++
+		} else {
+			runState, run = state, 1
+		}
+		if state == "ON" && run > res.LongestOnRun {
+			res.LongestOnRun = run
+		}
+		if state == "OFF" && run > res.LongestOffRun {
+			res.LongestOffRun = run
+		}
+
+		for _, s := range m.evaluate(b.Height, state, t, rules) {
+			switch s.Type {
+			case "ON":
+				res.OnSignals++
+			case "OFF":
+				res.OffSignals++
+			case "SEQ":
+				res.SeqSignals++
+			case "ALT":
+				res.AltSignals++
+			}
+		}
+		if m.HitOutcome == "" {
+			continue
+		}
+		if m.HitOutcome == "HIT" {
+			res.Hits++
+			hitStreak++
+			missStreak = 0
+		} else {
+			res.Misses++
+			missStreak++
+			hitStreak = 0
+		}
+		res.LongestHitStreak = max(res.LongestHitStreak, hitStreak)
+		res.LongestMissStreak = max(res.LongestMissStreak, missStreak)
+	}
+	if n := res.Hits + res.Misses; n > 0 {
+		res.HitRate = float64(res.Hits) / float64(n)
+	}
+	return res
+}
+
+func apiBacktest(w http.ResponseWriter, r *http.Request) {
+	var req BacktestRequest
+	if r.ContentLength != 0 {
+		if err := readJSON(r, &req); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	to, err := parseBacktestTime(req.To, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseBacktestTime(req.From, to.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > backtestMaxRange {
+		http.Error(w, "range too large", http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.RLock()
+	rules := cfg.Rules
+	cfgMu.RUnlock()
+	if req.Rules != nil {
+		rr := *req.Rules
+		if err := normalizeRules(&rr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rr.Judge.Type == "" {
+			rr.Judge = rules.Judge
+		}
+		rules = rr
+	}
+	if err := normalizeJudge(&rules.Judge); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blocks, err := readHistory(from, to)
+	if err != nil {
+		http.Error(w, "read history failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := runBacktest(blocks, rules)
+	res.From = from.UTC().Format(time.RFC3339)
+	res.To = to.UTC().Format(time.RFC3339)
+	res.Rules.Judge.Source = ""
+	logger.Printf("BACKTEST from=%s to=%s blocks=%d hits=%d misses=%d", res.From, res.To, res.Blocks, res.Hits, res.Misses)
+	mustJSON(w, 200, res)
+}
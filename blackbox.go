@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	黑匣子（Black box）
+	- 持续记录管线输入与判定：区块接收、ON/OFF 判定、状态机迁移、信号发出、规则快照、运行态清零
+	- 仅保留最近 N 分钟（内存），超窗的记录被裁掉；被裁掉的最后一份规则/状态作为导出锚点
+	- 导出：GET /api/blackbox（二进制）；本地复现：tron-signal -replay <file>
+	- 格式：magic + 若干帧；帧 = uvarint(len) + kind(1B) + varint(unixMilli) + payload
+*/
+
+const (
+	bbMagic          = "TSBB1\n"
+	bbDefaultMinutes = 10
+	bbMaxRecords     = 200000 // hard cap so a runaway source can't eat memory
+)
+
+const (
+	bbKindBlock  byte = 1 // height, hash, block unixMilli, txCount (-1 unknown; absent in old dumps)
+	bbKindJudge  byte = 2 // height, state ("" = invalid hash)
+	bbKindState  byte = 3 // machineState after a transition
+	bbKindSignal byte = 4 // emitted signal
+	bbKindRules  byte = 5 // rules snapshot (json)
+	bbKindReset  byte = 6 // runtime reset
+)
+
+type bbRecord struct {
+	at   time.Time
+	kind byte
+	data []byte
+}
+
+type blackBox struct {
+	mu      sync.Mutex
+	window  time.Duration
+	records []bbRecord
+
+	// anchors: latest rules/state records that fell out of the window
+	baseRules *bbRecord
+	baseState *bbRecord
+
+	lastRules []byte
+}
+
+var bb = &blackBox{window: bbDefaultMinutes * time.Minute}
+
+func (b *blackBox) setWindow(minutes int) {
+	if minutes <= 0 {
+		minutes = bbDefaultMinutes
+	}
+	b.mu.Lock()
+	b.window = time.Duration(minutes) * time.Minute
+	b.mu.Unlock()
+}
+
+func (b *blackBox) append(kind byte, data []byte) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.records = append(b.records, bbRecord{at: now, kind: kind, data: data})
+
+	// prune by time and by count, keeping the newest anchors
+	cutoff := now.Add(-b.window)
+	drop := 0
+	for drop < len(b.records) && (b.records[drop].at.Before(cutoff) || len(b.records)-drop > bbMaxRecords) {
+		r := b.records[drop]
+		switch r.kind {
+		case bbKindRules:
+			b.baseRules = &r
+		case bbKindState:
+			b.baseState = &r
+		case bbKindReset:
+			b.baseState = nil
+		}
+		drop++
+	}
+	if drop > 0 {
+		b.records = append(b.records[:0:0], b.records[drop:]...)
+	}
+}
+
+func (b *blackBox) recordBlock(blk Block) {
+	var w bbWriter
+	w.varint(blk.Height)
+	w.str(blk.Hash)
+	w.varint(blk.Time.UnixMilli())
+	w.varint(int64(blk.TxCount))
+	b.append(bbKindBlock, w.b)
+}
+
+func (b *blackBox) recordJudge(height int64, state string) {
+	var w bbWriter
+	w.varint(height)
+	w.str(state)
+	b.append(bbKindJudge, w.b)
+}
+
+func (b *blackBox) recordState(m machineState) {
+	b.append(bbKindState, encodeMachineState(m))
+}
+
+func (b *blackBox) recordSignal(s Signal) {
+	var w bbWriter
+	w.str(s.Type)
+	w.varint(s.Height)
+	w.varint(s.BaseHeight)
+	w.str(s.State)
+	w.str(s.TimeISO)
+	w.varint(int64(s.Offset))
+	w.varint(int64(s.Streak))
+	w.str(s.Expect)
+	b.append(bbKindSignal, w.b)
+}
+
+// recordRules only writes when the rules differ from the last recorded snapshot.
+func (b *blackBox) recordRules(r Rules) {
+	js, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	same := bytes.Equal(js, b.lastRules)
+	if !same {
+		b.lastRules = js
+	}
+	b.mu.Unlock()
+	if !same {
+		b.append(bbKindRules, js)
+	}
+}
+
+func (b *blackBox) recordReset() {
+	b.append(bbKindReset, nil)
+}
+
+// dump writes anchors first, then every record still inside the window.
+func (b *blackBox) dump(w io.Writer) error {
+	b.mu.Lock()
+	recs := make([]bbRecord, 0, len(b.records)+2)
+	if b.baseRules != nil {
+		recs = append(recs, *b.baseRules)
+	}
+	if b.baseState != nil {
+		recs = append(recs, *b.baseState)
+	}
+	recs = append(recs, b.records...)
+	b.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(bbMagic); err != nil {
+		return err
+	}
+	var hdr [binary.MaxVarintLen64]byte
+	for _, r := range recs {
+		var f bbWriter
+		f.b = append(f.b, r.kind)
+		f.varint(r.at.UnixMilli())
+		f.b = append(f.b, r.data...)
+
+		n := binary.PutUvarint(hdr[:], uint64(len(f.b)))
+		if _, err := bw.Write(hdr[:n]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(f.b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func apiBlackBox(w http.ResponseWriter, r *http.Request) {
+	prefix := "tron-signal-"
+	if instanceName != "" {
+		prefix += instanceName + "-"
+	}
+	name := prefix + "blackbox-" + time.Now().UTC().Format("20060102T150405Z") + ".bin"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := bb.dump(w); err != nil {
+		logger.Printf("BLACKBOX_DUMP_ERROR: %v", err)
+		return
+	}
+	logger.Printf("BLACKBOX_DUMP remote=%s", r.RemoteAddr)
+}
+
+// ---------- encoding ----------
+
+type bbWriter struct {
+	b []byte
+}
+
+func (w *bbWriter) varint(v int64) {
+	w.b = binary.AppendVarint(w.b, v)
+}
+
+func (w *bbWriter) str(s string) {
+	w.b = binary.AppendUvarint(w.b, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *bbWriter) flag(v bool) {
+	if v {
+		w.b = append(w.b, 1)
+	} else {
+		w.b = append(w.b, 0)
+	}
+}
+
+type bbReader struct {
+	b   []byte
+	err error
+}
+
+func (r *bbReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errors.New("blackbox: bad varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *bbReader) str() string {
+	if r.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(r.b)
+	if n <= 0 || uint64(len(r.b)-n) < l {
+		r.err = errors.New("blackbox: bad string")
+		return ""
+	}
+	s := string(r.b[n : n+int(l)])
+	r.b = r.b[n+int(l):]
+	return s
+}
+
+func (r *bbReader) flag() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.b) < 1 {
+		r.err = errors.New("blackbox: short flag")
+		return false
+	}
+	v := r.b[0] != 0
+	r.b = r.b[1:]
+	return v
+}
+
+func encodeMachineState(m machineState) []byte {
+	var w bbWriter
+	w.varint(int64(m.OnCounter))
+	w.varint(int64(m.OffCounter))
+	w.flag(m.WaitingReverse)
+	w.str(m.LastTriggered)
+	w.varint(m.BaseHeight)
+	w.flag(m.HitWaiting)
+	w.varint(m.HitBase)
+	w.varint(int64(m.HitOffset))
+	w.str(m.HitExpect)
+	w.varint(m.LimitDay)
+	w.varint(int64(m.DayTriggers))
+	w.varint(m.LimitHour)
+	w.varint(int64(m.HourTriggers))
+	w.str(m.SeqHistory)
+	w.str(m.HitMore)
+	w.varint(int64(m.HitSpan))
+	w.str(m.HitMatch)
+	w.varint(int64(m.MissStreak))
+	w.str(m.CountHistory)
+	w.str(m.AltLast)
+	w.varint(int64(m.AltRun))
+	w.str(m.Pending)
+	w.str(m.PendingState)
+	w.varint(m.PendingHeight)
+	w.varint(int64(m.PendingStreak))
+	return w.b
+}
+
+func decodeMachineState(r *bbReader) machineState {
+	var m machineState
+	m.OnCounter = int(r.varint())
+	m.OffCounter = int(r.varint())
+	m.WaitingReverse = r.flag()
+	m.LastTriggered = r.str()
+	m.BaseHeight = r.varint()
+	m.HitWaiting = r.flag()
+	m.HitBase = r.varint()
+	m.HitOffset = int(r.varint())
+	m.HitExpect = r.str()
+	if len(r.b) > 0 { // trigger caps; absent in older dumps
+		m.LimitDay = r.varint()
+		m.DayTriggers = int(r.varint())
+		m.LimitHour = r.varint()
+		m.HourTriggers = int(r.varint())
+	}
+	if len(r.b) > 0 {
+		m.SeqHistory = r.str()
+	}
+	if len(r.b) > 0 {
+		m.HitMore = r.str()
+	}
+	if len(r.b) > 0 {
+		m.HitSpan = int(r.varint())
+		m.HitMatch = r.str()
+	}
+	if len(r.b) > 0 {
+		m.MissStreak = int(r.varint())
+	}
+	if len(r.b) > 0 {
+		m.CountHistory = r.str()
+	}
+	if len(r.b) > 0 {
+		m.AltLast = r.str()
+		m.AltRun = int(r.varint())
+	}
+	if len(r.b) > 0 {
+		m.Pending = r.str()
+		m.PendingState = r.str()
+		m.PendingHeight = r.varint()
+		m.PendingStreak = int(r.varint())
+	}
+	return m
+}
+
+func decodeSignal(r *bbReader) Signal {
+	var s Signal
+	s.Type = r.str()
+	s.Height = r.varint()
+	s.BaseHeight = r.varint()
+	s.State = r.str()
+	s.TimeISO = r.str()
+	if len(r.b) > 0 {
+		s.Offset = int(r.varint())
+	}
+	if len(r.b) > 0 {
+		s.Streak = int(r.varint())
+	}
+	if len(r.b) > 0 {
+		s.Expect = r.str()
+	}
+	return s
+}
+
+// ---------- replay ----------
+
+// runReplay re-drives a fresh state machine with the recorded blocks and rules and
+// compares every judge result, transition and signal with what the engine recorded.
+func runReplay(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(raw, []byte(bbMagic)) {
+		return errors.New("not a blackbox dump")
+	}
+	raw = raw[len(bbMagic):]
+
+	var (
+		m        RuntimeState
+		rules    Rules
+		started  bool
+		blocks   int
+		mismatch int
+
+		wantJudge   []string
+		wantState   []machineState
+		wantSignals []Signal
+	)
+	m.WaitingReverse = true
+
+	report := func(format string, args ...any) {
+		mismatch++
+		fmt.Printf("MISMATCH "+format+"\n", args...)
+	}
+	flush := func() {
+		for _, j := range wantJudge {
+			report("judge=%q not recorded", j)
+		}
+		for _, st := range wantState {
+			report("state=%+v not recorded", st)
+		}
+		for _, s := range wantSignals {
+			report("signal=%+v not recorded", s)
+		}
+		wantJudge, wantState, wantSignals = nil, nil, nil
+	}
+
+	for len(raw) > 0 {
+		l, n := binary.Uvarint(raw)
+		if n <= 0 || uint64(len(raw)-n) < l || l < 1 {
+			return errors.New("blackbox: truncated frame")
+		}
+		frame := raw[n : n+int(l)]
+		raw = raw[n+int(l):]
+
+		kind := frame[0]
+		rd := &bbReader{b: frame[1:]}
+		at := time.UnixMilli(rd.varint())
+
+		switch kind {
+		case bbKindRules:
+			if err := json.Unmarshal(rd.b, &rules); err != nil {
+				return fmt.Errorf("rules record: %w", err)
+			}
+			fmt.Printf("%s RULES %s\n", at.UTC().Format(time.RFC3339Nano), string(rd.b))
+
+		case bbKindReset:
+			flush()
+			m = RuntimeState{WaitingReverse: true}
+			fmt.Printf("%s RESET\n", at.UTC().Format(time.RFC3339Nano))
+
+		case bbKindState:
+			st := decodeMachineState(rd)
+			if !started {
+				// anchor: machine state at the beginning of the window
+				m.restoreMachine(st)
+				continue
+			}
+			if len(wantState) == 0 || wantState[0] != st {
+				report("state recorded=%+v replayed=%+v", st, m.machineSnapshot())
+				continue
+			}
+			wantState = wantState[1:]
+
+		case bbKindBlock:
+			flush()
+			started = true
+			blocks++
+			height := rd.varint()
+			hash := rd.str()
+			bt := time.UnixMilli(rd.varint()).UTC()
+			txCount := -1
+			if len(rd.b) > 0 {
+				txCount = int(rd.varint())
+			}
+			fmt.Printf("%s BLOCK height=%d hash=%s\n", at.UTC().Format(time.RFC3339Nano), height, hash)
+
+			state, ok := judgeBlock(rules.Judge, Block{Height: height, Hash: hash, Time: bt, TxCount: txCount})
+			wantJudge = append(wantJudge, state)
+			if !ok {
+				continue
+			}
+			before := m.machineSnapshot()
+			out := m.evaluate(height, state, bt, rules)
+			if after := m.machineSnapshot(); after != before {
+				wantState = append(wantState, after)
+			}
+			wantSignals = append(wantSignals, out...)
+
+		case bbKindJudge:
+			rd.varint()
+			got := rd.str()
+			if len(wantJudge) == 0 || wantJudge[0] != got {
+				report("judge recorded=%q replayed=%v", got, wantJudge)
+				continue
+			}
+			wantJudge = wantJudge[1:]
+
+		case bbKindSignal:
+			s := decodeSignal(rd)
+			fmt.Printf("%s SIGNAL %+v\n", at.UTC().Format(time.RFC3339Nano), s)
+			if len(wantSignals) == 0 || wantSignals[0] != s {
+				report("signal recorded=%+v replayed=%v", s, wantSignals)
+				continue
+			}
+			wantSignals = wantSignals[1:]
+
+		default:
+			return fmt.Errorf("blackbox: unknown record kind %d", kind)
+		}
+		if rd.err != nil {
+			return rd.err
+		}
+	}
+	flush()
+
+	fmt.Printf("REPLAY_DONE blocks=%d mismatches=%d\n", blocks, mismatch)
+	if mismatch > 0 {
+		return fmt.Errorf("%d mismatches", mismatch)
+	}
+	return nil
+}
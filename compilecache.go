@@ -0,0 +1,58 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ---------- Compile caches ----------
+
+// Judges compile their rule (regex, expression, script, ...) once and reuse it
+// on every block, but previews and uploads can send any number of distinct
+// sources, so the caches keep only the compileCacheSize most recently used
+// entries. The active rule is used on every block and never falls out.
+
+const compileCacheSize = 64
+
+type compileCache struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List // front = most recently used
+	items map[string]*list.Element
+}
+
+type compileEntry struct {
+	key string
+	v   any
+}
+
+func newCompileCache(max int) *compileCache {
+	return &compileCache{max: max, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *compileCache) Load(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*compileEntry).v, true
+}
+
+func (c *compileCache) Store(key string, v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*compileEntry).v = v
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&compileEntry{key: key, v: v})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*compileEntry).key)
+	}
+}
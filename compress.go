@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ---------- Response compression ----------
+
+// Responses are gzipped for clients that accept it, which matters for phones
+// polling /api/status over cellular. The decision is made on the first write:
+// bodies under gzipMinSize, already-encoded bodies and event streams go out as
+// they are. SSE, WS upgrades and range requests are never wrapped. Brotli would
+// need a third-party encoder, so gzip is the only encoding offered.
+
+const gzipMinSize = 1024
+
+var gzipPool = sync.Pool{New: func() any {
+	zw, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return zw
+}}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, q, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") && strings.ReplaceAll(q, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" ||
+			strings.HasPrefix(r.URL.Path, "/sse/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter compresses the body once the first write shows it is worth it.
+type gzipWriter struct {
+	http.ResponseWriter
+	status  int
+	decided bool
+	zw      *gzip.Writer // nil = passing through
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipWriter) decide(first []byte) {
+	g.decided = true
+	h := g.Header()
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if len(first) >= gzipMinSize && h.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") &&
+		g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(first))
+		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.zw = gzipPool.Get().(*gzip.Writer)
+		g.zw.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.decided {
+		g.decide(p)
+	}
+	if g.zw != nil {
+		return g.zw.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.decided {
+		g.decide(nil)
+	}
+	if g.zw != nil {
+		_ = g.zw.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipWriter) close() {
+	if !g.decided {
+		if g.status == 0 {
+			return // nothing written; net/http sends the default 200
+		}
+		g.decide(nil)
+	}
+	if g.zw != nil {
+		_ = g.zw.Close()
+		gzipPool.Put(g.zw)
+		g.zw = nil
+	}
+}
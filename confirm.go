@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// ---------- Confirmed triggers ----------
+
+// With Rules.Confirm an ON/OFF rule that would fire emits a PENDING signal instead
+// (state = the rule, ON or OFF). The next judged block decides: if it shows the
+// same state as the pending block the usual ON/OFF signal fires on it (HIT is armed
+// from there); otherwise a CANCELLED signal goes out and that block counts as
+// usual. NEUTRAL blocks leave a pending trigger waiting. Sequence and alternation
+// triggers are never held back. The pending trigger is part of machineState.
+
+// setPending holds back the kind trigger found on this block.
+func (s *RuntimeState) setPending(kind, state string, height int64, t time.Time, streak int) Signal {
+	s.Pending, s.PendingState, s.PendingHeight, s.PendingStreak = kind, state, height, streak
+	s.logf("TRIGGER_PENDING kind=%s height=%d", kind, height)
+	return Signal{
+		Type:       "PENDING",
+		Height:     height,
+		BaseHeight: height,
+		State:      kind,
+		TimeISO:    t.UTC().Format(time.RFC3339Nano),
+		Streak:     streak,
+	}
+}
+
+// resolvePending confirms or cancels the pending trigger with a judged block.
+// done means the block was used up by the confirmed trigger.
+func (s *RuntimeState) resolvePending(height int64, state string, t time.Time, rules Rules) (sig Signal, done bool) {
+	kind, base, streak := s.Pending, s.PendingHeight, s.PendingStreak
+	confirmed := state == s.PendingState
+	s.clearPending()
+	if confirmed {
+		return s.fire(kind, height, t, rules, streak), true
+	}
+	s.logf("TRIGGER_CANCELLED kind=%s height=%d base=%d", kind, height, base)
+	return Signal{
+		Type:       "CANCELLED",
+		Height:     height,
+		BaseHeight: base,
+		State:      kind,
+		TimeISO:    t.UTC().Format(time.RFC3339Nano),
+	}, false
+}
+
+func (s *RuntimeState) clearPending() {
+	s.Pending, s.PendingState, s.PendingHeight, s.PendingStreak = "", "", 0, 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import "strings"
+
+// ---------- Counting modes ----------
+
+// Rules.Counting picks how the ON/OFF counters move before the thresholds are
+// checked:
+//   - "reset" (default): a block of the opposite state zeroes the counter, so a
+//     threshold of N means N in a row.
+//   - "window": the counters are the number of ON / OFF blocks among the last
+//     Window judged blocks ("N of the last M"). The window lives in
+//     RuntimeState.CountHistory so replays see the same counts.
+//   - "decay": an opposite block takes Decay off the counter instead of zeroing it.
+//
+// Triggers, the reverse gate and NEUTRAL blocks work the same in every mode.
+
+// CountingRule.Mode values
+const (
+	countReset  = "reset"
+	countWindow = "window"
+	countDecay  = "decay"
+)
+
+const countMaxWindow = 50
+
+type CountingRule struct {
+	Mode   string `json:"mode,omitempty"`
+	Window int    `json:"window,omitempty"` // window mode: M, 2-50
+	Decay  int    `json:"decay,omitempty"`  // decay mode: taken off per opposite block, 1-20
+}
+
+func (c *CountingRule) sanitize() {
+	c.Mode = strings.ToLower(strings.TrimSpace(c.Mode))
+	switch c.Mode {
+	case countWindow:
+		c.Window = clamp(c.Window, 2, countMaxWindow)
+		c.Decay = 0
+	case countDecay:
+		c.Decay = clamp(c.Decay, 1, 20)
+		c.Window = 0
+	default:
+		*c = CountingRule{Mode: countReset}
+	}
+}
+
+// count moves the counters for a judged ON/OFF block.
+func (s *RuntimeState) count(state string, rules Rules) {
+	c := rules.Counting
+	switch c.Mode {
+	case countWindow:
+		code, _ := seqCode(state)
+		h := s.CountHistory + string(code)
+		if n := clamp(c.Window, 2, countMaxWindow); len(h) > n {
+			h = h[len(h)-n:]
+		}
+		s.CountHistory = h
+		on := strings.Count(h, "1")
+		s.OnCounter, s.OffCounter = on, len(h)-on
+	case countDecay:
+		decay := clamp(c.Decay, 1, 20)
+		if state == "ON" {
+			s.OnCounter++
+			s.OffCounter = max(0, s.OffCounter-decay)
+		} else {
+			s.OffCounter++
+			s.OnCounter = max(0, s.OnCounter-decay)
+		}
+	default:
+		if state == "ON" {
+			s.OnCounter++
+			s.OffCounter = 0
+		} else {
+			s.OffCounter++
+			s.OnCounter = 0
+		}
+	}
+	if !rules.On.Enabled {
+		s.OnCounter = 0
+	}
+	if !rules.Off.Enabled {
+		s.OffCounter = 0
+	}
+}
+
+// clearCounters starts counting from scratch (after a trigger or the reverse gate).
+func (s *RuntimeState) clearCounters() {
+	s.OnCounter = 0
+	s.OffCounter = 0
+	s.CountHistory = ""
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Discord notifier ----------
+
+// Signals and incidents (SOURCES_DOWN, CONFIG_SAVE_FAILED, MISS_STREAK, ...) are
+// posted as embeds to Discord channel webhooks (POST /api/discord). Each channel
+// picks what it gets: signals, optionally only some types, and/or incidents. A
+// 429 from Discord is honoured by waiting retry_after before the next attempt.
+// The webhook URLs carry their token, so GET shows them as "****"; posting
+// "****" back keeps the stored URL of the channel with that name (or, for a
+// renamed channel, at that position).
+
+const (
+	discordQueueSize   = 256
+	discordAttempts    = 3
+	discordTimeout     = 10 * time.Second
+	discordMaxWait     = 30 * time.Second
+	maxDiscordChannels = 10
+)
+
+type DiscordConfig struct {
+	Channels []DiscordChannel `json:"channels"`
+}
+
+type DiscordChannel struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"` // https://discord.com/api/webhooks/<id>/<token>
+	Signals   bool     `json:"signals"`
+	Types     []string `json:"types,omitempty"` // signal types; empty = all
+	Incidents bool     `json:"incidents"`
+	// lowest signal severity posted; "" = all (see severity.go)
+	MinSeverity string `json:"minSeverity,omitempty"`
+}
+
+var (
+	discordC = make(chan notice, discordQueueSize)
+
+	discordStatsMu sync.Mutex
+	discordStats   struct {
+		Sent      uint64 `json:"sent"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueueDiscord(m notice) {
+	select {
+	case discordC <- m:
+	default:
+		discordStatsMu.Lock()
+		discordStats.Dropped++
+		discordStatsMu.Unlock()
+		logger.Printf("DISCORD_DROP (queue full)")
+	}
+}
+
+func (ch DiscordChannel) wants(m notice) bool {
+	if m.incident != nil {
+		return ch.Incidents
+	}
+	if !ch.Signals || !severityAtLeast(m.signal.Severity, ch.MinSeverity) {
+		return false
+	}
+	types := parseTypes(ch.Types)
+	return len(types) == 0 || types[m.signal.Type]
+}
+
+func discordLoop() {
+	client := &http.Client{Timeout: discordTimeout}
+	for m := range discordC {
+		cfgMu.RLock()
+		channels := cfg.Discord.Channels
+		cfgMu.RUnlock()
+
+		var body []byte
+		for _, ch := range channels {
+			if !ch.wants(m) {
+				continue
+			}
+			if body == nil {
+				body, _ = json.Marshal(map[string]any{"embeds": []discordEmbed{discordEmbedFor(m)}})
+			}
+			var err error
+			for attempt := 1; attempt <= discordAttempts; attempt++ {
+				var wait time.Duration
+				if wait, err = postDiscord(client, ch.URL, body); err == nil {
+					break
+				}
+				if attempt < discordAttempts {
+					time.Sleep(max(wait, time.Second*time.Duration(attempt)))
+				}
+			}
+
+			discordStatsMu.Lock()
+			if err != nil {
+				discordStats.Failed++
+				discordStats.LastError = ch.Name + ": " + err.Error()
+			} else {
+				discordStats.Sent++
+			}
+			discordStatsMu.Unlock()
+			if err != nil {
+				logger.Printf("DISCORD_ERROR channel=%q: %v", ch.Name, err)
+			}
+		}
+	}
+}
+
+// postDiscord sends body once. On a 429 it also returns how long Discord asked
+// us to wait.
+func postDiscord(client *http.Client, target string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var rl struct {
+			RetryAfter float64 `json:"retry_after"` // seconds
+		}
+		_ = json.Unmarshal(b, &rl)
+		if rl.RetryAfter == 0 {
+			rl.RetryAfter, _ = strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+		}
+		wait := min(time.Duration(rl.RetryAfter*float64(time.Second)), discordMaxWait)
+		return wait, &httpStatusError{Code: resp.StatusCode, Body: "rate limited"}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	return 0, nil
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+	Footer      *struct {
+		Text string `json:"text"`
+	} `json:"footer,omitempty"`
+}
+
+// discordColors by signal type; anything else is grey.
+var discordColors = map[string]int{
+	"ON":          0x2ecc71,
+	"OFF":         0x95a5a6,
+	"HIT":         0x3498db,
+	"MISS":        0xe67e22,
+	"MISS_STREAK": 0xe74c3c,
+	"PENDING":     0xf1c40f,
+	"CANCELLED":   0x7f8c8d,
+}
+
+func discordEmbedFor(m notice) discordEmbed {
+	var e discordEmbed
+	if inc := m.incident; inc != nil {
+		e = discordEmbed{
+			Title:       "⚠ " + inc.Kind,
+			Description: inc.Detail,
+			Color:       0xe74c3c,
+			Timestamp:   inc.TimeISO,
+		}
+	} else {
+		s := m.signal
+		color, ok := discordColors[s.Type]
+		if !ok {
+			color = 0x95a5a6
+		}
+		e = discordEmbed{
+			Title: fmt.Sprintf("%s @ %d", s.Type, s.Height),
+			Color: color,
+			Fields: []discordField{
+				{Name: "height", Value: strconv.FormatInt(s.Height, 10), Inline: true},
+				{Name: "base", Value: strconv.FormatInt(s.BaseHeight, 10), Inline: true},
+				{Name: "state", Value: orDash(s.State), Inline: true},
+				{Name: "seq", Value: strconv.FormatUint(s.Seq, 10), Inline: true},
+			},
+			Timestamp: s.TimeISO,
+		}
+	}
+	if instanceName != "" {
+		e.Footer = &struct {
+			Text string `json:"text"`
+		}{instanceName}
+	}
+	return e
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func validateDiscord(dc *DiscordConfig) error {
+	if len(dc.Channels) > maxDiscordChannels {
+		return fmt.Errorf("at most %d channels", maxDiscordChannels)
+	}
+	for i := range dc.Channels {
+		ch := &dc.Channels[i]
+		ch.Name = strings.TrimSpace(ch.Name)
+		ch.URL = strings.TrimSpace(ch.URL)
+		if ch.Name == "" {
+			ch.Name = "channel" + strconv.Itoa(i+1)
+		}
+		u, err := url.Parse(ch.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("channel %s: url must be https://discord.com/api/webhooks/...", ch.Name)
+		}
+		if err := normalizeSeverity(&ch.MinSeverity); err != nil {
+			return fmt.Errorf("channel %s: %v", ch.Name, err)
+		}
+		types := parseTypes(ch.Types)
+		ch.Types = nil
+		for t := range types {
+			ch.Types = append(ch.Types, t)
+		}
+		sort.Strings(ch.Types)
+	}
+	return nil
+}
+
+func apiGetDiscord(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	dc := cfg.Discord
+	cfgMu.RUnlock()
+	discordStatsMu.Lock()
+	stats := discordStats
+	discordStatsMu.Unlock()
+	maskDiscordURLs(&dc)
+	mustJSON(w, 200, map[string]any{"discord": dc, "stats": stats})
+}
+
+// maskDiscordURLs masks the webhook URLs of a copy of the config.
+func maskDiscordURLs(dc *DiscordConfig) {
+	dc.Channels = slices.Clone(dc.Channels)
+	for i := range dc.Channels {
+		if dc.Channels[i].URL != "" {
+			dc.Channels[i].URL = "****"
+		}
+	}
+}
+
+// keepDiscordURLs puts the stored URLs back where dc has "****".
+func keepDiscordURLs(dc *DiscordConfig, prev DiscordConfig) {
+	for i := range dc.Channels {
+		ch := &dc.Channels[i]
+		if strings.TrimSpace(ch.URL) != "****" {
+			continue
+		}
+		name := strings.TrimSpace(ch.Name)
+		if j := slices.IndexFunc(prev.Channels, func(p DiscordChannel) bool { return p.Name == name }); j >= 0 {
+			ch.URL = prev.Channels[j].URL
+		} else if i < len(prev.Channels) {
+			ch.URL = prev.Channels[i].URL
+		}
+	}
+}
+
+func apiSetDiscord(w http.ResponseWriter, r *http.Request) {
+	var dc DiscordConfig
+	if err := readJSON(r, &dc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.Discord
+	keepDiscordURLs(&dc, prev)
+	if err := validateDiscord(&dc); err != nil {
+		cfgMu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Discord = dc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Discord = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("DISCORD_SET channels=%d", len(dc.Channels))
+	maskDiscordURLs(&dc)
+	mustJSON(w, 200, map[string]any{"ok": true, "discord": dc})
+}
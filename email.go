@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Email alerts ----------
+
+// Incidents (ABNORMAL_RESTART, SOURCES_DOWN, CONFIG_SAVE_FAILED, ...) and,
+// optionally, signals are mailed to a list of recipients over SMTP (POST
+// /api/email). To avoid mail storms nothing is sent per event: the first one
+// opens a batch window and everything arriving within it goes out as one mail,
+// at most emailMaxItems lines (the rest are counted). TLS is "starttls" (the
+// default, usually port 587), "tls" (implicit, usually 465) or "none".
+
+const (
+	emailQueueSize     = 256
+	emailAttempts      = 3
+	emailTimeout       = 30 * time.Second
+	emailMaxItems      = 200
+	emailDefaultWindow = 60 * time.Second
+	maxEmailRecipients = 20
+)
+
+type EmailConfig struct {
+	Host     string   `json:"host"` // empty = disabled
+	Port     int      `json:"port"`
+	TLS      string   `json:"tls"` // "starttls" | "tls" | "none"
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	Incidents bool     `json:"incidents"`
+	Signals   bool     `json:"signals"`
+	Types     []string `json:"types,omitempty"` // signal types; empty = all
+	// lowest signal severity mailed; "" = all (see severity.go)
+	MinSeverity string `json:"minSeverity,omitempty"`
+	// seconds to collect before mailing; 0 = 60
+	BatchSeconds int `json:"batchSeconds,omitempty"`
+}
+
+func (ec EmailConfig) wants(n notice) bool {
+	if ec.Host == "" || len(ec.To) == 0 {
+		return false
+	}
+	if n.incident != nil {
+		return ec.Incidents
+	}
+	if !ec.Signals || !severityAtLeast(n.signal.Severity, ec.MinSeverity) {
+		return false
+	}
+	types := parseTypes(ec.Types)
+	return len(types) == 0 || types[n.signal.Type]
+}
+
+func (ec EmailConfig) window() time.Duration {
+	if ec.BatchSeconds > 0 {
+		return time.Duration(ec.BatchSeconds) * time.Second
+	}
+	return emailDefaultWindow
+}
+
+var (
+	emailC = make(chan notice, emailQueueSize)
+
+	emailStatsMu sync.Mutex
+	emailStats   struct {
+		Sent      uint64 `json:"sent"` // mails
+		Items     uint64 `json:"items"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueueEmail(n notice) {
+	select {
+	case emailC <- n:
+	default:
+		emailStatsMu.Lock()
+		emailStats.Dropped++
+		emailStatsMu.Unlock()
+		logger.Printf("EMAIL_DROP (queue full)")
+	}
+}
+
+func emailLoop() {
+	var (
+		batch    []notice
+		overflow int
+		flush    <-chan time.Time
+	)
+	for {
+		select {
+		case n := <-emailC:
+			cfgMu.RLock()
+			ec := cfg.Email
+			cfgMu.RUnlock()
+			if !ec.wants(n) {
+				continue
+			}
+			if len(batch) >= emailMaxItems {
+				overflow++
+				continue
+			}
+			batch = append(batch, n)
+			if flush == nil {
+				flush = time.After(ec.window())
+			}
+		case <-flush:
+			flush = nil
+			cfgMu.RLock()
+			ec := cfg.Email
+			cfgMu.RUnlock()
+			sendEmailBatch(ec, batch, overflow)
+			batch, overflow = nil, 0
+		}
+	}
+}
+
+func sendEmailBatch(ec EmailConfig, batch []notice, overflow int) {
+	if ec.Host == "" || len(ec.To) == 0 || len(batch) == 0 {
+		return
+	}
+	subject, body := emailContent(batch, overflow)
+	var err error
+	for attempt := 1; attempt <= emailAttempts; attempt++ {
+		if err = sendMail(ec, subject, body); err == nil {
+			break
+		}
+		if attempt < emailAttempts {
+			time.Sleep(5 * time.Second * time.Duration(attempt))
+		}
+	}
+
+	emailStatsMu.Lock()
+	if err != nil {
+		emailStats.Failed++
+		emailStats.LastError = err.Error()
+	} else {
+		emailStats.Sent++
+		emailStats.Items += uint64(len(batch) + overflow)
+	}
+	emailStatsMu.Unlock()
+	if err != nil {
+		logger.Printf("EMAIL_ERROR items=%d: %v", len(batch)+overflow, err)
+	} else {
+		logger.Printf("EMAIL_SENT to=%d items=%d", len(ec.To), len(batch)+overflow)
+	}
+}
+
+func emailContent(batch []notice, overflow int) (subject, body string) {
+	var incidents, signals int
+	var b strings.Builder
+	for _, n := range batch {
+		if inc := n.incident; inc != nil {
+			incidents++
+			fmt.Fprintf(&b, "%s  INCIDENT %s: %s\r\n", inc.TimeISO, inc.Kind, inc.Detail)
+		} else {
+			s := n.signal
+			signals++
+			fmt.Fprintf(&b, "%s  %s height=%d base=%d state=%s seq=%d\r\n", s.TimeISO, s.Type, s.Height, s.BaseHeight, s.State, s.Seq)
+		}
+	}
+	if overflow > 0 {
+		fmt.Fprintf(&b, "\r\n... and %d more (see /api/incidents and /api/signals)\r\n", overflow)
+	}
+
+	var parts []string
+	if incidents > 0 {
+		parts = append(parts, fmt.Sprintf("%d incident(s)", incidents))
+	}
+	if signals > 0 {
+		parts = append(parts, fmt.Sprintf("%d signal(s)", signals))
+	}
+	subject = "[tron-signal] " + strings.Join(parts, ", ")
+	if instanceName != "" {
+		subject = "[tron-signal " + instanceName + "] " + strings.Join(parts, ", ")
+	}
+	return subject, b.String()
+}
+
+func sendMail(ec EmailConfig, subject, body string) error {
+	addr := net.JoinHostPort(ec.Host, strconv.Itoa(ec.Port))
+	d := &net.Dialer{Timeout: emailTimeout}
+	tlsCfg := &tls.Config{ServerName: ec.Host}
+	var conn net.Conn
+	var err error
+	if ec.TLS == "tls" {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, ec.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ec.TLS == "" || ec.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp: %s does not offer STARTTLS", ec.Host)
+		}
+		if err := c.StartTLS(tlsCfg); err != nil {
+			return err
+		}
+	}
+	if ec.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", ec.Username, ec.Password, ec.Host)); err != nil {
+			return err
+		}
+	}
+	// envelope addresses without display names
+	if err := c.Mail(bareAddress(ec.From)); err != nil {
+		return err
+	}
+	for _, to := range ec.To {
+		if err := c.Rcpt(bareAddress(to)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	hdr := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n",
+		ec.From, strings.Join(ec.To, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z))
+	if _, err := w.Write([]byte(hdr + body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func bareAddress(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return s
+}
+
+func validateEmail(ec *EmailConfig) error {
+	ec.Host = strings.TrimSpace(ec.Host)
+	ec.From = strings.TrimSpace(ec.From)
+	if ec.Host == "" {
+		return nil
+	}
+	switch ec.TLS {
+	case "":
+		ec.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("tls must be starttls, tls or none")
+	}
+	if ec.Port == 0 {
+		ec.Port = 587
+		if ec.TLS == "tls" {
+			ec.Port = 465
+		}
+	}
+	if ec.Port < 1 || ec.Port > 65535 {
+		return fmt.Errorf("bad port")
+	}
+	if _, err := mail.ParseAddress(ec.From); err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	var to []string
+	for _, x := range ec.To {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(x); err != nil {
+			return fmt.Errorf("to %q: %v", x, err)
+		}
+		to = append(to, x)
+	}
+	if len(to) == 0 || len(to) > maxEmailRecipients {
+		return fmt.Errorf("1-%d recipients required", maxEmailRecipients)
+	}
+	ec.To = to
+	if ec.BatchSeconds < 0 || ec.BatchSeconds > 3600 {
+		return fmt.Errorf("batchSeconds must be 0-3600")
+	}
+	if err := normalizeSeverity(&ec.MinSeverity); err != nil {
+		return err
+	}
+	types := parseTypes(ec.Types)
+	ec.Types = nil
+	for t := range types {
+		ec.Types = append(ec.Types, t)
+	}
+	sort.Strings(ec.Types)
+	return nil
+}
+
+func apiGetEmail(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	ec := cfg.Email
+	cfgMu.RUnlock()
+	if ec.Password != "" {
+		ec.Password = "****"
+	}
+	emailStatsMu.Lock()
+	stats := emailStats
+	emailStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"email": ec, "stats": stats})
+}
+
+func apiSetEmail(w http.ResponseWriter, r *http.Request) {
+	var ec EmailConfig
+	if err := readJSON(r, &ec); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateEmail(&ec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.Email
+	if ec.Password == "****" {
+		ec.Password = prev.Password // unchanged from what GET showed
+	}
+	cfg.Email = ec
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Email = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("EMAIL_SET enabled=%v to=%d incidents=%v signals=%v", ec.Host != "", len(ec.To), ec.Incidents, ec.Signals)
+	if ec.Password != "" {
+		ec.Password = "****"
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "email": ec})
+}
+
+// apiTestEmail: POST /api/email/test mails the saved recipients right away.
+func apiTestEmail(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	ec := cfg.Email
+	cfgMu.RUnlock()
+	if ec.Host == "" {
+		http.Error(w, "email not configured", http.StatusBadRequest)
+		return
+	}
+	if err := sendMail(ec, "[tron-signal] test", "Test mail from tron-signal.\r\n"); err != nil {
+		http.Error(w, "send failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	mustJSON(w, 200, map[string]any{"ok": true})
+}
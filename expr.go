@@ -0,0 +1,673 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Expression language (judge "expr") ----------
+
+/*
+	极简表达式（纯标准库，无第三方依赖）
+	- 值：整数 / 字符串 / 布尔
+	- 运算：|| && ! == != < <= > >= + - * / % 以及 cond ? a : b（字符串 + 的结果不超过 maxExprStrLen 字节）
+	- 函数：len(s) last(s,n) count(s,sub) contains(s,sub) isDigit(c) isLetter(c) hex(s)
+	- 结果：true/"ON" -> ON，false/"OFF" -> OFF
+	例：lastDigit >= 0 && lastDigit % 2 == 0
+	    digitCount > 40 ? "ON" : "OFF"
+*/
+
+const (
+	maxExprLen    = 1024
+	maxExprStrLen = 4096 // longest string + may build; scripts could double one per line
+)
+
+type exprValue = any // int64 | string | bool
+
+type exprEnv map[string]exprValue
+
+// exprCtx carries variables and the optional resource limits of one evaluation.
+type exprCtx struct {
+	vars     exprEnv
+	budget   int       // remaining node evaluations; < 0 = unlimited
+	deadline time.Time // zero = none
+	steps    int
+}
+
+var errExprBudget = errors.New("evaluation budget exhausted")
+var errExprTimeout = errors.New("evaluation timed out")
+
+func (c *exprCtx) step() error {
+	c.steps++
+	if c.budget >= 0 {
+		if c.budget == 0 {
+			return errExprBudget
+		}
+		c.budget--
+	}
+	// clock reads are not free; check every 64 steps
+	if !c.deadline.IsZero() && c.steps%64 == 0 && time.Now().After(c.deadline) {
+		return errExprTimeout
+	}
+	return nil
+}
+
+type exprNode interface {
+	eval(c *exprCtx) (exprValue, error)
+}
+
+// compiled expressions are cached: the judge runs on every block
+var exprCache = newCompileCache(compileCacheSize) // source -> exprNode
+
+func compileExpr(src string) (exprNode, error) {
+	if v, ok := exprCache.Load(src); ok {
+		return v.(exprNode), nil
+	}
+	if len(src) > maxExprLen {
+		return nil, fmt.Errorf("expression longer than %d chars", maxExprLen)
+	}
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	exprCache.Store(src, n)
+	return n, nil
+}
+
+func init() {
+	registerJudge(judgeImpl{
+		name: judgeExpr,
+		desc: "admin expression over block variables: true/\"ON\" -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			state, err := evalJudgeExpr(j.Expr, b)
+			if err != nil {
+				return "", false
+			}
+			return state, true
+		},
+		normalize: func(j *JudgeRule) error {
+			*j = JudgeRule{Type: judgeExpr, Expr: strings.TrimSpace(j.Expr)}
+			if j.Expr == "" {
+				return fmt.Errorf("expression required")
+			}
+			if _, err := compileExpr(j.Expr); err != nil {
+				return err
+			}
+			_, err := evalJudgeExpr(j.Expr, judgeSampleBlock)
+			return err
+		},
+	})
+}
+
+// blockEnv exposes a block to expressions.
+func blockEnv(b Block) exprEnv {
+	hash := strings.ToLower(strings.TrimSpace(b.Hash))
+	lastDigit := int64(-1)
+	digits, letters := int64(0), int64(0)
+	for i := len(hash) - 1; i >= 0; i-- {
+		c := hash[i]
+		switch {
+		case c >= '0' && c <= '9':
+			if lastDigit < 0 {
+				lastDigit = int64(c - '0')
+			}
+			digits++
+		case c >= 'a' && c <= 'z':
+			letters++
+		}
+	}
+	lastChar := ""
+	if hash != "" {
+		lastChar = hash[len(hash)-1:]
+	}
+	return exprEnv{
+		"hash":        hash,
+		"height":      b.Height,
+		"lastChar":    lastChar,
+		"lastDigit":   lastDigit,
+		"digitCount":  digits,
+		"letterCount": letters,
+		"txCount":     int64(b.TxCount), // -1 when unknown
+		"time":        b.Time.UnixMilli(),
+	}
+}
+
+// exprState converts an expression result to "ON"/"OFF"/"NEUTRAL".
+func exprState(v exprValue) (string, error) {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return "ON", nil
+		}
+		return "OFF", nil
+	case string:
+		switch strings.ToUpper(x) {
+		case "ON":
+			return "ON", nil
+		case "OFF":
+			return "OFF", nil
+		case stateNeutral:
+			return stateNeutral, nil
+		}
+	}
+	return "", fmt.Errorf("expression must yield a bool or \"ON\"/\"OFF\"/\"NEUTRAL\", got %v", v)
+}
+
+// ---------- lexer ----------
+
+type exprTok struct {
+	kind byte // 'n' number, 's' string, 'i' ident, 'o' operator
+	text string
+}
+
+func lexExpr(src string) ([]exprTok, error) {
+	var toks []exprTok
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			toks = append(toks, exprTok{'n', src[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, exprTok{'s', src[i+1 : j]})
+			i = j + 1
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i
+			for j < len(src) && (src[j] == '_' || (src[j] >= 'a' && src[j] <= 'z') || (src[j] >= 'A' && src[j] <= 'Z') || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, exprTok{'i', src[i:j]})
+			i = j
+		default:
+			if i+1 < len(src) {
+				two := src[i : i+2]
+				switch two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					toks = append(toks, exprTok{'o', two})
+					i += 2
+					continue
+				}
+			}
+			if strings.IndexByte("+-*/%<>!()?:,", c) < 0 {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			toks = append(toks, exprTok{'o', string(c)})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+// ---------- parser (precedence climbing) ----------
+
+type exprParser struct {
+	toks []exprTok
+	pos  int
+}
+
+func (p *exprParser) peek() (exprTok, bool) {
+	if p.pos >= len(p.toks) {
+		return exprTok{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t, ok := p.peek(); ok && t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return fmt.Errorf("expected %q", op)
+	}
+	return nil
+}
+
+var exprBinaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	a, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &exprCond{cond, a, b}, nil
+}
+
+func (p *exprParser) parseBinary(minPrec int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != 'o' {
+			return left, nil
+		}
+		prec, isBin := exprBinaryPrec[t.text]
+		if !isBin || prec < minPrec {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{t.text, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{"!", x}, nil
+	}
+	if p.accept("-") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{"-", x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of expression")
+	}
+	p.pos++
+	switch t.kind {
+	case 'n':
+		v, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return exprLit{v}, nil
+	case 's':
+		return exprLit{t.text}, nil
+	case 'i':
+		switch t.text {
+		case "true":
+			return exprLit{true}, nil
+		case "false":
+			return exprLit{false}, nil
+		case "ON", "OFF":
+			return exprLit{t.text}, nil
+		}
+		if p.accept("(") {
+			fn, ok := exprFuncs[t.text]
+			if !ok {
+				return nil, fmt.Errorf("unknown function %q", t.text)
+			}
+			var args []exprNode
+			if !p.accept(")") {
+				for {
+					a, err := p.parseTernary()
+					if err != nil {
+						return nil, err
+					}
+					args = append(args, a)
+					if p.accept(")") {
+						break
+					}
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if len(args) != fn.arity {
+				return nil, fmt.Errorf("%s() takes %d argument(s)", t.text, fn.arity)
+			}
+			return &exprCall{t.text, fn.fn, args}, nil
+		}
+		return exprVar(t.text), nil
+	case 'o':
+		if t.text == "(" {
+			n, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// ---------- AST ----------
+
+type exprLit struct{ v exprValue }
+
+func (n exprLit) eval(c *exprCtx) (exprValue, error) { return n.v, c.step() }
+
+type exprVar string
+
+func (n exprVar) eval(c *exprCtx) (exprValue, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	v, ok := c.vars[string(n)]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", string(n))
+	}
+	return v, nil
+}
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (n *exprUnary) eval(c *exprCtx) (exprValue, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	v, err := n.x.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs a bool, got %v", v)
+		}
+		return !b, nil
+	default:
+		i, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("- needs an int, got %v", v)
+		}
+		return -i, nil
+	}
+}
+
+type exprCond struct{ cond, a, b exprNode }
+
+func (n *exprCond) eval(c *exprCtx) (exprValue, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	cv, err := n.cond.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := cv.(bool)
+	if !ok {
+		return nil, fmt.Errorf("?: condition must be a bool, got %v", cv)
+	}
+	if b {
+		return n.a.eval(c)
+	}
+	return n.b.eval(c)
+}
+
+type exprBinary struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *exprBinary) eval(c *exprCtx) (exprValue, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	l, err := n.l.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	// short-circuit
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs bools, got %v", n.op, l)
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := n.r.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs bools, got %v", n.op, r)
+		}
+		return rb, nil
+	}
+
+	r, err := n.r.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(l, r)
+	case "!=":
+		eq, err := exprEqual(l, r)
+		if err != nil {
+			return nil, err
+		}
+		return !eq.(bool), nil
+	}
+
+	switch lv := l.(type) {
+	case int64:
+		rv, ok := r.(int64)
+		if !ok {
+			return nil, fmt.Errorf("%v %s %v: type mismatch", l, n.op, r)
+		}
+		switch n.op {
+		case "+":
+			return lv + rv, nil
+		case "-":
+			return lv - rv, nil
+		case "*":
+			return lv * rv, nil
+		case "/", "%":
+			if rv == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if n.op == "/" {
+				return lv / rv, nil
+			}
+			return lv % rv, nil
+		case "<":
+			return lv < rv, nil
+		case "<=":
+			return lv <= rv, nil
+		case ">":
+			return lv > rv, nil
+		case ">=":
+			return lv >= rv, nil
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v %s %v: type mismatch", l, n.op, r)
+		}
+		switch n.op {
+		case "+":
+			if len(lv)+len(rv) > maxExprStrLen {
+				return nil, fmt.Errorf("string longer than %d bytes", maxExprStrLen)
+			}
+			return lv + rv, nil
+		case "<":
+			return lv < rv, nil
+		case "<=":
+			return lv <= rv, nil
+		case ">":
+			return lv > rv, nil
+		case ">=":
+			return lv >= rv, nil
+		}
+	}
+	return nil, fmt.Errorf("operator %s not supported for %v", n.op, l)
+}
+
+func exprEqual(l, r exprValue) (exprValue, error) {
+	switch lv := l.(type) {
+	case int64:
+		if rv, ok := r.(int64); ok {
+			return lv == rv, nil
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			return lv == rv, nil
+		}
+	case bool:
+		if rv, ok := r.(bool); ok {
+			return lv == rv, nil
+		}
+	}
+	return nil, fmt.Errorf("%v == %v: type mismatch", l, r)
+}
+
+// ---------- functions ----------
+
+type exprFunc struct {
+	arity int
+	fn    func(args []exprValue) (exprValue, error)
+}
+
+var exprFuncs = map[string]exprFunc{
+	"len": {1, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		return int64(len(s)), err
+	}},
+	"last": {2, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		if err != nil {
+			return nil, err
+		}
+		n, ok := a[1].(int64)
+		if !ok || n < 0 {
+			return nil, errors.New("last(s, n): n must be a non-negative int")
+		}
+		if int(n) >= len(s) {
+			return s, nil
+		}
+		return s[len(s)-int(n):], nil
+	}},
+	"count": {2, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		if err != nil {
+			return nil, err
+		}
+		sub, err := exprStr(a[1])
+		if err != nil || sub == "" {
+			return nil, errors.New("count(s, sub): sub must be a non-empty string")
+		}
+		return int64(strings.Count(s, sub)), nil
+	}},
+	"contains": {2, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		if err != nil {
+			return nil, err
+		}
+		sub, err := exprStr(a[1])
+		return strings.Contains(s, sub), err
+	}},
+	"isDigit": {1, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		return len(s) == 1 && s[0] >= '0' && s[0] <= '9', err
+	}},
+	"isLetter": {1, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		return len(s) == 1 && s[0] >= 'a' && s[0] <= 'z', err
+	}},
+	"hex": {1, func(a []exprValue) (exprValue, error) {
+		s, err := exprStr(a[0])
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(s, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("hex(%q): %v", s, err)
+		}
+		return v, nil
+	}},
+}
+
+func exprStr(v exprValue) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("want a string, got %v", v)
+	}
+	return s, nil
+}
+
+type exprCall struct {
+	name string
+	fn   func([]exprValue) (exprValue, error)
+	args []exprNode
+}
+
+func (n *exprCall) eval(c *exprCtx) (exprValue, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	vals := make([]exprValue, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return n.fn(vals)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Block history ----------
+
+// Every accepted block (live and warm-up) is appended to data/blocks/YYYY-MM-DD.jsonl,
+// keyed by the block's UTC day. It feeds backtests and /api/blocks; the engine never
+// reads it back, so the "runtime resets every boot" rule still holds.
+
+const historyRetention = 30 // days
+
+type blockHistory struct {
+	mu   sync.Mutex
+	date string
+	f    *os.File
+}
+
+var history = &blockHistory{}
+
+func historyPath(date string) string {
+	return filepath.Join(historyDir, date+".jsonl")
+}
+
+func (h *blockHistory) append(b BlockInfo) {
+	t, err := time.Parse(time.RFC3339Nano, b.TimeISO)
+	if err != nil {
+		t = time.Now()
+	}
+	date := t.UTC().Format("2006-01-02")
+	line, err := json.Marshal(b)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.f == nil || h.date != date {
+		if h.f != nil {
+			_ = h.f.Close()
+			h.f = nil
+		}
+		f, err := os.OpenFile(historyPath(date), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			logger.Printf("HISTORY_OPEN_ERROR: %v", err)
+			return
+		}
+		h.f, h.date = f, date
+		pruneDayFiles(historyDir, historyRetention)
+	}
+	if _, err := h.f.Write(line); err != nil {
+		logger.Printf("HISTORY_WRITE_ERROR: %v", err)
+	}
+}
+
+// pruneDayFiles drops YYYY-MM-DD.jsonl (or .log) files in dir older than days.
+func pruneDayFiles(dir string, days int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	for _, e := range entries {
+		fn := e.Name()
+		date, ok := strings.CutSuffix(fn, ".jsonl")
+		if !ok {
+			date, ok = strings.CutSuffix(fn, ".log")
+		}
+		if e.IsDir() || !ok {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			continue
+		}
+		if t.Before(cutoff) {
+			_ = os.Remove(filepath.Join(dir, fn))
+		}
+	}
+}
+
+// readHistory returns stored blocks with from <= time < to, ascending by height.
+// Blocks seen twice (warm-up after a restart) are returned once.
+func readHistory(from, to time.Time) ([]BlockInfo, error) {
+	var out []BlockInfo
+	seen := map[int64]bool{}
+	for d := from.UTC().Truncate(24 * time.Hour); d.Before(to); d = d.Add(24 * time.Hour) {
+		f, err := os.Open(historyPath(d.Format("2006-01-02")))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var b BlockInfo
+			if json.Unmarshal(sc.Bytes(), &b) != nil {
+				continue // torn line from a crash
+			}
+			t, err := time.Parse(time.RFC3339Nano, b.TimeISO)
+			if err != nil || t.Before(from) || !t.Before(to) || seen[b.Height] {
+				continue
+			}
+			seen[b.Height] = true
+			out = append(out, b)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Height < out[j].Height })
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ---------- Extra HIT checks ----------
+
+// HitRule.Extra adds checks after the primary t+x one, e.g. t+3 expect OFF and
+// t+5 expect ON. Each resolves on its own block and emits its own HIT (with the
+// offset in the signal). Pending extras live in RuntimeState.HitMore as
+// "3:OFF,5:ON" so machineState stays comparable for the black box.
+//
+// HitRule.Window widens every check to blocks t+x..t+x+Window. With Match "first"
+// the first block showing the expected state is a HIT (none: miss at the window's
+// end); with "all" every block must show it (the first one that doesn't: miss).
+
+const maxHitChecks = 8
+
+// HitRule.Match values
+const (
+	hitMatchFirst = "first"
+	hitMatchAll   = "all"
+)
+
+type HitCheck struct {
+	Offset int    `json:"offset"` // >= 1
+	Expect string `json:"expect"` // "ON" or "OFF"
+}
+
+// sanitizeHitChecks clamps and sorts the extras, dropping any whose block range
+// (offset..offset+window) overlaps the primary check or an earlier extra.
+func sanitizeHitChecks(in []HitCheck, primary, window int) []HitCheck {
+	var cs []HitCheck
+	for _, c := range in {
+		c.Offset = clamp(c.Offset, 1, 20)
+		c.Expect = strings.ToUpper(strings.TrimSpace(c.Expect))
+		if c.Expect != "ON" && c.Expect != "OFF" {
+			c.Expect = "ON"
+		}
+		cs = append(cs, c)
+	}
+	sort.SliceStable(cs, func(i, j int) bool { return cs[i].Offset < cs[j].Offset })
+
+	overlaps := func(a, b int) bool { return a <= b+window && b <= a+window }
+	var out []HitCheck
+	for _, c := range cs {
+		if overlaps(c.Offset, primary) {
+			continue
+		}
+		if n := len(out); n > 0 && overlaps(c.Offset, out[n-1].Offset) {
+			continue
+		}
+		out = append(out, c)
+	}
+	if len(out) > maxHitChecks-1 {
+		out = out[:maxHitChecks-1]
+	}
+	return out
+}
+
+// hitChecks returns every check of the rule, ascending by offset.
+func hitChecks(h HitRule) []HitCheck {
+	expect := strings.ToUpper(strings.TrimSpace(h.Expect))
+	if expect != "ON" && expect != "OFF" {
+		expect = "ON"
+	}
+	offset := h.Offset
+	if offset < 1 {
+		offset = 1
+	}
+	all := append([]HitCheck{{Offset: offset, Expect: expect}}, sanitizeHitChecks(h.Extra, offset, h.Window)...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Offset < all[j].Offset })
+	return all
+}
+
+func encodeHitChecks(cs []HitCheck) string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = fmt.Sprintf("%d:%s", c.Offset, c.Expect)
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkHit resolves the pending check against the block at height, if it is due.
+// It returns "HIT", "MISS" or "" (nothing resolved on this block).
+func (s *RuntimeState) checkHit(height int64, state string) string {
+	if !s.HitWaiting {
+		return ""
+	}
+	start := s.HitBase + int64(s.HitOffset)
+	end := start + int64(s.HitSpan)
+	if height < start || height > end {
+		return ""
+	}
+	match := state == s.HitExpect
+	switch {
+	case s.HitMatch == hitMatchAll && !match:
+		return "MISS"
+	case s.HitMatch == hitMatchAll && height == end:
+		return "HIT"
+	case s.HitMatch != hitMatchAll && match:
+		return "HIT"
+	case s.HitMatch != hitMatchAll && height == end:
+		return "MISS"
+	}
+	return ""
+}
+
+// nextHit moves the machine to the next pending check, or ends the HIT wait.
+func (s *RuntimeState) nextHit() {
+	if s.HitMore == "" {
+		s.HitWaiting = false
+		return
+	}
+	first, rest, _ := strings.Cut(s.HitMore, ",")
+	s.HitMore = rest
+	off, expect, _ := strings.Cut(first, ":")
+	n, err := strconv.Atoi(off)
+	if err != nil {
+		s.HitWaiting = false
+		s.HitMore = ""
+		return
+	}
+	s.HitOffset = n
+	s.HitExpect = expect
+}
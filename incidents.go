@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------- Incidents ----------
+
+// Incidents are operator-facing problems that need attention (persistence failures,
+// outages, ...). They are logged with an INCIDENT marker and the most recent ones are
+// kept in memory for /api/incidents. Like all runtime state they don't survive a restart.
+
+const maxIncidents = 100
+
+type Incident struct {
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+	TimeISO string `json:"time"`
+}
+
+var (
+	incMu     sync.Mutex
+	incidents []Incident
+)
+
+// raiseIncident must not take cfgMu: it is called from paths that already hold it.
+func raiseIncident(kind, detail string) {
+	inc := Incident{Kind: kind, Detail: detail, TimeISO: time.Now().UTC().Format(time.RFC3339Nano)}
+	logger.Printf("INCIDENT kind=%s detail=%q", kind, detail)
+
+	incMu.Lock()
+	incidents = append(incidents, inc)
+	if len(incidents) > maxIncidents {
+		incidents = append([]Incident(nil), incidents[len(incidents)-maxIncidents:]...)
+	}
+	incMu.Unlock()
+
+	notifyIncident(inc)
+}
+
+func apiIncidents(w http.ResponseWriter, r *http.Request) {
+	incMu.Lock()
+	out := make([]Incident, 0, len(incidents))
+	// newest first
+	for i := len(incidents) - 1; i >= 0; i-- {
+		out = append(out, incidents[i])
+	}
+	incMu.Unlock()
+	mustJSON(w, 200, map[string]any{"instance": instanceName, "incidents": out})
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------- Judge rules ----------
+
+// A judge rule maps one block to "ON"/"OFF". The rule lives inside Rules so the
+// black box snapshots it and replays stay deterministic.
+
+const (
+	judgeLucky    = "lucky"    // default: last two hash chars, letter/digit type XOR (window configurable)
+	judgeRegex    = "regex"    // admin regex over the hash (or its last N chars): match -> ON
+	judgeDigitSum = "digitsum" // sum of the last N decimal digits: even -> ON, or sum >= threshold -> ON
+	judgeExpr     = "expr"     // admin expression over block variables (see expr.go)
+	judgeScript   = "script"   // uploaded, versioned multi-line script (see script.go)
+
+	judgeHeightParity = "heightparity" // block height even -> ON
+	judgeHeightDigit  = "heightdigit"  // last decimal digit of the height >= AtLeast -> ON
+	judgePattern3     = "pattern3"     // last three hash chars classified by Spec (letters/digits)
+	judgeTxParity     = "txparity"     // transaction count even -> ON; unknown count -> NEUTRAL
+)
+
+// stateNeutral is a third judge result for blocks a rule has no opinion on (no digits,
+// malformed hash, or a script that says so). Machines skip it unless the rule maps it.
+const stateNeutral = "NEUTRAL"
+
+// JudgeRule.Neutral values
+const (
+	neutralSkip = "skip" // default: counters untouched; a HIT due on that block misses
+	neutralOn   = "on"
+	neutralOff  = "off"
+)
+
+// ---------- registry ----------
+
+// judgeImpl is one rule type. Rules register themselves from init (see the built-ins
+// below, expr.go and script.go); the API and the switch endpoint only go through here.
+type judgeImpl struct {
+	name string
+	desc string
+
+	// judge returns "ON"/"OFF"/"NEUTRAL"; false when the rule itself fails
+	judge func(j JudgeRule, b Block) (string, bool)
+	// normalize validates j and drops fields the type doesn't use
+	normalize func(j *JudgeRule) error
+}
+
+var (
+	judgeRegistry = map[string]judgeImpl{}
+	judgeTypes    []string // sorted by name
+)
+
+func registerJudge(impl judgeImpl) {
+	if impl.name == "" || impl.judge == nil || impl.normalize == nil {
+		panic("judge: incomplete registration")
+	}
+	if _, dup := judgeRegistry[impl.name]; dup {
+		panic("judge: duplicate type " + impl.name)
+	}
+	judgeRegistry[impl.name] = impl
+	judgeTypes = append(judgeTypes, impl.name)
+	sort.Strings(judgeTypes)
+}
+
+// JudgeType is what GET /api/judge lists.
+type JudgeType struct {
+	Name string `json:"name"`
+	Desc string `json:"desc"`
+}
+
+func judgeTypeList() []JudgeType {
+	out := make([]JudgeType, 0, len(judgeTypes))
+	for _, name := range judgeTypes {
+		out = append(out, JudgeType{Name: name, Desc: judgeRegistry[name].desc})
+	}
+	return out
+}
+
+// sample block used to smoke-test expressions when they are saved
+var judgeSampleBlock = Block{
+	Height:  1,
+	Hash:    "0000000003a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b",
+	Time:    time.Unix(0, 0),
+	TxCount: 2,
+}
+
+type JudgeRule struct {
+	Type string `json:"type"` // empty means lucky
+
+	// lucky: window of Width chars starting Pos chars from the end (1 = last char).
+	// Mixed letter/digit types -> ON, all the same type -> OFF. Zero values mean 1/2.
+	Pos   int `json:"pos,omitempty"`
+	Width int `json:"width,omitempty"`
+
+	// regex
+	Pattern string `json:"pattern,omitempty"` // RE2 syntax, matched against the lower-case hash
+	Last    int    `json:"last,omitempty"`    // only the last N chars; 0 = whole hash
+
+	// digitsum
+	Digits     int `json:"digits,omitempty"`     // N: how many trailing digits to sum
+	SumAtLeast int `json:"sumAtLeast,omitempty"` // 0 = parity mode (even -> ON)
+
+	// heightdigit: 1-9, zero means 5 (5-9 ON, 0-4 OFF)
+	AtLeast int `json:"atLeast,omitempty"`
+
+	// pattern3: "class=STATE,..." first match wins, no match -> NEUTRAL (see parsePattern3)
+	Spec string `json:"spec,omitempty"`
+
+	// expr
+	Expr string `json:"expr,omitempty"` // vars: hash height lastChar lastDigit digitCount letterCount txCount time
+
+	// script: Version 0 means "latest" when switching; the source is pinned into the rule
+	Script  string `json:"script,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Source  string `json:"source,omitempty"`
+
+	// Neutral: how NEUTRAL results reach the machine ("" = skip, "on", "off")
+	Neutral string `json:"neutral,omitempty"`
+}
+
+// Block is what a judge rule gets to look at.
+type Block struct {
+	Height  int64
+	Hash    string
+	Time    time.Time
+	TxCount int // transactions in the block; -1 when unknown
+}
+
+// judgeBlock returns "ON"/"OFF"/"NEUTRAL" (after the rule's neutral mapping);
+// false means the rule itself failed and the block is dropped.
+func judgeBlock(j JudgeRule, b Block) (string, bool) {
+	state, ok := judgeRaw(j, b)
+	if ok && state == stateNeutral {
+		switch j.Neutral {
+		case neutralOn:
+			return "ON", true
+		case neutralOff:
+			return "OFF", true
+		}
+	}
+	return state, ok
+}
+
+func judgeRaw(j JudgeRule, b Block) (string, bool) {
+	t := j.Type
+	if t == "" {
+		t = judgeLucky
+	}
+	impl, ok := judgeRegistry[t]
+	if !ok {
+		return "", false
+	}
+	return impl.judge(j, b)
+}
+
+// ---------- built-in rules ----------
+
+func init() {
+	registerJudge(judgeImpl{
+		name: judgeLucky,
+		desc: "last chars of the hash: mixed letter/digit types -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			var state string
+			var ok bool
+			if (j.Pos == 0 || j.Pos == 1) && (j.Width == 0 || j.Width == 2) {
+				state, ok = blockStateByHash(b.Hash)
+			} else {
+				state, ok = luckyWindow(b.Hash, j.Pos, j.Width)
+			}
+			if !ok {
+				return stateNeutral, true // malformed hash
+			}
+			return state, true
+		},
+		normalize: func(j *JudgeRule) error {
+			pos, width := j.Pos, j.Width
+			if pos == 0 {
+				pos = 1
+			}
+			if width == 0 {
+				width = 2
+			}
+			if pos < 1 || pos > 63 {
+				return fmt.Errorf("pos must be 1-63")
+			}
+			if width < 2 || pos+width-1 > 64 {
+				return fmt.Errorf("width must be >= 2 and the window must fit in 64 chars")
+			}
+			*j = JudgeRule{Type: judgeLucky, Pos: pos, Width: width}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgeRegex,
+		desc: "regex over the hash (or its last N chars): match -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			re, err := compileJudgeRegex(j.Pattern)
+			if err != nil {
+				return "", false
+			}
+			if re.MatchString(hashTail(b.Hash, j.Last)) {
+				return "ON", true
+			}
+			return "OFF", true
+		},
+		normalize: func(j *JudgeRule) error {
+			*j = JudgeRule{Type: judgeRegex, Pattern: j.Pattern, Last: j.Last}
+			if strings.TrimSpace(j.Pattern) == "" {
+				return fmt.Errorf("pattern required")
+			}
+			if len(j.Pattern) > 256 {
+				return fmt.Errorf("pattern too long")
+			}
+			if _, err := compileJudgeRegex(j.Pattern); err != nil {
+				return err
+			}
+			if j.Last < 0 || j.Last > 64 {
+				return fmt.Errorf("last must be 0-64")
+			}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgeDigitSum,
+		desc: "sum of the last N hash digits: even -> ON, or sum >= threshold -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			sum, n := 0, 0
+			h := strings.TrimSpace(b.Hash)
+			for i := len(h) - 1; i >= 0 && n < j.Digits; i-- {
+				if c := h[i]; c >= '0' && c <= '9' {
+					sum += int(c - '0')
+					n++
+				}
+			}
+			if n == 0 {
+				return stateNeutral, true
+			}
+			if j.SumAtLeast > 0 {
+				if sum >= j.SumAtLeast {
+					return "ON", true
+				}
+				return "OFF", true
+			}
+			if sum%2 == 0 {
+				return "ON", true
+			}
+			return "OFF", true
+		},
+		normalize: func(j *JudgeRule) error {
+			if j.Digits < 1 || j.Digits > 64 {
+				return fmt.Errorf("digits must be 1-64")
+			}
+			if j.SumAtLeast < 0 || j.SumAtLeast > 9*j.Digits {
+				return fmt.Errorf("sumAtLeast must be 0-%d", 9*j.Digits)
+			}
+			*j = JudgeRule{Type: judgeDigitSum, Digits: j.Digits, SumAtLeast: j.SumAtLeast}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgeHeightParity,
+		desc: "block height even -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			if b.Height%2 == 0 {
+				return "ON", true
+			}
+			return "OFF", true
+		},
+		normalize: func(j *JudgeRule) error {
+			*j = JudgeRule{Type: judgeHeightParity}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgeHeightDigit,
+		desc: "last digit of the block height >= atLeast -> ON",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			at := j.AtLeast
+			if at == 0 {
+				at = 5
+			}
+			if b.Height%10 >= int64(at) {
+				return "ON", true
+			}
+			return "OFF", true
+		},
+		normalize: func(j *JudgeRule) error {
+			at := j.AtLeast
+			if at == 0 {
+				at = 5
+			}
+			if at < 1 || at > 9 {
+				return fmt.Errorf("atLeast must be 1-9")
+			}
+			*j = JudgeRule{Type: judgeHeightDigit, AtLeast: at}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgeTxParity,
+		desc: "transaction count even -> ON (unknown -> NEUTRAL)",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			if b.TxCount < 0 {
+				return stateNeutral, true
+			}
+			if b.TxCount%2 == 0 {
+				return "ON", true
+			}
+			return "OFF", true
+		},
+		normalize: func(j *JudgeRule) error {
+			*j = JudgeRule{Type: judgeTxParity}
+			return nil
+		},
+	})
+
+	registerJudge(judgeImpl{
+		name: judgePattern3,
+		desc: "letter/digit shape of the last three hash chars, mapped by spec",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			spec, err := parsePattern3(j.Spec)
+			if err != nil {
+				return "", false
+			}
+			return spec.judge(b.Hash), true
+		},
+		normalize: func(j *JudgeRule) error {
+			spec, err := parsePattern3(j.Spec)
+			if err != nil {
+				return err
+			}
+			*j = JudgeRule{Type: judgePattern3, Spec: spec.String()}
+			return nil
+		},
+	})
+}
+
+// luckyWindow generalizes blockStateByHash to chars pos..pos+width-1 counted from the end.
+func luckyWindow(hash string, pos, width int) (string, bool) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if pos < 1 {
+		pos = 1
+	}
+	if width < 2 {
+		width = 2
+	}
+	end := len(hash) - pos + 1 // exclusive
+	start := end - width
+	if start < 0 || end > len(hash) {
+		return "", false
+	}
+
+	first, ok := hexCharType(hash[start])
+	if !ok {
+		return "", false
+	}
+	mixed := false
+	for i := start + 1; i < end; i++ {
+		t, ok := hexCharType(hash[i])
+		if !ok {
+			return "", false
+		}
+		if t != first {
+			mixed = true
+		}
+	}
+	if mixed {
+		return "ON", true
+	}
+	return "OFF", true
+}
+
+func evalJudgeExpr(src string, b Block) (string, error) {
+	n, err := compileExpr(src)
+	if err != nil {
+		return "", err
+	}
+	v, err := n.eval(&exprCtx{vars: blockEnv(b), budget: -1})
+	if err != nil {
+		return "", err
+	}
+	return exprState(v)
+}
+
+func hashTail(hash string, n int) string {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if n > 0 && n < len(hash) {
+		return hash[len(hash)-n:]
+	}
+	return hash
+}
+
+// ---------- pattern3 spec ----------
+
+// A pattern3 spec maps the letter/digit shape of the last three hash chars to a
+// state, e.g. "letters=ON,digits=ON,mixed=OFF" or "LLD=ON,DD?=OFF,*=OFF".
+// A class is three of L (a-f), D (0-9), ? (either), or one of the aliases
+// letters (LLL), digits (DDD), mixed (neither) and * (anything).
+
+type pattern3Entry struct {
+	class string
+	state string
+}
+
+type pattern3Spec []pattern3Entry
+
+var pattern3Cache = newCompileCache(compileCacheSize) // spec -> pattern3Spec
+
+func parsePattern3(spec string) (pattern3Spec, error) {
+	if v, ok := pattern3Cache.Load(spec); ok {
+		return v.(pattern3Spec), nil
+	}
+	var out pattern3Spec
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		class, state, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q: want class=STATE", part)
+		}
+		class = strings.TrimSpace(class)
+		switch strings.ToLower(class) {
+		case "letters", "digits", "mixed", "*":
+			class = strings.ToLower(class)
+		default:
+			class = strings.ToUpper(class)
+			if len(class) != 3 || strings.Trim(class, "LD?") != "" {
+				return nil, fmt.Errorf("entry %q: class must be 3 of L/D/? or letters/digits/mixed/*", part)
+			}
+		}
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if state != "ON" && state != "OFF" && state != stateNeutral {
+			return nil, fmt.Errorf("entry %q: state must be ON, OFF or NEUTRAL", part)
+		}
+		out = append(out, pattern3Entry{class: class, state: state})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("spec required")
+	}
+	if len(out) > 32 {
+		return nil, fmt.Errorf("too many entries")
+	}
+	pattern3Cache.Store(spec, out)
+	return out, nil
+}
+
+func (p pattern3Spec) String() string {
+	parts := make([]string, len(p))
+	for i, e := range p {
+		parts[i] = e.class + "=" + e.state
+	}
+	return strings.Join(parts, ",")
+}
+
+// judge returns the state of the first matching class; malformed hashes are NEUTRAL.
+func (p pattern3Spec) judge(hash string) string {
+	tail := hashTail(hash, 3)
+	if len(tail) != 3 {
+		return stateNeutral
+	}
+	var shape [3]byte
+	for i := 0; i < 3; i++ {
+		t, ok := hexCharType(tail[i])
+		if !ok {
+			return stateNeutral
+		}
+		if t == "alpha" {
+			shape[i] = 'L'
+		} else {
+			shape[i] = 'D'
+		}
+	}
+	for _, e := range p {
+		if pattern3Match(e.class, shape) {
+			return e.state
+		}
+	}
+	return stateNeutral
+}
+
+func pattern3Match(class string, shape [3]byte) bool {
+	switch class {
+	case "*":
+		return true
+	case "letters":
+		return shape == [3]byte{'L', 'L', 'L'}
+	case "digits":
+		return shape == [3]byte{'D', 'D', 'D'}
+	case "mixed":
+		return shape != [3]byte{'L', 'L', 'L'} && shape != [3]byte{'D', 'D', 'D'}
+	}
+	for i := 0; i < 3; i++ {
+		if class[i] != '?' && class[i] != shape[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compiled patterns are cached: the judge runs on every block
+var judgeRegexCache = newCompileCache(compileCacheSize) // pattern -> *regexp.Regexp
+
+func compileJudgeRegex(pattern string) (*regexp.Regexp, error) {
+	if v, ok := judgeRegexCache.Load(pattern); ok {
+		return v.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	judgeRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// normalizeJudge validates j in place.
+func normalizeJudge(j *JudgeRule) error {
+	j.Type = strings.ToLower(strings.TrimSpace(j.Type))
+	if j.Type == "" {
+		j.Type = judgeLucky
+	}
+	neutral := strings.ToLower(strings.TrimSpace(j.Neutral))
+	switch neutral {
+	case "", neutralSkip:
+		neutral = ""
+	case neutralOn, neutralOff:
+	default:
+		return fmt.Errorf("neutral must be skip, on or off")
+	}
+	impl, ok := judgeRegistry[j.Type]
+	if !ok {
+		return fmt.Errorf("unknown judge type %q", j.Type)
+	}
+	if err := impl.normalize(j); err != nil {
+		return fmt.Errorf("%s: %v", impl.name, err)
+	}
+	j.Neutral = neutral
+	return nil
+}
+
+func apiGetJudge(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	j := cfg.Rules.Judge
+	cfgMu.RUnlock()
+	if j.Type == "" {
+		j.Type = judgeLucky
+	}
+	mustJSON(w, 200, map[string]any{"rule": j, "types": judgeTypeList()})
+}
+
+// apiSetJudge switches the judge rule. Counters built under the old rule are
+// meaningless under the new one, so the state machine is wiped.
+func apiSetJudge(w http.ResponseWriter, r *http.Request) {
+	var j JudgeRule
+	if err := readJSON(r, &j); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalizeJudge(&j); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	before := cfg.Rules
+	prev := cfg.Rules.Judge
+	cfg.Rules.Judge = j
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Rules.Judge = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	after := cfg.Rules
+	cfgMu.Unlock()
+	auditRules(r, "judge", before, after)
+
+	rtMu.Lock()
+	rt.resetMachine()
+	rtMu.Unlock()
+	bb.recordReset()
+	judgeStats.reset()
+
+	logged := j
+	logged.Source = "" // pinned script source is too long for a log line
+	lb, _ := json.Marshal(logged)
+	logger.Printf("JUDGE_SWITCHED rule=%s", lb)
+	broadcastStatus()
+	mustJSON(w, 200, map[string]any{"ok": true, "rule": j})
+}
+
+// apiJudgePreview evaluates a rule (the active one when the body is empty) over the
+// blocks currently in the ring buffer, without touching config or machine state.
+func apiJudgePreview(w http.ResponseWriter, r *http.Request) {
+	var j JudgeRule
+	// no body (whatever the framing) previews the active rule
+	if err := readJSON(r, &j); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfgMu.RLock()
+	active := cfg.Rules.Judge
+	cfgMu.RUnlock()
+	if j.Type == "" {
+		j = active
+	}
+	if err := normalizeJudge(&j); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rtMu.Lock()
+	blocks := rt.Ring.recent()
+	rtMu.Unlock()
+
+	type previewRow struct {
+		Height  int64  `json:"height"`
+		Hash    string `json:"hash"`
+		Current string `json:"current"` // what the engine judged when the block arrived
+		Preview string `json:"preview"` // what this rule says ("" = can't judge)
+	}
+	rows := make([]previewRow, 0, len(blocks))
+	var on, off, neutral, unjudged, changed int
+	for _, b := range blocks {
+		state, ok := judgeBlock(j, b.block())
+		switch {
+		case !ok:
+			unjudged++
+		case state == stateNeutral:
+			neutral++
+		case state == "ON":
+			on++
+		default:
+			off++
+		}
+		if state != b.State {
+			changed++
+		}
+		rows = append(rows, previewRow{Height: b.Height, Hash: b.Hash, Current: b.State, Preview: state})
+	}
+
+	logged := j
+	logged.Source = ""
+	mustJSON(w, 200, map[string]any{
+		"rule":     logged,
+		"blocks":   rows,
+		"on":       on,
+		"off":      off,
+		"neutral":  neutral,
+		"unjudged": unjudged,
+		"changed":  changed,
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------- Judge distribution stats ----------
+
+// Per-block ON/OFF distribution of the active judge rule: a rolling window for the
+// ratio plus run-length histograms since the rule became active. Switching the judge
+// (or restarting) starts over. NEUTRAL blocks are counted but don't break a run,
+// matching how the machine skips them.
+
+const (
+	judgeStatsWindow = 1000 // blocks in the rolling ratio
+	judgeStatsMaxRun = 20   // runs this long or longer share the last bucket
+)
+
+type judgeStatsStore struct {
+	mu    sync.Mutex
+	since time.Time
+
+	recent []string // ring of the last judgeStatsWindow results
+	pos    int
+
+	total map[string]uint64 // state -> blocks since reset
+
+	runState string
+	runLen   int
+	runs     map[string][]uint64 // "ON"/"OFF" -> completed runs by length (index = len-1)
+}
+
+var judgeStats = newJudgeStats()
+
+func newJudgeStats() *judgeStatsStore {
+	return &judgeStatsStore{
+		since: time.Now(),
+		total: map[string]uint64{},
+		runs: map[string][]uint64{
+			"ON":  make([]uint64, judgeStatsMaxRun),
+			"OFF": make([]uint64, judgeStatsMaxRun),
+		},
+	}
+}
+
+func (s *judgeStatsStore) reset() {
+	fresh := newJudgeStats()
+	s.mu.Lock()
+	s.since, s.recent, s.pos = fresh.since, nil, 0
+	s.total, s.runs = fresh.total, fresh.runs
+	s.runState, s.runLen = "", 0
+	s.mu.Unlock()
+}
+
+func (s *judgeStatsStore) observe(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recent) < judgeStatsWindow {
+		s.recent = append(s.recent, state)
+	} else {
+		s.recent[s.pos] = state
+		s.pos = (s.pos + 1) % judgeStatsWindow
+	}
+	s.total[state]++
+
+	if state == stateNeutral {
+		return
+	}
+	if state == s.runState {
+		s.runLen++
+		return
+	}
+	s.closeRunLocked()
+	s.runState, s.runLen = state, 1
+}
+
+func (s *judgeStatsStore) closeRunLocked() {
+	h := s.runs[s.runState]
+	if h == nil || s.runLen == 0 {
+		return
+	}
+	h[min(s.runLen, judgeStatsMaxRun)-1]++
+}
+
+type judgeCounts struct {
+	Blocks  uint64  `json:"blocks"`
+	On      uint64  `json:"on"`
+	Off     uint64  `json:"off"`
+	Neutral uint64  `json:"neutral"`
+	OnRatio float64 `json:"onRatio"` // on / (on+off)
+}
+
+func countsOf(on, off, neutral uint64) judgeCounts {
+	c := judgeCounts{Blocks: on + off + neutral, On: on, Off: off, Neutral: neutral}
+	if on+off > 0 {
+		c.OnRatio = float64(on) / float64(on+off)
+	}
+	return c
+}
+
+func apiJudgeStats(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	rule := cfg.Rules.Judge
+	cfgMu.RUnlock()
+	rule.Source = ""
+
+	s := judgeStats
+	s.mu.Lock()
+	var on, off, neutral uint64
+	for _, st := range s.recent {
+		switch st {
+		case "ON":
+			on++
+		case "OFF":
+			off++
+		case stateNeutral:
+			neutral++
+		}
+	}
+	recent := countsOf(on, off, neutral)
+	total := countsOf(s.total["ON"], s.total["OFF"], s.total[stateNeutral])
+
+	// histogram keys are run lengths; the last one means "that many or more"
+	runs := map[string]map[string]uint64{}
+	for state, h := range s.runs {
+		m := map[string]uint64{}
+		for i, n := range h {
+			if n == 0 {
+				continue
+			}
+			k := strconv.Itoa(i + 1)
+			if i+1 == judgeStatsMaxRun {
+				k += "+"
+			}
+			m[k] = n
+		}
+		runs[state] = m
+	}
+	current := map[string]any{"state": s.runState, "len": s.runLen}
+	since := s.since.UTC().Format(time.RFC3339)
+	s.mu.Unlock()
+
+	mustJSON(w, 200, map[string]any{
+		"rule":       rule,
+		"since":      since,
+		"window":     judgeStatsWindow,
+		"recent":     recent,
+		"total":      total,
+		"runs":       runs,
+		"currentRun": current,
+	})
+}
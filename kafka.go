@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Kafka producer ----------
+
+// Every accepted block (after dedupe, judged or not) and every signal can be
+// written to Kafka topics for analytics pipelines (POST /api/kafka). The record
+// key is "<instance>/<height>" (just the height without an instance name), so one
+// height always lands on the same partition. This is a minimal producer speaking
+// Metadata v1 and Produce v3 with one-record batches; compression, idempotence
+// and SASL/TLS are not offered. Like MQTT it runs off a queue and retries against
+// fresh metadata before giving up on a record.
+
+const (
+	kafkaQueueSize = 1024
+	kafkaAttempts  = 3
+	kafkaTimeout   = 5 * time.Second
+)
+
+type KafkaConfig struct {
+	Brokers     []string `json:"brokers"`               // host:port bootstrap list; empty = disabled
+	SignalTopic string   `json:"signalTopic,omitempty"` // empty = signals not written
+	BlockTopic  string   `json:"blockTopic,omitempty"`  // empty = blocks not written
+	// wait for all in-sync replicas instead of just the leader
+	AcksAll bool `json:"acksAll,omitempty"`
+}
+
+func (k KafkaConfig) equal(o KafkaConfig) bool {
+	return strings.Join(k.Brokers, ",") == strings.Join(o.Brokers, ",") &&
+		k.SignalTopic == o.SignalTopic && k.BlockTopic == o.BlockTopic && k.AcksAll == o.AcksAll
+}
+
+type kafkaMsg struct {
+	topic string
+	key   []byte
+	value []byte
+	ts    time.Time
+}
+
+var (
+	kafkaC = make(chan kafkaMsg, kafkaQueueSize)
+
+	kafkaStatsMu sync.Mutex
+	kafkaStats   struct {
+		Produced  uint64 `json:"produced"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func kafkaKey(height int64) []byte {
+	if instanceName == "" {
+		return []byte(strconv.FormatInt(height, 10))
+	}
+	return []byte(instanceName + "/" + strconv.FormatInt(height, 10))
+}
+
+func enqueueKafkaSignal(s Signal) {
+	cfgMu.RLock()
+	kc := cfg.Kafka
+	cfgMu.RUnlock()
+	if len(kc.Brokers) == 0 || kc.SignalTopic == "" {
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	enqueueKafka(kafkaMsg{kc.SignalTopic, kafkaKey(s.Height), b, time.Now()})
+}
+
+func enqueueKafkaBlock(info BlockInfo) {
+	cfgMu.RLock()
+	kc := cfg.Kafka
+	cfgMu.RUnlock()
+	if len(kc.Brokers) == 0 || kc.BlockTopic == "" {
+		return
+	}
+	b, err := json.Marshal(struct {
+		BlockInfo
+		Instance string `json:"instance,omitempty"`
+	}{info, instanceName})
+	if err != nil {
+		return
+	}
+	enqueueKafka(kafkaMsg{kc.BlockTopic, kafkaKey(info.Height), b, time.Now()})
+}
+
+func enqueueKafka(m kafkaMsg) {
+	select {
+	case kafkaC <- m:
+	default:
+		kafkaStatsMu.Lock()
+		kafkaStats.Dropped++
+		kafkaStatsMu.Unlock()
+		logger.Printf("KAFKA_DROP topic=%s key=%s (queue full)", m.topic, m.key)
+	}
+}
+
+func kafkaLoop() {
+	var p *kafkaProducer
+	for m := range kafkaC {
+		cfgMu.RLock()
+		kc := cfg.Kafka
+		cfgMu.RUnlock()
+		if p != nil && !p.cfg.equal(kc) {
+			p.close()
+			p = nil
+		}
+		if len(kc.Brokers) == 0 {
+			continue
+		}
+		if p == nil {
+			p = &kafkaProducer{cfg: kc, conns: map[int32]*kafkaConn{}}
+		}
+		var err error
+		for attempt := 1; attempt <= kafkaAttempts; attempt++ {
+			if err = p.produce(m); err == nil {
+				break
+			}
+			// stale leader or broken connection: start over from the bootstrap list
+			p.close()
+			time.Sleep(time.Second * time.Duration(attempt))
+		}
+
+		kafkaStatsMu.Lock()
+		if err != nil {
+			kafkaStats.Failed++
+			kafkaStats.LastError = err.Error()
+		} else {
+			kafkaStats.Produced++
+		}
+		kafkaStatsMu.Unlock()
+		if err != nil {
+			logger.Printf("KAFKA_ERROR topic=%s key=%s: %v", m.topic, m.key, err)
+		}
+	}
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+type kafkaProducer struct {
+	cfg     KafkaConfig
+	brokers map[int32]string // node id -> host:port
+	topics  map[string][]kafkaPartition
+	conns   map[int32]*kafkaConn
+}
+
+func (p *kafkaProducer) close() {
+	for _, c := range p.conns {
+		c.conn.Close()
+	}
+	p.conns = map[int32]*kafkaConn{}
+	p.brokers = nil
+	p.topics = nil
+}
+
+func (p *kafkaProducer) produce(m kafkaMsg) error {
+	parts := p.topics[m.topic]
+	if parts == nil {
+		if err := p.refreshMetadata(m.topic); err != nil {
+			return err
+		}
+		if parts = p.topics[m.topic]; len(parts) == 0 {
+			return fmt.Errorf("kafka: topic %s has no partitions", m.topic)
+		}
+	}
+	part := parts[crc32.ChecksumIEEE(m.key)%uint32(len(parts))]
+	if part.leader < 0 {
+		return fmt.Errorf("kafka: %s/%d has no leader", m.topic, part.id)
+	}
+	c, err := p.conn(part.leader)
+	if err != nil {
+		return err
+	}
+
+	acks := int16(1)
+	if p.cfg.AcksAll {
+		acks = -1
+	}
+	var req []byte
+	req = binary.BigEndian.AppendUint16(req, 0xffff) // transactional_id: null
+	req = binary.BigEndian.AppendUint16(req, uint16(acks))
+	req = binary.BigEndian.AppendUint32(req, uint32(kafkaTimeout/time.Millisecond))
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = kafkaString(req, m.topic)
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = binary.BigEndian.AppendUint32(req, uint32(part.id))
+	batch := kafkaRecordBatch(m)
+	req = binary.BigEndian.AppendUint32(req, uint32(len(batch)))
+	req = append(req, batch...)
+
+	resp, err := c.roundTrip(0, 3, req) // Produce v3
+	if err != nil {
+		return err
+	}
+	r := kafkaReader{b: resp}
+	for nt := r.int32(); nt > 0 && r.err == nil; nt-- {
+		r.string()
+		for np := r.int32(); np > 0 && r.err == nil; np-- {
+			r.int32()
+			if code := r.int16(); code != 0 {
+				return fmt.Errorf("kafka: produce to %s/%d failed with error code %d", m.topic, part.id, code)
+			}
+			r.int64()
+			r.int64()
+		}
+	}
+	return r.err
+}
+
+func (p *kafkaProducer) refreshMetadata(topic string) error {
+	var lastErr error
+	for _, addr := range p.cfg.Brokers {
+		c, err := dialKafka(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req := binary.BigEndian.AppendUint32(nil, 1)
+		req = kafkaString(req, topic)
+		resp, err := c.roundTrip(3, 1, req) // Metadata v1
+		c.conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return p.parseMetadata(resp)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("kafka: no brokers configured")
+	}
+	return lastErr
+}
+
+func (p *kafkaProducer) parseMetadata(resp []byte) error {
+	r := kafkaReader{b: resp}
+	brokers := map[int32]string{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller id
+	topics := map[string][]kafkaPartition{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code := r.int16()
+		name := r.string()
+		r.bool()
+		var parts []kafkaPartition
+		for np := r.int32(); np > 0 && r.err == nil; np-- {
+			r.int16()
+			part := kafkaPartition{id: r.int32(), leader: r.int32()}
+			for nr := r.int32(); nr > 0 && r.err == nil; nr-- {
+				r.int32()
+			}
+			for ni := r.int32(); ni > 0 && r.err == nil; ni-- {
+				r.int32()
+			}
+			parts = append(parts, part)
+		}
+		if code != 0 {
+			return fmt.Errorf("kafka: metadata for %s failed with error code %d", name, code)
+		}
+		topics[name] = parts
+	}
+	if r.err != nil {
+		return r.err
+	}
+	p.brokers, p.topics = brokers, topics
+	return nil
+}
+
+func (p *kafkaProducer) conn(node int32) (*kafkaConn, error) {
+	if c := p.conns[node]; c != nil {
+		return c, nil
+	}
+	addr, ok := p.brokers[node]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown broker %d", node)
+	}
+	c, err := dialKafka(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[node] = c
+	return c, nil
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	corrID int32
+}
+
+func dialKafka(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends one request (header v1) and returns the response body after
+// the correlation id.
+func (c *kafkaConn) roundTrip(apiKey, version int16, body []byte) ([]byte, error) {
+	c.corrID++
+	var hdr []byte
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(apiKey))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(version))
+	hdr = binary.BigEndian.AppendUint32(hdr, uint32(c.corrID))
+	hdr = kafkaString(hdr, "tron-signal")
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(hdr)+len(body)))
+	msg = append(append(msg, hdr...), body...)
+
+	_ = c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.br, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 16<<20 {
+		return nil, errors.New("kafka: bad response size")
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.br, resp); err != nil {
+		return nil, err
+	}
+	if int32(binary.BigEndian.Uint32(resp)) != c.corrID {
+		return nil, errors.New("kafka: correlation id mismatch")
+	}
+	return resp[4:], nil
+}
+
+// kafkaRecordBatch encodes m as a magic-2 record batch holding one record.
+func kafkaRecordBatch(m kafkaMsg) []byte {
+	var rec []byte
+	rec = append(rec, 0)              // attributes
+	rec = binary.AppendVarint(rec, 0) // timestamp delta
+	rec = binary.AppendVarint(rec, 0) // offset delta
+	rec = binary.AppendVarint(rec, int64(len(m.key)))
+	rec = append(rec, m.key...)
+	rec = binary.AppendVarint(rec, int64(len(m.value)))
+	rec = append(rec, m.value...)
+	rec = binary.AppendVarint(rec, 0) // headers
+	rec = append(binary.AppendVarint(nil, int64(len(rec))), rec...)
+
+	ts := uint64(m.ts.UnixMilli())
+	var tail []byte                               // everything the CRC covers
+	tail = binary.BigEndian.AppendUint16(tail, 0) // attributes
+	tail = binary.BigEndian.AppendUint32(tail, 0) // last offset delta
+	tail = binary.BigEndian.AppendUint64(tail, ts)
+	tail = binary.BigEndian.AppendUint64(tail, ts)
+	tail = binary.BigEndian.AppendUint64(tail, ^uint64(0)) // producer id -1
+	tail = binary.BigEndian.AppendUint16(tail, 0xffff)     // producer epoch -1
+	tail = binary.BigEndian.AppendUint32(tail, 0xffffffff) // base sequence -1
+	tail = binary.BigEndian.AppendUint32(tail, 1)          // record count
+	tail = append(tail, rec...)
+
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, 0)                       // base offset
+	b = binary.BigEndian.AppendUint32(b, uint32(4+1+4+len(tail))) // batch length
+	b = binary.BigEndian.AppendUint32(b, 0xffffffff)              // partition leader epoch
+	b = append(b, 2)                                              // magic
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(tail, crc32.MakeTable(crc32.Castagnoli)))
+	return append(b, tail...)
+}
+
+func kafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// kafkaReader decodes a response; the first short read sticks in err.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("kafka: short response")
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *kafkaReader) bool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a (nullable) int16-length string.
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n <= 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func validKafkaTopic(t string) bool {
+	if len(t) > 249 || t == "." || t == ".." {
+		return false
+	}
+	for _, c := range t {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func validateKafka(kc *KafkaConfig) error {
+	var brokers []string
+	for _, b := range kc.Brokers {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(b); err != nil || port == "" {
+			return fmt.Errorf("broker %q: must be host:port", b)
+		}
+		brokers = append(brokers, b)
+	}
+	kc.Brokers = brokers
+	kc.SignalTopic = strings.TrimSpace(kc.SignalTopic)
+	kc.BlockTopic = strings.TrimSpace(kc.BlockTopic)
+	if len(kc.Brokers) == 0 {
+		return nil
+	}
+	if kc.SignalTopic == "" && kc.BlockTopic == "" {
+		return fmt.Errorf("set signalTopic and/or blockTopic")
+	}
+	for _, t := range []string{kc.SignalTopic, kc.BlockTopic} {
+		if t != "" && !validKafkaTopic(t) {
+			return fmt.Errorf("bad topic %q", t)
+		}
+	}
+	return nil
+}
+
+func apiGetKafka(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	kc := cfg.Kafka
+	cfgMu.RUnlock()
+	kafkaStatsMu.Lock()
+	stats := kafkaStats
+	kafkaStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"kafka": kc, "stats": stats})
+}
+
+func apiSetKafka(w http.ResponseWriter, r *http.Request) {
+	var kc KafkaConfig
+	if err := readJSON(r, &kc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateKafka(&kc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.Kafka
+	cfg.Kafka = kc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Kafka = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("KAFKA_SET brokers=%d signals=%q blocks=%q acksAll=%v", len(kc.Brokers), kc.SignalTopic, kc.BlockTopic, kc.AcksAll)
+	mustJSON(w, 200, map[string]any{"ok": true, "kafka": kc})
+}
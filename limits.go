@@ -0,0 +1,58 @@
+package main
+
+import "time"
+
+// ---------- Trigger caps ----------
+
+// Rules.Limits caps how many ON/OFF triggers the machine may fire per Beijing-time
+// day / hour. Once a cap is reached the machine pauses (no counting, no triggers)
+// until that window rolls over. Windows follow block time, so replays and backtests
+// see the same pauses as the live engine.
+
+var beijing = time.FixedZone("UTC+8", 8*3600)
+
+type TriggerLimits struct {
+	PerDay  int `json:"perDay"`  // max ON+OFF triggers per day (UTC+8); 0 = unlimited
+	PerHour int `json:"perHour"` // max ON+OFF triggers per hour; 0 = unlimited
+}
+
+// limitWindows returns the day and hour indexes (UTC+8) that t falls into.
+func limitWindows(t time.Time) (day, hour int64) {
+	sec := t.Unix() + 8*3600
+	return floorDiv(sec, 86400), floorDiv(sec, 3600)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// limitPaused reports which cap (if any) holds the machine at time t, and when it lifts.
+func (s *RuntimeState) limitPaused(l TriggerLimits, t time.Time) (string, time.Time) {
+	day, hour := limitWindows(t)
+	if l.PerDay > 0 && s.LimitDay == day && s.DayTriggers >= l.PerDay {
+		return "day", time.Unix((day+1)*86400-8*3600, 0)
+	}
+	if l.PerHour > 0 && s.LimitHour == hour && s.HourTriggers >= l.PerHour {
+		return "hour", time.Unix((hour+1)*3600-8*3600, 0)
+	}
+	return "", time.Time{}
+}
+
+// countTrigger books one trigger at t and returns the cap it just reached, if any.
+func (s *RuntimeState) countTrigger(l TriggerLimits, t time.Time) string {
+	day, hour := limitWindows(t)
+	if s.LimitDay != day {
+		s.LimitDay, s.DayTriggers = day, 0
+	}
+	if s.LimitHour != hour {
+		s.LimitHour, s.HourTriggers = hour, 0
+	}
+	s.DayTriggers++
+	s.HourTriggers++
+	reason, _ := s.limitPaused(l, t)
+	return reason
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ---------- Listen address and base path ----------
+
+// The HTTP server binds host:port (default :8080) and can live under a URL
+// prefix, e.g. /tron behind a reverse proxy that forwards the subpath as is. Each
+// setting comes from the first of: command-line flag (-host, -port, -base-path),
+// environment (TRON_SIGNAL_HOST, TRON_SIGNAL_PORT, TRON_SIGNAL_BASE_PATH) and
+// config.json ("server"). Handlers keep seeing unprefixed paths; redirects and
+// the session cookie carry the prefix, and the web UI uses relative URLs.
+//
+// With a certificate and key (-tls-cert/-tls-key, TRON_SIGNAL_TLS_CERT/KEY or
+// server.tlsCert/tlsKey, PEM files) the server speaks HTTPS itself, so tokens and
+// the session cookie (then marked Secure) never cross the wire in cleartext.
+// -http-redirect or server.httpRedirect (e.g. ":80") additionally listens for
+// plain HTTP and redirects everything to the HTTPS port. server.acmeDomains
+// obtains the certificate automatically instead (acme.go).
+//
+// -socket, TRON_SIGNAL_SOCKET or server.socket also serves plain HTTP on a unix
+// socket, for a proxy on the same host; with socketOnly (-socket-only,
+// TRON_SIGNAL_SOCKET_ONLY=1) no TCP port is opened at all.
+
+const defaultPort = 8080
+
+type ServerConfig struct {
+	Host     string `json:"host,omitempty"`     // bind address; empty = all interfaces
+	Port     int    `json:"port,omitempty"`     // 0 = defaultPort
+	BasePath string `json:"basePath,omitempty"` // "/tron"; empty = served at /
+
+	TLSCert      string `json:"tlsCert,omitempty"`      // PEM certificate (chain) file
+	TLSKey       string `json:"tlsKey,omitempty"`       // PEM private key file
+	HTTPRedirect string `json:"httpRedirect,omitempty"` // plain HTTP addr redirecting to HTTPS; TLS only
+
+	// certificates from an ACME CA instead of tlsCert/tlsKey (see acme.go)
+	ACMEDomains   []string `json:"acmeDomains,omitempty"`
+	ACMEEmail     string   `json:"acmeEmail,omitempty"`     // contact for expiry notices
+	ACMEDirectory string   `json:"acmeDirectory,omitempty"` // empty = Let's Encrypt
+
+	Socket     string `json:"socket,omitempty"`     // unix socket path
+	SocketOnly bool   `json:"socketOnly,omitempty"` // no TCP listener
+}
+
+// listenFlags are the command-line overrides; zero values are unset.
+type listenFlags struct {
+	host         string
+	port         int
+	base         string
+	tlsCert      string
+	tlsKey       string
+	httpRedirect string
+	socket       string
+	socketOnly   bool
+}
+
+var (
+	listenAddr = ":" + strconv.Itoa(defaultPort)
+	basePath   string // "" or "/a/b", no trailing slash
+
+	tlsCertFile, tlsKeyFile string // both set = HTTPS
+	httpRedirectAddr        string
+
+	acmeDomains      []string
+	acmeEmail        string
+	acmeDirectoryURL string
+
+	socketPath string
+	socketOnly bool
+)
+
+func tlsEnabled() bool {
+	return tlsCertFile != "" || acmeEnabled()
+}
+
+// firstSet returns the first non-empty value.
+func firstSet(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolveListen sets the listen settings from the flags, the environment and sc.
+func resolveListen(fl listenFlags, sc ServerConfig) error {
+	host := firstSet(fl.host, os.Getenv("TRON_SIGNAL_HOST"), sc.Host)
+	port := defaultPort
+	if len(sc.ACMEDomains) > 0 {
+		port = 443
+	}
+	if sc.Port != 0 {
+		port = sc.Port
+	}
+	if v := os.Getenv("TRON_SIGNAL_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("TRON_SIGNAL_PORT: %q is not a number", v)
+		}
+		port = n
+	}
+	if fl.port != 0 {
+		port = fl.port
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	bp, err := normalizeBasePath(firstSet(fl.base, os.Getenv("TRON_SIGNAL_BASE_PATH"), sc.BasePath))
+	if err != nil {
+		return err
+	}
+	cert := firstSet(fl.tlsCert, os.Getenv("TRON_SIGNAL_TLS_CERT"), sc.TLSCert)
+	key := firstSet(fl.tlsKey, os.Getenv("TRON_SIGNAL_TLS_KEY"), sc.TLSKey)
+	redirect := firstSet(fl.httpRedirect, os.Getenv("TRON_SIGNAL_HTTP_REDIRECT"), sc.HTTPRedirect)
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	var domains []string
+	for _, d := range sc.ACMEDomains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "" || strings.ContainsAny(d, "*/: ") {
+			return fmt.Errorf("acmeDomains: bad domain %q (http-01 cannot issue wildcards)", d)
+		}
+		if !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) > 0 {
+		if cert != "" {
+			return fmt.Errorf("use either tlsCert/tlsKey or acmeDomains")
+		}
+		if redirect == "" {
+			redirect = ":80" // http-01 challenges arrive on port 80
+		}
+	}
+	if cert != "" {
+		// fail at startup rather than on the first handshake
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			return fmt.Errorf("TLS: %v", err)
+		}
+	} else if redirect != "" && len(domains) == 0 {
+		return fmt.Errorf("httpRedirect needs TLS")
+	}
+	sock := firstSet(fl.socket, os.Getenv("TRON_SIGNAL_SOCKET"), sc.Socket)
+	sockOnly := fl.socketOnly || os.Getenv("TRON_SIGNAL_SOCKET_ONLY") == "1" || sc.SocketOnly
+	if sockOnly {
+		if sock == "" {
+			return fmt.Errorf("socketOnly needs a socket path")
+		}
+		if cert != "" || len(domains) > 0 {
+			return fmt.Errorf("TLS needs the TCP listener; socketOnly serves plain HTTP")
+		}
+	}
+	listenAddr = net.JoinHostPort(host, strconv.Itoa(port))
+	basePath = bp
+	socketPath, socketOnly = sock, sockOnly
+	tlsCertFile, tlsKeyFile, httpRedirectAddr = cert, key, redirect
+	acmeDomains, acmeEmail = domains, strings.TrimSpace(sc.ACMEEmail)
+	acmeDirectoryURL = firstSet(sc.ACMEDirectory, acmeLetsEncrypt)
+	return nil
+}
+
+// httpsRedirect sends plain HTTP requests to the same host and path on the
+// HTTPS listener.
+func httpsRedirect() http.Handler {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// listenUnix opens the unix socket at path, replacing a stale socket left by a
+// previous run; other files there are not touched. The socket is group-writable
+// so a proxy in the same group can connect.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// normalizeBasePath turns "tron/", "/tron" or "/" into "/tron" or "".
+func normalizeBasePath(p string) (string, error) {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return "", nil
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." || strings.ContainsAny(seg, "?#%\\ ") {
+			return "", fmt.Errorf("bad base path %q", p)
+		}
+	}
+	return "/" + p, nil
+}
+
+// appPath prefixes an absolute app path with the base path.
+func appPath(p string) string {
+	return basePath + p
+}
+
+// withBasePath serves next under basePath: the prefix is stripped before next
+// sees the request, the bare prefix redirects to prefix/ and anything outside it
+// is 404.
+func withBasePath(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	strip := http.StripPrefix(basePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == basePath:
+			u := basePath + "/"
+			if r.URL.RawQuery != "" {
+				u += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, u, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, basePath+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
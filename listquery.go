@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Block and log queries ----------
+
+// Lists can be narrowed instead of always coming back whole. Blocks (the ring in
+// /api/status) take fromHeight/toHeight, from/to (RFC 3339), state, limit and
+// offset; /api/logs reads the daily log files (kind=access: the access log) with
+// from/to, a substring q, limit and offset. Both page newest first. GET /api/blocks takes the same block
+// filters without the rest of the status and, when the ring doesn't reach back
+// far enough, carries on into the block history (data/blocks).
+
+const (
+	defaultBlockLimit = ringSize
+	maxBlockLimit     = 5000
+	maxLogLimit       = 2000
+	defaultLogLimit   = 200
+	maxLogRange       = 7 * 24 * time.Hour
+	logTimeLayout     = "2006/01/02 15:04:05.000000" // log.LstdFlags|log.Lmicroseconds
+)
+
+type blockQuery struct {
+	fromHeight, toHeight int64
+	from, to             time.Time
+	state                string
+	limit, offset        int // limit < 0 = all
+	set                  bool
+}
+
+// parseBlockQuery reads the block filters; set is false when there are none.
+func parseBlockQuery(r *http.Request) (blockQuery, error) {
+	q := r.URL.Query()
+	bq := blockQuery{limit: -1}
+	var err error
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"fromHeight", &bq.fromHeight}, {"toHeight", &bq.toHeight}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return bq, fmt.Errorf("bad %s", p.name)
+			}
+			bq.set = true
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &bq.from}, {"to", &bq.to}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return bq, fmt.Errorf("bad %s: %v", p.name, err)
+			}
+			bq.set = true
+		}
+	}
+	if v := q.Get("state"); v != "" {
+		bq.state, bq.set = strings.ToUpper(v), true
+	}
+	if v := q.Get("limit"); v != "" {
+		if bq.limit, err = strconv.Atoi(v); err != nil || bq.limit < 0 {
+			return bq, fmt.Errorf("bad limit")
+		}
+		bq.set = true
+	}
+	if v := q.Get("offset"); v != "" {
+		if bq.offset, err = strconv.Atoi(v); err != nil || bq.offset < 0 {
+			return bq, fmt.Errorf("bad offset")
+		}
+		bq.set = true
+	}
+	return bq, nil
+}
+
+func (bq blockQuery) match(b BlockInfo) bool {
+	if (bq.fromHeight > 0 && b.Height < bq.fromHeight) || (bq.toHeight > 0 && b.Height > bq.toHeight) {
+		return false
+	}
+	if bq.state != "" && b.State != bq.state {
+		return false
+	}
+	if !bq.from.IsZero() || !bq.to.IsZero() {
+		t, err := time.Parse(time.RFC3339Nano, b.TimeISO)
+		if err != nil || (!bq.from.IsZero() && t.Before(bq.from)) || (!bq.to.IsZero() && !t.Before(bq.to)) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters blocks (newest first) and cuts the requested page.
+func (bq blockQuery) apply(blocks []BlockInfo) []BlockInfo {
+	out := []BlockInfo{}
+	skip := bq.offset
+	for _, b := range blocks {
+		if bq.limit >= 0 && len(out) >= bq.limit {
+			break
+		}
+		if !bq.match(b) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// apiBlocks: GET /api/blocks?fromHeight=&toHeight=&limit= (plus the other block
+// filters), newest first; limit defaults to defaultBlockLimit.
+func apiBlocks(w http.ResponseWriter, r *http.Request) {
+	bq, err := parseBlockQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("limit") == "" {
+		bq.limit = defaultBlockLimit
+	}
+	bq.limit = min(bq.limit, maxBlockLimit)
+
+	rtMu.Lock()
+	blocks := rt.Ring.recent()
+	rtMu.Unlock()
+
+	want := bq.offset + bq.limit
+	for _, b := range blocks {
+		if bq.match(b) {
+			want--
+		}
+	}
+	fromHistory := false
+	if want > 0 && !ringCovers(bq, blocks) {
+		before, to := int64(math.MaxInt64), time.Now()
+		if !bq.to.IsZero() {
+			to = bq.to
+		}
+		if n := len(blocks); n > 0 {
+			before = blocks[n-1].Height
+			if t, err := time.Parse(time.RFC3339Nano, blocks[n-1].TimeISO); err == nil && t.Before(to) {
+				to = t
+			}
+		}
+		older, err := olderBlocks(bq, before, to, want)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		blocks = append(blocks, older...)
+		fromHistory = len(older) > 0
+	}
+	mustJSON(w, 200, map[string]any{
+		"blocks":  bq.apply(blocks),
+		"offset":  bq.offset,
+		"limit":   bq.limit,
+		"history": fromHistory,
+	})
+}
+
+// ringCovers reports whether the query's lower bound lies within the ring, so
+// nothing older can match.
+func ringCovers(bq blockQuery, ring []BlockInfo) bool {
+	if len(ring) == 0 {
+		return false
+	}
+	oldest := ring[len(ring)-1]
+	if bq.fromHeight > 0 && bq.fromHeight >= oldest.Height {
+		return true
+	}
+	if !bq.from.IsZero() {
+		t, err := time.Parse(time.RFC3339Nano, oldest.TimeISO)
+		return err == nil && !bq.from.Before(t)
+	}
+	return false
+}
+
+// olderBlocks walks the block history back a day at a time from to, returning up
+// to want matching blocks below height before, newest first. It stops at the
+// query's lower bound or after historyRetention days.
+func olderBlocks(bq blockQuery, before int64, to time.Time, want int) ([]BlockInfo, error) {
+	stop := to.AddDate(0, 0, -historyRetention)
+	if !bq.from.IsZero() && bq.from.After(stop) {
+		stop = bq.from
+	}
+	if bq.fromHeight > 0 && before != math.MaxInt64 {
+		// one block per blockInterval, with a day of slack for missed slots
+		est := to.Add(-time.Duration(before-bq.fromHeight)*blockInterval - 24*time.Hour)
+		if est.After(stop) {
+			stop = est
+		}
+	}
+	var out []BlockInfo
+	for end := to; end.After(stop) && len(out) < want; {
+		start := end.UTC().Truncate(24 * time.Hour)
+		if start.Equal(end) {
+			start = start.Add(-24 * time.Hour)
+		}
+		if start.Before(stop) {
+			start = stop
+		}
+		day, err := readHistory(start, end)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(day) - 1; i >= 0 && len(out) < want; i-- {
+			if b := day[i]; b.Height < before && bq.match(b) {
+				out = append(out, b)
+			}
+		}
+		end = start
+	}
+	return out, nil
+}
+
+// apiLogs: GET /api/logs?kind=&from=&to=&q=&limit=&offset= (RFC 3339 times,
+// default the last hour), newest first.
+func apiLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dir := logDir
+	switch q.Get("kind") {
+	case "", "main":
+	case "access":
+		dir = accessLogDir
+	default:
+		http.Error(w, "bad kind: main or access", http.StatusBadRequest)
+		return
+	}
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) || to.Sub(from) > maxLogRange {
+		http.Error(w, "from must be before to, at most 7 days apart", http.StatusBadRequest)
+		return
+	}
+	limit := defaultLogLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxLogLimit)
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	offset = max(offset, 0)
+
+	lines, err := readLogs(dir, from, to, q.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := []string{}
+	for i := len(lines) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, lines[i])
+	}
+	mustJSON(w, 200, map[string]any{
+		"from":   from.UTC().Format(time.RFC3339),
+		"to":     to.UTC().Format(time.RFC3339),
+		"total":  len(lines),
+		"offset": offset,
+		"limit":  limit,
+		"lines":  page,
+	})
+}
+
+// readLogs returns the log lines in dir with from <= time < to containing sub,
+// oldest first. Lines are stamped in local time, one file per local day; continuation
+// lines without a stamp belong to the line before.
+func readLogs(dir string, from, to time.Time, sub string) ([]string, error) {
+	var out []string
+	lf := from.Local()
+	for d := time.Date(lf.Year(), lf.Month(), lf.Day(), 0, 0, 0, 0, time.Local); d.Before(to); d = d.AddDate(0, 0, 1) {
+		f, err := os.Open(filepath.Join(dir, d.Format("2006-01-02")+".log"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		in := false
+		for sc.Scan() {
+			line := sc.Text()
+			if len(line) >= len(logTimeLayout) {
+				if t, err := time.ParseInLocation(logTimeLayout, line[:len(logTimeLayout)], time.Local); err == nil {
+					in = !t.Before(from) && t.Before(to)
+				}
+			}
+			if in && (sub == "" || strings.Contains(line, sub)) {
+				out = append(out, line)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
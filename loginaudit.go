@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------- Login lockout and audit ----------
+
+// Failed logins are counted per account: web.lockout.maxFailures of them in a
+// row (within web.lockout.minutes of each other) lock the account for
+// web.lockout.minutes, whatever IP they come from, with an ACCOUNT_LOCKED
+// incident. A locked account answers 423 with Retry-After, even to the right
+// password; an admin setting a new password through /api/users/{name} unlocks
+// it. Names without an account are counted and locked the same way, so the
+// lockout does not tell which accounts exist; stale entries are swept once
+// there are lockoutSweepAt of them. The per-IP limits of authguard.go still
+// apply on top.
+//
+// Every attempt is logged (LOGIN_OK / LOGIN_FAILED) and the last
+// maxLoginAttempts are kept in memory for GET /api/logins, together with the
+// accounts locked right now.
+
+const (
+	maxLoginAttempts = 200
+	lockoutSweepAt   = 1000
+)
+
+var defaultLockout = LockoutConfig{MaxFailures: 5, Minutes: 15}
+
+type LockoutConfig struct {
+	MaxFailures int `json:"maxFailures,omitempty"` // 0 = 5
+	Minutes     int `json:"minutes,omitempty"`     // 0 = 15
+}
+
+func (l LockoutConfig) withDefaults() LockoutConfig {
+	if l.MaxFailures <= 0 {
+		l.MaxFailures = defaultLockout.MaxFailures
+	}
+	if l.Minutes <= 0 {
+		l.Minutes = defaultLockout.Minutes
+	}
+	return l
+}
+
+type LoginAttempt struct {
+	TimeISO  string `json:"timeISO"`
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	// ok | bad_password | unknown_user | locked
+	Result string `json:"result"`
+}
+
+type AccountLock struct {
+	Username string `json:"username"`
+	UntilISO string `json:"untilISO"`
+	LastIP   string `json:"lastIP"` // of the last failed attempt
+}
+
+type accountLogins struct {
+	fails       int // in a row
+	lastFail    time.Time
+	lastIP      string
+	lockedUntil time.Time
+}
+
+var loginAudit = struct {
+	mu       sync.Mutex
+	accounts map[string]*accountLogins
+	attempts []LoginAttempt // oldest first
+}{accounts: map[string]*accountLogins{}}
+
+func recordLoginLocked(user, ip, result string, now time.Time) {
+	loginAudit.attempts = append(loginAudit.attempts, LoginAttempt{TimeISO: isoOrEmpty(now), Username: user, IP: ip, Result: result})
+	if len(loginAudit.attempts) > maxLoginAttempts {
+		loginAudit.attempts = append([]LoginAttempt(nil), loginAudit.attempts[len(loginAudit.attempts)-maxLoginAttempts:]...)
+	}
+}
+
+// sweepLoginsLocked drops names that are neither locked nor counting failures.
+func sweepLoginsLocked(now time.Time, period time.Duration) {
+	for user, a := range loginAudit.accounts {
+		if !now.Before(a.lockedUntil) && now.Sub(a.lastFail) > period {
+			delete(loginAudit.accounts, user)
+		}
+	}
+}
+
+// accountLocked returns how long user is still locked, booking the attempt if so.
+func accountLocked(user, ip string, now time.Time) time.Duration {
+	loginAudit.mu.Lock()
+	defer loginAudit.mu.Unlock()
+	a := loginAudit.accounts[user]
+	if a == nil || !now.Before(a.lockedUntil) {
+		return 0
+	}
+	recordLoginLocked(user, ip, "locked", now)
+	logger.Printf("LOGIN_FAILED user=%q ip=%s reason=locked", user, ip)
+	return a.lockedUntil.Sub(now)
+}
+
+// loginFailed books a failed login; the name gets locked after too many.
+func loginFailed(user, ip, reason string, lc LockoutConfig, now time.Time) {
+	lc = lc.withDefaults()
+	period := time.Duration(lc.Minutes) * time.Minute
+
+	loginAudit.mu.Lock()
+	recordLoginLocked(user, ip, reason, now)
+	logger.Printf("LOGIN_FAILED user=%q ip=%s reason=%s", user, ip, reason)
+	a := loginAudit.accounts[user]
+	if a == nil {
+		if len(loginAudit.accounts) >= lockoutSweepAt {
+			sweepLoginsLocked(now, period)
+		}
+		a = &accountLogins{}
+		loginAudit.accounts[user] = a
+	}
+	if now.Sub(a.lastFail) > period {
+		a.fails = 0
+	}
+	a.fails++
+	a.lastFail, a.lastIP = now, ip
+	n := a.fails
+	locked := n >= lc.MaxFailures
+	if locked {
+		a.lockedUntil = now.Add(period)
+		a.fails = 0
+	}
+	loginAudit.mu.Unlock()
+
+	if locked {
+		raiseIncident("ACCOUNT_LOCKED", fmt.Sprintf("user=%q locked for %s after %d failed logins, last from ip=%s", user, period, n, ip))
+	}
+}
+
+func loginSucceeded(user, ip string, now time.Time) {
+	loginAudit.mu.Lock()
+	defer loginAudit.mu.Unlock()
+	delete(loginAudit.accounts, user)
+	recordLoginLocked(user, ip, "ok", now)
+	logger.Printf("LOGIN_OK user=%q ip=%s", user, ip)
+}
+
+// unlockAccount clears user's failures and lock.
+func unlockAccount(user string) {
+	loginAudit.mu.Lock()
+	defer loginAudit.mu.Unlock()
+	delete(loginAudit.accounts, user)
+}
+
+// writeLocked answers a login to a locked account.
+func writeLocked(w http.ResponseWriter, left time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+	http.Error(w, "account locked", http.StatusLocked)
+}
+
+// apiLogins: GET /api/logins is the recent login attempts (newest first) and
+// the accounts locked now.
+func apiLogins(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	loginAudit.mu.Lock()
+	attempts := make([]LoginAttempt, 0, len(loginAudit.attempts))
+	for i := len(loginAudit.attempts) - 1; i >= 0; i-- {
+		attempts = append(attempts, loginAudit.attempts[i])
+	}
+	locked := []AccountLock{}
+	for user, a := range loginAudit.accounts {
+		if now.Before(a.lockedUntil) {
+			locked = append(locked, AccountLock{Username: user, UntilISO: isoOrEmpty(a.lockedUntil), LastIP: a.lastIP})
+		}
+	}
+	loginAudit.mu.Unlock()
+	mustJSON(w, 200, map[string]any{"attempts": attempts, "locked": locked})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---------- Machine enable / disable / reset ----------
+
+// Rules.Disabled freezes the state machine: blocks are still judged and recorded,
+// but nothing counts, triggers or resolves a pending HIT until it is enabled again.
+// It has its own endpoint, so the rules form and templates never flip it.
+// Resetting the machine (reset, or enable/disable with ?reset=1) needs an admin.
+
+// machineReset reports whether r asks for a machine reset.
+func machineReset(r *http.Request) bool {
+	if r.URL.Path == "/api/machine/reset" {
+		return true
+	}
+	if r.URL.Path != "/api/machine/enable" && r.URL.Path != "/api/machine/disable" {
+		return false
+	}
+	v := r.URL.Query().Get("reset")
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// apiSetMachineEnabled handles POST /api/machine/enable and /disable; ?reset=1
+// also clears the machine's runtime state.
+func apiSetMachineEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	reset := machineReset(r)
+
+	cfgMu.Lock()
+	before := cfg.Rules
+	prev := cfg.Rules.Disabled
+	cfg.Rules.Disabled = !enabled
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Rules.Disabled = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	after := cfg.Rules
+	cfgMu.Unlock()
+	action := "disable"
+	if enabled {
+		action = "enable"
+	}
+	auditRules(r, action, before, after)
+
+	if reset {
+		rtMu.Lock()
+		rt.resetMachine()
+		rtMu.Unlock()
+		bb.recordReset()
+		auditMachine(r, "reset")
+	}
+
+	logger.Printf("MACHINE_ENABLED enabled=%v reset=%v", enabled, reset)
+	broadcastStatus()
+	mustJSON(w, 200, map[string]any{"ok": true, "enabled": enabled, "reset": reset})
+}
+
+// apiResetMachine handles POST /api/machine/reset: counters, reverse gate, pending
+// HIT checks and trigger caps start over; the block ring and config are untouched.
+func apiResetMachine(w http.ResponseWriter, r *http.Request) {
+	rtMu.Lock()
+	rt.resetMachine()
+	rtMu.Unlock()
+	bb.recordReset()
+	auditMachine(r, "reset")
+
+	logger.Printf("MACHINE_RESET user=%s", requestUser(r))
+	broadcastStatus()
+	mustJSON(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------- Machine statistics ----------
+
+// Counters for the live state machine: since boot ("lifetime", runtime isn't kept
+// across restarts) and for the current Beijing-time day. Fed by the engine only;
+// backtests and replays don't touch them. Included in Status, so SSE carries them.
+
+type StatCounters struct {
+	Triggers    uint64  `json:"triggers"` // ON + OFF + SEQ + ALT
+	OnTriggers  uint64  `json:"onTriggers"`
+	OffTriggers uint64  `json:"offTriggers"`
+	SeqTriggers uint64  `json:"seqTriggers"`
+	AltTriggers uint64  `json:"altTriggers"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	HitRate     float64 `json:"hitRate"` // hits / (hits+misses)
+}
+
+type MachineStats struct {
+	Since    string       `json:"since"`
+	Lifetime StatCounters `json:"lifetime"`
+	Day      string       `json:"day"` // YYYY-MM-DD, UTC+8
+	Today    StatCounters `json:"today"`
+
+	// consecutive judged ON / OFF blocks (NEUTRAL doesn't break a streak)
+	OnStreak         int `json:"onStreak"`
+	LongestOnStreak  int `json:"longestOnStreak"`
+	OffStreak        int `json:"offStreak"`
+	LongestOffStreak int `json:"longestOffStreak"`
+}
+
+type machineStatsStore struct {
+	mu sync.Mutex
+	st MachineStats
+}
+
+var machineStats = &machineStatsStore{st: MachineStats{Since: time.Now().UTC().Format(time.RFC3339)}}
+
+func (c *StatCounters) add(signals []Signal, outcome string) {
+	for _, s := range signals {
+		switch s.Type {
+		case "ON":
+			c.OnTriggers++
+		case "OFF":
+			c.OffTriggers++
+		case "SEQ":
+			c.SeqTriggers++
+		case "ALT":
+			c.AltTriggers++
+		}
+	}
+	c.Triggers = c.OnTriggers + c.OffTriggers + c.SeqTriggers + c.AltTriggers
+	switch outcome {
+	case "HIT":
+		c.Hits++
+	case "MISS":
+		c.Misses++
+	}
+	if n := c.Hits + c.Misses; n > 0 {
+		c.HitRate = float64(c.Hits) / float64(n)
+	}
+}
+
+// observe books one evaluated block.
+func (m *machineStatsStore) observe(state string, t time.Time, signals []Signal, outcome string) {
+	day := t.In(beijing).Format("2006-01-02")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := &m.st
+	if st.Day != day {
+		st.Day, st.Today = day, StatCounters{}
+	}
+	st.Lifetime.add(signals, outcome)
+	st.Today.add(signals, outcome)
+
+	switch state {
+	case "ON":
+		st.OnStreak++
+		st.OffStreak = 0
+		st.LongestOnStreak = max(st.LongestOnStreak, st.OnStreak)
+	case "OFF":
+		st.OffStreak++
+		st.OnStreak = 0
+		st.LongestOffStreak = max(st.LongestOffStreak, st.OffStreak)
+	}
+}
+
+func (m *machineStatsStore) snapshot() MachineStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.st
+}
+
+func apiMachineStats(w http.ResponseWriter, r *http.Request) {
+	rtMu.Lock()
+	missStreak := rt.MissStreak
+	rtMu.Unlock()
+	mustJSON(w, 200, map[string]any{"stats": machineStats.snapshot(), "missStreak": missStreak})
+}
+
+// MachineView is the live state machine as shown in Status.
+type MachineView struct {
+	OnCounter      int    `json:"onCounter"`
+	OffCounter     int    `json:"offCounter"`
+	WaitingReverse bool   `json:"waitingReverse"`
+	LastTriggered  string `json:"lastTriggered,omitempty"`
+	BaseHeight     int64  `json:"baseHeight,omitempty"`
+	HitWaiting     bool   `json:"hitWaiting"`
+	HitBase        int64  `json:"hitBase,omitempty"`
+	HitOffset      int    `json:"hitOffset,omitempty"`
+	HitExpect      string `json:"hitExpect,omitempty"`
+	MissStreak     int    `json:"missStreak"`
+	Pending        string `json:"pending,omitempty"`
+}
+
+// machineView is called with rtMu held.
+func (s *RuntimeState) machineView() MachineView {
+	v := MachineView{
+		OnCounter:      s.OnCounter,
+		OffCounter:     s.OffCounter,
+		WaitingReverse: s.WaitingReverse,
+		LastTriggered:  s.LastTriggered,
+		BaseHeight:     s.BaseHeight,
+		HitWaiting:     s.HitWaiting,
+		MissStreak:     s.MissStreak,
+		Pending:        s.Pending,
+	}
+	if s.HitWaiting {
+		v.HitBase, v.HitOffset, v.HitExpect = s.HitBase, s.HitOffset, s.HitExpect
+	}
+	return v
+}
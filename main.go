@@ -7,10 +7,12 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -19,39 +21,69 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 /*
 	Tron 实时区块监听与交易信号系统（落地版）
 	- 纯标准库：无第三方依赖
-	- Web 管理台：首次 setup + login
+	- Web 管理台：首次 setup + login；密码 argon2id（纯 Go 实现，web.argon2 可调成本，旧 SHA-256 登录时自动升级）；同一账号连续登录失败 N 次锁定 M 分钟（web.lockout，ACCOUNT_LOCKED incident），/api/logins 查看最近登录记录；修改类请求需带 X-CSRF-Token（由 /api/me 提供）；登录会话存于 data/sessions.json（只存哈希，web.sessionHours 有效期，默认 7 天），重启不掉线；web.cookie 可设 Secure（auto 按 TLS / X-Forwarded-Proto）、SameSite 与 Domain；多个账号，角色 viewer（只读）/ operator（可改规则、机器等）/ admin（另管 token、API Key、账号），/api/users 管理
 	- API Key 管理：最多 3 个，热更新
 	- 规则：ON/OFF 阈值（滑块）；HIT：t+x（x 可配）+ expect
+	- 监听：默认 :8080；-host / -port / -base-path（或环境变量 TRON_SIGNAL_HOST / TRON_SIGNAL_PORT / TRON_SIGNAL_BASE_PATH，或 config.json 的 server）可改绑定地址、端口与反向代理子路径；-tls-cert / -tls-key 直接提供 HTTPS，可选 -http-redirect 把 HTTP 跳转到 HTTPS；或 server.acmeDomains 自动向 Let's Encrypt 申请并续期证书（存于 data/acme）；-socket 另在 unix socket 上提供 HTTP（-socket-only 则不开 TCP 端口）
+	- 访问 Token：X-Token / ?token= 可代替登录，按 scope（signals / read / control）限定可用接口，可设过期时间（到期自动清理）与标签，记录最后使用时间 / IP；config.json 只存 SHA-256；/api/tokens 管理
+	- 限流：config.json 的 access.rateLimit 按 token / 白名单 IP 限制每分钟请求数，超出返回 429 + Retry-After
+	- 防爆破：登录 / 初始设置每 IP 每分钟限次；同一 IP 15 分钟内 10 次 401 即封禁 30 分钟并产生 AUTH_BANNED incident
+	- 访问日志：logs/access/YYYY-MM-DD.log（方法、路径、状态、耗时、IP、token，可抽样），/api/logs?kind=access 查询
+	- 响应压缩：客户端支持时 gzip（SSE / WS 除外）
 	- 区块来源：轮询 Tron Fullnode /wallet/getnowblock（可后续替换为 TronGrid WS）
-	- 去重：RingBuffer(50) on (height+hash)
-	- ON/OFF 判定：hash 最后两位 “字母/数字 类型异或”
+	- 去重：RingBuffer(50) on (height+hash)；启动时用 getblockbylatestnum 预热最近 50 块
+	- ON/OFF 判定：默认 lucky（hash 最后两位 “字母/数字 类型异或”），可切换为 regex 等判定规则
 	- 状态机：waitingReverse（触发后需先见反向状态才能重新计数）
-	- 信号广播：/ws 服务器端 WS 广播（不缓存、不重试、不确认）
-	- SSE：/sse/status 推最新块信息给页面
+	- 信号广播：/ws 服务器端 WS 广播（可选 ACK 重发；新连接可补发最近 N 条，带 replay:true），另可推 Webhook / MQTT / NATS / Kafka / Discord / Slack / 邮件 / ntfy / Gotify（Kafka 另写入每个区块，Discord / Slack / 邮件 / 手机推送另推 incident；严重 incident 可发短信）
+	- SSE：/sse/status 推最新块信息给页面；/sse/signals 与 /ws 同一信号流；模拟运行的信号只走 /sse/simulated
 	- 重启：运行态强制清零（不恢复任何历史状态）
+	- 区块历史：data/blocks/YYYY-MM-DD.jsonl（供回测与 /api/blocks 查询，引擎不读回）
+	- 信号历史：data/signals/YYYY-MM-DD.jsonl，/api/signals 查询；/api/signals/wait 长轮询等新信号
+	- API 文档：/api/openapi.json（OpenAPI 3，由代码生成），/docs/swagger 浏览（仅 admin；Swagger UI 文件需自行放入 web/swagger-ui/，不从 CDN 加载）；接口均可经 /api/v1/... 访问（旧路径保留为别名）
+	- Webhook 积压：失败或队列满的投递落盘 data/outbox/，端点恢复后按序补发，/api/deliveries 查看
+	- 性能分析：/debug/pprof/（需登录，且 config.json 中 debug.pprof=true 才开启）
+	- 黑匣子：内存保留最近 N 分钟的输入与判定（二进制），可导出并用 -replay 本地复现
 */
 
 const (
-	listenAddr   = ":8080"
 	dataDir      = "data"
 	configPath   = "data/config.json"
+	slaDir       = "data/sla"
+	historyDir   = "data/blocks"
+	signalDir    = "data/signals"
+	outboxDir    = "data/outbox"
 	logDir       = "logs"
 	logRetention = 3 // days
 
 	ringSize = 50
 
+	maxAPIKeys = 3
+
+	// config persistence: retries per save, and consecutive failed saves before an incident
+	configSaveAttempts      = 3
+	configSaveBackoff       = 100 * time.Millisecond
+	configSaveIncidentAfter = 3
+
 	// 轮询间隔：为了“实时”，默认 1s
 	pollInterval = 1 * time.Second
 
+	// a source counts as down after this many consecutive failures;
+	// when all are down they are only probed every sourceProbeInterval
+	sourceDownAfter     = 3
+	sourceProbeInterval = 10 * time.Second
+
 	// Tron Fullnode API（可用 TronGrid 公共网关）
 	defaultNodeURL = "https://api.trongrid.io"
 )
@@ -59,60 +91,251 @@ const (
 // ---------- Config / Models ----------
 
 type Config struct {
+	// Instance labels everything this deployment emits (signals, status, logs, reports)
+	Instance string `json:"instance"`
+
 	Web WebCred `json:"web"`
 
+	// bind address, port and URL prefix (see listen.go); read at startup
+	Server ServerConfig `json:"server"`
+
 	APIKeys []string `json:"apiKeys"`
 
+	// source pools: sourceID -> "primary"|"backup" (missing = primary)
+	SourceGroups map[string]string `json:"sourceGroups,omitempty"`
+	SourcePolicy string            `json:"sourcePolicy,omitempty"` // "all" (default) | "failover"
+
 	Rules Rules `json:"rules"`
 
+	// uploaded judge scripts: name -> versions (oldest first)
+	JudgeScripts map[string][]ScriptVersion `json:"judgeScripts,omitempty"`
+
 	Access AccessControl `json:"access"`
+
+	BlackBox BlackBoxConfig `json:"blackbox"`
+
+	Warmup WarmupConfig `json:"warmup"`
+
+	Webhook WebhookConfig `json:"webhook"`
+
+	// signed, type-filtered webhook endpoints (see webhook.go)
+	WebhookEndpoints []WebhookEndpoint `json:"webhookEndpoints,omitempty"`
+
+	WS WSConfig `json:"ws"`
+
+	MQTT MQTTConfig `json:"mqtt"`
+
+	NATS NATSConfig `json:"nats"`
+
+	Kafka KafkaConfig `json:"kafka"`
+
+	Discord DiscordConfig `json:"discord"`
+
+	Slack SlackConfig `json:"slack"`
+
+	Email EmailConfig `json:"email"`
+
+	SMS SMSConfig `json:"sms"`
+
+	Push PushConfig `json:"push"`
+
+	// IPs / access tokens refused on /ws (see wsbans.go)
+	WSBans WSBanList `json:"wsBans"`
+
+	// saved rule sets: name -> rules (judge and shadow not included)
+	RuleTemplates map[string]Rules `json:"ruleTemplates,omitempty"`
+
+	// /debug/pprof (see pprof.go); config file only
+	Debug DebugConfig `json:"debug"`
+
+	// per-request access log (see accesslog.go); config file only
+	AccessLog AccessLogConfig `json:"accessLog"`
 }
 
 type WebCred struct {
 	Initialized bool   `json:"initialized"`
-	Username    string `json:"username"`
-	SaltHex     string `json:"saltHex"`
-	HashHex     string `json:"hashHex"`
+	Users       []User `json:"users"` // see users.go
+	// password hashing cost (see users.go)
+	Argon2 Argon2Params `json:"argon2"`
+	// account lockout after failed logins (see loginaudit.go)
+	Lockout LockoutConfig `json:"lockout"`
+	// login session lifetime; 0 = a week (see sessions.go)
+	SessionHours int `json:"sessionHours,omitempty"`
+	// session cookie attributes (see sessions.go)
+	Cookie CookieConfig `json:"cookie"`
+	// the single account of older configs; moved into Users on startup
+	Username string `json:"username,omitempty"`
+	SaltHex  string `json:"saltHex,omitempty"`
+	HashHex  string `json:"hashHex,omitempty"`
 }
 
 type AccessControl struct {
-	IPWhitelist []string          `json:"ipWhitelist"`
-	Tokens      map[string]uint64 `json:"tokens"` // token -> usage count
+	IPWhitelist []string               `json:"ipWhitelist"`
+	Tokens      map[string]AccessToken `json:"tokens"` // token -> scopes and usage (see tokens.go)
+	// requests per minute per token / whitelisted IP (see ratelimit.go)
+	RateLimit RateLimits `json:"rateLimit"`
+}
+
+type BlackBoxConfig struct {
+	Minutes int `json:"minutes"` // replay window kept in memory; 0 means default
+}
+
+type WarmupConfig struct {
+	Disabled     bool `json:"disabled"`
+	Blocks       int  `json:"blocks"`       // 1..ringSize; 0 means ringSize
+	PrimeMachine bool `json:"primeMachine"` // feed warm-up blocks into the state machine (no signals)
 }
 
 type Rules struct {
+	// Disabled freezes the machine; managed by /api/machine/enable|disable
+	Disabled bool `json:"disabled,omitempty"`
+	// Simulate keeps signals off the WS stream and webhook (see simulate.go)
+	Simulate bool `json:"simulate,omitempty"`
+	// Confirm holds ON/OFF triggers as PENDING until the next block (see confirm.go)
+	Confirm bool `json:"confirm,omitempty"`
+	// Payload: static fields added to every signal (see payload.go)
+	Payload map[string]any `json:"payload,omitempty"`
+	// TTL: blocks a signal stays actionable, stamped as expiresAt (see ttl.go); 0 = none
+	TTL int `json:"ttl,omitempty"`
+	// Severity overrides the default severity per signal type (see severity.go)
+	Severity map[string]string `json:"severity,omitempty"`
+
 	On  ThresholdRule `json:"on"`
 	Off ThresholdRule `json:"off"`
 	Hit HitRule       `json:"hit"`
+
+	Sequence    SequenceRule    `json:"sequence"`
+	Alternation AlternationRule `json:"alternation"`
+	Counting    CountingRule    `json:"counting"`
+
+	Limits   TriggerLimits `json:"limits"`
+	Schedule Schedule      `json:"schedule"`
+
+	// Judge maps a block to ON/OFF; managed by /api/judge (switching wipes machine state)
+	Judge JudgeRule `json:"judge"`
+
+	// Shadow is judged and recorded on every block but never drives the machine
+	Shadow *JudgeRule `json:"shadow,omitempty"`
 }
 
 type ThresholdRule struct {
 	Enabled   bool `json:"enabled"`
 	Threshold int  `json:"threshold"` // 0-20; 0 means never trigger
+
+	// "reach" (default), "range" (Threshold..Max) or "below"; see threshold.go
+	Mode string `json:"mode,omitempty"`
+	Max  int    `json:"max,omitempty"`
 }
 
 type HitRule struct {
 	Enabled bool   `json:"enabled"`
 	Expect  string `json:"expect"` // "ON" or "OFF"
 	Offset  int    `json:"offset"` // x, >=1
+
+	// more checks after the same trigger, each emitting its own HIT (see hits.go)
+	Extra []HitCheck `json:"extra,omitempty"`
+
+	// each check spans blocks t+x..t+x+Window; Match: "first" (default) or "all"
+	Window int    `json:"window,omitempty"`
+	Match  string `json:"match,omitempty"`
+
+	// MissAlarm: consecutive missed checks that raise a MISS_STREAK warning; 0 = off
+	MissAlarm int `json:"missAlarm,omitempty"`
 }
 
 type Status struct {
+	Instance      string `json:"instance,omitempty"`
 	Listening     bool   `json:"listening"`
 	LastHeight    int64  `json:"lastHeight"`
 	LastHash      string `json:"lastHash"`
 	LastTimeISO   string `json:"lastTimeISO"`
 	Reconnects    uint64 `json:"reconnects"`
 	ConnectedKeys int    `json:"connectedKeys"`
+	SourcesDown   bool   `json:"sourcesDown"`
+	SourcePool    string `json:"sourcePool,omitempty"` // pool in use under the failover policy
+
+	// trigger caps: window that paused the machine ("day"|"hour") and when it lifts
+	Paused      string `json:"paused,omitempty"`
+	PausedUntil string `json:"pausedUntil,omitempty"`
+	// outside the configured active hours
+	OffSchedule bool `json:"offSchedule,omitempty"`
+	// machine switched off via /api/machine/disable
+	Disabled bool `json:"disabled,omitempty"`
+	// signal emission snoozed until then; seconds left
+	SnoozedUntil  string `json:"snoozedUntil,omitempty"`
+	SnoozeSeconds int    `json:"snoozeSeconds,omitempty"`
+	// seq of the last signal sent
+	Seq uint64 `json:"seq"`
+	// signals dropped by the dedup guard (see signaldedup.go)
+	Duplicates uint64 `json:"duplicatesDropped"`
+
+	Stats   MachineStats `json:"stats"`
+	Machine MachineView  `json:"machine"`
+
+	Blocks []BlockInfo `json:"blocks"` // ring buffer, newest first
+}
+
+// BlockInfo is one accepted block as kept in the ring buffer.
+type BlockInfo struct {
+	Height  int64  `json:"height"`
+	Hash    string `json:"hash"`
+	TimeISO string `json:"time"`
+	State   string `json:"state"`             // "ON"|"OFF"|"NEUTRAL"; empty when the judge rule failed
+	Shadow  string `json:"shadow,omitempty"`  // shadow rule result, when one is configured
+	TxCount *int   `json:"txCount,omitempty"` // nil when the source didn't report transactions
+}
+
+func blockInfoOf(b Block, state string) BlockInfo {
+	info := BlockInfo{Height: b.Height, Hash: b.Hash, TimeISO: isoOrEmpty(b.Time), State: state}
+	if b.TxCount >= 0 {
+		n := b.TxCount
+		info.TxCount = &n
+	}
+	return info
+}
+
+// block converts a stored BlockInfo back into judge input.
+func (b BlockInfo) block() Block {
+	blk := Block{Height: b.Height, Hash: b.Hash, Time: parseISOOrNow(b.TimeISO), TxCount: -1}
+	if b.TxCount != nil {
+		blk.TxCount = *b.TxCount
+	}
+	return blk
+}
+
+// Event is a system notification broadcast to WS clients alongside signals
+type Event struct {
+	Type     string `json:"type"` // "SOURCES_DOWN"|"SOURCES_RECOVERED"|"LIMIT_REACHED"|"SUBSCRIBED"
+	Detail   string `json:"detail,omitempty"`
+	TimeISO  string `json:"time"`
+	Instance string `json:"instance,omitempty"`
 }
 
 // Signal broadcast to trading program
 type Signal struct {
-	Type       string `json:"type"`       // "ON"|"OFF"|"HIT"
+	Type       string `json:"type"`       // "ON"|"OFF"|"HIT"|"MISS"|"SEQ"|"ALT"|"PENDING"|"CANCELLED"|"MISS_STREAK" (warning)
 	Height     int64  `json:"height"`     // current block height (trigger/hit block)
 	BaseHeight int64  `json:"baseHeight"` // trigger base height (for HIT: trigger base)
-	State      string `json:"state"`      // "ON"|"OFF" (for HIT: the state observed at t+x)
+	State      string `json:"state"`      // "ON"|"OFF" (for HIT/MISS: the state observed at t+x)
 	TimeISO    string `json:"time"`       // ISO timestamp
+	Instance   string `json:"instance,omitempty"`
+	// HIT/MISS/MISS_STREAK only: x of the check (t+x)
+	Offset int `json:"offset,omitempty"`
+	// MISS/MISS_STREAK: consecutive missed checks; ON/OFF in range/below mode: the ended streak
+	Streak int `json:"streak,omitempty"`
+	// MISS only: the state the check expected
+	Expect string `json:"expect,omitempty"`
+	// produced while Rules.Simulate was on; such signals never reach /ws
+	Simulated bool `json:"simulated,omitempty"`
+	// position in the stream of sent signals (see seq.go); 0 for simulated ones
+	Seq uint64 `json:"seq,omitempty"`
+	// with Rules.TTL: last block and time the signal is actionable (see ttl.go)
+	ExpiresHeight int64  `json:"expiresHeight,omitempty"`
+	ExpiresAt     string `json:"expiresAt,omitempty"`
+	// "info" | "normal" | "critical" (see severity.go)
+	Severity string `json:"severity,omitempty"`
+	// Rules.Payload as a JSON object, merged into the output (see payload.go)
+	Extra string `json:"-"`
 }
 
 // ---------- Globals (runtime state must be reset every boot) ----------
@@ -121,9 +344,12 @@ var (
 	cfgMu sync.RWMutex
 	cfg   Config
 
-	// sessions: token -> username
+	// consecutive failed saveConfigLocked calls (guarded by cfgMu)
+	configSaveFailures int
+
+	// sessions: sha256(session id) -> account (see sessions.go)
 	sessMu   sync.Mutex
-	sessions = map[string]string{}
+	sessions = map[string]webSession{}
 
 	// runtime: forced reset every start
 	rtMu sync.Mutex
@@ -133,12 +359,17 @@ var (
 	wsMu      sync.Mutex
 	wsClients = map[*wsConn]struct{}{}
 
-	// sse subscribers
+	// sse subscribers, fed the marshalled status
 	sseMu   sync.Mutex
-	sseSubs = map[chan Status]struct{}{}
+	sseSubs = map[chan []byte]struct{}{}
+	// last status pushed to them (guarded by sseMu)
+	lastStatusJSON []byte
 
 	// logger
 	logger *log.Logger
+
+	// deployment label from config; fixed after boot
+	instanceName string
 )
 
 type RuntimeState struct {
@@ -157,6 +388,32 @@ type RuntimeState struct {
 	HitOffset    int
 	HitExpect    string // "ON"|"OFF"
 	HitArmedTime time.Time
+	HitMore      string // pending extra checks after the current one, "3:OFF,5:ON"
+	HitSpan      int    // window length past t+x (0 = single block)
+	HitMatch     string // "first"|"all"
+	HitOutcome   string // "HIT"|"MISS" when a check resolved on the last evaluated block
+	MissStreak   int    // consecutive missed HIT checks
+
+	// trigger caps (see limits.go): window index and triggers fired in it
+	LimitDay     int64
+	DayTriggers  int
+	LimitHour    int64
+	HourTriggers int
+	// sequence trigger window, '1'/'0' per judged block (see sequence.go)
+	SeqHistory string
+	// window counting mode: last judged blocks, '1'/'0' (see counting.go)
+	CountHistory string
+	// alternation trigger: last judged state and length of the alternating run
+	AltLast string
+	AltRun  int
+	// confirmed triggers: rule held back, state that confirms it, where and streak
+	Pending       string
+	PendingState  string
+	PendingHeight int64
+	PendingStreak int
+
+	// cap reached on the last evaluated block ("day"|"hour"); consumed by the engine
+	LimitReached string
 
 	// ring buffer (height+hash)
 	Ring ringBuffer
@@ -168,13 +425,107 @@ type RuntimeState struct {
 
 	// listening
 	Listening bool
+
+	// Quiet suppresses engine logs (simulations such as backtests)
+	Quiet bool
+
+	// signals are computed but not sent until then (see snooze.go)
+	SnoozeUntil time.Time
+}
+
+// machineState is the comparable subset of RuntimeState that drives signal decisions.
+type machineState struct {
+	OnCounter      int
+	OffCounter     int
+	WaitingReverse bool
+	LastTriggered  string
+	BaseHeight     int64
+	HitWaiting     bool
+	HitBase        int64
+	HitOffset      int
+	HitExpect      string
+	HitMore        string
+	HitSpan        int
+	HitMatch       string
+	MissStreak     int
+	LimitDay       int64
+	DayTriggers    int
+	LimitHour      int64
+	HourTriggers   int
+	SeqHistory     string
+	CountHistory   string
+	AltLast        string
+	AltRun         int
+	Pending        string
+	PendingState   string
+	PendingHeight  int64
+	PendingStreak  int
+}
+
+func (s *RuntimeState) machineSnapshot() machineState {
+	return machineState{
+		OnCounter:      s.OnCounter,
+		OffCounter:     s.OffCounter,
+		WaitingReverse: s.WaitingReverse,
+		LastTriggered:  s.LastTriggered,
+		BaseHeight:     s.BaseHeight,
+		HitWaiting:     s.HitWaiting,
+		HitBase:        s.HitBase,
+		HitOffset:      s.HitOffset,
+		HitExpect:      s.HitExpect,
+		HitMore:        s.HitMore,
+		HitSpan:        s.HitSpan,
+		HitMatch:       s.HitMatch,
+		MissStreak:     s.MissStreak,
+		LimitDay:       s.LimitDay,
+		DayTriggers:    s.DayTriggers,
+		LimitHour:      s.LimitHour,
+		HourTriggers:   s.HourTriggers,
+		SeqHistory:     s.SeqHistory,
+		CountHistory:   s.CountHistory,
+		AltLast:        s.AltLast,
+		AltRun:         s.AltRun,
+		Pending:        s.Pending,
+		PendingState:   s.PendingState,
+		PendingHeight:  s.PendingHeight,
+		PendingStreak:  s.PendingStreak,
+	}
+}
+
+func (s *RuntimeState) restoreMachine(m machineState) {
+	s.OnCounter = m.OnCounter
+	s.OffCounter = m.OffCounter
+	s.WaitingReverse = m.WaitingReverse
+	s.LastTriggered = m.LastTriggered
+	s.BaseHeight = m.BaseHeight
+	s.HitWaiting = m.HitWaiting
+	s.HitBase = m.HitBase
+	s.HitOffset = m.HitOffset
+	s.HitExpect = m.HitExpect
+	s.HitMore = m.HitMore
+	s.HitSpan = m.HitSpan
+	s.HitMatch = m.HitMatch
+	s.MissStreak = m.MissStreak
+	s.LimitDay = m.LimitDay
+	s.DayTriggers = m.DayTriggers
+	s.LimitHour = m.LimitHour
+	s.HourTriggers = m.HourTriggers
+	s.SeqHistory = m.SeqHistory
+	s.CountHistory = m.CountHistory
+	s.AltLast = m.AltLast
+	s.AltRun = m.AltRun
+	s.Pending = m.Pending
+	s.PendingState = m.PendingState
+	s.PendingHeight = m.PendingHeight
+	s.PendingStreak = m.PendingStreak
 }
 
 type ringBuffer struct {
-	buf   [ringSize]string
-	idx   int
-	full  bool
-	index map[string]struct{}
+	buf    [ringSize]string
+	blocks [ringSize]BlockInfo
+	idx    int
+	full   bool
+	index  map[string]struct{}
 }
 
 func (r *ringBuffer) reset() {
@@ -183,6 +534,7 @@ func (r *ringBuffer) reset() {
 	r.index = make(map[string]struct{}, ringSize)
 	for i := 0; i < ringSize; i++ {
 		r.buf[i] = ""
+		r.blocks[i] = BlockInfo{}
 	}
 }
 
@@ -191,7 +543,7 @@ func (r *ringBuffer) has(key string) bool {
 	return ok
 }
 
-func (r *ringBuffer) add(key string) {
+func (r *ringBuffer) add(key string, b BlockInfo) {
 	if r.index == nil {
 		r.reset()
 	}
@@ -201,6 +553,7 @@ func (r *ringBuffer) add(key string) {
 		delete(r.index, old)
 	}
 	r.buf[r.idx] = key
+	r.blocks[r.idx] = b
 	r.index[key] = struct{}{}
 
 	r.idx++
@@ -210,6 +563,19 @@ func (r *ringBuffer) add(key string) {
 	}
 }
 
+// recent returns the buffered blocks, newest first.
+func (r *ringBuffer) recent() []BlockInfo {
+	n := r.idx
+	if r.full {
+		n = ringSize
+	}
+	out := make([]BlockInfo, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.blocks[(r.idx-i+ringSize)%ringSize])
+	}
+	return out
+}
+
 // ---------- Utilities ----------
 
 func ensureDirs() error {
@@ -219,6 +585,24 @@ func ensureDirs() error {
 	if err := os.MkdirAll(logDir, 0o755); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(slaDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(historyDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(signalDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outboxDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(accessLogDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(acmeDir, 0o700); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -265,7 +649,7 @@ func loadConfig() (Config, error) {
 	if err != nil {
 		if os.IsNotExist(err) {
 			// defaults
-			c.Access.Tokens = map[string]uint64{}
+			c.Access.Tokens = map[string]AccessToken{}
 			return c, nil
 		}
 		return c, err
@@ -274,23 +658,80 @@ func loadConfig() (Config, error) {
 		return c, err
 	}
 	if c.Access.Tokens == nil {
-		c.Access.Tokens = map[string]uint64{}
+		c.Access.Tokens = map[string]AccessToken{}
 	}
 	return c, nil
 }
 
+// saveConfigLocked persists c, retrying with backoff; caller holds cfgMu for
+// writing. The lock stays held through the backoff (at most ~300ms): callers
+// change, save and roll back as one step, and nobody may see or change the
+// unsaved state in between. Repeated failures (e.g. disk full) raise an
+// incident.
 func saveConfigLocked(c Config) error {
-	tmp := configPath + ".tmp"
 	b, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+	backoff := configSaveBackoff
+	for attempt := 1; attempt <= configSaveAttempts; attempt++ {
+		if err = writeConfigFile(b); err == nil {
+			if configSaveFailures > 0 {
+				logger.Printf("CONFIG_SAVE_RECOVERED after=%d", configSaveFailures)
+			}
+			configSaveFailures = 0
+			return nil
+		}
+		logger.Printf("CONFIG_SAVE_ERROR attempt=%d: %v", attempt, err)
+		if attempt < configSaveAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	configSaveFailures++
+	if configSaveFailures >= configSaveIncidentAfter {
+		raiseIncident("CONFIG_SAVE_FAILED", fmt.Sprintf("%d consecutive saves failed: %v", configSaveFailures, err))
+	}
+	return err
+}
+
+func writeConfigFile(b []byte) error {
+	tmp := configPath + ".tmp"
+	// API keys, notifier secrets and password hashes: owner only (a stale tmp
+	// file would keep its old mode, hence the chmod)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		_ = os.Remove(tmp)
 		return err
 	}
 	return os.Rename(tmp, configPath)
 }
 
+// writeSaveError reports a failed config persist; the in-memory change must be rolled back by the caller.
+func writeSaveError(w http.ResponseWriter, err error) {
+	http.Error(w, "save config failed: "+err.Error(), http.StatusInternalServerError)
+}
+
+// sanitizeInstance returns the label if it is safe to embed in logs, paths and payloads, else "".
+func sanitizeInstance(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > 64 {
+		return ""
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return ""
+		}
+	}
+	return s
+}
+
 func randHex(n int) (string, error) {
 	buf := make([]byte, n)
 	if _, err := rand.Read(buf); err != nil {
@@ -327,13 +768,7 @@ func readJSON(r *http.Request, dst any) error {
 // ---------- Auth ----------
 
 func isLoggedIn(r *http.Request) bool {
-	c, err := r.Cookie("TSID")
-	if err != nil || c.Value == "" {
-		return false
-	}
-	sessMu.Lock()
-	defer sessMu.Unlock()
-	_, ok := sessions[c.Value]
+	_, ok := sessionUser(r)
 	return ok
 }
 
@@ -345,14 +780,32 @@ func requireLogin(next http.HandlerFunc) http.HandlerFunc {
 		if !initialized {
 			// force setup
 			if r.URL.Path != "/setup" && r.URL.Path != "/api/setup" {
-				http.Redirect(w, r, "/setup", http.StatusFound)
+				http.Redirect(w, r, appPath("/setup"), http.StatusFound)
 				return
 			}
 			next(w, r)
 			return
 		}
-		if !isLoggedIn(r) {
-			http.Redirect(w, r, "/login", http.StatusFound)
+		u, ok := sessionUser(r)
+		if !ok {
+			// scripts may present an access token instead
+			switch code, msg := tokenAccess(r); code {
+			case 0:
+				http.Redirect(w, r, appPath("/login"), http.StatusFound)
+			case http.StatusOK:
+				next(w, r)
+			default:
+				http.Error(w, msg, code)
+			}
+			return
+		}
+		if need := requiredRole(r); roleRank(u.Role) < roleRank(need) {
+			http.Error(w, "needs the "+need+" role", http.StatusForbidden)
+			return
+		}
+		if !csrfOK(r, sessionCookie(r)) {
+			logger.Printf("CSRF_REJECTED method=%s path=%s user=%s ip=%s", r.Method, r.URL.Path, u.Username, remoteIP(r))
+			http.Error(w, "missing or invalid "+csrfHeader, http.StatusForbidden)
 			return
 		}
 		next(w, r)
@@ -364,7 +817,7 @@ func setupPage(w http.ResponseWriter, r *http.Request) {
 	initialized := cfg.Web.Initialized
 	cfgMu.RUnlock()
 	if initialized {
-		http.Redirect(w, r, "/login", http.StatusFound)
+		http.Redirect(w, r, appPath("/login"), http.StatusFound)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -373,7 +826,7 @@ func setupPage(w http.ResponseWriter, r *http.Request) {
 </head><body>
 <h2>首次设置账号密码</h2>
 <p>设置完成后才能进入系统。</p>
-<form method="post" action="/api/setup">
+<form method="post" action="api/setup">
 <label>用户名</label><input name="u" required>
 <label>密码</label><input name="p" type="password" required>
 <button type="submit">保存</button>
@@ -386,38 +839,36 @@ func setupSubmit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad form", http.StatusBadRequest)
 		return
 	}
-	u := strings.TrimSpace(r.FormValue("u"))
+	u, err := normalizeUsername(r.FormValue("u"))
 	p := r.FormValue("p")
-	if u == "" || p == "" {
+	if err != nil || p == "" {
 		http.Error(w, "username/password required", http.StatusBadRequest)
 		return
 	}
 
-	salt, err := randHex(16)
+	hash, err := newPasswordHash(p)
 	if err != nil {
 		http.Error(w, "rand failed", http.StatusInternalServerError)
 		return
 	}
-	hash := sha256Hex(salt + ":" + p)
 
 	cfgMu.Lock()
 	defer cfgMu.Unlock()
 	if cfg.Web.Initialized {
-		http.Redirect(w, r, "/login", http.StatusFound)
+		http.Redirect(w, r, appPath("/login"), http.StatusFound)
 		return
 	}
 	cfg.Web = WebCred{
 		Initialized: true,
-		Username:    u,
-		SaltHex:     salt,
-		HashHex:     hash,
+		Users:       []User{{Username: u, Role: roleAdmin, PasswordHash: hash}},
 	}
 	if err := saveConfigLocked(cfg); err != nil {
-		http.Error(w, "save config failed", http.StatusInternalServerError)
+		cfg.Web = WebCred{}
+		writeSaveError(w, err)
 		return
 	}
 	logger.Println("SYSTEM_SETUP_DONE")
-	http.Redirect(w, r, "/login", http.StatusFound)
+	http.Redirect(w, r, appPath("/login"), http.StatusFound)
 }
 
 func loginPage(w http.ResponseWriter, r *http.Request) {
@@ -425,7 +876,7 @@ func loginPage(w http.ResponseWriter, r *http.Request) {
 	initialized := cfg.Web.Initialized
 	cfgMu.RUnlock()
 	if !initialized {
-		http.Redirect(w, r, "/setup", http.StatusFound)
+		http.Redirect(w, r, appPath("/setup"), http.StatusFound)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -433,7 +884,7 @@ func loginPage(w http.ResponseWriter, r *http.Request) {
 <style>body{font-family:system-ui;padding:24px;max-width:480px;margin:auto}input{width:100%;padding:10px;margin:8px 0}button{padding:10px 14px}</style>
 </head><body>
 <h2>登录</h2>
-<form method="post" action="/api/login">
+<form method="post" action="api/login">
 <label>用户名</label><input name="u" required>
 <label>密码</label><input name="p" type="password" required>
 <button type="submit">登录</button>
@@ -454,52 +905,57 @@ func loginSubmit(w http.ResponseWriter, r *http.Request) {
 	cfgMu.RUnlock()
 
 	if !web.Initialized {
-		http.Redirect(w, r, "/setup", http.StatusFound)
+		http.Redirect(w, r, appPath("/setup"), http.StatusFound)
 		return
 	}
 
-	if u != web.Username {
+	ip, now := remoteIP(r), time.Now()
+	i := slices.IndexFunc(web.Users, func(x User) bool { return x.Username == u })
+	if i < 0 && utf8.RuneCountInString(u) > maxUsernameRunes {
+		u = string([]rune(u)[:maxUsernameRunes])
+	}
+	// unknown names lock like real ones, so a 423 does not give an account away
+	if left := accountLocked(u, ip, now); left > 0 {
+		writeLocked(w, left)
+		return
+	}
+	if i < 0 {
+		checkPassword(User{PasswordHash: dummyPasswordHash()}, p) // same time as a wrong password
+		loginFailed(u, ip, "unknown_user", web.Lockout, now)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	hash := sha256Hex(web.SaltHex + ":" + p)
-	if hash != web.HashHex {
+	ok, rehash := checkPassword(web.Users[i], p)
+	if !ok {
+		loginFailed(u, ip, "bad_password", web.Lockout, now)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	loginSucceeded(u, ip, now)
+	if rehash {
+		rehashPassword(web.Users[i], p)
+	}
 
-	sid, err := randHex(24)
+	sid, ttl, err := newSession(u)
 	if err != nil {
 		http.Error(w, "rand failed", http.StatusInternalServerError)
 		return
 	}
-	sessMu.Lock()
-	sessions[sid] = u
-	sessMu.Unlock()
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "TSID",
-		Value:    sid,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	http.SetCookie(w, newSessionCookie(r, sid, int(ttl.Seconds())))
 
 	// login gate satisfied -> attempt start listener if keys available
 	tryStartListener()
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, appPath("/"), http.StatusFound)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("TSID")
-	if err == nil && c.Value != "" {
-		sessMu.Lock()
-		delete(sessions, c.Value)
-		sessMu.Unlock()
+	if sid := sessionCookie(r); sid != "" {
+		endSession(sid)
 	}
-	http.SetCookie(w, &http.Cookie{Name: "TSID", Value: "", Path: "/", MaxAge: -1})
-	http.Redirect(w, r, "/login", http.StatusFound)
+	http.SetCookie(w, newSessionCookie(r, "", -1))
+	http.Redirect(w, r, appPath("/login"), http.StatusFound)
 }
 
 // ---------- Access control (optional; used for external HTTP only) ----------
@@ -535,9 +991,9 @@ func tokenOK(r *http.Request) (string, bool) {
 		return "", false
 	}
 	cfgMu.RLock()
-	_, ok := cfg.Access.Tokens[tok]
+	t, ok := cfg.Access.Tokens[tokenKey(tok)]
 	cfgMu.RUnlock()
-	return tok, ok
+	return tok, ok && !t.expired(time.Now())
 }
 
 func externalGuard(next http.HandlerFunc) http.HandlerFunc {
@@ -558,10 +1014,7 @@ func externalGuard(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		cfgMu.Lock()
-		cfg.Access.Tokens[tok]++
-		_ = saveConfigLocked(cfg)
-		cfgMu.Unlock()
+		noteTokenUse(tokenKey(tok), remoteIP(r), time.Now())
 
 		next(w, r)
 	}
@@ -580,17 +1033,57 @@ func staticHandler() http.Handler {
 
 // ---------- API endpoints ----------
 
-func apiStatus(w http.ResponseWriter, r *http.Request) {
-	rtMu.Lock()
-	defer rtMu.Unlock()
+// statusLocked builds the status payload; caller holds rtMu.
+func statusLocked() Status {
+	cfgMu.RLock()
+	limits := cfg.Rules.Limits
+	sched := cfg.Rules.Schedule
+	disabled := cfg.Rules.Disabled
+	cfgMu.RUnlock()
+	now := time.Now()
+	paused, until := rt.limitPaused(limits, now)
+	var snoozeLeft int
+	if rt.SnoozeUntil.After(now) {
+		snoozeLeft = int(math.Ceil(rt.SnoozeUntil.Sub(now).Seconds()))
+	}
 
-	st := Status{
+	return Status{
+		Instance:      instanceName,
 		Listening:     rt.Listening,
 		LastHeight:    rt.LastHeight,
 		LastHash:      rt.LastHash,
 		LastTimeISO:   isoOrEmpty(rt.LastTime),
 		Reconnects:    atomic.LoadUint64(&reconnects),
 		ConnectedKeys: currentKeyCount(),
+		SourcesDown:   health.down.Load(),
+		SourcePool:    health.activePool(),
+		Paused:        paused,
+		PausedUntil:   isoOrEmpty(until),
+		OffSchedule:   !sched.active(now),
+		Disabled:      disabled,
+		SnoozedUntil:  isoOrEmpty(snoozedUntil(rt.SnoozeUntil, now)),
+		SnoozeSeconds: snoozeLeft,
+		Seq:           lastSignalSeq(),
+		Duplicates:    duplicatesDropped.Load(),
+		Stats:         machineStats.snapshot(),
+		Machine:       rt.machineView(),
+		Blocks:        rt.Ring.recent(),
+	}
+}
+
+// apiStatus: GET /api/status; the block filters of listquery.go narrow "blocks".
+func apiStatus(w http.ResponseWriter, r *http.Request) {
+	bq, err := parseBlockQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rtMu.Lock()
+	defer rtMu.Unlock()
+
+	st := statusLocked()
+	if bq.set {
+		st.Blocks = bq.apply(st.Blocks)
 	}
 	mustJSON(w, 200, st)
 }
@@ -609,9 +1102,19 @@ func apiSetAPIKeys(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	keys := make([]string, 0, 3)
+	keys := normalizeAPIKeys(req.APIKeys)
+	if err := applyAPIKeys(keys, nil); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "apiKeys": keys})
+}
+
+// normalizeAPIKeys trims, dedupes and caps the list at maxAPIKeys.
+func normalizeAPIKeys(in []string) []string {
+	keys := make([]string, 0, maxAPIKeys)
 	seen := map[string]struct{}{}
-	for _, k := range req.APIKeys {
+	for _, k := range in {
 		k = strings.TrimSpace(k)
 		if k == "" {
 			continue
@@ -621,29 +1124,42 @@ func apiSetAPIKeys(w http.ResponseWriter, r *http.Request) {
 		}
 		seen[k] = struct{}{}
 		keys = append(keys, k)
-		if len(keys) >= 3 {
+		if len(keys) >= maxAPIKeys {
 			break
 		}
 	}
+	return keys
+}
 
+// applyAPIKeys persists the key list and hot-updates the listener.
+// groups (sourceID -> pool) replaces the pool assignment when non-nil; entries
+// for keys that are gone are dropped either way.
+func applyAPIKeys(keys []string, groups map[string]string) error {
 	cfgMu.Lock()
+	prevKeys, prevGroups := cfg.APIKeys, cfg.SourceGroups
+	if groups == nil {
+		groups = cfg.SourceGroups
+	}
 	cfg.APIKeys = keys
+	cfg.SourceGroups = pruneSourceGroups(keys, groups)
 	if err := saveConfigLocked(cfg); err != nil {
+		cfg.APIKeys, cfg.SourceGroups = prevKeys, prevGroups
 		cfgMu.Unlock()
-		http.Error(w, "save failed", http.StatusInternalServerError)
-		return
+		return err
 	}
 	cfgMu.Unlock()
 
-	logger.Printf("APIKEYS_UPDATED count=%d", len(keys))
+	apiKeysChanged(keys)
+	return nil
+}
 
-	// hot-update listener start/stop
+// apiKeysChanged follows a saved key change: hot-update listener start/stop.
+func apiKeysChanged(keys []string) {
+	logger.Printf("APIKEYS_UPDATED count=%d", len(keys))
 	tryStartListener()
 	if len(keys) == 0 {
 		stopListener()
 	}
-
-	mustJSON(w, 200, map[string]any{"ok": true, "apiKeys": keys})
 }
 
 func apiGetRules(w http.ResponseWriter, r *http.Request) {
@@ -658,37 +1174,96 @@ func apiSetRules(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	// sanitize
-	rr.On.Threshold = clamp(rr.On.Threshold, 0, 20)
-	rr.Off.Threshold = clamp(rr.Off.Threshold, 0, 20)
-	rr.Hit.Offset = clamp(rr.Hit.Offset, 1, 20)
-	rr.Hit.Expect = strings.ToUpper(strings.TrimSpace(rr.Hit.Expect))
-	if rr.Hit.Expect != "ON" && rr.Hit.Expect != "OFF" {
-		rr.Hit.Expect = "ON"
+	if v := r.URL.Query().Get("strict"); v == "1" || strings.EqualFold(v, "true") {
+		if errs := strictRuleErrors(rr); len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+	}
+	if err := normalizeRules(&rr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rr, err := storeRules(r, "rules", rr)
+	if err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "rules": rr})
+}
+
+// normalizeRules clamps the sliders and validates schedule, payload and sequence.
+func normalizeRules(rr *Rules) error {
+	sanitizeRules(rr)
+	if err := rr.Schedule.normalize(); err != nil {
+		return err
+	}
+	if err := validatePayload(rr.Payload); err != nil {
+		return err
+	}
+	if err := validateSeverities(rr.Severity); err != nil {
+		return err
 	}
+	return rr.Sequence.normalize()
+}
 
+// storeRules makes rr the live rules, persists them and records the change under
+// action. Judge, shadow and the enabled switch have their own endpoints and are kept
+// as they are. Returns what was stored.
+func storeRules(r *http.Request, action string, rr Rules) (Rules, error) {
 	cfgMu.Lock()
+	prev := cfg.Rules
+	rr.Judge = prev.Judge
+	rr.Shadow = prev.Shadow
+	rr.Disabled = prev.Disabled
 	cfg.Rules = rr
 	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Rules = prev
 		cfgMu.Unlock()
-		http.Error(w, "save failed", http.StatusInternalServerError)
-		return
+		return prev, err
 	}
 	cfgMu.Unlock()
+	auditRules(r, action, prev, rr)
 
-	logger.Printf("RULES_UPDATED on=(%v,%d) off=(%v,%d) hit=(%v,expect=%s,offset=%d)",
-		rr.On.Enabled, rr.On.Threshold, rr.Off.Enabled, rr.Off.Threshold, rr.Hit.Enabled, rr.Hit.Expect, rr.Hit.Offset)
+	logger.Printf("RULES_UPDATED on=(%v,%d) off=(%v,%d) hit=(%v,expect=%s,offset=%d) limits=(day=%d,hour=%d)",
+		rr.On.Enabled, rr.On.Threshold, rr.Off.Enabled, rr.Off.Threshold, rr.Hit.Enabled, rr.Hit.Expect, rr.Hit.Offset,
+		rr.Limits.PerDay, rr.Limits.PerHour)
+	return rr, nil
+}
 
-	mustJSON(w, 200, map[string]any{"ok": true, "rules": rr})
+// sanitizeRules clamps the slider values into their allowed ranges.
+func sanitizeRules(rr *Rules) {
+	rr.On.sanitize()
+	rr.Off.sanitize()
+	rr.Hit.Offset = clamp(rr.Hit.Offset, 1, 20)
+	rr.Hit.Expect = strings.ToUpper(strings.TrimSpace(rr.Hit.Expect))
+	if rr.Hit.Expect != "ON" && rr.Hit.Expect != "OFF" {
+		rr.Hit.Expect = "ON"
+	}
+	rr.Hit.Window = clamp(rr.Hit.Window, 0, 20)
+	rr.Hit.Match = strings.ToLower(strings.TrimSpace(rr.Hit.Match))
+	if rr.Hit.Match != hitMatchAll {
+		rr.Hit.Match = hitMatchFirst
+	}
+	rr.Hit.MissAlarm = clamp(rr.Hit.MissAlarm, 0, 100)
+	rr.Hit.Extra = sanitizeHitChecks(rr.Hit.Extra, rr.Hit.Offset, rr.Hit.Window)
+	rr.Limits.PerDay = clamp(rr.Limits.PerDay, 0, 10000)
+	rr.Limits.PerHour = clamp(rr.Limits.PerHour, 0, 10000)
+	rr.TTL = clamp(rr.TTL, 0, maxTTLBlocks)
+	rr.Counting.sanitize()
+	rr.Alternation.sanitize()
 }
 
 // ---------- SSE status ----------
 
+// Status is pushed when something calls broadcastStatus (new block, rules or
+// machine changes, source health) and only if it differs from the last push; it
+// is marshalled once for all subscribers. Idle streams get a comment line every
+// sseKeepAlive so proxies don't close them.
+
+const sseKeepAlive = 25 * time.Second
+
 func sseStatus(w http.ResponseWriter, r *http.Request) {
-	if !isLoggedIn(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -699,7 +1274,7 @@ func sseStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ch := make(chan Status, 8)
+	ch := make(chan []byte, 8)
 	sseMu.Lock()
 	sseSubs[ch] = struct{}{}
 	sseMu.Unlock()
@@ -713,53 +1288,62 @@ func sseStatus(w http.ResponseWriter, r *http.Request) {
 
 	// initial push
 	rtMu.Lock()
-	st := Status{
-		Listening:     rt.Listening,
-		LastHeight:    rt.LastHeight,
-		LastHash:      rt.LastHash,
-		LastTimeISO:   isoOrEmpty(rt.LastTime),
-		Reconnects:    atomic.LoadUint64(&reconnects),
-		ConnectedKeys: currentKeyCount(),
-	}
+	st := statusLocked()
 	rtMu.Unlock()
-	writeSSE(w, st)
+	b, _ := json.Marshal(st)
+	writeSSE(w, "status", b)
 	flusher.Flush()
 
+	// ?delta=1: see ssedelta.go
+	var delta *sseDeltaState
+	if r.URL.Query().Get("delta") == "1" {
+		delta = &sseDeltaState{}
+		delta.reset(b, time.Now())
+	}
+
+	keepalive := time.NewTicker(sseKeepAlive)
+	defer keepalive.Stop()
 	notify := r.Context().Done()
 	for {
 		select {
 		case <-notify:
 			return
-		case s := <-ch:
-			writeSSE(w, s)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		case b := <-ch:
+			event := "status"
+			if delta != nil {
+				if event, b = delta.next(b, time.Now()); event == "" {
+					continue
+				}
+			}
+			writeSSE(w, event, b)
 			flusher.Flush()
 		}
 	}
 }
 
-func writeSSE(w io.Writer, st Status) {
-	b, _ := json.Marshal(st)
-	fmt.Fprintf(w, "event: status\n")
-	fmt.Fprintf(w, "data: %s\n\n", string(b))
+func writeSSE(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	fmt.Fprintf(w, "data: %s\n\n", string(data))
 }
 
 func broadcastStatus() {
 	rtMu.Lock()
-	st := Status{
-		Listening:     rt.Listening,
-		LastHeight:    rt.LastHeight,
-		LastHash:      rt.LastHash,
-		LastTimeISO:   isoOrEmpty(rt.LastTime),
-		Reconnects:    atomic.LoadUint64(&reconnects),
-		ConnectedKeys: currentKeyCount(),
-	}
+	st := statusLocked()
 	rtMu.Unlock()
+	b, _ := json.Marshal(st)
 
 	sseMu.Lock()
 	defer sseMu.Unlock()
+	if bytes.Equal(b, lastStatusJSON) {
+		return
+	}
+	lastStatusJSON = b
 	for ch := range sseSubs {
 		select {
-		case ch <- st:
+		case ch <- b:
 		default:
 			// drop if slow
 		}
@@ -772,6 +1356,9 @@ var (
 	listenerOnce  sync.Once
 	listenerStopC = make(chan struct{})
 	reconnects    uint64
+
+	// closed once the startup warm-up finished (or was skipped)
+	warmupDone = make(chan struct{})
 )
 
 func currentKeyCount() int {
@@ -789,10 +1376,7 @@ func tryStartListener() {
 		return
 	}
 	// login gate: if any active session exists
-	sessMu.Lock()
-	hasSession := len(sessions) > 0
-	sessMu.Unlock()
-	if !hasSession {
+	if !hasLiveSession() {
 		return
 	}
 
@@ -823,9 +1407,13 @@ type tronNowBlockResp struct {
 			Timestamp int64 `json:"timestamp"`
 		} `json:"raw_data"`
 	} `json:"block_header"`
+	// only counted; kept raw so the body isn't decoded into structs
+	Transactions []json.RawMessage `json:"transactions"`
 }
 
 func listenerLoop() {
+	// don't race the startup warm-up for the ring buffer
+	<-warmupDone
 	logger.Println("LISTENER_LOOP_START")
 
 	ticker := time.NewTicker(pollInterval)
@@ -842,13 +1430,12 @@ func listenerLoop() {
 			cfgMu.RLock()
 			keys := append([]string(nil), cfg.APIKeys...)
 			rules := cfg.Rules
+			groups := cfg.SourceGroups
+			policy := cfg.SourcePolicy
 			cfgMu.RUnlock()
 
 			// if keys empty or no active session => not allowed to listen (gate)
-			sessMu.Lock()
-			hasSession := len(sessions) > 0
-			sessMu.Unlock()
-			if len(keys) == 0 || !hasSession {
+			if len(keys) == 0 || !hasLiveSession() {
 				rtMu.Lock()
 				rt.Listening = false
 				rtMu.Unlock()
@@ -858,12 +1445,29 @@ func listenerLoop() {
 			rt.Listening = true
 			rtMu.Unlock()
 
-			// pick a key (round-robin by time)
-			key := keys[int(time.Now().UnixNano()%int64(len(keys)))]
-			height, hash, tISO, err := fetchNowBlock(client, defaultNodeURL, key)
+			var (
+				height  int64
+				hash    string
+				tISO    string
+				txCount int
+				err     error
+			)
+			if health.allDown(keys) {
+				// outage: low-frequency probing of every source; first success resumes polling
+				if time.Since(health.lastProbe) < sourceProbeInterval {
+					continue
+				}
+				health.lastProbe = time.Now()
+				for _, k := range keys {
+					if height, hash, tISO, txCount, err = pollSource(client, keys, k); err == nil {
+						break
+					}
+				}
+			} else {
+				key := health.pick(keys, groups, policy)
+				height, hash, tISO, txCount, err = pollSource(client, keys, key)
+			}
 			if err != nil {
-				atomic.AddUint64(&reconnects, 1)
-				logger.Printf("BLOCK_FETCH_ERROR: %v", err)
 				continue
 			}
 
@@ -875,12 +1479,22 @@ func listenerLoop() {
 			rtMu.Unlock()
 			broadcastStatus()
 
-			processBlock(height, hash, parseISOOrNow(tISO), rules)
+			processBlock(Block{Height: height, Hash: hash, Time: parseISOOrNow(tISO), TxCount: txCount}, rules)
 		}
 	}
 }
 
-func fetchNowBlock(client *http.Client, nodeURL, apiKey string) (height int64, hash string, timeISO string, err error) {
+// httpStatusError is a non-200 answer from the node.
+type httpStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("http %d: %s", e.Code, e.Body)
+}
+
+func fetchNowBlock(client *http.Client, nodeURL, apiKey string) (height int64, hash string, timeISO string, txCount int, err error) {
 	url := strings.TrimRight(nodeURL, "/") + "/wallet/getnowblock"
 	req, _ := http.NewRequest("POST", url, bytes.NewReader([]byte("{}")))
 	req.Header.Set("Content-Type", "application/json")
@@ -891,20 +1505,21 @@ func fetchNowBlock(client *http.Client, nodeURL, apiKey string) (height int64, h
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, "", "", err
+		return 0, "", "", 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
-		return 0, "", "", fmt.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		return 0, "", "", 0, &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
 	}
 
 	var out tronNowBlockResp
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return 0, "", "", err
+		return 0, "", "", 0, err
 	}
 	height = out.BlockHeader.RawData.Number
 	hash = out.BlockID
+	txCount = len(out.Transactions)
 	ts := out.BlockHeader.RawData.Timestamp
 	// Tron returns ms timestamp
 	if ts > 0 {
@@ -915,209 +1530,458 @@ func fetchNowBlock(client *http.Client, nodeURL, apiKey string) (height int64, h
 	return
 }
 
-// ---------- ON/OFF 判定（你已确认的映射表） ----------
+// ---------- Startup warm-up ----------
 
-func blockStateByHash(hash string) (string, bool) {
-	hash = strings.ToLower(strings.TrimSpace(hash))
-	if len(hash) < 2 {
-		return "", false
-	}
-	a := hash[len(hash)-2]
-	b := hash[len(hash)-1]
+type tronBlockListResp struct {
+	Block []tronNowBlockResp `json:"block"`
+}
 
-	t1, ok1 := hexCharType(a)
-	t2, ok2 := hexCharType(b)
-	if !ok1 || !ok2 {
-		return "", false
+func fetchLatestBlocks(client *http.Client, nodeURL, apiKey string, num int) ([]tronNowBlockResp, error) {
+	url := strings.TrimRight(nodeURL, "/") + "/wallet/getblockbylatestnum"
+	body := fmt.Sprintf(`{"num":%d}`, num)
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("TRON-PRO-API-KEY", apiKey)
 	}
 
-	// 字母+数字 或 数字+字母 => ON；同类 => OFF
-	if t1 != t2 {
-		return "ON", true
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return nil, &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
 	}
-	return "OFF", true
-}
 
-func hexCharType(c byte) (string, bool) {
-	switch {
-	case c >= '0' && c <= '9':
-		return "digit", true
-	case c >= 'a' && c <= 'f':
-		return "alpha", true
-	default:
-		return "", false
+	var out tronBlockListResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
 	}
+	// node returns them unordered; oldest first for the ring and the machine
+	sort.Slice(out.Block, func(i, j int) bool {
+		return out.Block[i].BlockHeader.RawData.Number < out.Block[j].BlockHeader.RawData.Number
+	})
+	return out.Block, nil
 }
 
-// ---------- Core processing pipeline ----------
+// warmup fills the ring buffer with the most recent blocks so status and the block
+// list aren't empty right after boot. Signals are never emitted for these blocks;
+// with PrimeMachine the state machine is fed too, so counters start from real context.
+func warmup() {
+	defer close(warmupDone)
 
-func processBlock(height int64, hash string, t time.Time, rules Rules) {
-	// Step 2: dedupe (height+hash)
-	key := fmt.Sprintf("%d:%s", height, hash)
+	cfgMu.RLock()
+	wc := cfg.Warmup
+	keys := append([]string(nil), cfg.APIKeys...)
+	rules := cfg.Rules
+	cfgMu.RUnlock()
 
-	rtMu.Lock()
-	if rt.Ring.index == nil {
-		rt.Ring.reset()
+	if wc.Disabled {
+		return
+	}
+	num := wc.Blocks
+	if num <= 0 || num > ringSize {
+		num = ringSize
+	}
+	key := ""
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+
+	client := &http.Client{Timeout: 8 * time.Second}
+	blocks, err := fetchLatestBlocks(client, defaultNodeURL, key, num)
+	if err != nil {
+		logger.Printf("WARMUP_ERROR: %v", err)
+		return
+	}
+
+	rtMu.Lock()
+	if rt.Ring.index == nil {
+		rt.Ring.reset()
+	}
+	for _, b := range blocks {
+		height := b.BlockHeader.RawData.Number
+		t := time.UnixMilli(b.BlockHeader.RawData.Timestamp).UTC()
+		rk := fmt.Sprintf("%d:%s", height, b.BlockID)
+		if rt.Ring.has(rk) {
+			continue
+		}
+		blk := Block{Height: height, Hash: b.BlockID, Time: t, TxCount: len(b.Transactions)}
+		state, ok := judgeBlock(rules.Judge, blk)
+		info := blockInfoOf(blk, state)
+		rt.Ring.add(rk, info)
+		history.append(info)
+		if wc.PrimeMachine && ok {
+			// signals from history are discarded on purpose
+			_ = rt.evaluate(height, state, t, rules)
+		}
+		rt.LastHeight = height
+		rt.LastHash = b.BlockID
+		rt.LastTime = t
+	}
+	primed := rt.machineSnapshot()
+	rtMu.Unlock()
+
+	if wc.PrimeMachine {
+		// anchor for replay: primed blocks themselves are not part of the black box
+		bb.recordState(primed)
+	}
+	logger.Printf("WARMUP_DONE blocks=%d prime=%v", len(blocks), wc.PrimeMachine)
+	broadcastStatus()
+}
+
+// ---------- ON/OFF 判定（你已确认的映射表） ----------
+
+func blockStateByHash(hash string) (string, bool) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if len(hash) < 2 {
+		return "", false
+	}
+	a := hash[len(hash)-2]
+	b := hash[len(hash)-1]
+
+	t1, ok1 := hexCharType(a)
+	t2, ok2 := hexCharType(b)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+
+	// 字母+数字 或 数字+字母 => ON；同类 => OFF
+	if t1 != t2 {
+		return "ON", true
+	}
+	return "OFF", true
+}
+
+func hexCharType(c byte) (string, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return "digit", true
+	case c >= 'a' && c <= 'f':
+		return "alpha", true
+	default:
+		return "", false
+	}
+}
+
+// ---------- Core processing pipeline ----------
+
+func processBlock(blk Block, rules Rules) {
+	height, hash, t := blk.Height, blk.Hash, blk.Time
+
+	// Step 2: dedupe (height+hash)
+	key := fmt.Sprintf("%d:%s", height, hash)
+
+	// Step 3: judge ON/OFF (pure; done up front so the ring can keep the result)
+	state, ok := judgeBlock(rules.Judge, blk)
+
+	rtMu.Lock()
+	if rt.Ring.index == nil {
+		rt.Ring.reset()
 	}
 	if rt.Ring.has(key) {
 		rtMu.Unlock()
 		return
 	}
-	rt.Ring.add(key)
+	info := blockInfoOf(blk, state)
+	if rules.Shadow != nil {
+		info.Shadow = judgeShadow(*rules.Shadow, blk, state)
+	}
+	rt.Ring.add(key, info)
 	rtMu.Unlock()
 
-	// Step 3: judge ON/OFF
-	state, ok := blockStateByHash(hash)
+	history.append(info)
+	enqueueKafkaBlock(info)
+
+	bb.recordRules(rules)
+	bb.recordBlock(blk)
+	bb.recordJudge(height, state)
+	if ok {
+		judgeStats.observe(state)
+	}
 	if !ok {
-		logger.Printf("DROP_BLOCK_INVALID_HASH height=%d hash=%q", height, hash)
+		logger.Printf("DROP_BLOCK_UNJUDGED height=%d hash=%q judge=%s", height, hash, rules.Judge.Type)
 		return
 	}
 
 	// Step 4 + 5: state machine + optional hit
 	signals := evaluateStateMachine(height, state, t, rules)
+	extra := encodePayload(rules.Payload)
+	snoozed := snoozeActive(time.Now())
 	for _, s := range signals {
-		broadcastSignal(s)
+		bb.recordSignal(s)
+		if snoozed {
+			logger.Printf("SIGNAL_SNOOZED type=%s height=%d", s.Type, s.Height)
+			continue
+		}
+		// stamped after recording: the black box only holds engine decisions
+		s.Instance = instanceName
+		s.Extra = extra
+		s.Simulated = rules.Simulate
+		stampExpiry(&s, rules.TTL)
+		s.Severity = rules.severityOf(s.Type)
+		if s.Simulated {
+			signalLog.append(s)
+			broadcastSimSignal(s)
+			continue
+		}
+		var sent bool
+		if s, sent = sendSignal(s); !sent {
+			continue
+		}
+		if s.Type == "MISS_STREAK" {
+			raiseIncident("MISS_STREAK", fmt.Sprintf("%d consecutive HIT misses, last at height %d", s.Streak, s.Height))
+		}
+		enqueueWebhook(s)
+		enqueueMQTT(s)
+		enqueueNATSSignal(s)
+		enqueueKafkaSignal(s)
+		notifySignal(s)
 	}
 }
 
 func evaluateStateMachine(height int64, state string, t time.Time, rules Rules) []Signal {
 	rtMu.Lock()
-	defer rtMu.Unlock()
+	before := rt.machineSnapshot()
+	out := rt.evaluate(height, state, t, rules)
+	if after := rt.machineSnapshot(); after != before {
+		bb.recordState(after)
+	}
+	machineStats.observe(state, t, out, rt.HitOutcome)
+	limit := rt.LimitReached
+	rt.LimitReached = ""
+	var until time.Time
+	if limit != "" {
+		_, until = rt.limitPaused(rules.Limits, t)
+	}
+	rtMu.Unlock()
 
+	if limit != "" {
+		broadcastEvent(Event{
+			Type:   "LIMIT_REACHED",
+			Detail: fmt.Sprintf("window=%s height=%d until=%s", limit, height, until.In(beijing).Format(time.RFC3339)),
+		})
+		broadcastStatus()
+	}
+	return out
+}
+
+func (s *RuntimeState) evaluate(height int64, state string, t time.Time, rules Rules) []Signal {
 	// 初始状态：waitingReverse=true
 	// 为了让“解除等待”有明确反向：若从未触发过，则默认 LastTriggered="ON"（要求先看到 OFF 才开始计数）
-	if rt.LastTriggered == "" {
-		rt.LastTriggered = "ON"
-		rt.WaitingReverse = true
+	if s.LastTriggered == "" {
+		s.LastTriggered = "ON"
+		s.WaitingReverse = true
+	}
+	if rules.Disabled {
+		return nil
 	}
 
-	// Step 5: if hit waiting and reach t+x -> check once
+	// Step 5: if hit waiting and inside t+x(..t+x+window) -> check
 	var out []Signal
-	if rt.HitWaiting && height == rt.HitBase+int64(rt.HitOffset) {
-		if state == rt.HitExpect {
+	s.HitOutcome = s.checkHit(height, state)
+	if s.HitOutcome != "" {
+		if s.HitOutcome == "HIT" {
 			out = append(out, Signal{
 				Type:       "HIT",
 				Height:     height,
-				BaseHeight: rt.HitBase,
+				BaseHeight: s.HitBase,
 				State:      state,
 				TimeISO:    t.UTC().Format(time.RFC3339Nano),
+				Offset:     s.HitOffset,
 			})
-			logger.Printf("HIT_SIGNAL height=%d base=%d state=%s", height, rt.HitBase, state)
+			s.logf("HIT_SIGNAL height=%d base=%d offset=%d state=%s", height, s.HitBase, s.HitOffset, state)
+			s.MissStreak = 0
 		} else {
-			logger.Printf("HIT_MISS height=%d base=%d got=%s expect=%s", height, rt.HitBase, state, rt.HitExpect)
+			s.logf("HIT_MISS height=%d base=%d offset=%d got=%s expect=%s", height, s.HitBase, s.HitOffset, state, s.HitExpect)
+			s.MissStreak++
+			out = append(out, Signal{
+				Type:       "MISS",
+				Height:     height,
+				BaseHeight: s.HitBase,
+				State:      state,
+				TimeISO:    t.UTC().Format(time.RFC3339Nano),
+				Offset:     s.HitOffset,
+				Streak:     s.MissStreak,
+				Expect:     s.HitExpect,
+			})
+			if n := rules.Hit.MissAlarm; n > 0 && s.MissStreak == n {
+				out = append(out, Signal{
+					Type:       "MISS_STREAK",
+					Height:     height,
+					BaseHeight: s.HitBase,
+					State:      state,
+					TimeISO:    t.UTC().Format(time.RFC3339Nano),
+					Offset:     s.HitOffset,
+					Streak:     s.MissStreak,
+				})
+				s.logf("MISS_STREAK height=%d streak=%d", height, s.MissStreak)
+			}
+		}
+		// this check is done regardless; move on to the next one, if any
+		s.nextHit()
+	}
+
+	// NEUTRAL: no opinion on this block, counters and the reverse gate stay as they are
+	if state == stateNeutral {
+		return out
+	}
+
+	// outside active hours, or trigger cap reached: no counting, no triggers
+	if !rules.Schedule.active(t) {
+		return out
+	}
+	if reason, _ := s.limitPaused(rules.Limits, t); reason != "" {
+		return out
+	}
+
+	// sequence trigger: independent of the reverse gate
+	if s.pushSeq(state, rules.Sequence) {
+		out = append(out, Signal{
+			Type:       "SEQ",
+			Height:     height,
+			BaseHeight: height,
+			State:      state,
+			TimeISO:    t.UTC().Format(time.RFC3339Nano),
+		})
+		s.logf("SEQ_SIGNAL height=%d pattern=%s", height, rules.Sequence.Pattern)
+		s.bookTrigger(height, t, rules)
+		s.armHit(height, rules)
+		if s.LimitReached != "" {
+			return out
+		}
+	}
+
+	// alternation trigger: likewise independent of the reverse gate
+	if s.pushAlt(state, rules.Alternation) {
+		out = append(out, Signal{
+			Type:       "ALT",
+			Height:     height,
+			BaseHeight: height,
+			State:      state,
+			TimeISO:    t.UTC().Format(time.RFC3339Nano),
+		})
+		s.logf("ALT_SIGNAL height=%d length=%d", height, rules.Alternation.Length)
+		s.bookTrigger(height, t, rules)
+		s.armHit(height, rules)
+		if s.LimitReached != "" {
+			return out
 		}
-		// end hit regardless
-		rt.HitWaiting = false
 	}
 
 	// waitingReverse gate
-	if rt.WaitingReverse {
-		reverse := reverseOf(rt.LastTriggered)
+	if s.WaitingReverse {
+		reverse := reverseOf(s.LastTriggered)
 		if state == reverse {
-			rt.WaitingReverse = false
+			s.WaitingReverse = false
 			// reset counters when unlock (clean start)
-			rt.OnCounter = 0
-			rt.OffCounter = 0
+			s.clearCounters()
 		} else {
 			// still waiting, stop here
 			return out
 		}
 	}
 
+	// a trigger held back on the previous block: confirm or cancel it
+	if s.Pending != "" {
+		sig, done := s.resolvePending(height, state, t, rules)
+		out = append(out, sig)
+		if done {
+			return out
+		}
+	}
+
 	// count stage
+	prevOn, prevOff := s.OnCounter, s.OffCounter
+	s.count(state, rules)
+	kind, streak := "", 0
 	switch state {
 	case "ON":
-		// reset opposite
-		rt.OffCounter = 0
-		if rules.On.Enabled {
-			if state == "ON" {
-				rt.OnCounter++
-			} else {
-				rt.OnCounter = 0
-			}
-		} else {
-			rt.OnCounter = 0
-		}
-
-		if rules.On.Enabled && rules.On.Threshold > 0 && rt.OnCounter >= rules.On.Threshold {
-			// trigger ON
-			rt.OnCounter = 0
-			rt.OffCounter = 0
-			rt.WaitingReverse = true
-			rt.LastTriggered = "ON"
-			rt.BaseHeight = height
-
-			s := Signal{
-				Type:       "ON",
-				Height:     height,
-				BaseHeight: height,
-				State:      "ON",
-				TimeISO:    t.UTC().Format(time.RFC3339Nano),
-			}
-			out = append(out, s)
-			logger.Printf("ON_SIGNAL height=%d", height)
-
-			// arm hit
-			armHitLocked(height, rules)
+		if rules.On.reached(s.OnCounter) {
+			kind = "ON"
+		} else if rules.Off.broke(prevOff) {
+			// an OFF streak just ended (range / below modes)
+			kind, streak = "OFF", prevOff
 		}
 
 	case "OFF":
-		rt.OnCounter = 0
-		if rules.Off.Enabled {
-			if state == "OFF" {
-				rt.OffCounter++
-			} else {
-				rt.OffCounter = 0
-			}
+		if rules.Off.reached(s.OffCounter) {
+			kind = "OFF"
+		} else if rules.On.broke(prevOn) {
+			kind, streak = "ON", prevOn
+		}
+	}
+	if kind != "" {
+		if rules.Confirm {
+			out = append(out, s.setPending(kind, state, height, t, streak))
 		} else {
-			rt.OffCounter = 0
+			out = append(out, s.fire(kind, height, t, rules, streak))
 		}
+	}
 
-		if rules.Off.Enabled && rules.Off.Threshold > 0 && rt.OffCounter >= rules.Off.Threshold {
-			// trigger OFF
-			rt.OnCounter = 0
-			rt.OffCounter = 0
-			rt.WaitingReverse = true
-			rt.LastTriggered = "OFF"
-			rt.BaseHeight = height
+	return out
+}
 
-			s := Signal{
-				Type:       "OFF",
-				Height:     height,
-				BaseHeight: height,
-				State:      "OFF",
-				TimeISO:    t.UTC().Format(time.RFC3339Nano),
-			}
-			out = append(out, s)
-			logger.Printf("OFF_SIGNAL height=%d", height)
+// fire triggers the ON or OFF rule: counting restarts behind the reverse gate and
+// the HIT check is armed. streak is the ended streak's length for range/below modes.
+func (s *RuntimeState) fire(kind string, height int64, t time.Time, rules Rules, streak int) Signal {
+	s.clearCounters()
+	s.WaitingReverse = true
+	s.LastTriggered = kind
+	s.BaseHeight = height
 
-			armHitLocked(height, rules)
-		}
+	if streak > 0 {
+		s.logf("%s_SIGNAL height=%d streak=%d", kind, height, streak)
+	} else {
+		s.logf("%s_SIGNAL height=%d", kind, height)
 	}
+	s.bookTrigger(height, t, rules)
+	s.armHit(height, rules)
 
-	return out
+	return Signal{
+		Type:       kind,
+		Height:     height,
+		BaseHeight: height,
+		State:      kind,
+		TimeISO:    t.UTC().Format(time.RFC3339Nano),
+		Streak:     streak,
+	}
 }
 
-func armHitLocked(triggerHeight int64, rules Rules) {
+func (s *RuntimeState) armHit(triggerHeight int64, rules Rules) {
 	// only when just triggered and hit enabled
 	if !rules.Hit.Enabled {
 		return
 	}
-	expect := strings.ToUpper(strings.TrimSpace(rules.Hit.Expect))
-	if expect != "ON" && expect != "OFF" {
-		expect = "ON"
-	}
-	offset := rules.Hit.Offset
-	if offset < 1 {
-		offset = 1
+	checks := hitChecks(rules.Hit)
+
+	s.HitWaiting = true
+	s.HitBase = triggerHeight
+	s.HitOffset = checks[0].Offset
+	s.HitExpect = checks[0].Expect
+	s.HitMore = encodeHitChecks(checks[1:])
+	s.HitSpan = rules.Hit.Window
+	s.HitMatch = rules.Hit.Match
+	s.HitArmedTime = time.Now()
+	s.logf("HIT_ARMED base=%d checks=%s", triggerHeight, encodeHitChecks(checks))
+}
+
+// bookTrigger counts a fired trigger against the caps and flags the one it reaches.
+func (s *RuntimeState) bookTrigger(height int64, t time.Time, rules Rules) {
+	if reason := s.countTrigger(rules.Limits, t); reason != "" {
+		s.LimitReached = reason
+		s.logf("LIMIT_REACHED window=%s height=%d", reason, height)
 	}
+}
 
-	rt.HitWaiting = true
-	rt.HitBase = triggerHeight
-	rt.HitOffset = offset
-	rt.HitExpect = expect
-	rt.HitArmedTime = time.Now()
-	logger.Printf("HIT_ARMED base=%d offset=%d expect=%s", triggerHeight, offset, expect)
+// logf writes an engine log line unless the machine is a quiet simulation.
+func (s *RuntimeState) logf(format string, args ...any) {
+	if s.Quiet {
+		return
+	}
+	logger.Printf(format, args...)
 }
 
 func reverseOf(s string) string {
@@ -1152,19 +2016,47 @@ type wsConn struct {
 	c   net.Conn
 	mu  sync.Mutex
 	dead atomic.Bool
+	remote string
+
+	// who connected (see wsclients.go)
+	id              uint64
+	ip, user, token string
+	lastPong        atomic.Int64 // unix nanos
+
+	// signal types this client subscribed to; empty = all (guarded by wsMu)
+	types map[string]bool
+	// lowest signal severity it gets; "" = all (guarded by wsMu, see severity.go)
+	minSeverity string
+
+	// outbound queue drained by writeLoop; done is closed with the connection
+	send      chan wsOut
+	done      chan struct{}
+	connected time.Time
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+
+	// negotiated the protobuf subprotocol (wsproto.go)
+	binary bool
+
+	// opted into acknowledgements (/ws?ack=1); the rest is guarded by ackMu
+	ack                         bool
+	ackMu                       sync.Mutex
+	unacked                     map[uint64]*pendingAck
+	acked, retransmits, expired uint64
 }
 
 func (w *wsConn) Close() {
 	if w.dead.CompareAndSwap(false, true) {
+		close(w.done)
 		_ = w.c.Close()
 	}
 }
 
+// wsHandler is mounted behind requireLogin, which checks the session or token.
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	// Note: WS broadcast is not protected by token/ip in this minimal version.
-	// If you need, add guards here.
-	if !isLoggedIn(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	if reason := wsBanned(r); reason != "" {
+		logger.Printf("WS_REJECTED remote=%s banned=%s", r.RemoteAddr, reason)
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
@@ -1185,11 +2077,16 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	accept := wsAcceptKey(key)
+	c := newWSConn(conn, r)
 
 	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
 		"Connection: Upgrade\r\n" +
-		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		"Sec-WebSocket-Accept: " + accept + "\r\n"
+	if c.binary {
+		resp += "Sec-WebSocket-Protocol: " + wsProtoBinary + "\r\n"
+	}
+	resp += "\r\n"
 
 	if _, err := buf.WriteString(resp); err != nil {
 		_ = conn.Close()
@@ -1200,14 +2097,21 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := &wsConn{c: conn}
+	replay := replayCount(r)
 	wsMu.Lock()
+	replaySignalsLocked(c, replay)
 	wsClients[c] = struct{}{}
 	wsMu.Unlock()
+	go c.writeLoop()
+	if c.ack {
+		go c.ackLoop()
+	}
 
-	logger.Printf("WS_CLIENT_CONNECTED remote=%s", r.RemoteAddr)
+	logger.Printf("WS_CLIENT_CONNECTED remote=%s replay=%d ack=%v binary=%v", r.RemoteAddr, replay, c.ack, c.binary)
 
-	// read loop to keep connection healthy (discard frames)
+	// read loop keeps the connection alive and takes subscribe messages
+	c.extendRead()
+	go c.pingLoop()
 	go func() {
 		defer func() {
 			wsMu.Lock()
@@ -1216,7 +2120,10 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 			c.Close()
 			logger.Printf("WS_CLIENT_DISCONNECTED remote=%s", r.RemoteAddr)
 		}()
-		_ = wsReadLoop(conn)
+		err := wsReadLoop(c, func(msg []byte) { handleClientMessage(c, msg) })
+		if isTimeout(err) {
+			c.evict("no frame for " + wsPongWait.String())
+		}
 	}()
 }
 
@@ -1226,8 +2133,10 @@ func wsAcceptKey(clientKey string) string {
 	return base64.StdEncoding.EncodeToString(h[:])
 }
 
-func wsReadLoop(conn net.Conn) error {
-	br := bufio.NewReader(conn)
+// wsReadLoop reads client frames until the connection ends, answering pings and
+// passing text messages to onText.
+func wsReadLoop(c *wsConn, onText func([]byte)) error {
+	br := bufio.NewReader(c.c)
 	for {
 		// minimal frame parser (masked client-to-server)
 		b1, err := br.ReadByte()
@@ -1279,19 +2188,27 @@ func wsReadLoop(conn net.Conn) error {
 			}
 		}
 
-		// handle close
-		if op == 0x8 {
+		c.extendRead()
+		switch op {
+		case wsOpClose:
 			return io.EOF
+		case wsOpPong:
+			c.lastPong.Store(time.Now().UnixNano())
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpText:
+			onText(payload)
 		}
-		// ping/pong ignored (browser handles)
 	}
 }
 
-func wsWriteText(conn net.Conn, msg []byte) error {
+func wsWriteFrame(conn net.Conn, op byte, msg []byte) error {
 	// server-to-client frames are NOT masked
-	// FIN=1, opcode=1 (text)
+	// FIN=1
 	var hdr bytes.Buffer
-	hdr.WriteByte(0x81)
+	hdr.WriteByte(0x80 | op)
 
 	n := len(msg)
 	switch {
@@ -1318,44 +2235,100 @@ func wsWriteText(conn net.Conn, msg []byte) error {
 
 func broadcastSignal(s Signal) {
 	b, _ := json.Marshal(s)
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	rememberSignalLocked(s, b)
+	broadcastWSLocked(s.Type, s.Severity, s.Seq, wsOut{text: b, bin: encodeSignalFrame(s, false)})
+}
+
+func broadcastEvent(e Event) {
+	e.Instance = instanceName
+	if e.TimeISO == "" {
+		e.TimeISO = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(e)
+	broadcastWS(wsOut{text: b, bin: encodeEventFrame(e)})
+	enqueueNATSEvent(e)
+}
 
+func broadcastWS(m wsOut) {
 	wsMu.Lock()
 	defer wsMu.Unlock()
+	broadcastWSLocked("", "", 0, m)
+}
+
+// broadcastWSLocked queues m for every client subscribed to signal type typ at
+// severity sev (typ "" for events, which go to everyone); signals with a seq are
+// tracked for ack clients. Caller holds wsMu.
+func broadcastWSLocked(typ, sev string, seq uint64, m wsOut) {
 	for c := range wsClients {
-		if c.dead.Load() {
+		if c.dead.Load() || (typ != "" && !c.wants(typ, sev)) {
 			continue
 		}
-		c.mu.Lock()
-		err := wsWriteText(c.c, b)
-		c.mu.Unlock()
-		if err != nil {
-			c.Close()
-		}
+		c.enqueue(m)
+		c.track(seq, m)
 	}
+	broadcastSSELocked(typ, seq, m.text)
 }
 
 // ---------- main ----------
 
+// resetMachine clears counters and the state machine (ring/status untouched).
+func (s *RuntimeState) resetMachine() {
+	s.OnCounter = 0
+	s.OffCounter = 0
+	s.WaitingReverse = true
+	s.HitWaiting = false
+	s.HitMore = ""
+	s.MissStreak = 0
+	s.BaseHeight = 0
+	s.LastTriggered = ""
+	s.LimitDay, s.DayTriggers = 0, 0
+	s.LimitHour, s.HourTriggers = 0, 0
+	s.LimitReached = ""
+	s.SeqHistory = ""
+	s.CountHistory = ""
+	s.AltLast, s.AltRun = "", 0
+	s.clearPending()
+}
+
 func resetRuntime() {
 	rtMu.Lock()
 	defer rtMu.Unlock()
 
-	rt.OnCounter = 0
-	rt.OffCounter = 0
-	rt.WaitingReverse = true
-	rt.HitWaiting = false
-	rt.BaseHeight = 0
-
-	rt.LastTriggered = ""
+	rt.resetMachine()
 	rt.Ring.reset()
 
 	rt.LastHeight = 0
 	rt.LastHash = ""
 	rt.LastTime = time.Time{}
 	rt.Listening = false
+
+	bb.recordReset()
 }
 
 func main() {
+	replayPath := flag.String("replay", "", "replay a black box dump and exit")
+	var lflags listenFlags
+	flag.StringVar(&lflags.host, "host", "", "bind address (default all interfaces; env TRON_SIGNAL_HOST)")
+	flag.IntVar(&lflags.port, "port", 0, "listen port (default 8080; env TRON_SIGNAL_PORT)")
+	flag.StringVar(&lflags.base, "base-path", "", "serve under this URL prefix, e.g. /tron (env TRON_SIGNAL_BASE_PATH)")
+	flag.StringVar(&lflags.tlsCert, "tls-cert", "", "PEM certificate file; with -tls-key serves HTTPS (env TRON_SIGNAL_TLS_CERT)")
+	flag.StringVar(&lflags.tlsKey, "tls-key", "", "PEM private key file (env TRON_SIGNAL_TLS_KEY)")
+	flag.StringVar(&lflags.httpRedirect, "http-redirect", "", "also listen here for plain HTTP and redirect to HTTPS, e.g. :80 (env TRON_SIGNAL_HTTP_REDIRECT)")
+	flag.StringVar(&lflags.socket, "socket", "", "also serve plain HTTP on this unix socket (env TRON_SIGNAL_SOCKET)")
+	flag.BoolVar(&lflags.socketOnly, "socket-only", false, "serve only on -socket, no TCP port (env TRON_SIGNAL_SOCKET_ONLY=1)")
+	flag.Parse()
+
+	if *replayPath != "" {
+		logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
+		if err := runReplay(*replayPath); err != nil {
+			logger.Printf("REPLAY_ERROR: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := ensureDirs(); err != nil {
 		panic(err)
 	}
@@ -1367,9 +2340,10 @@ func main() {
 	defer lf.Close()
 	logger = log.New(io.MultiWriter(os.Stdout, lf), "", log.LstdFlags|log.Lmicroseconds)
 
-	// abnormal restart marker
+	// abnormal restart marker (raised as an incident once the config is loaded)
 	lockPath := filepath.Join(dataDir, "running.lock")
-	if _, err := os.Stat(lockPath); err == nil {
+	prevStart, lockErr := os.ReadFile(lockPath)
+	if lockErr == nil {
 		logger.Println("ABNORMAL_RESTART")
 	}
 	_ = os.WriteFile(lockPath, []byte(time.Now().Format(time.RFC3339Nano)), 0o644)
@@ -1386,16 +2360,83 @@ func main() {
 	cfg = loaded
 	// defaults
 	if cfg.Access.Tokens == nil {
-		cfg.Access.Tokens = map[string]uint64{}
+		cfg.Access.Tokens = map[string]AccessToken{}
+	}
+	if migrateLegacyAdmin(&cfg.Web) {
+		if err := saveConfigLocked(cfg); err != nil {
+			logger.Printf("USERS_MIGRATE_SAVE_ERROR: %v", err)
+		} else {
+			logger.Printf("USERS_MIGRATED admin=%s", cfg.Web.Users[0].Username)
+		}
+	}
+	// tokens are stored hashed; older configs kept them in plaintext
+	if n := hashTokenKeys(cfg.Access.Tokens); n > 0 {
+		if err := saveConfigLocked(cfg); err != nil {
+			logger.Printf("TOKENS_HASH_SAVE_ERROR: %v", err)
+		} else {
+			logger.Printf("TOKENS_HASHED count=%d", n)
+		}
 	}
 	// default rules if zero
 	if cfg.Rules.Hit.Offset == 0 {
 		cfg.Rules.Hit.Offset = 1
 	}
+	bb.setWindow(cfg.BlackBox.Minutes)
+	instanceName = sanitizeInstance(cfg.Instance)
+	serverCfg := cfg.Server
 	cfgMu.Unlock()
 
+	if err := resolveListen(lflags, serverCfg); err != nil {
+		logger.Printf("LISTEN_CONFIG_ERROR: %v", err)
+		os.Exit(1)
+	}
+	cfgMu.RLock()
+	cookieCfg := cfg.Web.Cookie
+	cfgMu.RUnlock()
+	if err := checkCookieConfig(cookieCfg); err != nil {
+		logger.Printf("COOKIE_CONFIG_ERROR: %v", err)
+		os.Exit(1)
+	}
+
+	if instanceName != "" {
+		logger.SetPrefix("[" + instanceName + "] ")
+		logger.Printf("INSTANCE %s", instanceName)
+	} else if strings.TrimSpace(loaded.Instance) != "" {
+		logger.Printf("INSTANCE_INVALID %q (want [A-Za-z0-9._-], max 64)", loaded.Instance)
+	}
+
+	if lockErr == nil {
+		raiseIncident("ABNORMAL_RESTART", "previous run started "+strings.TrimSpace(string(prevStart))+" did not shut down cleanly")
+	}
+
 	// runtime must be fully reset every boot
 	resetRuntime()
+	loadSignalSeq()
+	loadOutbox()
+	loadSessions()
+
+	// prefetch recent blocks in the background; listener waits for it
+	go warmup()
+
+	// per-source SLA stats are persisted (unlike runtime state)
+	sla.load()
+	go sla.flushLoop()
+
+	go webhookLoop()
+	go outboxLoop()
+	go mqttLoop()
+	go natsLoop()
+	go kafkaLoop()
+	go discordLoop()
+	go slackLoop()
+	go emailLoop()
+	go smsLoop()
+	go pushLoop()
+	go tokenLoop()
+	go sessionLoop()
+
+	// sessions survive restarts, so the login gate may already be met
+	tryStartListener()
 
 	mux := http.NewServeMux()
 
@@ -1411,6 +2452,12 @@ func main() {
 
 	// APIs (require login)
 	mux.HandleFunc("/api/status", requireLogin(apiStatus))
+	mux.HandleFunc("/api/me", requireLogin(apiMe))
+	mux.HandleFunc("/api/users", requireLogin(apiUsers))
+	mux.HandleFunc("/api/users/{name}", requireLogin(apiUser))
+	mux.HandleFunc("/api/logins", requireLogin(apiLogins))
+	mux.HandleFunc("/api/tokens", requireLogin(apiTokens))
+	mux.HandleFunc("/api/tokens/{id}", requireLogin(apiToken))
 	mux.HandleFunc("/api/apikey", requireLogin(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
@@ -1421,6 +2468,310 @@ func main() {
 			http.Error(w, "method", http.StatusMethodNotAllowed)
 		}
 	}))
+	mux.HandleFunc("/api/judge", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetJudge(w, r)
+		case "POST":
+			apiSetJudge(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/judge/stats", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiJudgeStats(w, r)
+	}))
+	mux.HandleFunc("/api/judge/shadow", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetShadow(w, r)
+		case "POST":
+			apiSetShadow(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/rules/templates", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiListRuleTemplates(w, r)
+		case "POST":
+			apiSaveRuleTemplate(w, r)
+		case "DELETE":
+			apiDeleteRuleTemplate(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/rules/history", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiRulesHistory(w, r)
+	}))
+	mux.HandleFunc("/api/rules/export", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiRulesExport(w, r)
+	}))
+	mux.HandleFunc("/api/rules/import", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiRulesImport(w, r)
+	}))
+	mux.HandleFunc("/api/rules/templates/apply", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiApplyRuleTemplate(w, r)
+	}))
+	mux.HandleFunc("/api/signals", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSignals(w, r)
+	}))
+	mux.HandleFunc("/api/signals/wait", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSignalsWait(w, r)
+	}))
+	mux.HandleFunc("/api/webhook", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetWebhook(w, r)
+		case "POST":
+			apiSetWebhook(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/webhook/endpoints", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetWebhookEndpoints(w, r)
+		case "POST":
+			apiSetWebhookEndpoints(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/webhook/template/preview", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiPreviewTemplate(w, r)
+	}))
+	mux.HandleFunc("/api/deliveries", requireLogin(apiDeliveries))
+	mux.HandleFunc("/api/deliveries/retry", requireLogin(apiRetryDeliveries))
+	mux.HandleFunc("/api/webhook/deliveries", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiWebhookDeliveries(w, r)
+	}))
+	mux.HandleFunc("/api/mqtt", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetMQTT(w, r)
+		case "POST":
+			apiSetMQTT(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/nats", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetNATS(w, r)
+		case "POST":
+			apiSetNATS(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/kafka", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetKafka(w, r)
+		case "POST":
+			apiSetKafka(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/discord", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetDiscord(w, r)
+		case "POST":
+			apiSetDiscord(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/slack", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetSlack(w, r)
+		case "POST":
+			apiSetSlack(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/email", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetEmail(w, r)
+		case "POST":
+			apiSetEmail(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/email/test", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiTestEmail(w, r)
+	}))
+	mux.HandleFunc("/api/sms", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetSMS(w, r)
+		case "POST":
+			apiSetSMS(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/push", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetPush(w, r)
+		case "POST":
+			apiSetPush(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/ws/config", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetWS(w, r)
+		case "POST":
+			apiSetWS(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/ws/schema", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiWSSchema(w, r)
+	}))
+	mux.HandleFunc("/api/ws/clients/{id}/kick", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiKickWSClient(w, r)
+	}))
+	mux.HandleFunc("/api/ws/bans", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetWSBans(w, r)
+		case "POST":
+			apiSetWSBans(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/ws/clients", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiWSClients(w, r)
+	}))
+	mux.HandleFunc("/api/machine/enable", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSetMachineEnabled(w, r, true)
+	}))
+	mux.HandleFunc("/api/machine/disable", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSetMachineEnabled(w, r, false)
+	}))
+	mux.HandleFunc("/api/machine/reset", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiResetMachine(w, r)
+	}))
+	mux.HandleFunc("/api/machine/snooze", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSnooze(w, r)
+	}))
+	mux.HandleFunc("/api/machine/stats", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiMachineStats(w, r)
+	}))
+	mux.HandleFunc("/api/backtest", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiBacktest(w, r)
+	}))
+	mux.HandleFunc("/api/judge/preview", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiJudgePreview(w, r)
+	}))
+	mux.HandleFunc("/api/judge/scripts", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetScripts(w, r)
+		case "POST":
+			apiUploadScript(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
 	mux.HandleFunc("/api/rules", requireLogin(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
@@ -1432,8 +2783,55 @@ func main() {
 		}
 	}))
 
+	mux.HandleFunc("/api/incidents", requireLogin(apiIncidents))
+	mux.HandleFunc("/api/blocks", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiBlocks(w, r)
+	}))
+	mux.HandleFunc("/api/logs", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiLogs(w, r)
+	}))
+	mux.HandleFunc("/api/sources/report", requireLogin(apiSourcesReport))
+	mux.HandleFunc("/api/sources/export", requireLogin(apiSourcesExport))
+	mux.HandleFunc("/api/sources/groups", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			apiGetSourceGroups(w, r)
+		case "POST":
+			apiSetSourceGroups(w, r)
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/sources/import", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+			return
+		}
+		apiSourcesImport(w, r)
+	}))
+
+	// black box dump (require login)
+	mux.HandleFunc("/api/blackbox", requireLogin(apiBlackBox))
+	mux.HandleFunc("/api/openapi.json", requireLogin(apiOpenAPI))
+	mux.HandleFunc("/api/"+apiVersion+"/", apiV1(mux))
+	mux.HandleFunc("/docs/swagger", requireLogin(swaggerPage))
+	mux.HandleFunc("/docs/swagger-ui/{file}", requireLogin(swaggerAsset))
+
+	// profiling (require login, off unless debug.pprof)
+	mountPprof(mux)
+
 	// SSE + WS (require login)
 	mux.HandleFunc("/sse/status", requireLogin(sseStatus))
+	mux.HandleFunc("/sse/simulated", requireLogin(sseSimulated))
+	mux.HandleFunc("/sse/signals", requireLogin(sseSignals))
 	mux.HandleFunc("/ws", requireLogin(wsHandler))
 
 	// static assets (only after login gate)
@@ -1446,12 +2844,54 @@ func main() {
 
 	srv := &http.Server{
 		Addr:              listenAddr,
-		Handler:           withSecurityHeaders(mux),
+		Handler:           withAccessLog(withSecurityHeaders(withRateLimit(withBasePath(withAuthGuard(withCompression(mux)))))),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	logger.Printf("HTTP_LISTEN %s", listenAddr)
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if socketPath != "" {
+		ln, err := listenUnix(socketPath)
+		if err != nil {
+			logger.Printf("SOCKET_ERROR: %v", err)
+			os.Exit(1)
+		}
+		defer os.Remove(socketPath)
+		logger.Printf("HTTP_LISTEN unix:%s base=%q", socketPath, basePath)
+		if socketOnly {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Printf("SERVER_ERROR: %v", err)
+			}
+			return
+		}
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Printf("SOCKET_SERVER_ERROR: %v", err)
+			}
+		}()
+	}
+
+	if !tlsEnabled() {
+		logger.Printf("HTTP_LISTEN %s base=%q", listenAddr, basePath)
+		err = srv.ListenAndServe()
+	} else {
+		redirect := httpsRedirect()
+		if acmeEnabled() {
+			srv.TLSConfig = &tls.Config{GetCertificate: acmeGetCertificate}
+			redirect = acmeChallenge(redirect)
+			go acmeLoop()
+		}
+		if httpRedirectAddr != "" {
+			go func() {
+				logger.Printf("HTTP_REDIRECT_LISTEN %s", httpRedirectAddr)
+				rs := &http.Server{Addr: httpRedirectAddr, Handler: redirect, ReadHeaderTimeout: 5 * time.Second}
+				if err := rs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Printf("HTTP_REDIRECT_ERROR: %v", err)
+				}
+			}()
+		}
+		logger.Printf("HTTPS_LISTEN %s base=%q", listenAddr, basePath)
+		err = srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile) // both empty with ACME: TLSConfig supplies it
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Printf("SERVER_ERROR: %v", err)
 	}
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- MQTT publisher ----------
+
+// Every signal that goes to /ws is also published to an MQTT broker when one is
+// configured (POST /api/mqtt). The topic may contain {type} and {instance}. This
+// is a minimal MQTT 3.1.1 client — CONNECT, PUBLISH at QoS 0 or 1, PINGREQ — so
+// the binary stays dependency-free; QoS 2 is not offered. Like the webhook it runs
+// off a queue, reconnects on demand and drops (with a log line) what it can't
+// deliver.
+
+const (
+	mqttQueueSize = 256
+	mqttAttempts  = 3
+	mqttTimeout   = 5 * time.Second
+	mqttKeepAlive = 60 * time.Second
+)
+
+type MQTTConfig struct {
+	Broker   string `json:"broker"` // tcp://host:1883 | tls://host:8883; empty = disabled
+	Topic    string `json:"topic"`  // e.g. tron/{instance}/{type}
+	QoS      int    `json:"qos"`    // 0 or 1
+	Retain   bool   `json:"retain,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+var (
+	mqttC = make(chan Signal, mqttQueueSize)
+
+	mqttStatsMu sync.Mutex
+	mqttStats   struct {
+		Connected bool   `json:"connected"`
+		Published uint64 `json:"published"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueueMQTT(s Signal) {
+	cfgMu.RLock()
+	on := cfg.MQTT.Broker != ""
+	cfgMu.RUnlock()
+	if !on {
+		return
+	}
+	select {
+	case mqttC <- s:
+	default:
+		mqttStatsMu.Lock()
+		mqttStats.Dropped++
+		mqttStatsMu.Unlock()
+		logger.Printf("MQTT_DROP type=%s height=%d (queue full)", s.Type, s.Height)
+	}
+}
+
+type mqttClient struct {
+	cfg    MQTTConfig
+	conn   net.Conn
+	br     *bufio.Reader
+	nextID uint16
+}
+
+func mqttLoop() {
+	var c *mqttClient
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case s := <-mqttC:
+			cfgMu.RLock()
+			mc := cfg.MQTT
+			cfgMu.RUnlock()
+			if c != nil && c.cfg != mc {
+				c.close()
+				c = nil
+			}
+			if mc.Broker == "" {
+				continue
+			}
+			body, err := json.Marshal(s)
+			if err != nil {
+				continue
+			}
+			topic := mqttTopic(mc.Topic, s)
+			for attempt := 1; attempt <= mqttAttempts; attempt++ {
+				if c == nil {
+					if c, err = mqttDial(mc); err != nil {
+						time.Sleep(time.Second * time.Duration(attempt))
+						continue
+					}
+				}
+				if err = c.publish(topic, body); err == nil {
+					break
+				}
+				c.close()
+				c = nil
+			}
+			mqttRecord(c != nil, err)
+			if err != nil {
+				logger.Printf("MQTT_ERROR type=%s height=%d: %v", s.Type, s.Height, err)
+			}
+		case <-ping.C:
+			if c == nil {
+				continue
+			}
+			cfgMu.RLock()
+			changed := c.cfg != cfg.MQTT
+			cfgMu.RUnlock()
+			if changed {
+				c.close()
+				c = nil
+				mqttSetConnected(false, nil)
+				continue
+			}
+			if err := c.ping(); err != nil {
+				logger.Printf("MQTT_PING_ERROR: %v", err)
+				c.close()
+				c = nil
+				mqttSetConnected(false, err)
+			}
+		}
+	}
+}
+
+// mqttRecord counts one publish.
+func mqttRecord(connected bool, err error) {
+	mqttSetConnected(connected, err)
+	mqttStatsMu.Lock()
+	defer mqttStatsMu.Unlock()
+	if err != nil {
+		mqttStats.Failed++
+	} else {
+		mqttStats.Published++
+	}
+}
+
+func mqttSetConnected(connected bool, err error) {
+	mqttStatsMu.Lock()
+	defer mqttStatsMu.Unlock()
+	mqttStats.Connected = connected
+	if err != nil {
+		mqttStats.LastError = err.Error()
+	}
+}
+
+func mqttTopic(pattern string, s Signal) string {
+	return strings.NewReplacer("{type}", s.Type, "{instance}", s.Instance).Replace(pattern)
+}
+
+func mqttDial(mc MQTTConfig) (*mqttClient, error) {
+	u, err := url.Parse(mc.Broker)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tls", "ssl", "mqtts":
+		conn, err = tls.DialWithDialer(d, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		conn, err = d.Dial("tcp", u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttClient{cfg: mc, conn: conn, br: bufio.NewReader(conn)}
+	if err := c.connect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Printf("MQTT_CONNECTED broker=%s", u.Host)
+	return c, nil
+}
+
+func (c *mqttClient) close() {
+	_ = c.write(0xe0, nil) // DISCONNECT
+	_ = c.conn.Close()
+}
+
+func (c *mqttClient) connect() error {
+	clientID := c.cfg.ClientID
+	if clientID == "" {
+		clientID = "tron-signal"
+		if instanceName != "" {
+			clientID += "-" + instanceName
+		}
+	}
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = mqttString(payload, clientID)
+	if c.cfg.Username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, c.cfg.Username)
+		if c.cfg.Password != "" {
+			flags |= 0x40
+			payload = mqttString(payload, c.cfg.Password)
+		}
+	}
+	vh := mqttString(nil, "MQTT")
+	vh = append(vh, 4, flags) // protocol level 3.1.1
+	vh = binary.BigEndian.AppendUint16(vh, uint16(mqttKeepAlive/time.Second))
+	if err := c.write(0x10, append(vh, payload...)); err != nil {
+		return err
+	}
+	typ, body, err := c.read()
+	if err != nil {
+		return err
+	}
+	if typ != 0x20 || len(body) < 2 {
+		return fmt.Errorf("mqtt: expected CONNACK, got packet type %#x", typ)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("mqtt: connection refused (code %d)", body[1])
+	}
+	return nil
+}
+
+func (c *mqttClient) publish(topic string, payload []byte) error {
+	hdr := byte(0x30)
+	if c.cfg.Retain {
+		hdr |= 0x01
+	}
+	vh := mqttString(nil, topic)
+	var id uint16
+	if c.cfg.QoS > 0 {
+		hdr |= 0x02
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		vh = binary.BigEndian.AppendUint16(vh, id)
+	}
+	if err := c.write(hdr, append(vh, payload...)); err != nil {
+		return err
+	}
+	if c.cfg.QoS == 0 {
+		return nil
+	}
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if typ == 0x40 && len(body) >= 2 && binary.BigEndian.Uint16(body) == id {
+			return nil
+		}
+	}
+}
+
+func (c *mqttClient) ping() error {
+	if err := c.write(0xc0, nil); err != nil {
+		return err
+	}
+	for {
+		typ, _, err := c.read()
+		if err != nil {
+			return err
+		}
+		if typ == 0xd0 {
+			return nil
+		}
+	}
+}
+
+func (c *mqttClient) write(hdr byte, body []byte) error {
+	pkt := append([]byte{hdr}, binary.AppendUvarint(nil, uint64(len(body)))...)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(append(pkt, body...))
+	return err
+}
+
+// read returns the next packet's type (high nibble of the fixed header) and body.
+func (c *mqttClient) read() (byte, []byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	hdr, err := c.br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(c.br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("mqtt: packet too large")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr & 0xf0, body, nil
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func validateMQTT(mc *MQTTConfig) error {
+	mc.Broker = strings.TrimSpace(mc.Broker)
+	mc.Topic = strings.TrimSpace(mc.Topic)
+	if mc.Broker == "" {
+		return nil
+	}
+	u, err := url.Parse(mc.Broker)
+	if err != nil || u.Host == "" || u.Port() == "" {
+		return fmt.Errorf("broker must be tcp://host:port or tls://host:port")
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "tls", "ssl", "mqtts":
+	default:
+		return fmt.Errorf("broker must be tcp://host:port or tls://host:port")
+	}
+	if mc.Topic == "" || strings.ContainsAny(mc.Topic, "#+") || len(mc.Topic) > 256 {
+		return fmt.Errorf("topic must be set and may not contain wildcards")
+	}
+	if mc.QoS != 0 && mc.QoS != 1 {
+		return fmt.Errorf("qos must be 0 or 1")
+	}
+	if len(mc.ClientID) > 64 {
+		return fmt.Errorf("clientId: at most 64 characters")
+	}
+	return nil
+}
+
+func apiGetMQTT(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	mc := cfg.MQTT
+	cfgMu.RUnlock()
+	if mc.Password != "" {
+		mc.Password = "****"
+	}
+	mqttStatsMu.Lock()
+	stats := mqttStats
+	mqttStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"mqtt": mc, "stats": stats})
+}
+
+func apiSetMQTT(w http.ResponseWriter, r *http.Request) {
+	var mc MQTTConfig
+	if err := readJSON(r, &mc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateMQTT(&mc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.MQTT
+	if mc.Password == "****" {
+		mc.Password = prev.Password // unchanged from what GET showed
+	}
+	cfg.MQTT = mc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.MQTT = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("MQTT_SET enabled=%v qos=%d", mc.Broker != "", mc.QoS)
+	if mc.Password != "" {
+		mc.Password = "****"
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "mqtt": mc})
+}
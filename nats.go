@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- NATS publisher ----------
+
+// Signals (and the system events WS clients get: SOURCES_DOWN, LIMIT_REACHED, ...)
+// are published to a NATS server when one is configured (POST /api/nats).
+// Subject may contain {type} and {instance}; events go to EventSubject when set.
+// This speaks the plain-text NATS client protocol directly (CONNECT, PUB, PING);
+// every publish is followed by a PING so the PONG confirms the server has it. The
+// connection is re-established on the next message after it breaks.
+
+const (
+	natsQueueSize = 256
+	natsAttempts  = 3
+	natsTimeout   = 5 * time.Second
+)
+
+type NATSConfig struct {
+	URL          string `json:"url"`     // nats://host:4222 | tls://host:4222; empty = disabled
+	Subject      string `json:"subject"` // e.g. tron.{instance}.signal.{type}
+	EventSubject string `json:"eventSubject,omitempty"`
+	Token        string `json:"token,omitempty"`
+	User         string `json:"user,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+type natsMsg struct {
+	subject string
+	data    []byte
+}
+
+var (
+	natsC = make(chan natsMsg, natsQueueSize)
+
+	natsStatsMu sync.Mutex
+	natsStats   struct {
+		Connected bool   `json:"connected"`
+		Published uint64 `json:"published"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		Connects  uint64 `json:"connects"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueueNATSSignal(s Signal) {
+	cfgMu.RLock()
+	nc := cfg.NATS
+	cfgMu.RUnlock()
+	if nc.URL == "" {
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	enqueueNATS(natsMsg{natsSubject(nc.Subject, s.Type, s.Instance), b})
+}
+
+func enqueueNATSEvent(e Event) {
+	cfgMu.RLock()
+	nc := cfg.NATS
+	cfgMu.RUnlock()
+	if nc.URL == "" || nc.EventSubject == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	enqueueNATS(natsMsg{natsSubject(nc.EventSubject, e.Type, e.Instance), b})
+}
+
+func enqueueNATS(m natsMsg) {
+	select {
+	case natsC <- m:
+	default:
+		natsStatsMu.Lock()
+		natsStats.Dropped++
+		natsStatsMu.Unlock()
+		logger.Printf("NATS_DROP subject=%s (queue full)", m.subject)
+	}
+}
+
+func natsSubject(pattern, typ, instance string) string {
+	return strings.NewReplacer("{type}", typ, "{instance}", instance).Replace(pattern)
+}
+
+type natsConn struct {
+	cfg  NATSConfig
+	conn net.Conn
+	wmu  sync.Mutex
+	pong chan struct{}
+	errs chan error // -ERR from the server, or the read error that ended it
+}
+
+func natsLoop() {
+	var c *natsConn
+	for m := range natsC {
+		cfgMu.RLock()
+		nc := cfg.NATS
+		cfgMu.RUnlock()
+		if c != nil && c.cfg != nc {
+			c.close()
+			c = nil
+		}
+		if nc.URL == "" {
+			continue
+		}
+		var err error
+		for attempt := 1; attempt <= natsAttempts; attempt++ {
+			if c == nil {
+				if c, err = natsDial(nc); err != nil {
+					time.Sleep(time.Second * time.Duration(attempt))
+					continue
+				}
+			}
+			if err = c.publish(m.subject, m.data); err == nil {
+				break
+			}
+			c.close()
+			c = nil
+		}
+
+		natsStatsMu.Lock()
+		natsStats.Connected = c != nil
+		if err != nil {
+			natsStats.Failed++
+			natsStats.LastError = err.Error()
+		} else {
+			natsStats.Published++
+		}
+		natsStatsMu.Unlock()
+		if err != nil {
+			logger.Printf("NATS_ERROR subject=%s: %v", m.subject, err)
+		}
+	}
+}
+
+func natsDial(nc NATSConfig) (*natsConn, error) {
+	u, err := url.Parse(nc.URL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, natsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(natsTimeout))
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("nats: expected INFO from server")
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	_ = json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &info)
+	if info.TLSRequired || u.Scheme == "tls" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn, br = tc, bufio.NewReader(tc)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	name := "tron-signal"
+	if instanceName != "" {
+		name += "-" + instanceName
+	}
+	opts, _ := json.Marshal(struct {
+		Verbose     bool   `json:"verbose"`
+		Pedantic    bool   `json:"pedantic"`
+		TLSRequired bool   `json:"tls_required"`
+		Name        string `json:"name"`
+		Lang        string `json:"lang"`
+		Version     string `json:"version"`
+		AuthToken   string `json:"auth_token,omitempty"`
+		User        string `json:"user,omitempty"`
+		Pass        string `json:"pass,omitempty"`
+	}{
+		TLSRequired: info.TLSRequired || u.Scheme == "tls",
+		Name:        name,
+		Lang:        "go",
+		Version:     "1",
+		AuthToken:   nc.Token,
+		User:        nc.User,
+		Pass:        nc.Password,
+	})
+	c := &natsConn{cfg: nc, conn: conn, pong: make(chan struct{}, 1), errs: make(chan error, 1)}
+	if err := c.write("CONNECT " + string(opts) + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop(br)
+	// the PONG to this PING means CONNECT was accepted
+	if err := c.flush(); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	natsStatsMu.Lock()
+	natsStats.Connects++
+	natsStats.Connected = true
+	natsStatsMu.Unlock()
+	logger.Printf("NATS_CONNECTED server=%s", u.Host)
+	return c, nil
+}
+
+func (c *natsConn) readLoop(br *bufio.Reader) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				c.fail(err)
+				return
+			}
+		case line == "PONG":
+			select {
+			case c.pong <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			c.fail(errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+}
+
+func (c *natsConn) fail(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+func (c *natsConn) write(s string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	_, err := c.conn.Write([]byte(s))
+	return err
+}
+
+// flush sends PING and waits for the PONG.
+func (c *natsConn) flush() error {
+	if err := c.write("PING\r\n"); err != nil {
+		return err
+	}
+	select {
+	case <-c.pong:
+		return nil
+	case err := <-c.errs:
+		return err
+	case <-time.After(natsTimeout):
+		return errors.New("nats: no PONG")
+	}
+}
+
+func (c *natsConn) publish(subject string, data []byte) error {
+	if err := c.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data)); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *natsConn) close() {
+	_ = c.conn.Close()
+}
+
+var natsPlaceholders = strings.NewReplacer("{type}", "X", "{instance}", "X")
+
+func validNATSSubject(s string) bool {
+	s = natsPlaceholders.Replace(s)
+	if s == "" || len(s) > 256 || strings.ContainsAny(s, " \t\r\n*>") {
+		return false
+	}
+	for _, tok := range strings.Split(s, ".") {
+		if tok == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func validateNATS(nc *NATSConfig) error {
+	nc.URL = strings.TrimSpace(nc.URL)
+	nc.Subject = strings.TrimSpace(nc.Subject)
+	nc.EventSubject = strings.TrimSpace(nc.EventSubject)
+	if nc.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(nc.URL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" || u.Port() == "" {
+		return fmt.Errorf("url must be nats://host:port or tls://host:port")
+	}
+	if !validNATSSubject(nc.Subject) {
+		return fmt.Errorf("subject must be a dotted name without spaces or wildcards")
+	}
+	if nc.EventSubject != "" && !validNATSSubject(nc.EventSubject) {
+		return fmt.Errorf("eventSubject must be a dotted name without spaces or wildcards")
+	}
+	return nil
+}
+
+func apiGetNATS(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	nc := cfg.NATS
+	cfgMu.RUnlock()
+	maskNATSSecrets(&nc)
+	natsStatsMu.Lock()
+	stats := natsStats
+	natsStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"nats": nc, "stats": stats})
+}
+
+func maskNATSSecrets(nc *NATSConfig) {
+	if nc.Token != "" {
+		nc.Token = "****"
+	}
+	if nc.Password != "" {
+		nc.Password = "****"
+	}
+}
+
+func apiSetNATS(w http.ResponseWriter, r *http.Request) {
+	var nc NATSConfig
+	if err := readJSON(r, &nc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateNATS(&nc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.NATS
+	// "****" is what GET showed: keep the stored secret
+	if nc.Token == "****" {
+		nc.Token = prev.Token
+	}
+	if nc.Password == "****" {
+		nc.Password = prev.Password
+	}
+	cfg.NATS = nc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.NATS = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("NATS_SET enabled=%v events=%v", nc.URL != "", nc.EventSubject != "")
+	maskNATSSecrets(&nc)
+	mustJSON(w, 200, map[string]any{"ok": true, "nats": nc})
+}
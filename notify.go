@@ -0,0 +1,31 @@
+package main
+
+// ---------- Notifiers ----------
+
+// Chat/alert channels (Discord, Slack, email, SMS, phone push) get live signals and incidents through
+// notifySignal / notifyIncident. Each channel has its own queue and loop and
+// decides from its own config what to send; enqueueing must not take cfgMu
+// because raiseIncident may run under it.
+
+// notice is one signal or one incident.
+type notice struct {
+	signal   *Signal
+	incident *Incident
+}
+
+func notifySignal(s Signal) {
+	n := notice{signal: &s}
+	enqueueDiscord(n)
+	enqueueSlack(n)
+	enqueueEmail(n)
+	enqueuePush(n)
+}
+
+func notifyIncident(inc Incident) {
+	n := notice{incident: &inc}
+	enqueueDiscord(n)
+	enqueueSlack(n)
+	enqueueEmail(n)
+	enqueueSMS(n)
+	enqueuePush(n)
+}
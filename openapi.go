@@ -0,0 +1,294 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ---------- OpenAPI spec ----------
+
+// GET /api/openapi.json describes every /api endpoint as OpenAPI 3.0, under its
+// versioned name /api/v1/... (apiversion.go). Paths come from apiOps below (kept
+// next to the routes in main), schemas are generated from the Go types the
+// handlers read and write, so field changes show up without touching this file. /docs/swagger renders it with Swagger UI, for admins only.
+//
+// The page runs with the admin's session, so Swagger UI is not pulled from a
+// CDN: copy swagger-ui.css and swagger-ui-bundle.js from the swagger-ui-dist
+// release you trust into web/swagger-ui/ and they are served from here. Without
+// them the page says so and links the raw spec.
+
+const swaggerAssetsDir = "web/swagger-ui"
+
+var swaggerAssets = map[string]bool{"swagger-ui.css": true, "swagger-ui-bundle.js": true}
+
+type apiOp struct {
+	method, path, summary string
+	query                 []string // "name: description"
+	body, resp            any      // zero values of the request/response types; nil = none/generic
+}
+
+var apiOps = []apiOp{
+	{method: "GET", path: "/api/status", summary: "Instance, source and machine status, plus the recent blocks", query: blockQueryParams, resp: Status{}},
+	{method: "GET", path: "/api/me", summary: "The logged-in account, its role and the session's CSRF token", resp: MeInfo{}},
+	{method: "GET", path: "/api/users", summary: "Accounts and their roles (admin)", resp: []UserInfo{}},
+	{method: "POST", path: "/api/users", summary: "Create an account with a role (admin)", body: userBody{}, resp: UserInfo{}},
+	{method: "POST", path: "/api/users/{name}", summary: "Change an account's role or password (admin; fields left out are kept)", body: userBody{}, resp: UserInfo{}},
+	{method: "DELETE", path: "/api/users/{name}", summary: "Remove an account (admin); the last admin cannot be removed"},
+	{method: "GET", path: "/api/logins", summary: "Recent login attempts (newest first) and the accounts locked now (admin)", resp: []LoginAttempt{}},
+	{method: "GET", path: "/api/tokens", summary: "Access tokens (masked) with label, use count and last use, and the scopes they can carry", resp: []TokenInfo{}},
+	{method: "POST", path: "/api/tokens", summary: "Create an access token, optionally expiring; the reply is the only time it is shown in full", body: tokenBody{}, resp: TokenInfo{}},
+	{method: "POST", path: "/api/tokens/{id}", summary: "Change a token's scopes, expiry or label (fields left out are kept)", body: tokenBody{}, resp: TokenInfo{}},
+	{method: "DELETE", path: "/api/tokens/{id}", summary: "Revoke a token"},
+	{method: "GET", path: "/api/apikey", summary: "TronGrid API keys (masked)"},
+	{method: "POST", path: "/api/apikey", summary: "Replace the TronGrid API keys"},
+	{method: "GET", path: "/api/rules", summary: "Live rules", resp: Rules{}},
+	{method: "POST", path: "/api/rules", summary: "Replace the rules (judge, shadow and enabled are kept)", query: []string{"strict: 1 = report every invalid field instead of clamping"}, body: Rules{}},
+	{method: "GET", path: "/api/rules/templates", summary: "Saved rule templates"},
+	{method: "POST", path: "/api/rules/templates", summary: "Save a rule template {name, rules}; without rules the live rules are saved"},
+	{method: "DELETE", path: "/api/rules/templates", summary: "Delete a rule template", query: []string{"name: template name"}},
+	{method: "POST", path: "/api/rules/templates/apply", summary: "Make a template's rules the live rules {name}"},
+	{method: "GET", path: "/api/rules/history", summary: "Recent rule changes, newest first", query: []string{"limit: default 50"}},
+	{method: "GET", path: "/api/rules/export", summary: "Export rules and templates", query: []string{"format: json (default) or csv"}},
+	{method: "POST", path: "/api/rules/import", summary: "Import a rules bundle"},
+	{method: "GET", path: "/api/judge", summary: "Judge rule", resp: JudgeRule{}},
+	{method: "POST", path: "/api/judge", summary: "Switch the judge rule (wipes machine state)", body: JudgeRule{}},
+	{method: "GET", path: "/api/judge/stats", summary: "ON/OFF/NEUTRAL ratio of recent blocks"},
+	{method: "GET", path: "/api/judge/shadow", summary: "Shadow judge rule"},
+	{method: "POST", path: "/api/judge/shadow", summary: "Set the shadow judge rule; an empty type clears it", body: JudgeRule{}},
+	{method: "POST", path: "/api/judge/preview", summary: "Evaluate a judge rule over recent blocks", body: JudgeRule{}},
+	{method: "GET", path: "/api/judge/scripts", summary: "List judge scripts, or one version's source", query: []string{"name: script name", "version: script version"}},
+	{method: "POST", path: "/api/judge/scripts", summary: "Upload a judge script as its next version"},
+	{method: "GET", path: "/api/signals", summary: "Stored signals, newest first", query: []string{"type: comma-separated signal types", "from: RFC 3339, default to-24h", "to: RFC 3339, default now", "afterSeq: only seqs above it", "limit: default 100, max 1000", "offset: skip that many"}, resp: []Signal{}},
+	{method: "GET", path: "/api/signals/wait", summary: "Long-poll for signals with a seq above since", query: []string{"since: last seq seen; default the current one", "timeout: Go duration or seconds, default 30s, max 120s", "type: comma-separated signal types"}, resp: []Signal{}},
+	{method: "GET", path: "/api/webhook", summary: "Legacy single webhook", resp: WebhookConfig{}},
+	{method: "POST", path: "/api/webhook", summary: "Set the legacy single webhook", body: WebhookConfig{}},
+	{method: "GET", path: "/api/webhook/endpoints", summary: "Webhook endpoints (secrets masked)", resp: []WebhookEndpoint{}},
+	{method: "POST", path: "/api/webhook/endpoints", summary: "Replace the webhook endpoints {endpoints: [...]}"},
+	{method: "POST", path: "/api/webhook/template/preview", summary: "Render a body template against a sample signal {template, contentType}"},
+	{method: "GET", path: "/api/webhook/deliveries", summary: "Recent webhook deliveries, newest first", query: []string{"endpoint: endpoint id", "failed: 1 = failures only", "limit: default 100"}, resp: []WebhookDelivery{}},
+	{method: "GET", path: "/api/deliveries", summary: "Webhook deliveries parked in the outbox, oldest first", query: []string{"endpoint: endpoint id", "limit: default 100"}, resp: []OutboxItem{}},
+	{method: "DELETE", path: "/api/deliveries", summary: "Drop parked deliveries", query: []string{"endpoint: endpoint id (required)", "id: one delivery only"}},
+	{method: "POST", path: "/api/deliveries/retry", summary: "Retry parked deliveries now"},
+	{method: "GET", path: "/api/mqtt", summary: "MQTT publisher settings and stats", resp: MQTTConfig{}},
+	{method: "POST", path: "/api/mqtt", summary: "Set the MQTT publisher", body: MQTTConfig{}},
+	{method: "GET", path: "/api/nats", summary: "NATS publisher settings and stats", resp: NATSConfig{}},
+	{method: "POST", path: "/api/nats", summary: "Set the NATS publisher", body: NATSConfig{}},
+	{method: "GET", path: "/api/kafka", summary: "Kafka producer settings and stats", resp: KafkaConfig{}},
+	{method: "POST", path: "/api/kafka", summary: "Set the Kafka producer", body: KafkaConfig{}},
+	{method: "GET", path: "/api/discord", summary: "Discord channels and stats", resp: DiscordConfig{}},
+	{method: "POST", path: "/api/discord", summary: "Set the Discord channels", body: DiscordConfig{}},
+	{method: "GET", path: "/api/slack", summary: "Slack settings, stats and default templates", resp: SlackConfig{}},
+	{method: "POST", path: "/api/slack", summary: "Set the Slack notifier", body: SlackConfig{}},
+	{method: "GET", path: "/api/email", summary: "Email alert settings and stats", resp: EmailConfig{}},
+	{method: "POST", path: "/api/email", summary: "Set email alerts", body: EmailConfig{}},
+	{method: "POST", path: "/api/email/test", summary: "Mail the saved recipients now"},
+	{method: "GET", path: "/api/sms", summary: "SMS alert settings and today's usage", resp: SMSConfig{}},
+	{method: "POST", path: "/api/sms", summary: "Set SMS alerts", body: SMSConfig{}},
+	{method: "GET", path: "/api/push", summary: "ntfy/Gotify push settings and stats", resp: PushConfig{}},
+	{method: "POST", path: "/api/push", summary: "Set phone push", body: PushConfig{}},
+	{method: "GET", path: "/api/ws/config", summary: "WS replay and ack settings", resp: WSConfig{}},
+	{method: "POST", path: "/api/ws/config", summary: "Set WS replay and ack settings", body: WSConfig{}},
+	{method: "GET", path: "/api/ws/schema", summary: "Protobuf schema of the binary WS frames"},
+	{method: "GET", path: "/api/ws/clients", summary: "Connected WS clients, oldest first", resp: []WSClientInfo{}},
+	{method: "POST", path: "/api/ws/clients/{id}/kick", summary: "Disconnect a WS client"},
+	{method: "GET", path: "/api/ws/bans", summary: "Banned IPs and tokens", resp: WSBanList{}},
+	{method: "POST", path: "/api/ws/bans", summary: "Replace the WS ban lists", body: WSBanList{}},
+	{method: "POST", path: "/api/machine/enable", summary: "Switch the machine on", query: []string{"reset: 1 = clear machine state too"}},
+	{method: "POST", path: "/api/machine/disable", summary: "Switch the machine off", query: []string{"reset: 1 = clear machine state too"}},
+	{method: "POST", path: "/api/machine/reset", summary: "Clear counters, reverse gate and pending checks"},
+	{method: "POST", path: "/api/machine/snooze", summary: "Snooze signal emission", query: []string{"minutes: 0-1440; 0 ends a snooze"}},
+	{method: "GET", path: "/api/machine/stats", summary: "Trigger/hit statistics", resp: MachineStats{}},
+	{method: "POST", path: "/api/backtest", summary: "Replay stored blocks through rules", body: BacktestRequest{}, resp: BacktestResult{}},
+	{method: "GET", path: "/api/incidents", summary: "Recent incidents, newest first", resp: []Incident{}},
+	{method: "GET", path: "/api/blocks", summary: "Blocks, newest first, from the ring and then the block history", query: blockQueryParams},
+	{method: "GET", path: "/api/logs", summary: "Log lines, newest first", query: []string{"kind: main (default) or access", "from: RFC 3339, default to-1h", "to: RFC 3339, default now", "q: substring to match", "limit: default 200, max 2000", "offset: skip that many"}},
+	{method: "GET", path: "/api/sources/report", summary: "Per-source SLA for a day", query: []string{"date: YYYY-MM-DD, default today"}},
+	{method: "GET", path: "/api/sources/export", summary: "Export the source list", query: []string{"redact: false = include keys"}},
+	{method: "POST", path: "/api/sources/import", summary: "Replace the source list with a bundle"},
+	{method: "GET", path: "/api/sources/groups", summary: "Source failover groups"},
+	{method: "POST", path: "/api/sources/groups", summary: "Set source failover groups"},
+	{method: "GET", path: "/api/blackbox", summary: "Download the black box (binary)"},
+	{method: "GET", path: "/api/openapi.json", summary: "This document"},
+}
+
+var blockQueryParams = []string{
+	"fromHeight: lowest height", "toHeight: highest height", "from: RFC 3339", "to: RFC 3339",
+	"state: ON, OFF or NEUTRAL", "limit: blocks to return; 0 = none", "offset: skip that many matches",
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]any
+)
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() { openAPIDoc = buildOpenAPI() })
+	mustJSON(w, 200, openAPIDoc)
+}
+
+func buildOpenAPI() map[string]any {
+	g := &schemaGen{components: map[string]any{}}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOps {
+		o := map[string]any{"summary": op.summary}
+		var params []map[string]any
+		for _, q := range op.query {
+			name, desc, _ := strings.Cut(q, ":")
+			params = append(params, map[string]any{
+				"name": name, "in": "query", "description": strings.TrimSpace(desc),
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, seg := range strings.Split(op.path, "/") {
+			if name, ok := strings.CutPrefix(seg, "{"); ok {
+				params = append(params, map[string]any{"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+			}
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.body != nil {
+			o["requestBody"] = map[string]any{"content": map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.body))},
+			}}
+		}
+		ok := map[string]any{"description": "OK"}
+		if op.resp != nil {
+			ok["content"] = map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.resp))}}
+		}
+		o["responses"] = map[string]any{"200": ok}
+		path := "/api/" + apiVersion + strings.TrimPrefix(op.path, "/api")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(op.method)] = o
+	}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "tron-signal",
+			"version":     apiVersion,
+			"description": "Admin API. Requires a logged-in session (cookie; requests other than GET also need the X-CSRF-Token from /api/me) or an access token (X-Token). Every path is also served without /v1 as a legacy alias. Response schemas are the main payload; several GET endpoints wrap it together with stats.",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.components},
+	}
+	if basePath != "" {
+		doc["servers"] = []map[string]any{{"url": basePath}}
+	}
+	return doc
+}
+
+// schemaGen turns Go types into JSON schemas; named structs become components.
+type schemaGen struct {
+	components map[string]any
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string"} // json.RawMessage and []byte
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = map[string]any{} // placeholder against recursion
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{} // any
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	g.fields(t, props)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// fields adds t's JSON fields to props, flattening embedded structs.
+func (g *schemaGen) fields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
+
+// swaggerAsset: GET /docs/swagger-ui/{file}, the locally installed Swagger UI.
+func swaggerAsset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	if !swaggerAssets[name] {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(swaggerAssetsDir, name))
+}
+
+// swaggerPage: GET /docs/swagger
+func swaggerPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	for name := range swaggerAssets {
+		if _, err := os.Stat(filepath.Join(swaggerAssetsDir, name)); err != nil {
+			_, _ = w.Write([]byte(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>tron-signal API</title></head>
+<body>
+<p>Swagger UI is not installed: copy swagger-ui.css and swagger-ui-bundle.js from a pinned
+swagger-ui-dist release into ` + swaggerAssetsDir + `/ on the server.</p>
+<p>The spec itself: <a href="../api/openapi.json">api/openapi.json</a></p>
+</body>
+</html>
+`))
+			return
+		}
+	}
+	// Swagger UI draws its icons from data: URLs, which the default policy blocks
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-inline'")
+	_, _ = w.Write([]byte(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tron-signal API</title>
+<link rel="stylesheet" href="swagger-ui/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="swagger-ui/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "../api/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+}
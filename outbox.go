@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Webhook outbox ----------
+
+// A webhook delivery that still fails after its retries, or that does not fit in
+// the endpoint's queue, is not dropped but parked in data/outbox/<endpoint>.json.
+// Once an endpoint has something parked, newer signals for it queue up behind so
+// order is kept. Every outboxRetry the oldest parked delivery of each endpoint is
+// tried again; when it goes through, the rest follows right away. Parked
+// deliveries survive restarts. GET /api/deliveries shows them, POST
+// /api/deliveries/retry retries now and DELETE /api/deliveries?endpoint= gives up
+// on them. At most outboxMax are kept per endpoint; beyond that the oldest go.
+
+const (
+	outboxMax   = 5000
+	outboxRetry = 30 * time.Second
+)
+
+type OutboxItem struct {
+	ID       string `json:"id"` // delivery id, as sent in X-Tron-Signal-Delivery
+	Endpoint string `json:"endpoint"`
+	Seq      uint64 `json:"seq"`
+	Type     string `json:"type"`
+	Height   int64  `json:"height"`
+	Body     string `json:"body"` // as sent
+	// set when it is not application/json (a template's output)
+	ContentType string `json:"contentType,omitempty"`
+	Queued      string `json:"queued"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+var (
+	outboxMu sync.Mutex
+	outbox   = map[string][]OutboxItem{} // endpoint -> oldest first
+
+	outboxKick = make(chan struct{}, 1)
+)
+
+func outboxPath(endpoint string) string {
+	return filepath.Join(outboxDir, endpoint+".json")
+}
+
+func newOutboxItem(endpoint string, s Signal, body []byte, contentType string) OutboxItem {
+	it := OutboxItem{
+		ID:       endpoint + "-" + strconv.FormatUint(s.Seq, 10),
+		Endpoint: endpoint,
+		Seq:      s.Seq,
+		Type:     s.Type,
+		Height:   s.Height,
+		Body:     string(body),
+		Queued:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if contentType != "application/json" {
+		it.ContentType = contentType
+	}
+	return it
+}
+
+// outboxPending is how many deliveries endpoint has parked.
+func outboxPending(endpoint string) int {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	return len(outbox[endpoint])
+}
+
+// outboxPut parks it behind whatever endpoint already has parked.
+func outboxPut(it OutboxItem) {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	list := append(outbox[it.Endpoint], it)
+	if len(list) > outboxMax {
+		logger.Printf("OUTBOX_FULL endpoint=%s dropped=%s", it.Endpoint, list[0].ID)
+		list = list[1:]
+	}
+	outbox[it.Endpoint] = list
+	saveOutboxLocked(it.Endpoint)
+}
+
+// saveOutboxLocked writes endpoint's parked deliveries, removing the file once
+// there are none. Caller holds outboxMu.
+func saveOutboxLocked(endpoint string) {
+	path := outboxPath(endpoint)
+	list := outbox[endpoint]
+	if len(list) == 0 {
+		delete(outbox, endpoint)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Printf("OUTBOX_SAVE_ERROR endpoint=%s: %v", endpoint, err)
+		}
+		return
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		logger.Printf("OUTBOX_SAVE_ERROR endpoint=%s: %v", endpoint, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Printf("OUTBOX_SAVE_ERROR endpoint=%s: %v", endpoint, err)
+	}
+}
+
+// loadOutbox picks up what the previous run left parked.
+func loadOutbox() {
+	entries, err := os.ReadDir(outboxDir)
+	if err != nil {
+		return
+	}
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	for _, e := range entries {
+		endpoint, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(outboxPath(endpoint))
+		if err != nil {
+			continue
+		}
+		var list []OutboxItem
+		if err := json.Unmarshal(b, &list); err != nil {
+			logger.Printf("OUTBOX_LOAD_ERROR endpoint=%s: %v", endpoint, err)
+			continue
+		}
+		if len(list) > 0 {
+			outbox[endpoint] = list
+			logger.Printf("OUTBOX_LOADED endpoint=%s pending=%d", endpoint, len(list))
+		}
+	}
+}
+
+func outboxLoop() {
+	client := &http.Client{Timeout: webhookTimeout}
+	t := time.NewTicker(outboxRetry)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-outboxKick:
+		}
+		outboxMu.Lock()
+		endpoints := make([]string, 0, len(outbox))
+		for ep := range outbox {
+			endpoints = append(endpoints, ep)
+		}
+		outboxMu.Unlock()
+		for _, ep := range endpoints {
+			drainOutbox(client, ep)
+		}
+	}
+}
+
+// drainOutbox sends endpoint's parked deliveries in order until one fails.
+// Endpoints that were removed or disabled keep theirs until they are deleted.
+func drainOutbox(client *http.Client, endpoint string) {
+	t, ok := webhookTargetByID(endpoint)
+	if !ok {
+		return
+	}
+	for {
+		outboxMu.Lock()
+		if len(outbox[endpoint]) == 0 {
+			outboxMu.Unlock()
+			return
+		}
+		it := outbox[endpoint][0]
+		outboxMu.Unlock()
+
+		start := time.Now()
+		ct := it.ContentType
+		if ct == "" {
+			ct = "application/json"
+		}
+		status, err := postWebhook(client, t, it.ID, ct, []byte(it.Body))
+		it.Attempts++
+
+		outboxMu.Lock()
+		// the head may have been deleted meanwhile
+		if list := outbox[endpoint]; len(list) > 0 && list[0].ID == it.ID {
+			if err != nil {
+				list[0].Attempts, list[0].LastError = it.Attempts, err.Error()
+			} else {
+				outbox[endpoint] = list[1:]
+			}
+			saveOutboxLocked(endpoint)
+		}
+		outboxMu.Unlock()
+
+		d := WebhookDelivery{
+			ID:         it.ID,
+			Endpoint:   endpoint,
+			Seq:        it.Seq,
+			Type:       it.Type,
+			Height:     it.Height,
+			Attempts:   it.Attempts,
+			Status:     status,
+			OK:         err == nil,
+			TimeISO:    start.UTC().Format(time.RFC3339Nano),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			d.Error = err.Error()
+			webhookLog.add(d)
+			return
+		}
+		webhookLog.add(d)
+		logger.Printf("OUTBOX_DELIVERED id=%s attempts=%d", it.ID, it.Attempts)
+	}
+}
+
+// apiDeliveries: GET /api/deliveries?endpoint=&limit= lists parked deliveries,
+// oldest first; DELETE /api/deliveries?endpoint=[&id=] drops them.
+func apiDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	endpoint := q.Get("endpoint")
+	switch r.Method {
+	case "GET":
+		limit := 100
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, outboxMax)
+		}
+		outboxMu.Lock()
+		pending := map[string]int{}
+		var eps []string
+		for ep, list := range outbox {
+			pending[ep] = len(list)
+			if endpoint == "" || ep == endpoint {
+				eps = append(eps, ep)
+			}
+		}
+		sort.Strings(eps)
+		items := []OutboxItem{}
+		for _, ep := range eps {
+			for _, it := range outbox[ep] {
+				if len(items) == limit {
+					break
+				}
+				items = append(items, it)
+			}
+		}
+		outboxMu.Unlock()
+		mustJSON(w, 200, map[string]any{"pending": pending, "items": items})
+	case "DELETE":
+		if endpoint == "" {
+			http.Error(w, "endpoint required", http.StatusBadRequest)
+			return
+		}
+		id := q.Get("id")
+		outboxMu.Lock()
+		list := outbox[endpoint]
+		kept := list[:0:0]
+		for _, it := range list {
+			if id != "" && it.ID != id {
+				kept = append(kept, it)
+			}
+		}
+		removed := len(list) - len(kept)
+		outbox[endpoint] = kept
+		saveOutboxLocked(endpoint)
+		outboxMu.Unlock()
+		logger.Printf("OUTBOX_PURGED endpoint=%s id=%q removed=%d", endpoint, id, removed)
+		mustJSON(w, 200, map[string]any{"ok": true, "removed": removed})
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiRetryDeliveries: POST /api/deliveries/retry retries every endpoint now.
+func apiRetryDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case outboxKick <- struct{}{}:
+	default:
+	}
+	mustJSON(w, 200, map[string]any{"ok": true})
+}
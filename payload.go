@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ---------- Custom signal fields ----------
+
+// Rules.Payload holds static key/values (e.g. {"strategy":"A","weight":2}) merged
+// into every signal this machine emits, so consumers can route on them. Signal keeps
+// them pre-encoded in Extra (a string, so Signal stays comparable for replays) and
+// splices them in when it is marshalled. Keys may not shadow the built-in fields.
+
+const maxPayloadKeys = 16
+
+// signalKeys are the JSON names of Signal's own fields and of the markers added
+// on the way out.
+var signalKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeOf(Signal{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	keys["replay"] = true // added to replayed signals (wsreplay.go)
+	return keys
+}()
+
+func validatePayload(p map[string]any) error {
+	if len(p) > maxPayloadKeys {
+		return fmt.Errorf("payload: at most %d keys", maxPayloadKeys)
+	}
+	for k := range p {
+		if k == "" || len(k) > 64 {
+			return fmt.Errorf("payload: bad key %q", k)
+		}
+		if signalKeys[k] {
+			return fmt.Errorf("payload: key %q is a signal field", k)
+		}
+	}
+	if b, err := json.Marshal(p); err != nil || len(b) > 4096 {
+		return fmt.Errorf("payload: must encode to at most 4 KiB of JSON")
+	}
+	return nil
+}
+
+// encodePayload returns the object for Signal.Extra, "" when there is none.
+func encodePayload(p map[string]any) string {
+	if len(p) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// MarshalJSON writes the signal's fields followed by the Extra ones.
+func (s Signal) MarshalJSON() ([]byte, error) {
+	type plain Signal
+	b, err := json.Marshal(plain(s))
+	if err != nil || len(s.Extra) < 3 {
+		return b, err
+	}
+	out := make([]byte, 0, len(b)+len(s.Extra))
+	out = append(out, b[:len(b)-1]...)
+	out = append(out, ',')
+	out = append(out, s.Extra[1:]...)
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ---------- Webhook body templates ----------
+
+// A webhook endpoint may carry a Go text/template that replaces the default JSON
+// body, so signals can be shaped for a bot directly (TradingView-style alerts,
+// plain text, ...) without a translation proxy in between. The template sees the
+// signal's fields (.Type, .Height, .Seq, ...), .Fields (Rules.Payload) and .Unix
+// (signal time in seconds), plus the funcs json, lower and upper. The result is
+// sent as ContentType, or application/json when it is valid JSON and text/plain
+// otherwise; a secret signs the rendered body. POST /api/webhook/template/preview
+// renders a template against a sample signal.
+
+const maxTemplateSize = 8 << 10
+
+var payloadFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+type payloadData struct {
+	Signal
+	Fields map[string]any
+	Unix   int64
+}
+
+func parsePayloadTemplate(src string) (*template.Template, error) {
+	if len(src) > maxTemplateSize {
+		return nil, fmt.Errorf("template: at most %d bytes", maxTemplateSize)
+	}
+	return template.New("payload").Funcs(payloadFuncs).Option("missingkey=zero").Parse(src)
+}
+
+// renderPayload runs tmpl for s and returns the body and its content type
+// (contentType when set).
+func renderPayload(tmpl *template.Template, contentType string, s Signal) ([]byte, string, error) {
+	d := payloadData{Signal: s}
+	if s.Extra != "" {
+		_ = json.Unmarshal([]byte(s.Extra), &d.Fields)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s.TimeISO); err == nil {
+		d.Unix = t.Unix()
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, d); err != nil {
+		return nil, "", err
+	}
+	out := []byte(b.String())
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+		if json.Valid(out) {
+			contentType = "application/json"
+		}
+	}
+	return out, contentType, nil
+}
+
+// apiPreviewTemplate: POST /api/webhook/template/preview {"template","contentType"}
+func apiPreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Template    string `json:"template"`
+		ContentType string `json:"contentType"`
+	}
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tmpl, err := parsePayloadTemplate(in.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfgMu.RLock()
+	extra := encodePayload(cfg.Rules.Payload)
+	cfgMu.RUnlock()
+	sample := Signal{
+		Type:       "ON",
+		Height:     70000000,
+		BaseHeight: 70000000,
+		State:      "ON",
+		TimeISO:    time.Now().UTC().Format(time.RFC3339Nano),
+		Instance:   instanceName,
+		Seq:        lastSignalSeq() + 1,
+		Severity:   sevNormal,
+		Extra:      extra,
+	}
+	body, ct, err := renderPayload(tmpl, in.ContentType, sample)
+	if err != nil {
+		http.Error(w, "render: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mustJSON(w, 200, map[string]any{"body": string(body), "contentType": ct})
+}
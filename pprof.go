@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// ---------- Profiling ----------
+
+// net/http/pprof is mounted under /debug/pprof/ so CPU and heap profiles can be
+// taken from a running instance when the poller or the WS hub misbehaves. It sits
+// behind the admin login and answers 404 unless config.json has
+// "debug": {"pprof": true}, e.g.
+//
+//	go tool pprof -http=: 'http://host:8080/debug/pprof/heap'   (with the TSID cookie)
+//
+// A CPU profile (/debug/pprof/profile?seconds=30) holds its request open for
+// the whole sampling window.
+
+type DebugConfig struct {
+	Pprof bool `json:"pprof"`
+}
+
+// pprofEnabled gates next on cfg.Debug.Pprof.
+func pprofEnabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfgMu.RLock()
+		on := cfg.Debug.Pprof
+		cfgMu.RUnlock()
+		if !on {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func mountPprof(mux *http.ServeMux) {
+	for path, h := range map[string]http.HandlerFunc{
+		"/debug/pprof/":        pprof.Index, // named profiles: heap, goroutine, block, ...
+		"/debug/pprof/cmdline": pprof.Cmdline,
+		"/debug/pprof/profile": pprof.Profile,
+		"/debug/pprof/symbol":  pprof.Symbol,
+		"/debug/pprof/trace":   pprof.Trace,
+	} {
+		mux.HandleFunc(path, requireLogin(pprofEnabled(h)))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Phone push (ntfy / Gotify) ----------
+
+// Selected signal types and, optionally, incidents are pushed to an ntfy topic
+// (ntfy.sh or self-hosted) or a Gotify server so operators get them on their
+// phones with the stock apps (POST /api/push). Incidents and critical signals
+// go out at high priority, info signals at low. One instance runs one machine, so "per machine" is per instance
+// config; the instance name is in every title.
+
+const (
+	pushQueueSize = 128
+	pushAttempts  = 3
+	pushTimeout   = 10 * time.Second
+)
+
+type PushConfig struct {
+	Provider string `json:"provider"` // "" = disabled | "ntfy" | "gotify"
+	Server   string `json:"server"`   // e.g. https://ntfy.sh, https://gotify.example.com
+	Topic    string `json:"topic,omitempty"`
+	// ntfy access token or Gotify application token
+	Token string `json:"token,omitempty"`
+
+	Types     []string `json:"types,omitempty"` // signal types to push; empty = none
+	Incidents bool     `json:"incidents"`
+	// lowest signal severity pushed; "" = all (see severity.go)
+	MinSeverity string `json:"minSeverity,omitempty"`
+}
+
+func (pc PushConfig) wants(n notice) bool {
+	if pc.Provider == "" {
+		return false
+	}
+	if n.incident != nil {
+		return pc.Incidents
+	}
+	return parseTypes(pc.Types)[n.signal.Type] && severityAtLeast(n.signal.Severity, pc.MinSeverity)
+}
+
+var (
+	pushC = make(chan notice, pushQueueSize)
+
+	pushStatsMu sync.Mutex
+	pushStats   struct {
+		Sent      uint64 `json:"sent"`
+		Failed    uint64 `json:"failed"`
+		Dropped   uint64 `json:"dropped"`
+		LastError string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueuePush(n notice) {
+	select {
+	case pushC <- n:
+	default:
+		pushStatsMu.Lock()
+		pushStats.Dropped++
+		pushStatsMu.Unlock()
+		logger.Printf("PUSH_DROP (queue full)")
+	}
+}
+
+// pushMessage is what either provider gets.
+type pushMessage struct {
+	title    string
+	body     string
+	priority int // 1-5 (ntfy scale)
+	tags     string
+}
+
+func pushMessageFor(n notice) pushMessage {
+	prefix := "tron-signal"
+	if instanceName != "" {
+		prefix += " " + instanceName
+	}
+	if inc := n.incident; inc != nil {
+		return pushMessage{title: prefix + ": " + inc.Kind, body: inc.Detail, priority: 5, tags: "warning"}
+	}
+	s := n.signal
+	priority := 3
+	switch s.Severity {
+	case sevCritical:
+		priority = 5
+	case sevInfo:
+		priority = 2
+	}
+	return pushMessage{
+		title:    fmt.Sprintf("%s: %s @ %d", prefix, s.Type, s.Height),
+		body:     fmt.Sprintf("%s height=%d base=%d state=%s seq=%d", s.Type, s.Height, s.BaseHeight, s.State, s.Seq),
+		priority: priority,
+		tags:     strings.ToLower(s.Type),
+	}
+}
+
+func pushLoop() {
+	client := &http.Client{Timeout: pushTimeout}
+	for n := range pushC {
+		cfgMu.RLock()
+		pc := cfg.Push
+		cfgMu.RUnlock()
+		if !pc.wants(n) {
+			continue
+		}
+		m := pushMessageFor(n)
+		var err error
+		for attempt := 1; attempt <= pushAttempts; attempt++ {
+			if err = sendPush(client, pc, m); err == nil {
+				break
+			}
+			if attempt < pushAttempts {
+				time.Sleep(time.Second * time.Duration(attempt))
+			}
+		}
+
+		pushStatsMu.Lock()
+		if err != nil {
+			pushStats.Failed++
+			pushStats.LastError = err.Error()
+		} else {
+			pushStats.Sent++
+		}
+		pushStatsMu.Unlock()
+		if err != nil {
+			logger.Printf("PUSH_ERROR provider=%s: %v", pc.Provider, err)
+		}
+	}
+}
+
+func sendPush(client *http.Client, pc PushConfig, m pushMessage) error {
+	server := strings.TrimRight(pc.Server, "/")
+	var req *http.Request
+	var err error
+	switch pc.Provider {
+	case "ntfy":
+		req, err = http.NewRequest("POST", server+"/"+url.PathEscape(pc.Topic), strings.NewReader(m.body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Title", m.title)
+		req.Header.Set("Priority", fmt.Sprint(m.priority))
+		req.Header.Set("Tags", m.tags)
+		if pc.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+pc.Token)
+		}
+	default: // gotify
+		// Gotify priorities run 0-10; 8+ is "high" on Android
+		body, _ := json.Marshal(map[string]any{"title": m.title, "message": m.body, "priority": m.priority * 2})
+		req, err = http.NewRequest("POST", server+"/message", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", pc.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	return nil
+}
+
+func validatePush(pc *PushConfig) error {
+	pc.Provider = strings.TrimSpace(pc.Provider)
+	pc.Server = strings.TrimSpace(pc.Server)
+	pc.Topic = strings.TrimSpace(pc.Topic)
+	if pc.Provider == "" {
+		return nil
+	}
+	if pc.Provider == "ntfy" && pc.Server == "" {
+		pc.Server = "https://ntfy.sh"
+	}
+	u, err := url.Parse(pc.Server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("server must be http(s)://host")
+	}
+	switch pc.Provider {
+	case "ntfy":
+		if pc.Topic == "" || strings.ContainsAny(pc.Topic, "/ ") {
+			return fmt.Errorf("ntfy needs a topic (no slashes or spaces)")
+		}
+	case "gotify":
+		if pc.Token == "" {
+			return fmt.Errorf("gotify needs an application token")
+		}
+	default:
+		return fmt.Errorf("provider must be ntfy or gotify")
+	}
+	if err := normalizeSeverity(&pc.MinSeverity); err != nil {
+		return err
+	}
+	types := parseTypes(pc.Types)
+	pc.Types = nil
+	for t := range types {
+		pc.Types = append(pc.Types, t)
+	}
+	sort.Strings(pc.Types)
+	return nil
+}
+
+func apiGetPush(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	pc := cfg.Push
+	cfgMu.RUnlock()
+	if pc.Token != "" {
+		pc.Token = "****"
+	}
+	pushStatsMu.Lock()
+	stats := pushStats
+	pushStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"push": pc, "stats": stats})
+}
+
+func apiSetPush(w http.ResponseWriter, r *http.Request) {
+	var pc PushConfig
+	if err := readJSON(r, &pc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.Push
+	if pc.Token == "****" {
+		pc.Token = prev.Token // unchanged from what GET showed
+	}
+	if err := validatePush(&pc); err != nil {
+		cfgMu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Push = pc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Push = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("PUSH_SET provider=%q types=%v incidents=%v", pc.Provider, pc.Types, pc.Incidents)
+	if pc.Token != "" {
+		pc.Token = "****"
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "push": pc})
+}
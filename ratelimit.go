@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------- Request rate limits ----------
+
+// access.rateLimit.tokenRPM caps the requests per minute of each access token
+// (X-Token / ?token=), ipRPM those of each whitelisted IP without one; 0 leaves
+// it unlimited. Logged-in browser sessions are not limited. Each key gets a token
+// bucket holding a minute's worth, so short bursts pass and a client that keeps
+// going gets 429 with Retry-After instead of starving the API.
+
+type RateLimits struct {
+	TokenRPM int `json:"tokenRPM,omitempty"`
+	IPRPM    int `json:"ipRPM,omitempty"`
+}
+
+const rateIdle = 10 * time.Minute // buckets untouched this long are dropped
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateLimiter = struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}{buckets: map[string]*rateBucket{}}
+
+// rateTake takes one request from key's bucket (rpm per minute) and returns how
+// long to wait when it is empty.
+func rateTake(key string, rpm int, now time.Time) (bool, time.Duration) {
+	rateLimiter.mu.Lock()
+	defer rateLimiter.mu.Unlock()
+	if now.Sub(rateLimiter.swept) > rateIdle {
+		for k, b := range rateLimiter.buckets {
+			if now.Sub(b.last) > rateIdle {
+				delete(rateLimiter.buckets, k)
+			}
+		}
+		rateLimiter.swept = now
+	}
+	b := rateLimiter.buckets[key]
+	if b == nil {
+		b = &rateBucket{tokens: float64(rpm), last: now}
+		rateLimiter.buckets[key] = b
+	}
+	perSec := float64(rpm) / 60
+	b.tokens = math.Min(float64(rpm), b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+}
+
+// rateKey names the limit r falls under, if any.
+func rateKey(r *http.Request, rl RateLimits, whitelist []string) (string, int) {
+	if rl.TokenRPM > 0 {
+		if tok, ok := tokenOK(r); ok {
+			return "token:" + tok, rl.TokenRPM
+		}
+	}
+	if rl.IPRPM > 0 && ipAllowed(r.RemoteAddr, whitelist) {
+		return "ip:" + remoteIP(r), rl.IPRPM
+	}
+	return "", 0
+}
+
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfgMu.RLock()
+		rl := cfg.Access.RateLimit
+		whitelist := append([]string(nil), cfg.Access.IPWhitelist...)
+		cfgMu.RUnlock()
+		key, rpm := rateKey(r, rl, whitelist)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := rateTake(key, rpm, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------- Rules change history ----------
+
+// Every change to cfg.Rules (rules form, templates, import, judge, shadow,
+// enable/disable) is appended to data/rules-history.jsonl with who made it and the
+// rules before and after; runtime resets are recorded there too, with no changed
+// fields. The file is append-only; nothing prunes or rewrites it.
+
+const rulesHistoryPath = "data/rules-history.jsonl"
+
+type RulesChange struct {
+	Time    string   `json:"time"`
+	User    string   `json:"user"`
+	Action  string   `json:"action"`  // "rules", "judge", "shadow", "enable", "import", "template:<name>", ...
+	Changed []string `json:"changed"` // top-level rule fields that differ
+	Old     Rules    `json:"old"`
+	New     Rules    `json:"new"`
+}
+
+var rulesAuditMu sync.Mutex
+
+// requestUser names the logged-in user behind r.
+func requestUser(r *http.Request) string {
+	return sessionName(sessionCookie(r))
+}
+
+// changedRuleFields lists the JSON keys whose values differ between a and b.
+func changedRuleFields(a, b Rules) []string {
+	var ma, mb map[string]json.RawMessage
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	_ = json.Unmarshal(ja, &ma)
+	_ = json.Unmarshal(jb, &mb)
+	out := []string{}
+	for k, v := range mb {
+		if !bytes.Equal(ma[k], v) {
+			out = append(out, k)
+		}
+	}
+	for k := range ma {
+		if _, ok := mb[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// auditRules appends one change; no-op changes are skipped.
+func auditRules(r *http.Request, action string, old, new Rules) {
+	changed := changedRuleFields(old, new)
+	if len(changed) == 0 {
+		return
+	}
+	writeRulesChange(r, action, changed, old, new)
+}
+
+// auditMachine records an operator action on the machine that leaves the rules
+// as they are (e.g. a runtime reset).
+func auditMachine(r *http.Request, action string) {
+	cfgMu.RLock()
+	cur := cfg.Rules
+	cfgMu.RUnlock()
+	writeRulesChange(r, action, []string{}, cur, cur)
+}
+
+func writeRulesChange(r *http.Request, action string, changed []string, old, new Rules) {
+	line, err := json.Marshal(RulesChange{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		User:    requestUser(r),
+		Action:  action,
+		Changed: changed,
+		Old:     old,
+		New:     new,
+	})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	rulesAuditMu.Lock()
+	defer rulesAuditMu.Unlock()
+	f, err := os.OpenFile(rulesHistoryPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		logger.Printf("RULES_HISTORY_ERROR: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		logger.Printf("RULES_HISTORY_ERROR: %v", err)
+	}
+}
+
+// apiRulesHistory returns the latest ?limit= changes (default 50), newest first.
+func apiRulesHistory(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 1000)
+
+	rulesAuditMu.Lock()
+	defer rulesAuditMu.Unlock()
+	f, err := os.Open(rulesHistoryPath)
+	if os.IsNotExist(err) {
+		mustJSON(w, 200, map[string]any{"changes": []RulesChange{}})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	var all []RulesChange
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var c RulesChange
+		if json.Unmarshal(sc.Bytes(), &c) == nil {
+			all = append(all, c)
+		}
+		if len(all) > 2*limit {
+			all = append(all[:0], all[len(all)-limit:]...)
+		}
+	}
+	if len(all) > limit {
+		all = all[len(all)-limit:]
+	}
+	out := make([]RulesChange, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		out = append(out, all[i])
+	}
+	mustJSON(w, 200, map[string]any{"changes": out})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Rules export / import ----------
+
+// The live rules plus all templates as one bundle, to back up a setup or move it to
+// another deployment. JSON is lossless; CSV has one row per rule set (the live rules
+// are the row with an empty name) and leaves out the schedule (importing one keeps
+// the live schedule). The judge is never part of a bundle.
+
+const rulesBundleVersion = 1
+
+// import name collisions (?conflict=)
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+type RulesBundle struct {
+	Version   int            `json:"version"`
+	Instance  string         `json:"instance,omitempty"`
+	Exported  string         `json:"exported,omitempty"`
+	Rules     *Rules         `json:"rules,omitempty"` // nil on import: keep the live rules
+	Templates []ruleTemplate `json:"templates"`
+}
+
+var rulesCSVHeader = []string{
+	"name",
+	"on_enabled", "on_threshold", "off_enabled", "off_threshold",
+	"hit_enabled", "hit_expect", "hit_offset", "hit_window", "hit_match", "hit_extra", "hit_miss_alarm",
+	"limit_day", "limit_hour", "sequence", "alternation",
+	"count_mode", "count_window", "count_decay",
+	"on_mode", "on_max", "off_mode", "off_max",
+}
+
+func rulesCSVRow(name string, rr Rules) []string {
+	seq := ""
+	if rr.Sequence.Enabled {
+		seq = rr.Sequence.Pattern
+	}
+	alt := 0
+	if rr.Alternation.Enabled {
+		alt = rr.Alternation.Length
+	}
+	return []string{
+		name,
+		strconv.FormatBool(rr.On.Enabled), strconv.Itoa(rr.On.Threshold),
+		strconv.FormatBool(rr.Off.Enabled), strconv.Itoa(rr.Off.Threshold),
+		strconv.FormatBool(rr.Hit.Enabled), rr.Hit.Expect, strconv.Itoa(rr.Hit.Offset),
+		strconv.Itoa(rr.Hit.Window), rr.Hit.Match, encodeHitChecks(rr.Hit.Extra), strconv.Itoa(rr.Hit.MissAlarm),
+		strconv.Itoa(rr.Limits.PerDay), strconv.Itoa(rr.Limits.PerHour),
+		seq, strconv.Itoa(alt),
+		rr.Counting.Mode, strconv.Itoa(rr.Counting.Window), strconv.Itoa(rr.Counting.Decay),
+		rr.On.Mode, strconv.Itoa(rr.On.Max), rr.Off.Mode, strconv.Itoa(rr.Off.Max),
+	}
+}
+
+// parseRulesCSV reads rows written by rulesCSVRow (columns matched by header name).
+func parseRulesCSV(rd io.Reader) (RulesBundle, error) {
+	in := RulesBundle{Version: rulesBundleVersion}
+	cr := csv.NewReader(rd)
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return in, err
+	}
+	if len(rows) == 0 {
+		return in, fmt.Errorf("empty csv")
+	}
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := col["name"]; !ok {
+		return in, fmt.Errorf("csv: missing name column")
+	}
+	for n, row := range rows[1:] {
+		get := func(k string) string {
+			if i, ok := col[k]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		var bad error
+		atoi := func(k string) int {
+			v := get(k)
+			if v == "" {
+				return 0
+			}
+			x, err := strconv.Atoi(v)
+			if err != nil && bad == nil {
+				bad = fmt.Errorf("csv row %d: bad %s %q", n+2, k, v)
+			}
+			return x
+		}
+		flag := func(k string) bool {
+			v := get(k)
+			if v == "" {
+				return false
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil && bad == nil {
+				bad = fmt.Errorf("csv row %d: bad %s %q", n+2, k, v)
+			}
+			return b
+		}
+
+		var rr Rules
+		rr.On = ThresholdRule{Enabled: flag("on_enabled"), Threshold: atoi("on_threshold"), Mode: get("on_mode"), Max: atoi("on_max")}
+		rr.Off = ThresholdRule{Enabled: flag("off_enabled"), Threshold: atoi("off_threshold"), Mode: get("off_mode"), Max: atoi("off_max")}
+		rr.Hit = HitRule{
+			Enabled:   flag("hit_enabled"),
+			Expect:    get("hit_expect"),
+			Offset:    atoi("hit_offset"),
+			Window:    atoi("hit_window"),
+			Match:     get("hit_match"),
+			MissAlarm: atoi("hit_miss_alarm"),
+		}
+		for _, p := range strings.Split(get("hit_extra"), ",") {
+			off, expect, ok := strings.Cut(strings.TrimSpace(p), ":")
+			if !ok {
+				continue
+			}
+			x, err := strconv.Atoi(off)
+			if err != nil {
+				return in, fmt.Errorf("csv row %d: bad hit_extra %q", n+2, p)
+			}
+			rr.Hit.Extra = append(rr.Hit.Extra, HitCheck{Offset: x, Expect: expect})
+		}
+		rr.Limits = TriggerLimits{PerDay: atoi("limit_day"), PerHour: atoi("limit_hour")}
+		if seq := get("sequence"); seq != "" {
+			rr.Sequence = SequenceRule{Enabled: true, Pattern: seq}
+		}
+		if n := atoi("alternation"); n > 0 {
+			rr.Alternation = AlternationRule{Enabled: true, Length: n}
+		}
+		rr.Counting = CountingRule{Mode: get("count_mode"), Window: atoi("count_window"), Decay: atoi("count_decay")}
+		if bad != nil {
+			return in, bad
+		}
+
+		if name := get("name"); name == "" {
+			live := rr
+			in.Rules = &live
+		} else {
+			in.Templates = append(in.Templates, ruleTemplate{Name: name, Rules: rr})
+		}
+	}
+	return in, nil
+}
+
+// apiRulesExport returns the bundle as JSON, or as CSV with ?format=csv.
+func apiRulesExport(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	live := cfg.Rules
+	tpls := make([]ruleTemplate, 0, len(cfg.RuleTemplates))
+	for name, rr := range cfg.RuleTemplates {
+		tpls = append(tpls, ruleTemplate{Name: name, Rules: rr})
+	}
+	cfgMu.RUnlock()
+	sort.Slice(tpls, func(i, j int) bool { return tpls[i].Name < tpls[j].Name })
+	live.Judge, live.Shadow, live.Disabled = JudgeRule{}, nil, false
+
+	logger.Printf("RULES_EXPORT templates=%d format=%s", len(tpls), r.URL.Query().Get("format"))
+
+	if strings.EqualFold(r.URL.Query().Get("format"), "csv") {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="tron-signal-rules.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write(rulesCSVHeader)
+		_ = cw.Write(rulesCSVRow("", live))
+		for _, t := range tpls {
+			_ = cw.Write(rulesCSVRow(t.Name, t.Rules))
+		}
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="tron-signal-rules.json"`)
+	mustJSON(w, 200, RulesBundle{
+		Version:   rulesBundleVersion,
+		Instance:  instanceName,
+		Exported:  time.Now().UTC().Format(time.RFC3339),
+		Rules:     &live,
+		Templates: tpls,
+	})
+}
+
+// renameTemplate returns the first free "name-N" (kept within the name limit).
+func renameTemplate(name string, taken map[string]Rules) string {
+	for n := 2; ; n++ {
+		suffix := "-" + strconv.Itoa(n)
+		base := name
+		if len(base)+len(suffix) > 32 {
+			base = base[:32-len(suffix)]
+		}
+		if _, ok := taken[base+suffix]; !ok {
+			return base + suffix
+		}
+	}
+}
+
+// apiRulesImport merges the bundle's templates and, when it has them, replaces the
+// live rules. A template whose name exists is handled per ?conflict= (skip by default,
+// overwrite or rename). Body is JSON, or CSV when sent as text/csv.
+func apiRulesImport(w http.ResponseWriter, r *http.Request) {
+	conflict := strings.ToLower(r.URL.Query().Get("conflict"))
+	if conflict == "" {
+		conflict = conflictSkip
+	}
+	if conflict != conflictSkip && conflict != conflictOverwrite && conflict != conflictRename {
+		http.Error(w, "bad conflict (want skip, overwrite or rename)", http.StatusBadRequest)
+		return
+	}
+
+	var in RulesBundle
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		b, err := parseRulesCSV(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad csv: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		in = b
+		if in.Rules != nil {
+			// csv has no schedule column: keep the live one
+			cfgMu.RLock()
+			in.Rules.Schedule = cfg.Rules.Schedule
+			cfgMu.RUnlock()
+		}
+	} else if err := readJSON(r, &in); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if in.Version != rulesBundleVersion {
+		http.Error(w, fmt.Sprintf("unsupported bundle version %d", in.Version), http.StatusBadRequest)
+		return
+	}
+
+	// validate everything before touching config
+	for i := range in.Templates {
+		t := &in.Templates[i]
+		t.Name = strings.TrimSpace(t.Name)
+		if !scriptNameRe.MatchString(t.Name) {
+			http.Error(w, fmt.Sprintf("bad template name %q", t.Name), http.StatusBadRequest)
+			return
+		}
+		t.Rules.Judge, t.Rules.Shadow, t.Rules.Disabled = JudgeRule{}, nil, false
+		if err := normalizeRules(&t.Rules); err != nil {
+			http.Error(w, "template "+t.Name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if in.Rules != nil {
+		if err := normalizeRules(in.Rules); err != nil {
+			http.Error(w, "rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		added   = []string{}
+		skipped = []string{}
+	)
+	cfgMu.Lock()
+	prev := cfg.RuleTemplates
+	next := make(map[string]Rules, len(prev)+len(in.Templates))
+	for k, v := range prev {
+		next[k] = v
+	}
+	for _, t := range in.Templates {
+		name := t.Name
+		if _, exists := next[name]; exists {
+			switch conflict {
+			case conflictSkip:
+				skipped = append(skipped, name)
+				continue
+			case conflictRename:
+				name = renameTemplate(name, next)
+			}
+		}
+		next[name] = t.Rules
+		added = append(added, name)
+	}
+	if len(next) > maxRuleTemplates {
+		cfgMu.Unlock()
+		http.Error(w, fmt.Sprintf("too many templates (max %d)", maxRuleTemplates), http.StatusBadRequest)
+		return
+	}
+	cfg.RuleTemplates = next
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.RuleTemplates = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	out := map[string]any{"ok": true, "templates": added, "skipped": skipped}
+	if in.Rules != nil {
+		rr, err := storeRules(r, "import", *in.Rules)
+		if err != nil {
+			writeSaveError(w, err)
+			return
+		}
+		out["rules"] = rr
+	}
+	logger.Printf("RULES_IMPORT templates=%d skipped=%d rules=%v", len(added), len(skipped), in.Rules != nil)
+	mustJSON(w, 200, out)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Active hours ----------
+
+// Rules.Schedule limits the machine to time windows (Beijing time). Outside every
+// window the machine neither counts nor triggers; a HIT already armed still resolves.
+// Like the trigger caps it follows block time, so replays and backtests agree.
+
+type Schedule struct {
+	Windows []ActiveWindow `json:"windows,omitempty"` // empty = always active
+}
+
+type ActiveWindow struct {
+	From string `json:"from"` // "HH:MM", UTC+8
+	To   string `json:"to"`   // "HH:MM", exclusive; To <= From wraps past midnight
+	// Days the window starts on: "" (every day), "weekdays", "weekends" or a list
+	// like "1,3,5" (0 = Sunday)
+	Days string `json:"days,omitempty"`
+}
+
+func parseHHMM(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hh < 0 || hh > 23 || mm < 0 || mm > 59 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// parseDays returns a weekday bitmask (bit 0 = Sunday).
+func parseDays(s string) (uint8, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return 0x7f, nil
+	case "weekdays":
+		return 0x3e, nil
+	case "weekends":
+		return 0x41, nil
+	}
+	var mask uint8
+	for _, p := range strings.Split(s, ",") {
+		d, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || d < 0 || d > 6 {
+			return 0, fmt.Errorf("bad days %q, want weekdays, weekends or 0-6 list", s)
+		}
+		mask |= 1 << d
+	}
+	return mask, nil
+}
+
+// normalize validates the windows and rewrites times as HH:MM.
+func (sc *Schedule) normalize() error {
+	if len(sc.Windows) > 16 {
+		return fmt.Errorf("schedule: at most 16 windows")
+	}
+	for i := range sc.Windows {
+		w := &sc.Windows[i]
+		from, err := parseHHMM(w.From)
+		if err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		to, err := parseHHMM(w.To)
+		if err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		if _, err := parseDays(w.Days); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		w.From = fmt.Sprintf("%02d:%02d", from/60, from%60)
+		w.To = fmt.Sprintf("%02d:%02d", to/60, to%60)
+		w.Days = strings.ToLower(strings.ReplaceAll(w.Days, " ", ""))
+	}
+	return nil
+}
+
+// active reports whether t falls inside any window. Invalid windows never match.
+func (sc Schedule) active(t time.Time) bool {
+	if len(sc.Windows) == 0 {
+		return true
+	}
+	bt := t.In(beijing)
+	now := bt.Hour()*60 + bt.Minute()
+	today := bt.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range sc.Windows {
+		from, err1 := parseHHMM(w.From)
+		to, err2 := parseHHMM(w.To)
+		days, err3 := parseDays(w.Days)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		if from < to {
+			if days&(1<<today) != 0 && now >= from && now < to {
+				return true
+			}
+			continue
+		}
+		// wraps midnight: the evening part belongs to today, the morning part to yesterday's window
+		if days&(1<<today) != 0 && now >= from {
+			return true
+		}
+		if days&(1<<yesterday) != 0 && now < to {
+			return true
+		}
+	}
+	return false
+}
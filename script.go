@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Judge scripts ----------
+
+/*
+	判定脚本（judge "script"）
+	- 使用与 expr 相同的表达式语言（纯标准库，不嵌入 Lua/JS），按行执行：
+	    # 注释
+	    d = lastDigit
+	    big = d >= 5
+	    return big ? "ON" : "OFF"
+	- 输入：整块（hash/height/time 及 expr 的派生变量），输入变量只读
+	- 隔离：步数预算 + 超时 + 字符串长度上限 + recover，出错的块按“无法判定”丢弃，不影响主流程
+	- 版本：POST /api/judge/scripts 每次上传生成新版本；切换规则时钉住版本并把源码写入规则快照
+*/
+
+const (
+	scriptTimeout     = 20 * time.Millisecond
+	scriptStepBudget  = 20000
+	maxScriptLen      = 8192
+	maxScripts        = 20
+	maxScriptVersions = 20
+	scriptCacheSize   = 16 // compiled scripts kept; sources run up to maxScriptLen
+)
+
+type ScriptVersion struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+	Created string `json:"created"`
+}
+
+type scriptStmt struct {
+	assign string // "" = return
+	expr   exprNode
+}
+
+var (
+	scriptCache   = newCompileCache(scriptCacheSize) // source -> []scriptStmt
+	scriptNameRe  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	scriptAssignR = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=([^=].*)$`)
+)
+
+func init() {
+	registerJudge(judgeImpl{
+		name: judgeScript,
+		desc: "uploaded, versioned script (pinned at switch time)",
+		judge: func(j JudgeRule, b Block) (string, bool) {
+			state, err := runJudgeScript(j.Source, b)
+			if err != nil {
+				return "", false
+			}
+			return state, true
+		},
+		normalize: func(j *JudgeRule) error {
+			version, src, err := resolveScript(j.Script, j.Version)
+			if err != nil {
+				return err
+			}
+			*j = JudgeRule{Type: judgeScript, Script: j.Script, Version: version, Source: src}
+			_, err = runJudgeScript(src, judgeSampleBlock)
+			return err
+		},
+	})
+}
+
+func compileScript(src string) ([]scriptStmt, error) {
+	if v, ok := scriptCache.Load(src); ok {
+		return v.([]scriptStmt), nil
+	}
+	if len(src) > maxScriptLen {
+		return nil, fmt.Errorf("script longer than %d bytes", maxScriptLen)
+	}
+
+	inputs := blockEnv(judgeSampleBlock)
+	var stmts []scriptStmt
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		st := scriptStmt{}
+		body := line
+		if rest, ok := strings.CutPrefix(line, "return "); ok {
+			body = rest
+		} else if m := scriptAssignR.FindStringSubmatch(line); m != nil {
+			if _, isInput := inputs[m[1]]; isInput {
+				return nil, fmt.Errorf("line %d: %s is a read-only input", i+1, m[1])
+			}
+			st.assign, body = m[1], m[2]
+		} else {
+			return nil, fmt.Errorf("line %d: want `name = expr` or `return expr`", i+1)
+		}
+		n, err := compileExpr(strings.TrimSpace(body))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		st.expr = n
+		stmts = append(stmts, st)
+	}
+	if len(stmts) == 0 || stmts[len(stmts)-1].assign != "" {
+		return nil, errors.New("script must end with `return expr`")
+	}
+	scriptCache.Store(src, stmts)
+	return stmts, nil
+}
+
+// runJudgeScript executes src against b in isolation (budget, timeout, recover).
+func runJudgeScript(src string, b Block) (state string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			state, err = "", fmt.Errorf("script panic: %v", r)
+		}
+	}()
+
+	stmts, err := compileScript(src)
+	if err != nil {
+		return "", err
+	}
+	c := &exprCtx{
+		vars:     blockEnv(b),
+		budget:   scriptStepBudget,
+		deadline: time.Now().Add(scriptTimeout),
+	}
+	for _, st := range stmts {
+		v, err := st.expr.eval(c)
+		if err != nil {
+			return "", err
+		}
+		if st.assign == "" {
+			return exprState(v)
+		}
+		c.vars[st.assign] = v
+	}
+	return "", errors.New("script returned nothing")
+}
+
+// resolveScript returns the pinned version and source of a stored script (version 0 = latest).
+func resolveScript(name string, version int) (int, string, error) {
+	cfgMu.RLock()
+	vs := cfg.JudgeScripts[name]
+	cfgMu.RUnlock()
+	if len(vs) == 0 {
+		return 0, "", fmt.Errorf("script %q not found", name)
+	}
+	if version == 0 {
+		last := vs[len(vs)-1]
+		return last.Version, last.Source, nil
+	}
+	for _, v := range vs {
+		if v.Version == version {
+			return v.Version, v.Source, nil
+		}
+	}
+	return 0, "", fmt.Errorf("script %q has no version %d", name, version)
+}
+
+// apiGetScripts lists scripts, or returns one version's source with ?name=&version=.
+func apiGetScripts(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("name"); name != "" {
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+		v, src, err := resolveScript(name, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		mustJSON(w, 200, map[string]any{"name": name, "version": v, "source": src})
+		return
+	}
+
+	type scriptInfo struct {
+		Name     string `json:"name"`
+		Latest   int    `json:"latest"`
+		Versions []int  `json:"versions"`
+		Updated  string `json:"updated"`
+	}
+	cfgMu.RLock()
+	out := make([]scriptInfo, 0, len(cfg.JudgeScripts))
+	for name, vs := range cfg.JudgeScripts {
+		if len(vs) == 0 {
+			continue
+		}
+		si := scriptInfo{Name: name, Latest: vs[len(vs)-1].Version, Updated: vs[len(vs)-1].Created}
+		for _, v := range vs {
+			si.Versions = append(si.Versions, v.Version)
+		}
+		out = append(out, si)
+	}
+	cfgMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	mustJSON(w, 200, map[string]any{"scripts": out})
+}
+
+// apiUploadScript validates the source and stores it as the next version.
+func apiUploadScript(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		Source string `json:"source"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !scriptNameRe.MatchString(req.Name) {
+		http.Error(w, "bad name (want [A-Za-z0-9_-], max 32)", http.StatusBadRequest)
+		return
+	}
+	if _, err := compileScript(req.Source); err != nil {
+		http.Error(w, "compile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := runJudgeScript(req.Source, judgeSampleBlock); err != nil {
+		http.Error(w, "sample run: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.JudgeScripts
+	vs := prev[req.Name]
+	if vs == nil && len(prev) >= maxScripts {
+		cfgMu.Unlock()
+		http.Error(w, fmt.Sprintf("at most %d scripts", maxScripts), http.StatusBadRequest)
+		return
+	}
+	next := 1
+	if len(vs) > 0 {
+		next = vs[len(vs)-1].Version + 1
+	}
+	nvs := append(append([]ScriptVersion(nil), vs...), ScriptVersion{
+		Version: next,
+		Source:  req.Source,
+		Created: time.Now().UTC().Format(time.RFC3339),
+	})
+	if len(nvs) > maxScriptVersions {
+		nvs = nvs[len(nvs)-maxScriptVersions:]
+	}
+	scripts := make(map[string][]ScriptVersion, len(prev)+1)
+	for k, v := range prev {
+		scripts[k] = v
+	}
+	scripts[req.Name] = nvs
+	cfg.JudgeScripts = scripts
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.JudgeScripts = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("JUDGE_SCRIPT_UPLOADED name=%s version=%d size=%d", req.Name, next, len(req.Source))
+	mustJSON(w, 200, map[string]any{"ok": true, "name": req.Name, "version": next})
+}
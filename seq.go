@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ---------- Signal sequence numbers ----------
+
+// Every signal sent to /ws and the webhook carries "seq", one more than the
+// previous one. The counter continues across restarts (it picks up from the
+// signal history at boot), so a client that sees a jump knows it missed signals
+// and can fetch them with /api/signals?afterSeq=N. Simulated signals have no seq.
+
+var signalSeq struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// sendSignal numbers s, stores it and broadcasts it, in that order and under one
+// lock so clients never see seqs out of order. It reports false, sending nothing,
+// when s duplicates an earlier signal (see signaldedup.go).
+func sendSignal(s Signal) (Signal, bool) {
+	signalSeq.mu.Lock()
+	defer signalSeq.mu.Unlock()
+	if !firstSignalLocked(s) {
+		duplicatesDropped.Add(1)
+		logger.Printf("SIGNAL_DUPLICATE type=%s height=%d base=%d", s.Type, s.Height, s.BaseHeight)
+		return s, false
+	}
+	signalSeq.last++
+	s.Seq = signalSeq.last
+	signalLog.append(s)
+	broadcastSignal(s)
+	wakeSignalWaiters()
+	return s, true
+}
+
+func lastSignalSeq() uint64 {
+	signalSeq.mu.Lock()
+	defer signalSeq.mu.Unlock()
+	return signalSeq.last
+}
+
+// loadSignalSeq resumes the counter from the newest day file that has one.
+func loadSignalSeq() {
+	entries, err := os.ReadDir(signalDir)
+	if err != nil {
+		return
+	}
+	var days []string
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, ".jsonl") {
+			days = append(days, strings.TrimSuffix(name, ".jsonl"))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	for _, d := range days {
+		if n := maxSeqIn(signalPath(d)); n > 0 {
+			signalSeq.mu.Lock()
+			signalSeq.last = n
+			signalSeq.mu.Unlock()
+			logger.Printf("SIGNAL_SEQ_RESUMED seq=%d", n)
+			return
+		}
+	}
+}
+
+func maxSeqIn(path string) uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var n uint64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var s Signal
+		if json.Unmarshal(sc.Bytes(), &s) == nil && s.Seq > 0 {
+			n = max(n, s.Seq)
+			// seeds the dedup guard; only used at boot, before any sendSignal
+			firstSignalLocked(s)
+		}
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ---------- Sequence trigger ----------
+
+// Rules.Sequence fires a SEQ signal when the most recent judged states match a
+// pattern such as "ON,OFF,ON,ON" ("*" = either). It runs next to the threshold
+// counters: the reverse gate doesn't apply, but schedule and trigger caps do, and a
+// match arms the HIT check like any trigger. The window is part of machineState
+// (RuntimeState.SeqHistory) so replays see the same matches.
+
+const seqMaxLen = 16
+
+type SequenceRule struct {
+	Enabled bool   `json:"enabled"`
+	Pattern string `json:"pattern,omitempty"` // comma separated ON/OFF/*, 2-16 entries
+}
+
+// seqCode compresses a state or pattern entry to one char: '1' ON, '0' OFF, '*' any.
+func seqCode(s string) (byte, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "ON":
+		return '1', true
+	case "OFF":
+		return '0', true
+	case "*":
+		return '*', true
+	}
+	return 0, false
+}
+
+// compileSequence turns "ON,OFF,*" into "10*".
+func compileSequence(pattern string) (string, error) {
+	parts := strings.Split(pattern, ",")
+	if len(parts) < 2 || len(parts) > seqMaxLen {
+		return "", fmt.Errorf("sequence: pattern needs 2-%d entries", seqMaxLen)
+	}
+	code := make([]byte, len(parts))
+	for i, p := range parts {
+		c, ok := seqCode(p)
+		if !ok {
+			return "", fmt.Errorf("sequence: bad entry %q, want ON, OFF or *", strings.TrimSpace(p))
+		}
+		code[i] = c
+	}
+	return string(code), nil
+}
+
+func (r *SequenceRule) normalize() error {
+	if !r.Enabled && strings.TrimSpace(r.Pattern) == "" {
+		r.Pattern = ""
+		return nil
+	}
+	code, err := compileSequence(r.Pattern)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(code))
+	for i := range code {
+		switch code[i] {
+		case '1':
+			names[i] = "ON"
+		case '0':
+			names[i] = "OFF"
+		default:
+			names[i] = "*"
+		}
+	}
+	r.Pattern = strings.Join(names, ",")
+	return nil
+}
+
+// pushSeq appends a judged ON/OFF state to the window and reports whether the
+// configured pattern now matches its tail. A match clears the window.
+func (s *RuntimeState) pushSeq(state string, r SequenceRule) bool {
+	if !r.Enabled {
+		s.SeqHistory = ""
+		return false
+	}
+	code, err := compileSequence(r.Pattern)
+	if err != nil {
+		return false
+	}
+	c, _ := seqCode(state)
+	h := s.SeqHistory + string(c)
+	if len(h) > len(code) {
+		h = h[len(h)-len(code):]
+	}
+	s.SeqHistory = h
+	if len(h) < len(code) {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] != '*' && code[i] != h[i] {
+			return false
+		}
+	}
+	s.SeqHistory = ""
+	return true
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------- Login sessions ----------
+
+// Login sessions are kept in data/sessions.json (0600) as well as in memory, so
+// a restart or deploy does not log everyone out. The file holds only the
+// SHA-256 of each session id, like the access tokens. A session lasts
+// web.sessionHours from login (default a week); expired ones are refused, swept
+// every sessionSweepEvery and dropped when the file is loaded at startup. The
+// cookie carries the same lifetime.
+//
+// The cookie's attributes come from web.cookie: secure "auto" (default: when
+// the request came over TLS, directly or per X-Forwarded-Proto from a proxy),
+// "always" or "never"; sameSite "lax" (default), "strict" or "none" (needs
+// secure); and an optional domain to share it with subdomains.
+
+const (
+	sessionsPath      = "data/sessions.json"
+	sessionSweepEvery = 10 * time.Minute
+)
+
+const defaultSessionHours = 7 * 24
+
+type CookieConfig struct {
+	Secure   string `json:"secure,omitempty"`   // auto | always | never
+	SameSite string `json:"sameSite,omitempty"` // lax | strict | none
+	Domain   string `json:"domain,omitempty"`
+}
+
+func checkCookieConfig(c CookieConfig) error {
+	switch c.Secure {
+	case "", "auto", "always", "never":
+	default:
+		return fmt.Errorf("web.cookie.secure must be auto, always or never, not %q", c.Secure)
+	}
+	switch c.SameSite {
+	case "", "lax", "strict":
+	case "none":
+		if c.Secure == "never" {
+			return fmt.Errorf("web.cookie.sameSite none needs a secure cookie")
+		}
+	default:
+		return fmt.Errorf("web.cookie.sameSite must be lax, strict or none, not %q", c.SameSite)
+	}
+	if strings.ContainsAny(c.Domain, " ;,/") {
+		return fmt.Errorf("web.cookie.domain %q is not a domain", c.Domain)
+	}
+	return nil
+}
+
+// newSessionCookie is the TSID cookie for r holding value; maxAge < 0 deletes it.
+func newSessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	cfgMu.RLock()
+	cc := cfg.Web.Cookie
+	cfgMu.RUnlock()
+	c := &http.Cookie{
+		Name:     "TSID",
+		Value:    value,
+		Path:     appPath("/"),
+		Domain:   cc.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch cc.Secure {
+	case "always":
+		c.Secure = true
+	case "never":
+	default:
+		c.Secure = r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	}
+	switch cc.SameSite {
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite, c.Secure = http.SameSiteNoneMode, true
+	}
+	return c
+}
+
+type webSession struct {
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func sessionKey(sid string) string {
+	return sha256Hex(sid)
+}
+
+func sessionTTL() time.Duration {
+	cfgMu.RLock()
+	h := cfg.Web.SessionHours
+	cfgMu.RUnlock()
+	if h <= 0 {
+		h = defaultSessionHours
+	}
+	return time.Duration(h) * time.Hour
+}
+
+// saveSessionsLocked writes the sessions file; caller holds sessMu.
+func saveSessionsLocked() {
+	b, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(sessionsPath, b, 0o600); err != nil {
+		logger.Printf("SESSIONS_SAVE_ERROR: %v", err)
+	}
+}
+
+// sweepSessionsLocked drops expired sessions and reports whether any were;
+// caller holds sessMu.
+func sweepSessionsLocked(now time.Time) bool {
+	swept := false
+	for k, s := range sessions {
+		if !now.Before(s.ExpiresAt) {
+			delete(sessions, k)
+			swept = true
+		}
+	}
+	return swept
+}
+
+// loadSessions restores the sessions of the previous run.
+func loadSessions() {
+	b, err := os.ReadFile(sessionsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("SESSIONS_LOAD_ERROR: %v", err)
+		}
+		return
+	}
+	loaded := map[string]webSession{}
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		logger.Printf("SESSIONS_LOAD_ERROR: %v", err)
+		return
+	}
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	sessions = loaded
+	if sweepSessionsLocked(time.Now()) {
+		saveSessionsLocked()
+	}
+	logger.Printf("SESSIONS_LOADED count=%d", len(sessions))
+}
+
+func sessionLoop() {
+	for now := range time.Tick(sessionSweepEvery) {
+		sessMu.Lock()
+		if sweepSessionsLocked(now) {
+			saveSessionsLocked()
+		}
+		sessMu.Unlock()
+	}
+}
+
+// newSession logs user in and returns the session id for the cookie.
+func newSession(user string) (string, time.Duration, error) {
+	sid, err := randHex(24)
+	if err != nil {
+		return "", 0, err
+	}
+	ttl := sessionTTL()
+	now := time.Now()
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	sessions[sessionKey(sid)] = webSession{User: user, CreatedAt: now.UTC(), ExpiresAt: now.Add(ttl).UTC()}
+	saveSessionsLocked()
+	return sid, ttl, nil
+}
+
+// sessionName is the account of a live session, "" if there is none.
+func sessionName(sid string) string {
+	if sid == "" {
+		return ""
+	}
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	k := sessionKey(sid)
+	s, ok := sessions[k]
+	if !ok {
+		return ""
+	}
+	if !time.Now().Before(s.ExpiresAt) {
+		delete(sessions, k)
+		saveSessionsLocked()
+		return ""
+	}
+	return s.User
+}
+
+func endSession(sid string) {
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	if _, ok := sessions[sessionKey(sid)]; ok {
+		delete(sessions, sessionKey(sid))
+		saveSessionsLocked()
+	}
+}
+
+// dropSessions ends name's sessions except the one with id keep.
+func dropSessions(name, keep string) {
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	keepKey := ""
+	if keep != "" {
+		keepKey = sessionKey(keep)
+	}
+	dropped := false
+	for k, s := range sessions {
+		if s.User == name && k != keepKey {
+			delete(sessions, k)
+			dropped = true
+		}
+	}
+	if dropped {
+		saveSessionsLocked()
+	}
+}
+
+// hasLiveSession is the listener's login gate.
+func hasLiveSession() bool {
+	now := time.Now()
+	sessMu.Lock()
+	defer sessMu.Unlock()
+	for _, s := range sessions {
+		if now.Before(s.ExpiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func sessionCookie(r *http.Request) string {
+	c, err := r.Cookie("TSID")
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
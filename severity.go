@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ---------- Signal severity ----------
+
+// Every signal carries a severity: "info", "normal" or "critical". The defaults
+// below can be overridden per signal type with Rules.Severity (e.g.
+// {"ON":"critical"}). WS clients can drop anything below a level
+// (/ws?severity=critical or "minSeverity" in the subscribe message), and so can
+// each notifier through its MinSeverity. Signals stored before severities
+// existed count as normal.
+
+const (
+	sevInfo     = "info"
+	sevNormal   = "normal"
+	sevCritical = "critical"
+)
+
+var severityRank = map[string]int{sevInfo: 1, sevNormal: 2, sevCritical: 3}
+
+var defaultSeverity = map[string]string{
+	"PENDING":     sevInfo,
+	"CANCELLED":   sevInfo,
+	"MISS_STREAK": sevCritical,
+}
+
+// severityOf is the severity rules give signals of type typ.
+func (rr Rules) severityOf(typ string) string {
+	if sev := rr.Severity[typ]; sev != "" {
+		return sev
+	}
+	if sev := defaultSeverity[typ]; sev != "" {
+		return sev
+	}
+	return sevNormal
+}
+
+// severityAtLeast reports whether sev passes a minimum of min ("" passes all).
+func severityAtLeast(sev, min string) bool {
+	if min == "" {
+		return true
+	}
+	if sev == "" {
+		sev = sevNormal
+	}
+	return severityRank[sev] >= severityRank[min]
+}
+
+// normalizeSeverity lower-cases sev and checks it names a level ("" allowed).
+func normalizeSeverity(sev *string) error {
+	*sev = strings.ToLower(strings.TrimSpace(*sev))
+	if *sev != "" && severityRank[*sev] == 0 {
+		return fmt.Errorf("severity must be info, normal or critical")
+	}
+	return nil
+}
+
+func validateSeverities(m map[string]string) error {
+	for typ, sev := range m {
+		if typ != strings.ToUpper(typ) || typ == "" {
+			return fmt.Errorf("severity: bad signal type %q", typ)
+		}
+		if err := normalizeSeverity(&sev); err != nil || sev == "" {
+			return fmt.Errorf("severity %s: must be info, normal or critical", typ)
+		}
+		m[typ] = sev
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------- Shadow judge ----------
+
+// The shadow rule (Rules.Shadow) is judged on every block next to the active rule.
+// Its result is kept in the ring/history and disagreements are logged, but it never
+// touches the state machine, so switching to it later is an informed decision.
+
+type ShadowStats struct {
+	Since    string `json:"since"`
+	Blocks   uint64 `json:"blocks"`
+	Agree    uint64 `json:"agree"`
+	Disagree uint64 `json:"disagree"`
+	Failed   uint64 `json:"failed"` // shadow rule couldn't judge the block
+}
+
+var (
+	shadowMu    sync.Mutex
+	shadowStats = ShadowStats{Since: time.Now().UTC().Format(time.RFC3339)}
+)
+
+// judgeShadow judges b with the shadow rule and compares it with the active result.
+func judgeShadow(j JudgeRule, b Block, active string) string {
+	state, ok := judgeBlock(j, b)
+
+	shadowMu.Lock()
+	shadowStats.Blocks++
+	switch {
+	case !ok:
+		shadowStats.Failed++
+	case state == active:
+		shadowStats.Agree++
+	default:
+		shadowStats.Disagree++
+	}
+	shadowMu.Unlock()
+
+	if ok && state != active {
+		logger.Printf("SHADOW_DIFF height=%d active=%s shadow=%s type=%s", b.Height, active, state, j.Type)
+	}
+	return state
+}
+
+func resetShadowStats() {
+	shadowMu.Lock()
+	shadowStats = ShadowStats{Since: time.Now().UTC().Format(time.RFC3339)}
+	shadowMu.Unlock()
+}
+
+func apiGetShadow(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	sh := cfg.Rules.Shadow
+	cfgMu.RUnlock()
+
+	shadowMu.Lock()
+	st := shadowStats
+	shadowMu.Unlock()
+	mustJSON(w, 200, map[string]any{"rule": sh, "stats": st})
+}
+
+// apiSetShadow sets the shadow rule; an empty type clears it. Machine state is kept.
+func apiSetShadow(w http.ResponseWriter, r *http.Request) {
+	var j JudgeRule
+	if err := readJSON(r, &j); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var sh *JudgeRule
+	if j.Type != "" {
+		if err := normalizeJudge(&j); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sh = &j
+	}
+
+	cfgMu.Lock()
+	before := cfg.Rules
+	prev := cfg.Rules.Shadow
+	cfg.Rules.Shadow = sh
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Rules.Shadow = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	after := cfg.Rules
+	cfgMu.Unlock()
+	auditRules(r, "shadow", before, after)
+	resetShadowStats()
+
+	if sh == nil {
+		logger.Printf("SHADOW_CLEARED")
+	} else {
+		logged := *sh
+		logged.Source = ""
+		lb, _ := json.Marshal(logged)
+		logger.Printf("SHADOW_SET rule=%s", lb)
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "rule": sh})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// ---------- Signal dedup guard ----------
+
+// Last line of defence against double signals: at most one signal of each type
+// per block height is ever sent (HIT and MISS share one slot, being the two
+// outcomes of the same check). The ring already drops repeated (height, hash)
+// pairs, but a height can come back with another hash from a source on a fork,
+// or be evaluated again after a restart; whatever slips through is dropped in
+// sendSignal, logged as SIGNAL_DUPLICATE and counted in /api/status
+// (duplicatesDropped). The guard remembers the last dedupWindow signals and is
+// seeded at boot from the newest signal history file.
+
+const dedupWindow = 1000
+
+// signalDedup is guarded by signalSeq.mu.
+var signalDedup struct {
+	seen  map[string]struct{}
+	order []string
+}
+
+var duplicatesDropped atomic.Uint64
+
+func dedupKey(s Signal) string {
+	typ := s.Type
+	if typ == "MISS" {
+		typ = "HIT"
+	}
+	return typ + "@" + strconv.FormatInt(s.Height, 10)
+}
+
+// firstSignalLocked records s and reports whether it is the first of its kind
+// for its height. Caller holds signalSeq.mu.
+func firstSignalLocked(s Signal) bool {
+	k := dedupKey(s)
+	if _, dup := signalDedup.seen[k]; dup {
+		return false
+	}
+	if signalDedup.seen == nil {
+		signalDedup.seen = map[string]struct{}{}
+	}
+	signalDedup.seen[k] = struct{}{}
+	signalDedup.order = append(signalDedup.order, k)
+	if len(signalDedup.order) > dedupWindow {
+		delete(signalDedup.seen, signalDedup.order[0])
+		signalDedup.order = signalDedup.order[1:]
+	}
+	return true
+}
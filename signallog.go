@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Signal history ----------
+
+// Every signal that goes out (simulated ones included, snoozed ones not) is appended
+// to data/signals/YYYY-MM-DD.jsonl, keyed by the signal's UTC day, exactly as it was
+// sent. /api/signals queries it, so a client that was disconnected can see what it
+// missed.
+
+const (
+	signalRetention = 90 // days
+	maxSignalRange  = 31 * 24 * time.Hour
+)
+
+type signalHistory struct {
+	mu   sync.Mutex
+	date string
+	f    *os.File
+}
+
+var signalLog = &signalHistory{}
+
+func signalPath(date string) string {
+	return filepath.Join(signalDir, date+".jsonl")
+}
+
+func (h *signalHistory) append(s Signal) {
+	t, err := time.Parse(time.RFC3339Nano, s.TimeISO)
+	if err != nil {
+		t = time.Now()
+	}
+	date := t.UTC().Format("2006-01-02")
+	line, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.f == nil || h.date != date {
+		if h.f != nil {
+			_ = h.f.Close()
+			h.f = nil
+		}
+		f, err := os.OpenFile(signalPath(date), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			logger.Printf("SIGNAL_LOG_OPEN_ERROR: %v", err)
+			return
+		}
+		h.f, h.date = f, date
+		pruneDayFiles(signalDir, signalRetention)
+	}
+	if _, err := h.f.Write(line); err != nil {
+		logger.Printf("SIGNAL_LOG_WRITE_ERROR: %v", err)
+	}
+}
+
+// readSignals returns the stored signals with from <= time < to whose type is in
+// types (all when empty) and, when afterSeq > 0, whose seq is above it, oldest
+// first, as the raw JSON that was sent.
+func readSignals(from, to time.Time, types map[string]bool, afterSeq uint64) ([]json.RawMessage, error) {
+	var out []json.RawMessage
+	for d := from.UTC().Truncate(24 * time.Hour); d.Before(to); d = d.Add(24 * time.Hour) {
+		f, err := os.Open(signalPath(d.Format("2006-01-02")))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			var s struct {
+				Type    string `json:"type"`
+				TimeISO string `json:"time"`
+				Seq     uint64 `json:"seq"`
+			}
+			if json.Unmarshal(sc.Bytes(), &s) != nil {
+				continue // torn line from a crash
+			}
+			t, err := time.Parse(time.RFC3339Nano, s.TimeISO)
+			if err != nil || t.Before(from) || !t.Before(to) {
+				continue
+			}
+			if len(types) > 0 && !types[s.Type] {
+				continue
+			}
+			if afterSeq > 0 && s.Seq <= afterSeq {
+				continue
+			}
+			out = append(out, append(json.RawMessage(nil), sc.Bytes()...))
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// apiSignals: GET /api/signals?type=ON,HIT&from=&to=&afterSeq=&limit=&offset=
+// (RFC3339 times, default the last 24h), newest first.
+func apiSignals(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) || to.Sub(from) > maxSignalRange {
+		http.Error(w, "from must be before to, at most 31 days apart", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, 1000)
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	offset = max(offset, 0)
+	afterSeq, _ := strconv.ParseUint(q.Get("afterSeq"), 10, 64)
+
+	types := map[string]bool{}
+	for _, t := range strings.Split(q.Get("type"), ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			types[t] = true
+		}
+	}
+
+	all, err := readSignals(from, to, types, afterSeq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := []json.RawMessage{}
+	for i := len(all) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, all[i])
+	}
+	mustJSON(w, 200, map[string]any{
+		"from":    from.UTC().Format(time.RFC3339),
+		"to":      to.UTC().Format(time.RFC3339),
+		"total":   len(all),
+		"offset":  offset,
+		"limit":   limit,
+		"signals": page,
+	})
+}
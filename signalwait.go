@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Long-poll for signals ----------
+
+// GET /api/signals/wait?since=<seq>&timeout=30s&type=ON,HIT is for clients that
+// can't hold a WS/SSE connection (cron scripts, serverless functions): it answers
+// as soon as there are signals with a seq above since, or with none after
+// timeout (default 30s, at most signalWaitMax). The reply carries "seq", the
+// since to use next time. Without since it waits for the next signal. Recent
+// signals come from the WS replay buffer, older ones from the signal history.
+
+const (
+	signalWaitDefault = 30 * time.Second
+	signalWaitMax     = 120 * time.Second
+	signalWaitLimit   = 100
+)
+
+var signalWake struct {
+	mu sync.Mutex
+	ch chan struct{} // closed on the next signal
+}
+
+// signalWaitC returns a channel closed when the next signal is sent.
+func signalWaitC() <-chan struct{} {
+	signalWake.mu.Lock()
+	defer signalWake.mu.Unlock()
+	if signalWake.ch == nil {
+		signalWake.ch = make(chan struct{})
+	}
+	return signalWake.ch
+}
+
+// wakeSignalWaiters releases everybody blocked in apiSignalsWait.
+func wakeSignalWaiters() {
+	signalWake.mu.Lock()
+	defer signalWake.mu.Unlock()
+	if signalWake.ch != nil {
+		close(signalWake.ch)
+		signalWake.ch = nil
+	}
+}
+
+// signalsAfter returns up to signalWaitLimit sent signals with a seq above since,
+// oldest first, and the seq of the last one (since when there are none).
+func signalsAfter(since uint64, types map[string]bool) ([]json.RawMessage, uint64, error) {
+	out := []json.RawMessage{}
+	last := since
+	if since >= lastSignalSeq() {
+		return out, last, nil
+	}
+	wsMu.Lock()
+	covered := len(wsRecent) > 0 && wsRecent[0].s.Seq <= since+1
+	if covered {
+		for _, rs := range wsRecent {
+			if rs.s.Seq <= since || (len(types) > 0 && !types[rs.s.Type]) {
+				continue
+			}
+			if len(out) == signalWaitLimit {
+				break
+			}
+			out = append(out, rs.b)
+			last = rs.s.Seq
+		}
+	}
+	wsMu.Unlock()
+	if covered {
+		return out, last, nil
+	}
+
+	now := time.Now()
+	all, err := readSignals(now.Add(-maxSignalRange), now.Add(time.Minute), types, since)
+	if err != nil {
+		return nil, since, err
+	}
+	for _, raw := range all {
+		var s struct {
+			Seq uint64 `json:"seq"`
+		}
+		if json.Unmarshal(raw, &s) != nil || s.Seq == 0 {
+			continue // simulated
+		}
+		if len(out) == signalWaitLimit {
+			break
+		}
+		out = append(out, raw)
+		last = s.Seq
+	}
+	return out, last, nil
+}
+
+func apiSignalsWait(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since := lastSignalSeq()
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	timeout := signalWaitDefault
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			// plain seconds
+			n, nerr := strconv.Atoi(v)
+			if nerr != nil {
+				http.Error(w, "bad timeout", http.StatusBadRequest)
+				return
+			}
+			d = time.Duration(n) * time.Second
+		}
+		timeout = min(max(d, 0), signalWaitMax)
+	}
+	types := parseTypes(strings.Split(q.Get("type"), ","))
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// take the wake channel first so a signal sent meanwhile isn't missed
+		wake := signalWaitC()
+		signals, last, err := signalsAfter(since, types)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(signals) > 0 {
+			mustJSON(w, 200, map[string]any{"signals": signals, "seq": last, "timeout": false})
+			return
+		}
+		select {
+		case <-wake:
+		case <-deadline.C:
+			mustJSON(w, 200, map[string]any{"signals": signals, "seq": since, "timeout": true})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
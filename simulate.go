@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ---------- Simulation mode ----------
+
+// With Rules.Simulate the machine runs exactly as usual, but its signals are tagged
+// simulated:true and only go to /sse/simulated — never to the WS stream or the
+// webhook — so new settings can be trialled on live blocks without trading on them.
+
+var (
+	simMu   sync.Mutex
+	simSubs = map[chan Signal]struct{}{}
+)
+
+func broadcastSimSignal(s Signal) {
+	simMu.Lock()
+	defer simMu.Unlock()
+	for ch := range simSubs {
+		select {
+		case ch <- s:
+		default:
+			// drop if slow
+		}
+	}
+}
+
+func sseSimulated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "no flusher", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan Signal, 32)
+	simMu.Lock()
+	simSubs[ch] = struct{}{}
+	simMu.Unlock()
+
+	defer func() {
+		simMu.Lock()
+		delete(simSubs, ch)
+		simMu.Unlock()
+		close(ch)
+	}()
+
+	fmt.Fprintf(w, ": simulated signals\n\n")
+	flusher.Flush()
+
+	notify := r.Context().Done()
+	for {
+		select {
+		case <-notify:
+			return
+		case s := <-ch:
+			b, _ := json.Marshal(s)
+			fmt.Fprintf(w, "event: signal\n")
+			fmt.Fprintf(w, "data: %s\n\n", string(b))
+			flusher.Flush()
+		}
+	}
+}
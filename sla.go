@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Per-source daily SLA ----------
+
+// A source is one TronGrid API key. Stats are aggregated per local day and written
+// to data/sla/YYYY-MM-DD.json every minute, so operators can compare paid keys.
+// Sources are told apart by sourceID, a short hash; no part of the key is
+// stored. Files from versions that kept the first and last 4 characters are
+// rewritten without them at startup.
+
+const slaFlushInterval = time.Minute
+
+type SourceDayStats struct {
+	ID           string            `json:"id"`
+	Requests     uint64            `json:"requests"`
+	Successes    uint64            `json:"successes"`
+	Failures     uint64            `json:"failures"`
+	LatencySumMs int64             `json:"latencySumMs"`
+	UptimePct    float64           `json:"uptimePct"`
+	AvgLatencyMs float64           `json:"avgLatencyMs"`
+	Errors       map[string]uint64 `json:"errors"` // kind -> count
+}
+
+type slaDay struct {
+	Date    string                     `json:"date"`
+	Sources map[string]*SourceDayStats `json:"sources"`
+}
+
+type slaStore struct {
+	mu    sync.Mutex
+	day   slaDay
+	dirty bool
+}
+
+var sla = &slaStore{}
+
+// sourceID is a stable, non-secret identifier for an API key.
+func sourceID(key string) string {
+	return "src-" + sha256Hex(key)[:8]
+}
+
+func slaDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func slaPath(date string) string {
+	return filepath.Join(slaDir, date+".json")
+}
+
+// classifyFetchError buckets a poll error for the breakdown.
+func classifyFetchError(err error) string {
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		switch {
+		case se.Code == http.StatusTooManyRequests:
+			return "http_429"
+		case se.Code >= 500:
+			return "http_5xx"
+		case se.Code >= 400:
+			return "http_4xx"
+		default:
+			return "http_" + strconv.Itoa(se.Code)
+		}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	var je *json.SyntaxError
+	var ute *json.UnmarshalTypeError
+	if errors.As(err, &je) || errors.As(err, &ute) {
+		return "decode"
+	}
+	return "network"
+}
+
+func readSLADay(date string) (slaDay, error) {
+	d := slaDay{Date: date, Sources: map[string]*SourceDayStats{}}
+	b, err := os.ReadFile(slaPath(date))
+	if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return d, err
+	}
+	if d.Sources == nil {
+		d.Sources = map[string]*SourceDayStats{}
+	}
+	return d, nil
+}
+
+// scrubSLAKeys rewrites day files that still hold part of an API key.
+func scrubSLAKeys() {
+	paths, _ := filepath.Glob(filepath.Join(slaDir, "*.json"))
+	n := 0
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil || !bytes.Contains(b, []byte(`"key":`)) {
+			continue
+		}
+		date := strings.TrimSuffix(filepath.Base(p), ".json")
+		d, err := readSLADay(date)
+		if err != nil {
+			logger.Printf("SLA_SCRUB_ERROR file=%s: %v", p, err)
+			continue
+		}
+		d.Date = date
+		if err := writeSLADay(d); err != nil {
+			logger.Printf("SLA_SCRUB_ERROR file=%s: %v", p, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		logger.Printf("SLA_KEYS_SCRUBBED files=%d", n)
+	}
+}
+
+// load resumes today's aggregates after a restart.
+func (s *slaStore) load() {
+	scrubSLAKeys()
+	date := slaDate(time.Now())
+	d, err := readSLADay(date)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("SLA_LOAD_ERROR: %v", err)
+	}
+	s.mu.Lock()
+	s.day = d
+	s.mu.Unlock()
+}
+
+func (s *slaStore) record(key string, latency time.Duration, err error) {
+	now := time.Now()
+	date := slaDate(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.day.Date != date {
+		// day rolled over: persist the finished day before starting a new one
+		if s.day.Date != "" && s.dirty {
+			s.writeLocked()
+		}
+		s.day = slaDay{Date: date, Sources: map[string]*SourceDayStats{}}
+	}
+
+	id := sourceID(key)
+	st := s.day.Sources[id]
+	if st == nil {
+		st = &SourceDayStats{ID: id, Errors: map[string]uint64{}}
+		s.day.Sources[id] = st
+	}
+	if st.Errors == nil {
+		st.Errors = map[string]uint64{}
+	}
+	st.Requests++
+	if err != nil {
+		st.Failures++
+		st.Errors[classifyFetchError(err)]++
+	} else {
+		st.Successes++
+		st.LatencySumMs += latency.Milliseconds()
+	}
+	st.UptimePct = float64(st.Successes) * 100 / float64(st.Requests)
+	if st.Successes > 0 {
+		st.AvgLatencyMs = float64(st.LatencySumMs) / float64(st.Successes)
+	}
+	s.dirty = true
+}
+
+func writeSLADay(d slaDay) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := slaPath(d.Date)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *slaStore) writeLocked() {
+	if err := writeSLADay(s.day); err != nil {
+		logger.Printf("SLA_SAVE_ERROR: %v", err)
+		return
+	}
+	s.dirty = false
+}
+
+func (s *slaStore) flushLoop() {
+	t := time.NewTicker(slaFlushInterval)
+	defer t.Stop()
+	for range t.C {
+		s.mu.Lock()
+		if s.dirty {
+			s.writeLocked()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// report returns the stats for date, preferring live data for the current day.
+func (s *slaStore) report(date string) (slaDay, error) {
+	s.mu.Lock()
+	if s.day.Date == date {
+		d := slaDay{Date: date, Sources: make(map[string]*SourceDayStats, len(s.day.Sources))}
+		for id, st := range s.day.Sources {
+			cp := *st
+			cp.Errors = make(map[string]uint64, len(st.Errors))
+			for k, v := range st.Errors {
+				cp.Errors[k] = v
+			}
+			d.Sources[id] = &cp
+		}
+		s.mu.Unlock()
+		return d, nil
+	}
+	s.mu.Unlock()
+	return readSLADay(date)
+}
+
+func apiSourcesReport(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = slaDate(time.Now())
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "bad date, want YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	d, err := sla.report(date)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "read report failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]*SourceDayStats, 0, len(d.Sources))
+	for _, st := range d.Sources {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	mustJSON(w, 200, map[string]any{"instance": instanceName, "date": date, "sources": list})
+}
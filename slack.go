@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ---------- Slack notifier ----------
+
+// Signals and incidents can go to one Slack channel, either through an incoming
+// webhook or with a bot token (chat.postMessage to Channel). The message text
+// comes from Go templates kept in config.json (SignalTemplate gets the Signal,
+// IncidentTemplate the Incident plus Instance). Slack allows about one message
+// per second per channel, so posts are spaced slackMinGap apart and a 429 waits
+// out Retry-After; what piles up beyond the queue is dropped and counted.
+
+const (
+	slackQueueSize = 128
+	slackAttempts  = 3
+	slackTimeout   = 10 * time.Second
+	slackMinGap    = time.Second
+	slackMaxWait   = time.Minute
+	slackPostURL   = "https://slack.com/api/chat.postMessage"
+
+	defaultSlackSignalTemplate   = "*{{.Type}}* @ {{.Height}} (base {{.BaseHeight}}, state {{.State}}, seq {{.Seq}}){{if .Instance}} [{{.Instance}}]{{end}}"
+	defaultSlackIncidentTemplate = ":warning: *{{.Kind}}* {{.Detail}}{{if .Instance}} [{{.Instance}}]{{end}}"
+)
+
+type SlackConfig struct {
+	WebhookURL string `json:"webhookUrl,omitempty"` // incoming webhook; or BotToken + Channel
+	BotToken   string `json:"botToken,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+
+	Signals   bool     `json:"signals"`
+	Types     []string `json:"types,omitempty"` // signal types; empty = all
+	Incidents bool     `json:"incidents"`
+	// lowest signal severity posted; "" = all (see severity.go)
+	MinSeverity string `json:"minSeverity,omitempty"`
+
+	// text/template sources; empty = the defaults above
+	SignalTemplate   string `json:"signalTemplate,omitempty"`
+	IncidentTemplate string `json:"incidentTemplate,omitempty"`
+}
+
+func (sc SlackConfig) enabled() bool {
+	return sc.WebhookURL != "" || sc.BotToken != ""
+}
+
+func (sc SlackConfig) wants(n notice) bool {
+	if !sc.enabled() {
+		return false
+	}
+	if n.incident != nil {
+		return sc.Incidents
+	}
+	if !sc.Signals || !severityAtLeast(n.signal.Severity, sc.MinSeverity) {
+		return false
+	}
+	types := parseTypes(sc.Types)
+	return len(types) == 0 || types[n.signal.Type]
+}
+
+var (
+	slackC = make(chan notice, slackQueueSize)
+
+	slackStatsMu sync.Mutex
+	slackStats   struct {
+		Sent        uint64 `json:"sent"`
+		Failed      uint64 `json:"failed"`
+		Dropped     uint64 `json:"dropped"`
+		RateLimited uint64 `json:"rateLimited"`
+		LastError   string `json:"lastError,omitempty"`
+	}
+)
+
+func enqueueSlack(n notice) {
+	select {
+	case slackC <- n:
+	default:
+		slackStatsMu.Lock()
+		slackStats.Dropped++
+		slackStatsMu.Unlock()
+		logger.Printf("SLACK_DROP (queue full)")
+	}
+}
+
+func slackLoop() {
+	client := &http.Client{Timeout: slackTimeout}
+	var last time.Time
+	for n := range slackC {
+		cfgMu.RLock()
+		sc := cfg.Slack
+		cfgMu.RUnlock()
+		if !sc.wants(n) {
+			continue
+		}
+		text, err := slackText(sc, n)
+		if err != nil {
+			logger.Printf("SLACK_TEMPLATE_ERROR: %v", err)
+			continue
+		}
+
+		for attempt := 1; attempt <= slackAttempts; attempt++ {
+			if gap := slackMinGap - time.Since(last); gap > 0 {
+				time.Sleep(gap)
+			}
+			var wait time.Duration
+			wait, err = postSlack(client, sc, text)
+			last = time.Now()
+			if err == nil {
+				break
+			}
+			if wait > 0 {
+				slackStatsMu.Lock()
+				slackStats.RateLimited++
+				slackStatsMu.Unlock()
+			}
+			if attempt < slackAttempts {
+				time.Sleep(max(wait, time.Second*time.Duration(attempt)))
+			}
+		}
+
+		slackStatsMu.Lock()
+		if err != nil {
+			slackStats.Failed++
+			slackStats.LastError = err.Error()
+		} else {
+			slackStats.Sent++
+		}
+		slackStatsMu.Unlock()
+		if err != nil {
+			logger.Printf("SLACK_ERROR: %v", err)
+		}
+	}
+}
+
+func slackText(sc SlackConfig, n notice) (string, error) {
+	src, data := sc.SignalTemplate, any(nil)
+	if n.incident != nil {
+		src = sc.IncidentTemplate
+		if src == "" {
+			src = defaultSlackIncidentTemplate
+		}
+		data = struct {
+			Incident
+			Instance string
+		}{*n.incident, instanceName}
+	} else {
+		if src == "" {
+			src = defaultSlackSignalTemplate
+		}
+		data = n.signal
+	}
+	tmpl, err := template.New("slack").Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// postSlack sends text once. On a 429 it also returns how long Slack asked us
+// to wait.
+func postSlack(client *http.Client, sc SlackConfig, text string) (time.Duration, error) {
+	target := sc.WebhookURL
+	payload := map[string]any{"text": text}
+	if target == "" {
+		target = slackPostURL
+		payload["channel"] = sc.Channel
+	}
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if sc.WebhookURL == "" {
+		req.Header.Set("Authorization", "Bearer "+sc.BotToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		wait := min(time.Duration(max(secs, 1))*time.Second, slackMaxWait)
+		return wait, &httpStatusError{Code: resp.StatusCode, Body: "rate limited"}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	if sc.WebhookURL == "" {
+		// the Web API answers 200 with {"ok":false,"error":...}
+		var r struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &r) == nil && !r.OK {
+			return 0, fmt.Errorf("slack: %s", r.Error)
+		}
+	}
+	return 0, nil
+}
+
+func validateSlack(sc *SlackConfig) error {
+	sc.WebhookURL = strings.TrimSpace(sc.WebhookURL)
+	sc.BotToken = strings.TrimSpace(sc.BotToken)
+	sc.Channel = strings.TrimSpace(sc.Channel)
+	if sc.WebhookURL != "" {
+		u, err := url.Parse(sc.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhookUrl must be https://hooks.slack.com/services/...")
+		}
+		if sc.BotToken != "" {
+			return fmt.Errorf("set webhookUrl or botToken, not both")
+		}
+	}
+	if sc.BotToken != "" && sc.Channel == "" {
+		return fmt.Errorf("channel is required with botToken")
+	}
+	if err := normalizeSeverity(&sc.MinSeverity); err != nil {
+		return err
+	}
+	for _, src := range []string{sc.SignalTemplate, sc.IncidentTemplate} {
+		if _, err := template.New("slack").Parse(src); err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+	}
+	types := parseTypes(sc.Types)
+	sc.Types = nil
+	for t := range types {
+		sc.Types = append(sc.Types, t)
+	}
+	sort.Strings(sc.Types)
+	return nil
+}
+
+func apiGetSlack(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	sc := cfg.Slack
+	cfgMu.RUnlock()
+	maskSlackSecrets(&sc)
+	slackStatsMu.Lock()
+	stats := slackStats
+	slackStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{
+		"slack": sc,
+		"stats": stats,
+		"defaults": map[string]string{
+			"signalTemplate":   defaultSlackSignalTemplate,
+			"incidentTemplate": defaultSlackIncidentTemplate,
+		},
+	})
+}
+
+// maskSlackSecrets hides the webhook URL (it carries the token) and bot token.
+func maskSlackSecrets(sc *SlackConfig) {
+	if sc.WebhookURL != "" {
+		sc.WebhookURL = "****"
+	}
+	if sc.BotToken != "" {
+		sc.BotToken = "****"
+	}
+}
+
+func apiSetSlack(w http.ResponseWriter, r *http.Request) {
+	var sc SlackConfig
+	if err := readJSON(r, &sc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.Slack
+	// "****" is what GET showed: keep the stored secret
+	if strings.TrimSpace(sc.WebhookURL) == "****" {
+		sc.WebhookURL = prev.WebhookURL
+	}
+	if strings.TrimSpace(sc.BotToken) == "****" {
+		sc.BotToken = prev.BotToken
+	}
+	if err := validateSlack(&sc); err != nil {
+		cfgMu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Slack = sc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Slack = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("SLACK_SET enabled=%v signals=%v incidents=%v", sc.enabled(), sc.Signals, sc.Incidents)
+	maskSlackSecrets(&sc)
+	mustJSON(w, 200, map[string]any{"ok": true, "slack": sc})
+}
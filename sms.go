@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- SMS alerts ----------
+
+// Critical incidents (by default SOURCES_DOWN and ABNORMAL_RESTART) can be sent
+// as SMS, through Twilio or a generic HTTP gateway that takes {"to","text"} as
+// JSON (POST /api/sms). Texts cost money, so every message (one per recipient)
+// counts against DailyCap, per Beijing day; once it is reached the rest of the
+// day's alerts are dropped with a single SMS_CAP_REACHED log line. Signals are
+// never sent.
+
+const (
+	smsQueueSize     = 32
+	smsTimeout       = 10 * time.Second
+	smsDefaultCap    = 10
+	maxSMSRecipients = 5
+	twilioAPI        = "https://api.twilio.com/2010-04-01/Accounts/"
+)
+
+var smsDefaultKinds = []string{"SOURCES_DOWN", "ABNORMAL_RESTART"}
+
+type SMSConfig struct {
+	Provider string `json:"provider"` // "" = disabled | "twilio" | "http"
+	// twilio: account SID and auth token; http: optional bearer token
+	AccountSID string   `json:"accountSid,omitempty"`
+	AuthToken  string   `json:"authToken,omitempty"`
+	GatewayURL string   `json:"gatewayUrl,omitempty"` // provider "http"
+	From       string   `json:"from,omitempty"`       // twilio sender number
+	To         []string `json:"to"`
+	// incident kinds to text; empty = smsDefaultKinds
+	Kinds []string `json:"kinds,omitempty"`
+	// messages per day over all recipients; 0 = smsDefaultCap
+	DailyCap int `json:"dailyCap,omitempty"`
+}
+
+func (sc SMSConfig) wants(n notice) bool {
+	if sc.Provider == "" || len(sc.To) == 0 || n.incident == nil {
+		return false
+	}
+	kinds := sc.Kinds
+	if len(kinds) == 0 {
+		kinds = smsDefaultKinds
+	}
+	for _, k := range kinds {
+		if k == n.incident.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc SMSConfig) dailyCap() int {
+	if sc.DailyCap > 0 {
+		return sc.DailyCap
+	}
+	return smsDefaultCap
+}
+
+var (
+	smsC = make(chan notice, smsQueueSize)
+
+	smsStatsMu sync.Mutex
+	smsStats   struct {
+		Day       string `json:"day"`
+		SentToday int    `json:"sentToday"`
+		Sent      uint64 `json:"sent"`
+		Failed    uint64 `json:"failed"`
+		Capped    uint64 `json:"capped"` // not sent because of DailyCap
+		LastError string `json:"lastError,omitempty"`
+	}
+	// day SMS_CAP_REACHED was last logged (guarded by smsStatsMu)
+	smsCapLogged string
+)
+
+func enqueueSMS(n notice) {
+	select {
+	case smsC <- n:
+	default:
+		logger.Printf("SMS_DROP (queue full)")
+	}
+}
+
+func smsLoop() {
+	client := &http.Client{Timeout: smsTimeout}
+	for n := range smsC {
+		cfgMu.RLock()
+		sc := cfg.SMS
+		cfgMu.RUnlock()
+		if !sc.wants(n) {
+			continue
+		}
+		text := "[tron-signal] " + n.incident.Kind + ": " + n.incident.Detail
+		if instanceName != "" {
+			text = "[tron-signal " + instanceName + "] " + n.incident.Kind + ": " + n.incident.Detail
+		}
+		for _, to := range sc.To {
+			if !smsTake(sc.dailyCap()) {
+				break
+			}
+			err := sendSMS(client, sc, to, text)
+			smsStatsMu.Lock()
+			if err != nil {
+				smsStats.Failed++
+				smsStats.LastError = err.Error()
+			} else {
+				smsStats.Sent++
+			}
+			smsStatsMu.Unlock()
+			if err != nil {
+				logger.Printf("SMS_ERROR to=%s kind=%s: %v", maskPhone(to), n.incident.Kind, err)
+			}
+		}
+	}
+}
+
+// smsTake counts one message against today's cap; false when the cap is used
+// up. A failed send still counts: the provider may have billed it.
+func smsTake(limit int) bool {
+	smsStatsMu.Lock()
+	defer smsStatsMu.Unlock()
+	day := time.Now().In(beijing).Format("2006-01-02")
+	if smsStats.Day != day {
+		smsStats.Day, smsStats.SentToday = day, 0
+	}
+	if smsStats.SentToday >= limit {
+		if smsCapLogged != day {
+			logger.Printf("SMS_CAP_REACHED day=%s cap=%d", day, limit)
+			smsCapLogged = day
+		}
+		smsStats.Capped++
+		return false
+	}
+	smsStats.SentToday++
+	return true
+}
+
+func sendSMS(client *http.Client, sc SMSConfig, to, text string) error {
+	var req *http.Request
+	var err error
+	switch sc.Provider {
+	case "twilio":
+		form := url.Values{"From": {sc.From}, "To": {to}, "Body": {text}}
+		req, err = http.NewRequest("POST", twilioAPI+url.PathEscape(sc.AccountSID)+"/Messages.json", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(sc.AccountSID, sc.AuthToken)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		body, _ := json.Marshal(map[string]string{"to": to, "text": text})
+		req, err = http.NewRequest("POST", sc.GatewayURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if sc.AuthToken != "" {
+			req.Header.Set("Authorization", "Bearer "+sc.AuthToken)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	return nil
+}
+
+// maskPhone keeps the last 4 digits for logs.
+func maskPhone(s string) string {
+	if len(s) <= 4 {
+		return "****"
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
+
+func validateSMS(sc *SMSConfig) error {
+	sc.Provider = strings.TrimSpace(sc.Provider)
+	if sc.Provider == "" {
+		return nil
+	}
+	switch sc.Provider {
+	case "twilio":
+		if sc.AccountSID == "" || sc.AuthToken == "" || sc.From == "" {
+			return fmt.Errorf("twilio needs accountSid, authToken and from")
+		}
+	case "http":
+		u, err := url.Parse(strings.TrimSpace(sc.GatewayURL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("gatewayUrl must be http(s)://host/...")
+		}
+		sc.GatewayURL = u.String()
+	default:
+		return fmt.Errorf("provider must be twilio or http")
+	}
+	var to []string
+	for _, x := range sc.To {
+		if x = strings.TrimSpace(x); x != "" {
+			to = append(to, x)
+		}
+	}
+	if len(to) == 0 || len(to) > maxSMSRecipients {
+		return fmt.Errorf("1-%d recipients required", maxSMSRecipients)
+	}
+	sc.To = to
+	var kinds []string
+	for _, k := range sc.Kinds {
+		if k = strings.ToUpper(strings.TrimSpace(k)); k != "" {
+			kinds = append(kinds, k)
+		}
+	}
+	sc.Kinds = kinds
+	if sc.DailyCap < 0 || sc.DailyCap > 1000 {
+		return fmt.Errorf("dailyCap must be 0-1000")
+	}
+	return nil
+}
+
+func apiGetSMS(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	sc := cfg.SMS
+	cfgMu.RUnlock()
+	if sc.AuthToken != "" {
+		sc.AuthToken = "****"
+	}
+	smsStatsMu.Lock()
+	stats := smsStats
+	smsStatsMu.Unlock()
+	mustJSON(w, 200, map[string]any{"sms": sc, "stats": stats, "defaultKinds": smsDefaultKinds})
+}
+
+func apiSetSMS(w http.ResponseWriter, r *http.Request) {
+	var sc SMSConfig
+	if err := readJSON(r, &sc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.SMS
+	if sc.AuthToken == "****" {
+		sc.AuthToken = prev.AuthToken // unchanged from what GET showed
+	}
+	if err := validateSMS(&sc); err != nil {
+		cfgMu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.SMS = sc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.SMS = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("SMS_SET provider=%q to=%d cap=%d", sc.Provider, len(sc.To), sc.dailyCap())
+	if sc.AuthToken != "" {
+		sc.AuthToken = "****"
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "sms": sc})
+}
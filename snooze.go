@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------- Snooze ----------
+
+// Snoozing mutes the machine's signals for a while: blocks are judged and counted
+// as usual (and the black box records the decisions), but nothing goes out on /ws,
+// the webhook or /sse/simulated until the snooze ends. It is runtime state, so a
+// restart ends it.
+
+const maxSnooze = 24 * time.Hour
+
+// snoozedUntil returns until while it is still ahead of now, else the zero time.
+func snoozedUntil(until, now time.Time) time.Time {
+	if until.After(now) {
+		return until
+	}
+	return time.Time{}
+}
+
+func snoozeActive(now time.Time) bool {
+	rtMu.Lock()
+	defer rtMu.Unlock()
+	return rt.SnoozeUntil.After(now)
+}
+
+// apiSnooze handles POST /api/machine/snooze?minutes=N; 0 ends a running snooze.
+func apiSnooze(w http.ResponseWriter, r *http.Request) {
+	minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+	if err != nil || minutes < 0 || time.Duration(minutes)*time.Minute > maxSnooze {
+		http.Error(w, "minutes must be 0-1440", http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if minutes > 0 {
+		until = time.Now().Add(time.Duration(minutes) * time.Minute)
+	}
+	rtMu.Lock()
+	rt.SnoozeUntil = until
+	rtMu.Unlock()
+
+	logger.Printf("MACHINE_SNOOZE minutes=%d until=%s", minutes, isoOrEmpty(until))
+	broadcastStatus()
+	mustJSON(w, 200, map[string]any{"ok": true, "snoozedUntil": isoOrEmpty(until)})
+}
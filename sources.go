@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ---------- Sources (API keys) health ----------
+
+// sourceHealth tracks consecutive poll failures per API key. It is owned by the
+// listener goroutine; only `down` is read elsewhere (status).
+type sourceHealth struct {
+	fails     map[string]int
+	lastProbe time.Time
+	down      atomic.Bool
+	pool      atomic.Value // string: pool picked last under the failover policy
+}
+
+var health = &sourceHealth{fails: map[string]int{}}
+
+func (h *sourceHealth) allDown(keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	for _, k := range keys {
+		if h.fails[k] < sourceDownAfter {
+			return false
+		}
+	}
+	return true
+}
+
+// observe records one poll result and emits SOURCES_DOWN / SOURCES_RECOVERED on transitions.
+func (h *sourceHealth) observe(keys []string, key string, err error) {
+	if err != nil {
+		h.fails[key]++
+	} else {
+		h.fails[key] = 0
+	}
+
+	down := h.allDown(keys)
+	if down == h.down.Load() {
+		return
+	}
+	h.down.Store(down)
+
+	if down {
+		ids := make([]string, 0, len(keys))
+		for _, k := range keys {
+			ids = append(ids, sourceID(k))
+		}
+		detail := fmt.Sprintf("all %d sources failing (%s), last error: %v", len(keys), strings.Join(ids, ","), err)
+		logger.Printf("SOURCES_DOWN probe=%s", sourceProbeInterval)
+		raiseIncident("SOURCES_DOWN", detail)
+		broadcastEvent(Event{Type: "SOURCES_DOWN", Detail: detail})
+	} else {
+		detail := "recovered via " + sourceID(key)
+		logger.Printf("SOURCES_RECOVERED source=%s", sourceID(key))
+		broadcastEvent(Event{Type: "SOURCES_RECOVERED", Detail: detail})
+	}
+	broadcastStatus()
+}
+
+func (h *sourceHealth) healthy(key string) bool {
+	return h.fails[key] < sourceDownAfter
+}
+
+func (h *sourceHealth) activePool() string {
+	p, _ := h.pool.Load().(string)
+	return p
+}
+
+// pick is the dispatcher: round-robin (by time) over the candidate keys. Under the
+// failover policy the candidates are the healthy primary keys, then the healthy
+// backup keys once every primary is down.
+func (h *sourceHealth) pick(keys []string, groups map[string]string, policy string) string {
+	cands := keys
+	pool := ""
+	if policy == sourcePolicyFailover {
+		primary, backup := splitPools(keys, groups)
+		pool = sourcePoolPrimary
+		cands = healthyOnly(h, primary)
+		if len(cands) == 0 {
+			if b := healthyOnly(h, backup); len(b) > 0 {
+				pool, cands = sourcePoolBackup, b
+			} else {
+				// nothing healthy: keep trying the primary pool
+				cands = primary
+				if len(cands) == 0 {
+					pool, cands = sourcePoolBackup, backup
+				}
+			}
+		}
+	}
+	if prev := h.activePool(); prev != pool {
+		h.pool.Store(pool)
+		if prev != "" && pool != "" {
+			logger.Printf("SOURCES_FAILOVER from=%s to=%s", prev, pool)
+		}
+	}
+	return cands[int(time.Now().UnixNano()%int64(len(cands)))]
+}
+
+func healthyOnly(h *sourceHealth, keys []string) []string {
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if h.healthy(k) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// pollSource fetches the newest block through one key and feeds SLA + health.
+func pollSource(client *http.Client, keys []string, key string) (int64, string, string, int, error) {
+	started := time.Now()
+	height, hash, tISO, txCount, err := fetchNowBlock(client, defaultNodeURL, key)
+	sla.record(key, time.Since(started), err)
+	health.observe(keys, key, err)
+	if err != nil {
+		atomic.AddUint64(&reconnects, 1)
+		logger.Printf("BLOCK_FETCH_ERROR source=%s: %v", sourceID(key), err)
+	}
+	return height, hash, tISO, txCount, err
+}
+
+// ---------- Sources import/export ----------
+
+const sourcesBundleVersion = 1
+
+// SourcesBundle is the portable form of the source configuration.
+type SourcesBundle struct {
+	Version  int           `json:"version"`
+	Instance string        `json:"instance,omitempty"`
+	Exported string        `json:"exported,omitempty"`
+	Policy   string        `json:"policy,omitempty"`
+	Sources  []SourceEntry `json:"sources"`
+}
+
+type SourceEntry struct {
+	ID       string `json:"id"`
+	APIKey   string `json:"apiKey,omitempty"` // empty when redacted
+	Redacted bool   `json:"redacted,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// apiSourcesExport returns the bundle; keys are redacted unless ?redact=false.
+func apiSourcesExport(w http.ResponseWriter, r *http.Request) {
+	redact := true
+	if v := r.URL.Query().Get("redact"); v == "0" || strings.EqualFold(v, "false") {
+		redact = false
+	}
+
+	cfgMu.RLock()
+	keys := append([]string(nil), cfg.APIKeys...)
+	groups := cfg.SourceGroups
+	policy := cfg.SourcePolicy
+	cfgMu.RUnlock()
+
+	out := SourcesBundle{
+		Version:  sourcesBundleVersion,
+		Instance: instanceName,
+		Exported: time.Now().UTC().Format(time.RFC3339),
+		Policy:   policy,
+		Sources:  make([]SourceEntry, 0, len(keys)),
+	}
+	for _, k := range keys {
+		e := SourceEntry{ID: sourceID(k), Group: sourceGroupOf(groups, sourceID(k))}
+		if redact {
+			e.Redacted = true
+		} else {
+			e.APIKey = k
+		}
+		out.Sources = append(out.Sources, e)
+	}
+
+	logger.Printf("SOURCES_EXPORT count=%d redact=%v", len(keys), redact)
+	w.Header().Set("Content-Disposition", `attachment; filename="tron-signal-sources.json"`)
+	mustJSON(w, 200, out)
+}
+
+// apiSourcesImport replaces the source list with the bundle. Redacted entries are
+// resolved against the current keys by id; ones that can't be resolved are skipped.
+func apiSourcesImport(w http.ResponseWriter, r *http.Request) {
+	var in SourcesBundle
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if in.Version != sourcesBundleVersion {
+		http.Error(w, fmt.Sprintf("unsupported bundle version %d", in.Version), http.StatusBadRequest)
+		return
+	}
+
+	if in.Policy != "" && !validSourcePolicy(in.Policy) {
+		http.Error(w, "bad policy: "+in.Policy, http.StatusBadRequest)
+		return
+	}
+	for _, e := range in.Sources {
+		if e.Group != "" && e.Group != sourcePoolPrimary && e.Group != sourcePoolBackup {
+			http.Error(w, "bad group for "+e.ID+": "+e.Group, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// keys, groups and policy change together: one save, one rollback
+	cfgMu.Lock()
+	byID := map[string]string{}
+	for _, k := range cfg.APIKeys {
+		byID[sourceID(k)] = k
+	}
+	var (
+		raw     []string
+		skipped = []string{}
+		groups  = map[string]string{}
+	)
+	for _, e := range in.Sources {
+		k := strings.TrimSpace(e.APIKey)
+		if k == "" {
+			if cur, ok := byID[e.ID]; ok {
+				k = cur
+			} else {
+				skipped = append(skipped, e.ID)
+				continue
+			}
+		}
+		raw = append(raw, k)
+		if e.Group == sourcePoolBackup {
+			groups[sourceID(k)] = sourcePoolBackup
+		}
+	}
+	keys := normalizeAPIKeys(raw)
+
+	prevKeys, prevGroups, prevPolicy := cfg.APIKeys, cfg.SourceGroups, cfg.SourcePolicy
+	cfg.APIKeys = keys
+	cfg.SourceGroups = pruneSourceGroups(keys, groups)
+	if in.Policy != "" {
+		cfg.SourcePolicy = in.Policy
+	}
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.APIKeys, cfg.SourceGroups, cfg.SourcePolicy = prevKeys, prevGroups, prevPolicy
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	apiKeysChanged(keys)
+	logger.Printf("SOURCES_IMPORT count=%d skipped=%d", len(keys), len(skipped))
+
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, sourceID(k))
+	}
+	mustJSON(w, 200, map[string]any{"ok": true, "sources": ids, "skipped": skipped})
+}
+
+// ---------- Source pools ----------
+
+const (
+	sourcePolicyAll      = "all"
+	sourcePolicyFailover = "failover"
+
+	sourcePoolPrimary = "primary"
+	sourcePoolBackup  = "backup"
+)
+
+func validSourcePolicy(p string) bool {
+	return p == "" || p == sourcePolicyAll || p == sourcePolicyFailover
+}
+
+func sourceGroupOf(groups map[string]string, id string) string {
+	if groups[id] == sourcePoolBackup {
+		return sourcePoolBackup
+	}
+	return sourcePoolPrimary
+}
+
+func splitPools(keys []string, groups map[string]string) (primary, backup []string) {
+	for _, k := range keys {
+		if sourceGroupOf(groups, sourceID(k)) == sourcePoolBackup {
+			backup = append(backup, k)
+		} else {
+			primary = append(primary, k)
+		}
+	}
+	return primary, backup
+}
+
+// pruneSourceGroups keeps only backup assignments of keys that still exist (primary is the default).
+func pruneSourceGroups(keys []string, groups map[string]string) map[string]string {
+	out := map[string]string{}
+	for _, k := range keys {
+		id := sourceID(k)
+		if groups[id] == sourcePoolBackup {
+			out[id] = sourcePoolBackup
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func apiGetSourceGroups(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+
+	groups := map[string]string{}
+	for _, k := range cfg.APIKeys {
+		id := sourceID(k)
+		groups[id] = sourceGroupOf(cfg.SourceGroups, id)
+	}
+	policy := cfg.SourcePolicy
+	if policy == "" {
+		policy = sourcePolicyAll
+	}
+	mustJSON(w, 200, map[string]any{"policy": policy, "groups": groups, "active": health.activePool()})
+}
+
+func apiSetSourceGroups(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Policy string            `json:"policy"`
+		Groups map[string]string `json:"groups"` // sourceID -> "primary"|"backup"
+	}
+	if err := readJSON(r, &req); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validSourcePolicy(req.Policy) {
+		http.Error(w, "bad policy: "+req.Policy, http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	known := map[string]struct{}{}
+	for _, k := range cfg.APIKeys {
+		known[sourceID(k)] = struct{}{}
+	}
+	for id, g := range req.Groups {
+		if _, ok := known[id]; !ok {
+			cfgMu.Unlock()
+			http.Error(w, "unknown source: "+id, http.StatusBadRequest)
+			return
+		}
+		if g != sourcePoolPrimary && g != sourcePoolBackup {
+			cfgMu.Unlock()
+			http.Error(w, "bad group for "+id+": "+g, http.StatusBadRequest)
+			return
+		}
+	}
+
+	prevGroups, prevPolicy := cfg.SourceGroups, cfg.SourcePolicy
+	groups := pruneSourceGroups(cfg.APIKeys, req.Groups)
+	cfg.SourceGroups = groups
+	cfg.SourcePolicy = req.Policy
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.SourceGroups, cfg.SourcePolicy = prevGroups, prevPolicy
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("SOURCE_GROUPS_UPDATED policy=%s backup=%d", req.Policy, len(groups))
+	mustJSON(w, 200, map[string]any{"ok": true})
+}
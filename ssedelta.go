@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// ---------- SSE status deltas ----------
+
+// /sse/status?delta=1 sends a full "status" event first and then "delta" events
+// holding only what changed since the previous push:
+//
+//	{"changed":{"lastHeight":...}, "removed":["paused"], "blocksAdded":[...]}
+//
+// blocksAdded lists the ring entries above the previously sent newest height,
+// newest first; the client prepends them and trims to the ring size. A full
+// status is resent every sseFullEvery so a client that went wrong recovers.
+
+const sseFullEvery = time.Minute
+
+type statusDelta struct {
+	Changed     map[string]json.RawMessage `json:"changed,omitempty"`
+	Removed     []string                   `json:"removed,omitempty"`
+	BlocksAdded []BlockInfo                `json:"blocksAdded,omitempty"`
+}
+
+// sseDeltaState is what one delta subscriber last received.
+type sseDeltaState struct {
+	fields   map[string]json.RawMessage
+	topBlock int64
+	full     time.Time
+}
+
+func newestHeight(blocks []BlockInfo) int64 {
+	if len(blocks) == 0 {
+		return 0
+	}
+	return blocks[0].Height
+}
+
+// reset records a full status as sent.
+func (d *sseDeltaState) reset(status []byte, now time.Time) {
+	var st struct {
+		Blocks []BlockInfo `json:"blocks"`
+	}
+	_ = json.Unmarshal(status, &d.fields)
+	_ = json.Unmarshal(status, &st)
+	d.topBlock = newestHeight(st.Blocks)
+	d.full = now
+}
+
+// next returns the event to send for status: a full one when due, otherwise the
+// delta against the last push (nil when nothing changed).
+func (d *sseDeltaState) next(status []byte, now time.Time) (event string, data []byte) {
+	if d.fields == nil || now.Sub(d.full) >= sseFullEvery {
+		d.reset(status, now)
+		return "status", status
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(status, &fields) != nil {
+		return "", nil
+	}
+	var delta statusDelta
+	for k, v := range fields {
+		if k == "blocks" || bytes.Equal(d.fields[k], v) {
+			continue
+		}
+		if delta.Changed == nil {
+			delta.Changed = map[string]json.RawMessage{}
+		}
+		delta.Changed[k] = v
+	}
+	for k := range d.fields {
+		if _, ok := fields[k]; !ok {
+			delta.Removed = append(delta.Removed, k)
+		}
+	}
+	sort.Strings(delta.Removed)
+
+	var blocks []BlockInfo
+	_ = json.Unmarshal(fields["blocks"], &blocks)
+	if newestHeight(blocks) < d.topBlock {
+		// ring was reset; a delta can't express that
+		d.reset(status, now)
+		return "status", status
+	}
+	for _, b := range blocks {
+		if b.Height <= d.topBlock {
+			break
+		}
+		delta.BlocksAdded = append(delta.BlocksAdded, b)
+	}
+	d.topBlock = newestHeight(blocks)
+	d.fields = fields
+
+	if delta.Changed == nil && delta.Removed == nil && delta.BlocksAdded == nil {
+		return "", nil
+	}
+	out, _ := json.Marshal(delta)
+	return "delta", out
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- Signals over SSE ----------
+
+// /sse/signals streams what /ws sends (signals as "event: signal" with the seq as
+// the event id, system events as "event: event") for clients that can't hold a
+// WebSocket. ?types= filters signals like on /ws. On reconnect the browser's
+// Last-Event-ID brings back the signals after it that are still in the replay
+// buffer; without one, ?replay=N / WSConfig.Replay apply. A subscriber that falls
+// wsSendQueue messages behind is cut off and can resume the same way.
+
+type sseSignalSub struct {
+	ch    chan sseSignalMsg
+	types map[string]bool
+	lost  chan struct{} // closed when the subscriber fell behind
+}
+
+type sseSignalMsg struct {
+	event string
+	id    uint64
+	data  []byte
+}
+
+// SSE signal subscribers (guarded by wsMu, like the WS clients)
+var sseSignalSubs = map[*sseSignalSub]struct{}{}
+
+// broadcastSSELocked mirrors broadcastWSLocked for SSE. Caller holds wsMu.
+func broadcastSSELocked(typ string, seq uint64, b []byte) {
+	msg := sseSignalMsg{event: "signal", id: seq, data: b}
+	if typ == "" {
+		msg.event = "event"
+	}
+	for sub := range sseSignalSubs {
+		if typ != "" && len(sub.types) > 0 && !sub.types[typ] {
+			continue
+		}
+		select {
+		case sub.ch <- msg:
+		default:
+			delete(sseSignalSubs, sub)
+			close(sub.lost)
+		}
+	}
+}
+
+// sseReplayLocked queues the buffered signals sub should get on connect: those
+// after seq last when resuming, else the latest n. Caller holds wsMu.
+func sseReplayLocked(sub *sseSignalSub, last uint64, resume bool, n int) {
+	var picked []recentSignal
+	if resume {
+		for _, rs := range wsRecent {
+			if rs.s.Seq > last && (len(sub.types) == 0 || sub.types[rs.s.Type]) {
+				picked = append(picked, rs)
+			}
+		}
+	} else {
+		for i := len(wsRecent) - 1; i >= 0 && len(picked) < n; i-- {
+			if rs := wsRecent[i]; len(sub.types) == 0 || sub.types[rs.s.Type] {
+				picked = append([]recentSignal{rs}, picked...)
+			}
+		}
+	}
+	for _, rs := range picked {
+		sub.ch <- sseSignalMsg{event: "signal", id: rs.s.Seq, data: markReplay(rs.b)}
+	}
+}
+
+func sseSignals(w http.ResponseWriter, r *http.Request) {
+	if reason := wsBanned(r); reason != "" {
+		logger.Printf("SSE_REJECTED remote=%s banned=%s", r.RemoteAddr, reason)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "no flusher", http.StatusInternalServerError)
+		return
+	}
+
+	sub := &sseSignalSub{
+		ch:    make(chan sseSignalMsg, wsSendQueue),
+		types: queryTypes(r),
+		lost:  make(chan struct{}),
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(r.Header.Get("Last-Event-ID")), 10, 64)
+	n := replayCount(r)
+	wsMu.Lock()
+	sseReplayLocked(sub, last, err == nil, n)
+	sseSignalSubs[sub] = struct{}{}
+	wsMu.Unlock()
+
+	defer func() {
+		wsMu.Lock()
+		delete(sseSignalSubs, sub)
+		wsMu.Unlock()
+	}()
+
+	fmt.Fprintf(w, ": signals\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(wsPingInterval)
+	defer keepalive.Stop()
+	notify := r.Context().Done()
+	for {
+		select {
+		case <-notify:
+			return
+		case <-sub.lost:
+			logger.Printf("SSE_EVICTED remote=%s reason=%q", r.RemoteAddr, "send queue full")
+			return
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		case m := <-sub.ch:
+			fmt.Fprintf(w, "event: %s\n", m.event)
+			if m.id > 0 {
+				fmt.Fprintf(w, "id: %d\n", m.id)
+			}
+			fmt.Fprintf(w, "data: %s\n\n", string(m.data))
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ---------- Rule templates ----------
+
+// Named rule sets kept in config, so a tuned setup can be saved once and switched
+// back to without re-entering every slider. Applying a template goes through the
+// same path as POST /api/rules; judge and shadow are never part of a template.
+
+const maxRuleTemplates = 32
+
+type ruleTemplate struct {
+	Name  string `json:"name"`
+	Rules Rules  `json:"rules"`
+}
+
+func apiListRuleTemplates(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	out := make([]ruleTemplate, 0, len(cfg.RuleTemplates))
+	for name, rr := range cfg.RuleTemplates {
+		out = append(out, ruleTemplate{Name: name, Rules: rr})
+	}
+	cfgMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	mustJSON(w, 200, map[string]any{"templates": out})
+}
+
+// apiSaveRuleTemplate stores {name, rules}; without rules the live rules are saved.
+func apiSaveRuleTemplate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name  string `json:"name"`
+		Rules *Rules `json:"rules"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !scriptNameRe.MatchString(req.Name) {
+		http.Error(w, "bad name (want [A-Za-z0-9_-], max 32)", http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	var rr Rules
+	if req.Rules != nil {
+		rr = *req.Rules
+	} else {
+		rr = cfg.Rules
+	}
+	rr.Judge, rr.Shadow, rr.Disabled = JudgeRule{}, nil, false
+	if err := normalizeRules(&rr); err != nil {
+		cfgMu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prev, existed := cfg.RuleTemplates[req.Name]
+	if !existed && len(cfg.RuleTemplates) >= maxRuleTemplates {
+		cfgMu.Unlock()
+		http.Error(w, "too many templates", http.StatusBadRequest)
+		return
+	}
+	if cfg.RuleTemplates == nil {
+		cfg.RuleTemplates = map[string]Rules{}
+	}
+	cfg.RuleTemplates[req.Name] = rr
+	if err := saveConfigLocked(cfg); err != nil {
+		if existed {
+			cfg.RuleTemplates[req.Name] = prev
+		} else {
+			delete(cfg.RuleTemplates, req.Name)
+		}
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("RULE_TEMPLATE_SAVED name=%s", req.Name)
+	mustJSON(w, 200, map[string]any{"ok": true, "template": ruleTemplate{Name: req.Name, Rules: rr}})
+}
+
+// apiDeleteRuleTemplate removes ?name=.
+func apiDeleteRuleTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	cfgMu.Lock()
+	prev, ok := cfg.RuleTemplates[name]
+	if !ok {
+		cfgMu.Unlock()
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+	delete(cfg.RuleTemplates, name)
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.RuleTemplates[name] = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("RULE_TEMPLATE_DELETED name=%s", name)
+	mustJSON(w, 200, map[string]any{"ok": true})
+}
+
+// apiApplyRuleTemplate makes {name}'s rules the live rules.
+func apiApplyRuleTemplate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfgMu.RLock()
+	rr, ok := cfg.RuleTemplates[req.Name]
+	cfgMu.RUnlock()
+	if !ok {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+	if err := normalizeRules(&rr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rr, err := storeRules(r, "template:"+req.Name, rr)
+	if err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	logger.Printf("RULE_TEMPLATE_APPLIED name=%s", req.Name)
+	mustJSON(w, 200, map[string]any{"ok": true, "rules": rr})
+}
@@ -0,0 +1,56 @@
+package main
+
+import "strings"
+
+// ---------- Threshold modes ----------
+
+// ThresholdRule.Mode decides when the ON / OFF rule fires:
+//   - "reach" (default): as soon as the counter reaches Threshold.
+//   - "range": when a streak ends (the opposite state arrives) with a length
+//     between Threshold and Max.
+//   - "below": when a streak ends before it reached Threshold ("at most N-1").
+//
+// The ending modes fire on the breaking block; the signal keeps the rule's type
+// and state and carries the streak length in Signal.Streak.
+
+// ThresholdRule.Mode values
+const (
+	thresholdReach = "reach"
+	thresholdRange = "range"
+	thresholdBelow = "below"
+)
+
+func (r *ThresholdRule) sanitize() {
+	r.Threshold = clamp(r.Threshold, 0, 20)
+	r.Mode = strings.ToLower(strings.TrimSpace(r.Mode))
+	switch r.Mode {
+	case thresholdRange:
+		r.Max = clamp(r.Max, r.Threshold, 20)
+	case thresholdBelow:
+		r.Max = 0
+	default:
+		r.Mode, r.Max = thresholdReach, 0
+	}
+}
+
+// reached reports whether the running counter fires a "reach" rule.
+func (r ThresholdRule) reached(counter int) bool {
+	if !r.Enabled || r.Threshold <= 0 {
+		return false
+	}
+	return (r.Mode == "" || r.Mode == thresholdReach) && counter >= r.Threshold
+}
+
+// broke reports whether a streak of this length that just ended fires the rule.
+func (r ThresholdRule) broke(streak int) bool {
+	if !r.Enabled || r.Threshold <= 0 || streak <= 0 {
+		return false
+	}
+	switch r.Mode {
+	case thresholdRange:
+		return streak >= r.Threshold && streak <= max(r.Max, r.Threshold)
+	case thresholdBelow:
+		return streak < r.Threshold
+	}
+	return false
+}
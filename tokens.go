@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ---------- Access tokens ----------
+
+// Access tokens (X-Token header or ?token=) let bots and scripts use the server
+// without a login session. Each carries scopes, checked by requireLogin for the
+// endpoint being called:
+//
+//	signals  the signal feeds: /ws, /sse/signals, /api/signals, /api/signals/wait
+//	read     every GET endpoint
+//	control  every endpoint, changes included
+//
+// Accounts, token management, API keys, setup/login and pprof stay session-only. Tokens
+// from before scopes (stored as a bare use count) get signals. GET /api/tokens
+// lists them masked, POST /api/tokens {"scopes"} creates one and shows it this
+// once, POST /api/tokens/{id} changes its scopes and DELETE /api/tokens/{id}
+// revokes it.
+//
+// config.json keeps only "sha256:<hex>" of each token (plus a masked hint for
+// the list), so a leaked config does not leak the tokens; plaintext keys from
+// older configs are hashed on startup. The id is the start of that hash, so it
+// stays the same and never reveals the token.
+//
+// A token may carry an expiresAt (RFC 3339, set on create or through
+// POST /api/tokens/{id}; "" = never). Expired tokens are refused at once and
+// dropped from config.json by an hourly purge, so forgotten credentials do not
+// linger.
+//
+// Each use is counted with its time and client IP, and a token can carry a
+// label naming who holds it, so stale ones are easy to spot and revoke. Uses
+// pile up under their own small lock, off cfgMu, and tokenLoop folds them into
+// config.json every tokenUseSaveEvery; listings add the pending ones.
+
+const (
+	scopeSignals = "signals"
+	scopeRead    = "read"
+	scopeControl = "control"
+)
+
+var tokenScopes = []string{scopeSignals, scopeRead, scopeControl}
+
+type AccessToken struct {
+	Scopes []string `json:"scopes"`
+	Uses   uint64   `json:"uses"`
+	// RFC 3339; "" = never expires
+	ExpiresAt  string `json:"expiresAt,omitempty"`
+	Label      string `json:"label,omitempty"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
+	LastIP     string `json:"lastIP,omitempty"`
+	// masked form, the only part of the token kept
+	Hint string `json:"hint,omitempty"`
+}
+
+const (
+	tokenKeyPrefix     = "sha256:"
+	tokenPurgeEvery    = time.Hour
+	tokenUseSaveEvery  = time.Minute
+	maxTokenLabelRunes = 64
+)
+
+type tokenUseDelta struct {
+	uses     uint64
+	lastUsed time.Time
+	lastIP   string
+}
+
+// uses not yet folded into cfg, by token key
+var tokenUse = struct {
+	mu      sync.Mutex
+	pending map[string]tokenUseDelta
+	unsaved bool // folded but the save failed (guarded by cfgMu)
+}{pending: map[string]tokenUseDelta{}}
+
+// UnmarshalJSON also takes the old form, a bare use count.
+func (t *AccessToken) UnmarshalJSON(b []byte) error {
+	var uses uint64
+	if json.Unmarshal(b, &uses) == nil {
+		*t = AccessToken{Scopes: []string{scopeSignals}, Uses: uses}
+		return nil
+	}
+	type plain AccessToken
+	return json.Unmarshal(b, (*plain)(t))
+}
+
+// allows reports whether t's scopes cover scope (control > read > signals).
+func (t AccessToken) allows(scope string) bool {
+	for _, s := range t.Scopes {
+		switch {
+		case s == scopeControl,
+			s == scopeRead && scope != scopeControl,
+			s == scopeSignals && scope == scopeSignals:
+			return true
+		}
+	}
+	return false
+}
+
+func (t AccessToken) expired(now time.Time) bool {
+	if t.ExpiresAt == "" {
+		return false
+	}
+	exp, err := time.Parse(time.RFC3339Nano, t.ExpiresAt)
+	return err != nil || !now.Before(exp)
+}
+
+// tokenKey is what config.json stores for tok.
+func tokenKey(tok string) string {
+	return tokenKeyPrefix + sha256Hex(tok)
+}
+
+func keyID(key string) string {
+	h := strings.TrimPrefix(key, tokenKeyPrefix)
+	return h[:min(12, len(h))]
+}
+
+// hashTokenKeys replaces plaintext keys in m with their hashes and returns how
+// many there were.
+func hashTokenKeys(m map[string]AccessToken) int {
+	n := 0
+	for k, t := range m {
+		if strings.HasPrefix(k, tokenKeyPrefix) {
+			continue
+		}
+		delete(m, k)
+		t.Hint = maskToken(k)
+		m[tokenKey(k)] = t
+		n++
+	}
+	return n
+}
+
+var signalPaths = map[string]bool{
+	"/ws":               true,
+	"/sse/signals":      true,
+	"/api/signals":      true,
+	"/api/signals/wait": true,
+}
+
+var sessionOnlyPaths = []string{"/api/users", "/api/logins", "/api/me", "/api/tokens", "/api/apikey", "/api/sources/export", "/api/sources/import", "/api/setup", "/api/login", "/setup", "/login", "/debug/pprof/"}
+
+// requiredScope is the scope a token needs for r; "" = sessions only.
+func requiredScope(r *http.Request) string {
+	for _, p := range sessionOnlyPaths {
+		if r.URL.Path == p || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(p, "/")+"/") {
+			return ""
+		}
+	}
+	switch {
+	case signalPaths[r.URL.Path]:
+		return scopeSignals
+	case r.Method == "GET" || r.Method == "HEAD":
+		return scopeRead
+	}
+	return scopeControl
+}
+
+// tokenAccess checks the token r presents against its endpoint: 0 when there is
+// none, else 200, 401 (unknown token) or 403 (scope missing) and why.
+func tokenAccess(r *http.Request) (int, string) {
+	tok := strings.TrimSpace(r.Header.Get("X-Token"))
+	if tok == "" {
+		tok = strings.TrimSpace(r.URL.Query().Get("token"))
+	}
+	if tok == "" {
+		return 0, ""
+	}
+	key := tokenKey(tok)
+	cfgMu.RLock()
+	t, ok := cfg.Access.Tokens[key]
+	cfgMu.RUnlock()
+	if !ok {
+		return http.StatusUnauthorized, "invalid token"
+	}
+	if t.expired(time.Now()) {
+		return http.StatusUnauthorized, "token expired"
+	}
+	scope := requiredScope(r)
+	if scope == "" {
+		return http.StatusForbidden, "tokens cannot use this endpoint"
+	}
+	if !t.allows(scope) {
+		return http.StatusForbidden, "token lacks the " + scope + " scope"
+	}
+	noteTokenUse(key, remoteIP(r), time.Now())
+	return http.StatusOK, ""
+}
+
+// noteTokenUse counts a use of the token stored under key from ip.
+func noteTokenUse(key, ip string, now time.Time) {
+	tokenUse.mu.Lock()
+	defer tokenUse.mu.Unlock()
+	d := tokenUse.pending[key]
+	d.uses++
+	d.lastUsed, d.lastIP = now, ip
+	tokenUse.pending[key] = d
+}
+
+// withPendingUse adds the uses not yet folded into cfg to t.
+func withPendingUse(key string, t AccessToken) AccessToken {
+	tokenUse.mu.Lock()
+	d, ok := tokenUse.pending[key]
+	tokenUse.mu.Unlock()
+	if ok {
+		t.Uses += d.uses
+		t.LastUsedAt, t.LastIP = isoOrEmpty(d.lastUsed), d.lastIP
+	}
+	return t
+}
+
+// flushTokenUse folds the pending uses into the config and saves it; usage is
+// best effort, so a failed save is only logged and retried next time.
+func flushTokenUse() {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	tokenUse.mu.Lock()
+	pending := tokenUse.pending
+	tokenUse.pending = map[string]tokenUseDelta{}
+	tokenUse.mu.Unlock()
+	for key, d := range pending {
+		t, ok := cfg.Access.Tokens[key]
+		if !ok { // revoked meanwhile
+			continue
+		}
+		t.Uses += d.uses
+		t.LastUsedAt, t.LastIP = isoOrEmpty(d.lastUsed), d.lastIP
+		cfg.Access.Tokens[key] = t
+		tokenUse.unsaved = true
+	}
+	if !tokenUse.unsaved {
+		return
+	}
+	if err := saveConfigLocked(cfg); err != nil {
+		logger.Printf("TOKEN_USAGE_SAVE_ERROR: %v", err)
+		return
+	}
+	tokenUse.unsaved = false
+}
+
+func normalizeScopes(in []string) ([]string, error) {
+	out := []string{}
+	for _, s := range in {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !slices.Contains(tokenScopes, s) {
+			return nil, fmt.Errorf("unknown scope %q (one of %s)", s, strings.Join(tokenScopes, ", "))
+		}
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return out, nil
+}
+
+// normalizeExpiry checks an expiresAt from the API: "" or a future RFC 3339 time.
+func normalizeExpiry(s string, now time.Time) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	exp, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return "", fmt.Errorf("expiresAt must be RFC 3339: %v", err)
+	}
+	if !exp.After(now) {
+		return "", fmt.Errorf("expiresAt is in the past")
+	}
+	return isoOrEmpty(exp), nil
+}
+
+func normalizeLabel(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) > maxTokenLabelRunes {
+		return "", fmt.Errorf("label is longer than %d characters", maxTokenLabelRunes)
+	}
+	return s, nil
+}
+
+// tokenBody is the body of POST /api/tokens and /api/tokens/{id}; on the
+// latter, fields left out are kept.
+type tokenBody struct {
+	Scopes    []string `json:"scopes"`    // signals, read, control
+	ExpiresAt *string  `json:"expiresAt"` // RFC 3339; "" = never
+	Label     *string  `json:"label"`
+}
+
+type TokenInfo struct {
+	ID         string   `json:"id"`
+	Token      string   `json:"token"` // masked
+	Label      string   `json:"label,omitempty"`
+	Scopes     []string `json:"scopes"`
+	Uses       uint64   `json:"uses"`
+	ExpiresAt  string   `json:"expiresAt,omitempty"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	LastIP     string   `json:"lastIP,omitempty"`
+}
+
+func tokenInfo(key string, t AccessToken) TokenInfo {
+	t = withPendingUse(key, t)
+	return TokenInfo{ID: keyID(key), Token: t.Hint, Label: t.Label, Scopes: t.Scopes, Uses: t.Uses,
+		ExpiresAt: t.ExpiresAt, LastUsedAt: t.LastUsedAt, LastIP: t.LastIP}
+}
+
+// purgeExpiredTokens drops expired tokens from the config.
+func purgeExpiredTokens(now time.Time) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	expired := map[string]AccessToken{}
+	for key, t := range cfg.Access.Tokens {
+		if t.expired(now) {
+			expired[key] = t
+			delete(cfg.Access.Tokens, key)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	if err := saveConfigLocked(cfg); err != nil {
+		for key, t := range expired {
+			cfg.Access.Tokens[key] = t
+		}
+		logger.Printf("TOKEN_PURGE_SAVE_ERROR: %v", err)
+		return
+	}
+	for key, t := range expired {
+		logger.Printf("TOKEN_EXPIRED id=%s expiresAt=%s", keyID(key), t.ExpiresAt)
+	}
+}
+
+// tokenLoop purges expired tokens and saves use counters left pending.
+func tokenLoop() {
+	purgeExpiredTokens(time.Now())
+	purge := time.NewTicker(tokenPurgeEvery)
+	flush := time.NewTicker(tokenUseSaveEvery)
+	for {
+		select {
+		case now := <-purge.C:
+			purgeExpiredTokens(now)
+		case <-flush.C:
+			flushTokenUse()
+		}
+	}
+}
+
+// tokenByIDLocked finds the key of the token with id; caller holds cfgMu.
+func tokenByIDLocked(id string) (string, bool) {
+	for key := range cfg.Access.Tokens {
+		if keyID(key) == id {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// apiTokens: GET lists the tokens; POST {"scopes":[...],"expiresAt","label"} creates one.
+func apiTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		cfgMu.RLock()
+		out := make([]TokenInfo, 0, len(cfg.Access.Tokens))
+		for key, t := range cfg.Access.Tokens {
+			out = append(out, tokenInfo(key, t))
+		}
+		cfgMu.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+		mustJSON(w, 200, map[string]any{"tokens": out, "scopes": tokenScopes})
+	case "POST":
+		var in tokenBody
+		if err := readJSON(r, &in); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		scopes, err := normalizeScopes(in.Scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var expiresAt string
+		if in.ExpiresAt != nil {
+			if expiresAt, err = normalizeExpiry(*in.ExpiresAt, time.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var label string
+		if in.Label != nil {
+			if label, err = normalizeLabel(*in.Label); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		tok, err := randHex(24)
+		if err != nil {
+			http.Error(w, "rand failed", http.StatusInternalServerError)
+			return
+		}
+		t := AccessToken{Scopes: scopes, ExpiresAt: expiresAt, Label: label, Hint: maskToken(tok)}
+		key := tokenKey(tok)
+		cfgMu.Lock()
+		cfg.Access.Tokens[key] = t
+		if err := saveConfigLocked(cfg); err != nil {
+			delete(cfg.Access.Tokens, key)
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		logger.Printf("TOKEN_CREATED id=%s label=%q scopes=%s expiresAt=%s user=%s", keyID(key), label, strings.Join(scopes, ","), expiresAt, requestUser(r))
+		info := tokenInfo(key, t)
+		info.Token = tok // shown once
+		mustJSON(w, 200, info)
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiToken: POST /api/tokens/{id} {"scopes":[...],"expiresAt","label"} changes the
+// token; DELETE revokes it.
+func apiToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case "POST":
+		var in tokenBody
+		if err := readJSON(r, &in); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var scopes []string
+		if in.Scopes != nil {
+			var err error
+			if scopes, err = normalizeScopes(in.Scopes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var expiresAt string
+		if in.ExpiresAt != nil {
+			var err error
+			if expiresAt, err = normalizeExpiry(*in.ExpiresAt, time.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var label string
+		if in.Label != nil {
+			var err error
+			if label, err = normalizeLabel(*in.Label); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		cfgMu.Lock()
+		key, ok := tokenByIDLocked(id)
+		if !ok {
+			cfgMu.Unlock()
+			http.Error(w, "no such token", http.StatusNotFound)
+			return
+		}
+		prev := cfg.Access.Tokens[key]
+		t := prev
+		if scopes != nil {
+			t.Scopes = scopes
+		}
+		if in.ExpiresAt != nil {
+			t.ExpiresAt = expiresAt
+		}
+		if in.Label != nil {
+			t.Label = label
+		}
+		cfg.Access.Tokens[key] = t
+		if err := saveConfigLocked(cfg); err != nil {
+			cfg.Access.Tokens[key] = prev
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		logger.Printf("TOKEN_UPDATED id=%s label=%q scopes=%s expiresAt=%s user=%s", id, t.Label, strings.Join(t.Scopes, ","), t.ExpiresAt, requestUser(r))
+		mustJSON(w, 200, tokenInfo(key, t))
+	case "DELETE":
+		cfgMu.Lock()
+		key, ok := tokenByIDLocked(id)
+		if !ok {
+			cfgMu.Unlock()
+			http.Error(w, "no such token", http.StatusNotFound)
+			return
+		}
+		prev := cfg.Access.Tokens[key]
+		delete(cfg.Access.Tokens, key)
+		if err := saveConfigLocked(cfg); err != nil {
+			cfg.Access.Tokens[key] = prev
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		logger.Printf("TOKEN_REVOKED id=%s user=%s", id, requestUser(r))
+		mustJSON(w, 200, map[string]any{"ok": true})
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// ---------- Signal expiry ----------
+
+// With Rules.TTL > 0 every signal says how long it stays actionable: until block
+// Height+TTL (expiresHeight) or, in wall-clock terms, its time plus TTL block
+// intervals (expiresAt). A consumer that gets a signal late, say replayed after a
+// reconnect, compares either against the chain head or the clock and skips it.
+
+const (
+	maxTTLBlocks  = 1000
+	blockInterval = 3 * time.Second // TRON produces a block every 3s
+)
+
+// stampExpiry fills in the expiry fields of s for a ttl of blocks; 0 = none.
+func stampExpiry(s *Signal, ttl int) {
+	if ttl <= 0 {
+		return
+	}
+	s.ExpiresHeight = s.Height + int64(ttl)
+	t, err := time.Parse(time.RFC3339Nano, s.TimeISO)
+	if err != nil {
+		return
+	}
+	s.ExpiresAt = t.Add(time.Duration(ttl) * blockInterval).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ---------- Admin accounts ----------
+
+// The web UI can have several accounts, each with a role checked by
+// requireLogin for the endpoint being called:
+//
+//	viewer    every GET endpoint: status, signals, logs, history
+//	operator  also every change: rules, machine, sources, outputs
+//	admin     also tokens, API keys, WS bans, pprof, the accounts and login audit
+//
+// The account created at setup is an admin. Configs from before accounts (a
+// single web.username) are turned into that admin on startup. Roles are looked
+// up on every request, so a change or a deletion applies to open sessions at
+// once. GET /api/users lists the accounts, POST /api/users creates one,
+// POST /api/users/{name} changes its role or password and DELETE removes it;
+// the last admin can be neither demoted nor removed. GET /api/me is who is
+// logged in, with the session's CSRF token.
+//
+// Passwords are hashed with argon2id (argon2.go) and stored as a PHC string,
+// "$argon2id$v=19$m=<KiB>,t=<passes>,p=<lanes>$<salt>$<hash>". The cost comes
+// from web.argon2 (defaults: 19 MiB, 2 passes, 1 lane). Accounts still on the
+// old salted SHA-256, or hashed with other costs, are rehashed on their next
+// successful login.
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+
+	maxUsernameRunes = 64
+)
+
+var userRoles = []string{roleViewer, roleOperator, roleAdmin}
+
+type User struct {
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"passwordHash,omitempty"` // argon2id, PHC string
+	// salted SHA-256 of older configs; replaced at the next login
+	SaltHex string `json:"saltHex,omitempty"`
+	HashHex string `json:"hashHex,omitempty"`
+}
+
+type Argon2Params struct {
+	MemoryKiB uint32 `json:"memoryKiB,omitempty"`
+	Time      uint32 `json:"time,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+}
+
+const argon2KeyLen = 32
+
+var defaultArgon2 = Argon2Params{MemoryKiB: 19 * 1024, Time: 2, Threads: 1}
+
+// argon2Params is the configured cost, defaults filling what is unset.
+func argon2Params() Argon2Params {
+	cfgMu.RLock()
+	a := cfg.Web.Argon2
+	cfgMu.RUnlock()
+	if a.Time == 0 {
+		a.Time = defaultArgon2.Time
+	}
+	if a.Threads == 0 {
+		a.Threads = defaultArgon2.Threads
+	}
+	if a.MemoryKiB == 0 {
+		a.MemoryKiB = defaultArgon2.MemoryKiB
+	}
+	a.MemoryKiB = max(a.MemoryKiB, 8*uint32(a.Threads))
+	return a
+}
+
+// roleRank orders the roles; 0 = unknown.
+func roleRank(role string) int {
+	return slices.Index(userRoles, role) + 1
+}
+
+// adminPaths need the admin role.
+var adminPaths = []string{"/api/users", "/api/logins", "/api/tokens", "/api/apikey", "/api/sources/export", "/api/sources/import", "/api/ws/bans", "/docs/", "/debug/pprof/"}
+
+// requiredRole is the role a session needs for r.
+func requiredRole(r *http.Request) string {
+	for _, p := range adminPaths {
+		if r.URL.Path == p || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(p, "/")+"/") {
+			return roleAdmin
+		}
+	}
+	if machineReset(r) {
+		return roleAdmin
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return roleViewer
+	}
+	return roleOperator
+}
+
+func newPasswordHash(p string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	a := argon2Params()
+	key := argon2id([]byte(p), salt, a.Time, a.MemoryKiB, a.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2Version, a.MemoryKiB, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// dummyPasswordHash is checked for unknown usernames.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	h, _ := newPasswordHash("")
+	return h
+})
+
+// parsePasswordHash splits a PHC argon2id string.
+func parsePasswordHash(s string) (a Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2Version) {
+		return a, nil, nil, fmt.Errorf("not an argon2id v=%d hash", argon2Version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.MemoryKiB, &a.Time, &a.Threads); err != nil {
+		return a, nil, nil, err
+	}
+	if a.Time == 0 || a.Threads == 0 {
+		return a, nil, nil, fmt.Errorf("bad argon2id parameters %q", parts[3])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return a, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return a, nil, nil, err
+	}
+	return a, salt, key, nil
+}
+
+// checkPassword reports whether p is u's password, and whether the stored hash
+// should be redone (old scheme or other cost).
+func checkPassword(u User, p string) (ok, rehash bool) {
+	if u.PasswordHash == "" {
+		ok = u.HashHex != "" && subtle.ConstantTimeCompare([]byte(sha256Hex(u.SaltHex+":"+p)), []byte(u.HashHex)) == 1
+		return ok, ok
+	}
+	a, salt, key, err := parsePasswordHash(u.PasswordHash)
+	if err != nil {
+		logger.Printf("PASSWORD_HASH_INVALID user=%s: %v", u.Username, err)
+		return false, false
+	}
+	got := argon2id([]byte(p), salt, a.Time, a.MemoryKiB, a.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return false, false
+	}
+	return true, a != argon2Params()
+}
+
+// rehashPassword replaces u's stored hash after a login with p, unless the
+// account changed meanwhile.
+func rehashPassword(u User, p string) {
+	hash, err := newPasswordHash(p)
+	if err != nil {
+		return
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	i := userIndexLocked(u.Username)
+	if i < 0 || cfg.Web.Users[i] != u {
+		return
+	}
+	cfg.Web.Users[i].PasswordHash, cfg.Web.Users[i].SaltHex, cfg.Web.Users[i].HashHex = hash, "", ""
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Web.Users[i] = u
+		logger.Printf("PASSWORD_REHASH_SAVE_ERROR user=%s: %v", u.Username, err)
+		return
+	}
+	logger.Printf("PASSWORD_REHASHED user=%s", u.Username)
+}
+
+// userIndexLocked finds name in the accounts; caller holds cfgMu.
+func userIndexLocked(name string) int {
+	return slices.IndexFunc(cfg.Web.Users, func(u User) bool { return u.Username == name })
+}
+
+func adminCountLocked() int {
+	n := 0
+	for _, u := range cfg.Web.Users {
+		if u.Role == roleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// sessionUser is the account behind r's session cookie. Sessions of deleted
+// accounts are dropped.
+func sessionUser(r *http.Request) (User, bool) {
+	sid := sessionCookie(r)
+	name := sessionName(sid)
+	if name == "" {
+		return User{}, false
+	}
+	cfgMu.RLock()
+	i := userIndexLocked(name)
+	var u User
+	if i >= 0 {
+		u = cfg.Web.Users[i]
+	}
+	cfgMu.RUnlock()
+	if i < 0 {
+		endSession(sid)
+		return User{}, false
+	}
+	return u, true
+}
+
+// migrateLegacyAdmin turns the single account of older configs into an admin
+// and reports whether it did.
+func migrateLegacyAdmin(web *WebCred) bool {
+	if web.Username == "" || len(web.Users) > 0 {
+		return false
+	}
+	web.Users = []User{{Username: web.Username, Role: roleAdmin, SaltHex: web.SaltHex, HashHex: web.HashHex}}
+	web.Username, web.SaltHex, web.HashHex = "", "", ""
+	return true
+}
+
+func normalizeUsername(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return "", fmt.Errorf("username required")
+	case utf8.RuneCountInString(s) > maxUsernameRunes:
+		return "", fmt.Errorf("username is longer than %d characters", maxUsernameRunes)
+	case strings.IndexFunc(s, func(c rune) bool { return unicode.IsSpace(c) || c == '/' }) >= 0:
+		return "", fmt.Errorf("username must not contain spaces or /")
+	}
+	return s, nil
+}
+
+func normalizeRole(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if roleRank(s) == 0 {
+		return "", fmt.Errorf("unknown role %q (one of %s)", s, strings.Join(userRoles, ", "))
+	}
+	return s, nil
+}
+
+// userBody is the body of POST /api/users and /api/users/{name}; on the
+// latter, fields left out are kept.
+type userBody struct {
+	Username string  `json:"username,omitempty"` // create only
+	Role     *string `json:"role"`               // viewer, operator, admin
+	Password *string `json:"password"`
+}
+
+type UserInfo struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type MeInfo struct {
+	UserInfo
+	CSRFToken string `json:"csrfToken"` // for the X-CSRF-Token header (see csrf.go)
+}
+
+// apiMe: GET /api/me is the logged-in account.
+func apiMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := sessionUser(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	mustJSON(w, 200, MeInfo{UserInfo: UserInfo{Username: u.Username, Role: u.Role}, CSRFToken: csrfToken(sessionCookie(r))})
+}
+
+// apiUsers: GET lists the accounts; POST {"username","password","role"} adds one.
+func apiUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		cfgMu.RLock()
+		out := make([]UserInfo, 0, len(cfg.Web.Users))
+		for _, u := range cfg.Web.Users {
+			out = append(out, UserInfo{Username: u.Username, Role: u.Role})
+		}
+		cfgMu.RUnlock()
+		mustJSON(w, 200, map[string]any{"users": out, "roles": userRoles})
+	case "POST":
+		var in userBody
+		if err := readJSON(r, &in); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name, err := normalizeUsername(in.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if in.Role == nil || in.Password == nil || *in.Password == "" {
+			http.Error(w, "role and password required", http.StatusBadRequest)
+			return
+		}
+		role, err := normalizeRole(*in.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := newPasswordHash(*in.Password)
+		if err != nil {
+			http.Error(w, "rand failed", http.StatusInternalServerError)
+			return
+		}
+		cfgMu.Lock()
+		if userIndexLocked(name) >= 0 {
+			cfgMu.Unlock()
+			http.Error(w, "user exists", http.StatusConflict)
+			return
+		}
+		prev := cfg.Web.Users
+		cfg.Web.Users = append(slices.Clip(prev), User{Username: name, Role: role, PasswordHash: hash})
+		if err := saveConfigLocked(cfg); err != nil {
+			cfg.Web.Users = prev
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		logger.Printf("USER_CREATED name=%s role=%s by=%s", name, role, requestUser(r))
+		mustJSON(w, 200, UserInfo{Username: name, Role: role})
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiUser: POST /api/users/{name} {"role","password"} changes the account;
+// DELETE removes it.
+func apiUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case "POST":
+		var in userBody
+		if err := readJSON(r, &in); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var role string
+		if in.Role != nil {
+			var err error
+			if role, err = normalizeRole(*in.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var hash string
+		if in.Password != nil {
+			if *in.Password == "" {
+				http.Error(w, "password must not be empty", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if hash, err = newPasswordHash(*in.Password); err != nil {
+				http.Error(w, "rand failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		cfgMu.Lock()
+		i := userIndexLocked(name)
+		if i < 0 {
+			cfgMu.Unlock()
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		prev := cfg.Web.Users[i]
+		if prev.Role == roleAdmin && role != "" && role != roleAdmin && adminCountLocked() == 1 {
+			cfgMu.Unlock()
+			http.Error(w, "cannot demote the last admin", http.StatusConflict)
+			return
+		}
+		u := prev
+		if role != "" {
+			u.Role = role
+		}
+		if hash != "" {
+			u.PasswordHash, u.SaltHex, u.HashHex = hash, "", ""
+		}
+		cfg.Web.Users[i] = u
+		if err := saveConfigLocked(cfg); err != nil {
+			cfg.Web.Users[i] = prev
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		if hash != "" {
+			// a new password logs the account out everywhere else
+			dropSessions(name, sessionCookie(r))
+			unlockAccount(name)
+		}
+		logger.Printf("USER_UPDATED name=%s role=%s password=%t by=%s", name, u.Role, hash != "", requestUser(r))
+		mustJSON(w, 200, UserInfo{Username: u.Username, Role: u.Role})
+	case "DELETE":
+		cfgMu.Lock()
+		i := userIndexLocked(name)
+		if i < 0 {
+			cfgMu.Unlock()
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		if cfg.Web.Users[i].Role == roleAdmin && adminCountLocked() == 1 {
+			cfgMu.Unlock()
+			http.Error(w, "cannot remove the last admin", http.StatusConflict)
+			return
+		}
+		prev := cfg.Web.Users
+		cfg.Web.Users = slices.Delete(slices.Clone(prev), i, i+1)
+		if err := saveConfigLocked(cfg); err != nil {
+			cfg.Web.Users = prev
+			cfgMu.Unlock()
+			writeSaveError(w, err)
+			return
+		}
+		cfgMu.Unlock()
+		dropSessions(name, "")
+		logger.Printf("USER_DELETED name=%s by=%s", name, requestUser(r))
+		mustJSON(w, 200, map[string]any{"ok": true})
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ---------- Strict rules validation ----------
+
+// By default POST /api/rules clamps bad values into range (threshold 30 -> 20,
+// expect "foo" -> ON). With ?strict=1 it rejects them instead and lists every bad
+// field, so a broken client can't silently change what the machine does.
+
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type fieldErrors []FieldError
+
+func (fe *fieldErrors) add(field, format string, args ...any) {
+	*fe = append(*fe, FieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+}
+
+func (fe *fieldErrors) between(field string, v, lo, hi int) {
+	if v < lo || v > hi {
+		fe.add(field, "must be %d-%d, got %d", lo, hi, v)
+	}
+}
+
+func (fe *fieldErrors) oneOf(field, v string, allowed ...string) {
+	for _, a := range allowed {
+		if v == a {
+			return
+		}
+	}
+	names := make([]string, len(allowed))
+	for i, a := range allowed {
+		names[i] = a
+		if a == "" {
+			names[i] = `""`
+		}
+	}
+	fe.add(field, "must be one of %s, got %q", strings.Join(names, ", "), v)
+}
+
+func (fe *fieldErrors) threshold(name string, t ThresholdRule) {
+	fe.between(name+".threshold", t.Threshold, 0, 20)
+	fe.oneOf(name+".mode", t.Mode, "", thresholdReach, thresholdRange, thresholdBelow)
+	if t.Mode == thresholdRange {
+		if lo := clamp(t.Threshold, 0, 20); t.Max < lo || t.Max > 20 {
+			fe.add(name+".max", "must be between threshold (%d) and 20, got %d", lo, t.Max)
+		}
+	}
+}
+
+// strictRuleErrors checks rr as sent, before any clamping.
+func strictRuleErrors(rr Rules) []FieldError {
+	var fe fieldErrors
+	fe.threshold("on", rr.On)
+	fe.threshold("off", rr.Off)
+
+	h := rr.Hit
+	fe.between("hit.offset", h.Offset, 1, 20)
+	fe.oneOf("hit.expect", h.Expect, "ON", "OFF")
+	fe.between("hit.window", h.Window, 0, 20)
+	fe.oneOf("hit.match", h.Match, "", hitMatchFirst, hitMatchAll)
+	fe.between("hit.missAlarm", h.MissAlarm, 0, 100)
+	for i, c := range h.Extra {
+		fe.between(fmt.Sprintf("hit.extra[%d].offset", i), c.Offset, 1, 20)
+		fe.oneOf(fmt.Sprintf("hit.extra[%d].expect", i), c.Expect, "ON", "OFF")
+	}
+	if len(h.Extra) > 0 && len(sanitizeHitChecks(h.Extra, h.Offset, h.Window)) != len(h.Extra) {
+		fe.add("hit.extra", "checks overlap each other or the primary check (or more than %d)", maxHitChecks-1)
+	}
+
+	fe.between("limits.perDay", rr.Limits.PerDay, 0, 10000)
+	fe.between("limits.perHour", rr.Limits.PerHour, 0, 10000)
+	fe.between("ttl", rr.TTL, 0, maxTTLBlocks)
+
+	c := rr.Counting
+	fe.oneOf("counting.mode", c.Mode, "", countReset, countWindow, countDecay)
+	switch c.Mode {
+	case countWindow:
+		fe.between("counting.window", c.Window, 2, countMaxWindow)
+	case countDecay:
+		fe.between("counting.decay", c.Decay, 1, 20)
+	}
+	if rr.Alternation.Enabled {
+		fe.between("alternation.length", rr.Alternation.Length, 2, 20)
+	}
+
+	sc := rr.Schedule
+	if err := sc.normalize(); err != nil {
+		fe.add("schedule", "%v", err)
+	}
+	seq := rr.Sequence
+	if err := seq.normalize(); err != nil {
+		fe.add("sequence", "%v", err)
+	}
+	if err := validatePayload(rr.Payload); err != nil {
+		fe.add("payload", "%v", err)
+	}
+	if err := validateSeverities(rr.Severity); err != nil {
+		fe.add("severity", "%v", err)
+	}
+	return fe
+}
+
+func writeFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	mustJSON(w, http.StatusBadRequest, map[string]any{"error": "validation failed", "errors": errs})
+}
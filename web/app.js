@@ -8,10 +8,22 @@ async function apiGet(path) {
   return res.json();
 }
 
+// changes need the session's CSRF token (see csrf.go); fetched once
+let csrfPromise = null;
+function csrfToken() {
+  if (!csrfPromise) {
+    csrfPromise = apiGet("api/me").then(me => me.csrfToken).catch(e => {
+      csrfPromise = null;
+      throw e;
+    });
+  }
+  return csrfPromise;
+}
+
 async function apiPost(path, body) {
   const res = await fetch(path, {
     method: "POST",
-    headers: { "Content-Type": "application/json" },
+    headers: { "Content-Type": "application/json", "X-CSRF-Token": await csrfToken() },
     credentials: "include",
     body: JSON.stringify(body),
   });
@@ -19,6 +31,12 @@ async function apiPost(path, body) {
   return res.json();
 }
 
+async function apiDelete(path) {
+  const res = await fetch(path, { method: "DELETE", headers: { "X-CSRF-Token": await csrfToken() }, credentials: "include" });
+  if (!res.ok) throw new Error(await res.text());
+  return res.json();
+}
+
 function setMsg(id, text, ok) {
   const el = $(id);
   el.textContent = text || "";
@@ -35,7 +53,7 @@ function bindRange(rangeId, valId) {
 }
 
 async function loadAPIKeys() {
-  const data = await apiGet("/api/apikey");
+  const data = await apiGet("api/apikey");
   const keys = (data.apiKeys || []).join("\n");
   $("apikeys").value = keys;
 }
@@ -44,7 +62,7 @@ async function saveAPIKeys() {
   const raw = $("apikeys").value || "";
   const keys = raw.split("\n").map(s => s.trim()).filter(Boolean);
   try {
-    const out = await apiPost("/api/apikey", { apiKeys: keys });
+    const out = await apiPost("api/apikey", { apiKeys: keys });
     $("apikeys").value = (out.apiKeys || []).join("\n");
     setMsg("msg-apikey", "已保存", true);
   } catch (e) {
@@ -52,8 +70,677 @@ async function saveAPIKeys() {
   }
 }
 
+async function loadTokens() {
+  try {
+    const data = await apiGet("api/tokens");
+    const tbody = $("token-list");
+    tbody.innerHTML = "";
+    for (const t of data.tokens || []) {
+      const tr = document.createElement("tr");
+      const expires = t.expiresAt ? new Date(t.expiresAt).toLocaleString() : "永不";
+      const lastUsed = t.lastUsedAt ? new Date(t.lastUsedAt).toLocaleString() + " " + (t.lastIP || "") : "从未";
+      [t.id, t.label || "", t.token, (t.scopes || []).join(", "), String(t.uses), lastUsed, expires].forEach(text => {
+        const td = document.createElement("td");
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+      const td = document.createElement("td");
+      const btn = document.createElement("button");
+      btn.textContent = "吊销";
+      btn.addEventListener("click", () => revokeToken(t.id));
+      td.appendChild(btn);
+      tr.appendChild(td);
+      tbody.appendChild(tr);
+    }
+  } catch (e) {
+    setMsg("msg-tokens", "加载失败: " + e.message, false);
+  }
+}
+
+async function createToken() {
+  const scopes = ["signals", "read", "control"].filter(s => $("token-scope-" + s).checked);
+  try {
+    const days = Number($("token-ttl").value);
+    const expiresAt = days > 0 ? new Date(Date.now() + days * 86400000).toISOString() : "";
+    const label = $("token-label").value.trim();
+    const out = await apiPost("api/tokens", { scopes, expiresAt, label });
+    $("token-new").textContent = "新 Token（只显示这一次）：" + out.token;
+    $("token-label").value = "";
+    setMsg("msg-tokens", "已创建", true);
+    loadTokens();
+  } catch (e) {
+    setMsg("msg-tokens", "创建失败: " + e.message, false);
+  }
+}
+
+async function revokeToken(id) {
+  if (!confirm("吊销 Token " + id + "？")) return;
+  try {
+    await apiDelete("api/tokens/" + id);
+    setMsg("msg-tokens", "已吊销 " + id, true);
+  } catch (e) {
+    setMsg("msg-tokens", "吊销失败: " + e.message, false);
+  }
+  loadTokens();
+}
+
+async function loadMe() {
+  try {
+    const me = await apiGet("api/me");
+    $("me").textContent = "当前登录：" + me.username + "（" + me.role + "）";
+  } catch (e) {
+    $("me").textContent = "";
+  }
+}
+
+async function loadUsers() {
+  try {
+    const data = await apiGet("api/users");
+    const tbody = $("user-list");
+    tbody.innerHTML = "";
+    for (const u of data.users || []) {
+      const tr = document.createElement("tr");
+      const name = document.createElement("td");
+      name.textContent = u.username;
+      tr.appendChild(name);
+
+      const roleTd = document.createElement("td");
+      const sel = document.createElement("select");
+      for (const r of data.roles || []) {
+        const opt = document.createElement("option");
+        opt.value = opt.textContent = r;
+        opt.selected = r === u.role;
+        sel.appendChild(opt);
+      }
+      sel.addEventListener("change", () => updateUser(u.username, { role: sel.value }));
+      roleTd.appendChild(sel);
+      tr.appendChild(roleTd);
+
+      const td = document.createElement("td");
+      const pass = document.createElement("button");
+      pass.textContent = "改密码";
+      pass.addEventListener("click", () => {
+        const p = prompt("新密码（" + u.username + "）");
+        if (p) updateUser(u.username, { password: p });
+      });
+      const del = document.createElement("button");
+      del.textContent = "删除";
+      del.addEventListener("click", () => deleteUser(u.username));
+      td.append(pass, del);
+      tr.appendChild(td);
+      tbody.appendChild(tr);
+    }
+  } catch (e) {
+    setMsg("msg-users", "加载失败: " + e.message, false);
+  }
+}
+
+async function loadLogins() {
+  try {
+    const data = await apiGet("api/logins");
+    const locked = (data.locked || []).map(l => l.username + " 至 " + new Date(l.untilISO).toLocaleString());
+    $("login-locked").textContent = locked.length ? "已锁定：" + locked.join("；") : "";
+    const tbody = $("login-list");
+    tbody.innerHTML = "";
+    for (const a of (data.attempts || []).slice(0, 50)) {
+      const tr = document.createElement("tr");
+      [new Date(a.timeISO).toLocaleString(), a.username, a.ip, a.result].forEach(text => {
+        const td = document.createElement("td");
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+      tbody.appendChild(tr);
+    }
+  } catch (e) {
+    setMsg("msg-users", "加载失败: " + e.message, false);
+  }
+}
+
+async function createUser() {
+  try {
+    await apiPost("api/users", {
+      username: $("user-name").value.trim(),
+      password: $("user-pass").value,
+      role: $("user-role").value,
+    });
+    $("user-name").value = "";
+    $("user-pass").value = "";
+    setMsg("msg-users", "已创建", true);
+  } catch (e) {
+    setMsg("msg-users", "创建失败: " + e.message, false);
+  }
+  loadUsers();
+}
+
+async function updateUser(name, body) {
+  try {
+    await apiPost("api/users/" + encodeURIComponent(name), body);
+    setMsg("msg-users", "已保存 " + name, true);
+  } catch (e) {
+    setMsg("msg-users", "保存失败: " + e.message, false);
+  }
+  loadUsers();
+  loadMe();
+}
+
+async function deleteUser(name) {
+  if (!confirm("删除账号 " + name + "？")) return;
+  try {
+    await apiDelete("api/users/" + encodeURIComponent(name));
+    setMsg("msg-users", "已删除 " + name, true);
+  } catch (e) {
+    setMsg("msg-users", "删除失败: " + e.message, false);
+  }
+  loadUsers();
+}
+
+async function loadWebhook() {
+  const data = await apiGet("api/webhook");
+  $("webhook-url").value = data.url || "";
+}
+
+async function saveWebhook() {
+  try {
+    const out = await apiPost("api/webhook", { url: $("webhook-url").value.trim() });
+    $("webhook-url").value = out.webhook?.url || "";
+    setMsg("msg-webhook", "已保存", true);
+  } catch (e) {
+    setMsg("msg-webhook", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadWebhookEndpoints() {
+  const data = await apiGet("api/webhook/endpoints");
+  const eps = data.endpoints || [];
+  $("webhook-endpoints").value = eps.length ? JSON.stringify(eps, null, 2) : "";
+}
+
+async function saveWebhookEndpoints() {
+  try {
+    const text = $("webhook-endpoints").value.trim();
+    const endpoints = text ? JSON.parse(text) : [];
+    const out = await apiPost("api/webhook/endpoints", { endpoints });
+    const eps = out.endpoints || [];
+    $("webhook-endpoints").value = eps.length ? JSON.stringify(eps, null, 2) : "";
+    setMsg("msg-webhook-endpoints", "已保存", true);
+  } catch (e) {
+    setMsg("msg-webhook-endpoints", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadWebhookDeliveries() {
+  try {
+    const data = await apiGet("api/webhook/deliveries?limit=50");
+    const tbody = $("webhook-delivery-list");
+    tbody.textContent = "";
+    for (const d of data.deliveries || []) {
+      const tr = document.createElement("tr");
+      [
+        d.time,
+        d.endpoint,
+        String(d.seq),
+        d.type,
+        String(d.attempts),
+        d.ok ? "成功 " + d.status : "失败 " + (d.error || ""),
+      ].forEach(text => {
+        const td = document.createElement("td");
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+      tbody.appendChild(tr);
+    }
+    setMsg("msg-webhook-deliveries", (data.deliveries || []).length + " 条", true);
+    const ob = await apiGet("api/deliveries?limit=1");
+    const pending = Object.entries(ob.pending || {}).map(([ep, n]) => `${ep}: ${n}`);
+    $("outbox-stats").textContent = pending.length
+      ? "离线积压（端点恢复后按顺序补发，重启不丢）：" + pending.join("，")
+      : "无离线积压";
+  } catch (e) {
+    setMsg("msg-webhook-deliveries", "加载失败: " + e.message, false);
+  }
+}
+
+async function previewWebhookTemplate() {
+  try {
+    const data = await apiPost("api/webhook/template/preview", { template: $("webhook-template").value });
+    $("webhook-template-preview").textContent = data.contentType + "\n" + data.body;
+    setMsg("msg-webhook-template", "OK", true);
+  } catch (e) {
+    $("webhook-template-preview").textContent = "";
+    setMsg("msg-webhook-template", e.message, false);
+  }
+}
+
+async function retryDeliveries() {
+  try {
+    await apiPost("api/deliveries/retry", {});
+    setMsg("msg-webhook-deliveries", "已触发重试", true);
+    setTimeout(loadWebhookDeliveries, 2000);
+  } catch (e) {
+    setMsg("msg-webhook-deliveries", "重试失败: " + e.message, false);
+  }
+}
+
+async function loadSignals() {
+  try {
+    const data = await apiGet("api/signals?limit=50");
+    const tbody = $("signal-list");
+    tbody.textContent = "";
+    for (const s of data.signals || []) {
+      const tr = document.createElement("tr");
+      const sev = s.severity || "normal";
+      tr.className = "sev-" + sev;
+      [String(s.seq || "-"), s.type, sev, String(s.height), s.time].forEach(text => {
+        const td = document.createElement("td");
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+      tbody.appendChild(tr);
+    }
+    setMsg("msg-signals", (data.signals || []).length + " 条", true);
+  } catch (e) {
+    setMsg("msg-signals", "加载失败: " + e.message, false);
+  }
+}
+
+async function loadMQTT() {
+  const data = await apiGet("api/mqtt");
+  const m = data.mqtt || {};
+  $("mqtt-broker").value = m.broker || "";
+  $("mqtt-topic").value = m.topic || "";
+  $("mqtt-qos").value = String(m.qos || 0);
+  $("mqtt-username").value = m.username || "";
+  $("mqtt-password").value = m.password || "";
+  const st = data.stats || {};
+  $("mqtt-stats").textContent = m.broker
+    ? `${st.connected ? "已连接" : "未连接"}，已发布 ${st.published || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveMQTT() {
+  try {
+    await apiPost("api/mqtt", {
+      broker: $("mqtt-broker").value.trim(),
+      topic: $("mqtt-topic").value.trim(),
+      qos: parseInt($("mqtt-qos").value, 10) || 0,
+      username: $("mqtt-username").value.trim(),
+      password: $("mqtt-password").value,
+    });
+    setMsg("msg-mqtt", "已保存", true);
+    loadMQTT();
+  } catch (e) {
+    setMsg("msg-mqtt", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadNATS() {
+  const data = await apiGet("api/nats");
+  const n = data.nats || {};
+  $("nats-url").value = n.url || "";
+  $("nats-subject").value = n.subject || "";
+  $("nats-event-subject").value = n.eventSubject || "";
+  $("nats-token").value = n.token || "";
+  $("nats-user").value = n.user || "";
+  $("nats-password").value = n.password || "";
+  const st = data.stats || {};
+  $("nats-stats").textContent = n.url
+    ? `${st.connected ? "已连接" : "未连接"}（连接 ${st.connects || 0} 次），已发布 ${st.published || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveNATS() {
+  try {
+    await apiPost("api/nats", {
+      url: $("nats-url").value.trim(),
+      subject: $("nats-subject").value.trim(),
+      eventSubject: $("nats-event-subject").value.trim(),
+      token: $("nats-token").value,
+      user: $("nats-user").value.trim(),
+      password: $("nats-password").value,
+    });
+    setMsg("msg-nats", "已保存", true);
+    loadNATS();
+  loadKafka();
+  loadDiscord();
+  loadSlack();
+  loadEmail();
+  loadSMS();
+  loadPush();
+  } catch (e) {
+    setMsg("msg-nats", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadKafka() {
+  const data = await apiGet("api/kafka");
+  const k = data.kafka || {};
+  $("kafka-brokers").value = (k.brokers || []).join(",");
+  $("kafka-signal-topic").value = k.signalTopic || "";
+  $("kafka-block-topic").value = k.blockTopic || "";
+  $("kafka-acks-all").checked = !!k.acksAll;
+  const st = data.stats || {};
+  $("kafka-stats").textContent = (k.brokers || []).length
+    ? `已写入 ${st.produced || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveKafka() {
+  try {
+    await apiPost("api/kafka", {
+      brokers: $("kafka-brokers").value.split(",").map((s) => s.trim()).filter(Boolean),
+      signalTopic: $("kafka-signal-topic").value.trim(),
+      blockTopic: $("kafka-block-topic").value.trim(),
+      acksAll: $("kafka-acks-all").checked,
+    });
+    setMsg("msg-kafka", "已保存", true);
+    loadKafka();
+  } catch (e) {
+    setMsg("msg-kafka", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadDiscord() {
+  const data = await apiGet("api/discord");
+  const chs = data.discord?.channels || [];
+  $("discord-channels").value = chs.length ? JSON.stringify(chs, null, 2) : "";
+  const st = data.stats || {};
+  $("discord-stats").textContent = chs.length
+    ? `已发送 ${st.sent || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveDiscord() {
+  try {
+    const text = $("discord-channels").value.trim();
+    await apiPost("api/discord", { channels: text ? JSON.parse(text) : [] });
+    setMsg("msg-discord", "已保存", true);
+    loadDiscord();
+  } catch (e) {
+    setMsg("msg-discord", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadSlack() {
+  const data = await apiGet("api/slack");
+  const sc = data.slack || {};
+  const def = data.defaults || {};
+  $("slack-webhook-url").value = sc.webhookUrl || "";
+  $("slack-bot-token").value = sc.botToken || "";
+  $("slack-channel").value = sc.channel || "";
+  $("slack-signals").checked = !!sc.signals;
+  $("slack-types").value = (sc.types || []).join(",");
+  $("slack-min-severity").value = sc.minSeverity || "";
+  $("slack-incidents").checked = !!sc.incidents;
+  $("slack-signal-template").value = sc.signalTemplate || "";
+  $("slack-signal-template").placeholder = def.signalTemplate || "";
+  $("slack-incident-template").value = sc.incidentTemplate || "";
+  $("slack-incident-template").placeholder = def.incidentTemplate || "";
+  const st = data.stats || {};
+  $("slack-stats").textContent = sc.webhookUrl || sc.botToken
+    ? `已发送 ${st.sent || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}，限流 ${st.rateLimited || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveSlack() {
+  try {
+    await apiPost("api/slack", {
+      webhookUrl: $("slack-webhook-url").value.trim(),
+      botToken: $("slack-bot-token").value.trim(),
+      channel: $("slack-channel").value.trim(),
+      signals: $("slack-signals").checked,
+      types: $("slack-types").value.split(",").map((s) => s.trim()).filter(Boolean),
+      minSeverity: $("slack-min-severity").value,
+      incidents: $("slack-incidents").checked,
+      signalTemplate: $("slack-signal-template").value,
+      incidentTemplate: $("slack-incident-template").value,
+    });
+    setMsg("msg-slack", "已保存", true);
+    loadSlack();
+  } catch (e) {
+    setMsg("msg-slack", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadEmail() {
+  const data = await apiGet("api/email");
+  const ec = data.email || {};
+  $("email-host").value = ec.host || "";
+  $("email-port").value = ec.port || "";
+  $("email-tls").value = ec.tls || "starttls";
+  $("email-username").value = ec.username || "";
+  $("email-password").value = ec.password || "";
+  $("email-from").value = ec.from || "";
+  $("email-to").value = (ec.to || []).join(",");
+  $("email-batch").value = ec.batchSeconds || "";
+  $("email-incidents").checked = !!ec.incidents;
+  $("email-signals").checked = !!ec.signals;
+  $("email-types").value = (ec.types || []).join(",");
+  $("email-min-severity").value = ec.minSeverity || "";
+  const st = data.stats || {};
+  $("email-stats").textContent = ec.host
+    ? `已发 ${st.sent || 0} 封（${st.items || 0} 条），失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveEmail() {
+  try {
+    await apiPost("api/email", {
+      host: $("email-host").value.trim(),
+      port: parseInt($("email-port").value, 10) || 0,
+      tls: $("email-tls").value,
+      username: $("email-username").value.trim(),
+      password: $("email-password").value,
+      from: $("email-from").value.trim(),
+      to: $("email-to").value.split(",").map((s) => s.trim()).filter(Boolean),
+      batchSeconds: parseInt($("email-batch").value, 10) || 0,
+      incidents: $("email-incidents").checked,
+      signals: $("email-signals").checked,
+      types: $("email-types").value.split(",").map((s) => s.trim()).filter(Boolean),
+      minSeverity: $("email-min-severity").value,
+    });
+    setMsg("msg-email", "已保存", true);
+    loadEmail();
+  } catch (e) {
+    setMsg("msg-email", "保存失败: " + e.message, false);
+  }
+}
+
+async function testEmail() {
+  try {
+    await apiPost("api/email/test", {});
+    setMsg("msg-email", "测试邮件已发送", true);
+  } catch (e) {
+    setMsg("msg-email", "发送失败: " + e.message, false);
+  }
+}
+
+async function loadSMS() {
+  const data = await apiGet("api/sms");
+  const sc = data.sms || {};
+  $("sms-provider").value = sc.provider || "";
+  $("sms-account-sid").value = sc.accountSid || "";
+  $("sms-auth-token").value = sc.authToken || "";
+  $("sms-from").value = sc.from || "";
+  $("sms-gateway-url").value = sc.gatewayUrl || "";
+  $("sms-to").value = (sc.to || []).join(",");
+  $("sms-kinds").value = (sc.kinds || []).join(",");
+  $("sms-kinds").placeholder = "incident 类型（默认 " + (data.defaultKinds || []).join(",") + "）";
+  $("sms-daily-cap").value = sc.dailyCap || "";
+  const st = data.stats || {};
+  $("sms-stats").textContent = sc.provider
+    ? `今日已发 ${st.sentToday || 0}，累计 ${st.sent || 0}，失败 ${st.failed || 0}，超上限未发 ${st.capped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function saveSMS() {
+  try {
+    await apiPost("api/sms", {
+      provider: $("sms-provider").value,
+      accountSid: $("sms-account-sid").value.trim(),
+      authToken: $("sms-auth-token").value.trim(),
+      from: $("sms-from").value.trim(),
+      gatewayUrl: $("sms-gateway-url").value.trim(),
+      to: $("sms-to").value.split(",").map((s) => s.trim()).filter(Boolean),
+      kinds: $("sms-kinds").value.split(",").map((s) => s.trim()).filter(Boolean),
+      dailyCap: parseInt($("sms-daily-cap").value, 10) || 0,
+    });
+    setMsg("msg-sms", "已保存", true);
+    loadSMS();
+  } catch (e) {
+    setMsg("msg-sms", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadPush() {
+  const data = await apiGet("api/push");
+  const pc = data.push || {};
+  $("push-provider").value = pc.provider || "";
+  $("push-server").value = pc.server || "";
+  $("push-topic").value = pc.topic || "";
+  $("push-token").value = pc.token || "";
+  $("push-types").value = (pc.types || []).join(",");
+  $("push-min-severity").value = pc.minSeverity || "";
+  $("push-incidents").checked = !!pc.incidents;
+  const st = data.stats || {};
+  $("push-stats").textContent = pc.provider
+    ? `已推送 ${st.sent || 0}，失败 ${st.failed || 0}，丢弃 ${st.dropped || 0}` +
+      (st.lastError ? `，最近错误：${st.lastError}` : "")
+    : "";
+}
+
+async function savePush() {
+  try {
+    await apiPost("api/push", {
+      provider: $("push-provider").value,
+      server: $("push-server").value.trim(),
+      topic: $("push-topic").value.trim(),
+      token: $("push-token").value.trim(),
+      types: $("push-types").value.split(",").map((s) => s.trim()).filter(Boolean),
+      minSeverity: $("push-min-severity").value,
+      incidents: $("push-incidents").checked,
+    });
+    setMsg("msg-push", "已保存", true);
+    loadPush();
+  } catch (e) {
+    setMsg("msg-push", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadWS() {
+  const data = await apiGet("api/ws/config");
+  $("ws-replay").value = data.replay || 0;
+  $("ws-ack-retries").value = data.ackRetries || 0;
+}
+
+async function saveWS() {
+  try {
+    const out = await apiPost("api/ws/config", {
+      replay: parseInt($("ws-replay").value, 10) || 0,
+      ackRetries: parseInt($("ws-ack-retries").value, 10) || 0,
+    });
+    $("ws-replay").value = out.ws?.replay || 0;
+    $("ws-ack-retries").value = out.ws?.ackRetries || 0;
+    setMsg("msg-ws", "已保存", true);
+  } catch (e) {
+    setMsg("msg-ws", "保存失败: " + e.message, false);
+  }
+}
+
+async function loadWSClients() {
+  try {
+    const data = await apiGet("api/ws/clients");
+    const tbody = $("ws-client-list");
+    tbody.textContent = "";
+    for (const c of data.clients || []) {
+      const tr = document.createElement("tr");
+      [
+        String(c.id),
+        c.ip,
+        [c.user, c.token].filter(Boolean).join(" / ") || "-",
+        c.connected,
+        String(c.sent) + (c.dropped ? "（丢弃 " + c.dropped + "）" : ""),
+        c.lastPong || "-",
+      ].forEach(text => {
+        const td = document.createElement("td");
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+      const td = document.createElement("td");
+      const btn = document.createElement("button");
+      btn.textContent = "踢出";
+      btn.addEventListener("click", () => kickWSClient(c.id));
+      td.appendChild(btn);
+      tr.appendChild(td);
+      tbody.appendChild(tr);
+    }
+    setMsg("msg-ws-clients", (data.clients || []).length + " 个连接", true);
+  } catch (e) {
+    setMsg("msg-ws-clients", "加载失败: " + e.message, false);
+  }
+}
+
+async function kickWSClient(id) {
+  try {
+    await apiPost("api/ws/clients/" + id + "/kick", {});
+    setMsg("msg-ws-clients", "已踢出 #" + id, true);
+  } catch (e) {
+    setMsg("msg-ws-clients", "踢出失败: " + e.message, false);
+  }
+  setTimeout(loadWSClients, 300);
+}
+
+async function loadWSBans() {
+  const data = await apiGet("api/ws/bans");
+  $("ws-ban-ips").value = (data.ips || []).join(", ");
+  $("ws-ban-tokens").value = (data.tokens || []).join(", ");
+}
+
+async function saveWSBans() {
+  const list = id => $(id).value.split(",").map(s => s.trim()).filter(Boolean);
+  try {
+    const out = await apiPost("api/ws/bans", { ips: list("ws-ban-ips"), tokens: list("ws-ban-tokens") });
+    setMsg("msg-ws-bans", "已保存" + (out.kicked ? "，断开 " + out.kicked + " 个连接" : ""), true);
+    loadWSClients();
+  } catch (e) {
+    setMsg("msg-ws-bans", "保存失败: " + e.message, false);
+  }
+}
+
+async function toggleMachine() {
+  const enable = !!$("btn-machine-toggle").dataset.disabled;
+  try {
+    await apiPost(enable ? "api/machine/enable" : "api/machine/disable", {});
+    setMsg("msg-rules", enable ? "机器已启用" : "机器已停用", true);
+    loadStatus();
+  } catch (e) {
+    setMsg("msg-rules", "操作失败: " + e.message, false);
+  }
+}
+
+async function toggleSnooze() {
+  const minutes = $("btn-snooze").dataset.snoozed ? 0 : 30;
+  try {
+    await apiPost("api/machine/snooze?minutes=" + minutes, {});
+    setMsg("msg-rules", minutes ? "已静音 30 分钟" : "已取消静音", true);
+    loadStatus();
+  } catch (e) {
+    setMsg("msg-rules", "操作失败: " + e.message, false);
+  }
+}
+
+// last rules from the server: fields this form doesn't edit are sent back unchanged
+let loadedRules = {};
+
 async function loadRules() {
-  const r = await apiGet("/api/rules");
+  const r = await apiGet("api/rules");
+  loadedRules = r;
 
   $("on-enabled").checked = !!r.on?.enabled;
   $("off-enabled").checked = !!r.off?.enabled;
@@ -67,31 +754,180 @@ async function loadRules() {
   $("on-threshold-val").textContent = $("on-threshold").value;
   $("off-threshold-val").textContent = $("off-threshold").value;
   $("hit-offset-val").textContent = $("hit-offset").value;
+  $("hit-window").value = r.hit?.window ?? 0;
+  $("hit-window-val").textContent = $("hit-window").value;
+  $("hit-match").value = r.hit?.match || "first";
+  $("hit-miss-alarm").value = r.hit?.missAlarm ?? 0;
+  $("hit-extra").value = (r.hit?.extra || []).map((c) => `${c.offset}:${c.expect}`).join(",");
+  $("limit-day").value = r.limits?.perDay ?? 0;
+  $("limit-hour").value = r.limits?.perHour ?? 0;
+  $("simulate-enabled").checked = !!r.simulate;
+  $("confirm-enabled").checked = !!r.confirm;
+  $("payload").value = r.payload ? JSON.stringify(r.payload) : "";
+  $("signal-ttl").value = r.ttl ?? 0;
+  $("signal-severity").value = r.severity ? JSON.stringify(r.severity) : "";
+  $("on-mode").value = r.on?.mode || "reach";
+  $("on-max").value = r.on?.max ?? 0;
+  $("off-mode").value = r.off?.mode || "reach";
+  $("off-max").value = r.off?.max ?? 0;
+  $("count-mode").value = r.counting?.mode || "reset";
+  $("count-param").value = r.counting?.mode === "window" ? r.counting.window
+    : r.counting?.mode === "decay" ? r.counting.decay : 0;
 }
 
 async function saveRules() {
+  let payload;
+  try {
+    const raw = $("payload").value.trim();
+    payload = raw ? JSON.parse(raw) : undefined;
+  } catch (e) {
+    setMsg("msg-rules", "附加字段不是合法 JSON", false);
+    return;
+  }
+  let severity;
+  try {
+    const raw = $("signal-severity").value.trim();
+    severity = raw ? JSON.parse(raw) : undefined;
+  } catch (e) {
+    setMsg("msg-rules", "信号级别不是合法 JSON", false);
+    return;
+  }
   const body = {
+    ...loadedRules,
     on: {
       enabled: $("on-enabled").checked,
       threshold: parseInt($("on-threshold").value, 10),
+      mode: $("on-mode").value,
+      max: parseInt($("on-max").value, 10) || 0,
     },
     off: {
       enabled: $("off-enabled").checked,
       threshold: parseInt($("off-threshold").value, 10),
+      mode: $("off-mode").value,
+      max: parseInt($("off-max").value, 10) || 0,
     },
     hit: {
       enabled: $("hit-enabled").checked,
       offset: parseInt($("hit-offset").value, 10),
       expect: $("hit-expect").value,
-    }
+      window: parseInt($("hit-window").value, 10),
+      match: $("hit-match").value,
+      missAlarm: parseInt($("hit-miss-alarm").value, 10) || 0,
+      extra: $("hit-extra").value.split(",").map((p) => p.trim()).filter(Boolean).map((p) => {
+        const [offset, expect] = p.split(":");
+        return { offset: parseInt(offset, 10) || 1, expect: (expect || "ON").trim().toUpperCase() };
+      }),
+    },
+    limits: {
+      perDay: parseInt($("limit-day").value, 10) || 0,
+      perHour: parseInt($("limit-hour").value, 10) || 0,
+    },
+    simulate: $("simulate-enabled").checked,
+    confirm: $("confirm-enabled").checked,
+    payload,
+    ttl: parseInt($("signal-ttl").value, 10) || 0,
+    severity,
+    counting: {
+      mode: $("count-mode").value,
+      window: $("count-mode").value === "window" ? parseInt($("count-param").value, 10) || 0 : 0,
+      decay: $("count-mode").value === "decay" ? parseInt($("count-param").value, 10) || 0 : 0,
+    },
   };
 
   try {
-    await apiPost("/api/rules", body);
+    await apiPost("api/rules?strict=1", body);
     setMsg("msg-rules", "已保存", true);
   } catch (e) {
-    setMsg("msg-rules", "保存失败: " + e.message, false);
+    let msg = e.message;
+    try {
+      msg = JSON.parse(msg).errors.map((fe) => `${fe.field}: ${fe.error}`).join("; ");
+    } catch (_) {
+      // plain-text error
+    }
+    setMsg("msg-rules", "保存失败: " + msg, false);
+  }
+}
+
+function syncJudgeFields() {
+  const t = $("judge-type").value;
+  document.querySelectorAll("[data-judge]").forEach((el) => {
+    el.style.display = el.dataset.judge.split(" ").includes(t) ? "" : "none";
+  });
+}
+
+async function loadJudge() {
+  const data = await apiGet("api/judge");
+  const j = data.rule || {};
+  // rule types registered server-side but unknown to this page (plugins)
+  const sel = $("judge-type");
+  for (const t of data.types || []) {
+    if (![...sel.options].some((o) => o.value === t.name)) {
+      sel.add(new Option(`${t.name}（${t.desc}）`, t.name));
+    }
+  }
+  $("judge-type").value = j.type || "lucky";
+  $("judge-pattern").value = j.pattern || "";
+  $("judge-last").value = j.last ?? 0;
+  $("judge-last-val").textContent = $("judge-last").value;
+  $("judge-pos").value = j.pos || 1;
+  $("judge-pos-val").textContent = $("judge-pos").value;
+  $("judge-width").value = j.width || 2;
+  $("judge-width-val").textContent = $("judge-width").value;
+  $("judge-digits").value = j.digits || 3;
+  $("judge-digits-val").textContent = $("judge-digits").value;
+  $("judge-sum").value = j.sumAtLeast ?? 0;
+  $("judge-sum-val").textContent = $("judge-sum").value;
+  $("judge-atleast").value = j.atLeast || 5;
+  $("judge-atleast-val").textContent = $("judge-atleast").value;
+  $("judge-spec").value = j.spec || "";
+  $("judge-expr").value = j.expr || "";
+  $("judge-script").value = j.script || "";
+  $("judge-version").value = j.version || 0;
+  $("judge-neutral").value = j.neutral || "skip";
+  syncJudgeFields();
+}
+
+async function previewJudge() {
+  try {
+    const out = await apiPost("api/judge/preview", judgeBody());
+    setMsg("msg-judge",
+      `预览 ${out.blocks.length} 块：ON ${out.on} / OFF ${out.off} / NEUTRAL ${out.neutral} / 无法判定 ${out.unjudged}，与当前不同 ${out.changed}`, true);
+  } catch (e) {
+    setMsg("msg-judge", "预览失败: " + e.message, false);
+  }
+}
+
+async function saveJudge() {
+  try {
+    await apiPost("api/judge", judgeBody());
+    setMsg("msg-judge", "已切换（状态机已清零）", true);
+  } catch (e) {
+    setMsg("msg-judge", "切换失败: " + e.message, false);
+  }
+}
+
+function judgeBody() {
+  const body = { type: $("judge-type").value, neutral: $("judge-neutral").value };
+  if (body.type === "lucky") {
+    body.pos = parseInt($("judge-pos").value, 10);
+    body.width = parseInt($("judge-width").value, 10);
+  } else if (body.type === "regex") {
+    body.pattern = $("judge-pattern").value;
+    body.last = parseInt($("judge-last").value, 10);
+  } else if (body.type === "digitsum") {
+    body.digits = parseInt($("judge-digits").value, 10);
+    body.sumAtLeast = parseInt($("judge-sum").value, 10);
+  } else if (body.type === "heightdigit") {
+    body.atLeast = parseInt($("judge-atleast").value, 10);
+  } else if (body.type === "pattern3") {
+    body.spec = $("judge-spec").value;
+  } else if (body.type === "expr") {
+    body.expr = $("judge-expr").value;
+  } else if (body.type === "script") {
+    body.script = $("judge-script").value.trim();
+    body.version = parseInt($("judge-version").value, 10) || 0;
   }
+  return body;
 }
 
 function renderStatus(st) {
@@ -99,27 +935,86 @@ function renderStatus(st) {
   $("ws-reconnect").textContent = String(st.reconnects ?? 0);
   $("last-height").textContent = st.lastHeight ? String(st.lastHeight) : "-";
   $("last-time").textContent = st.lastTimeISO || "-";
+  $("btn-machine-toggle").textContent = st.disabled ? "启用机器" : "停用机器";
+  $("btn-machine-toggle").dataset.disabled = st.disabled ? "1" : "";
+  $("btn-snooze").textContent = st.snoozeSeconds ? "取消静音" : "静音 30 分钟";
+  $("btn-snooze").dataset.snoozed = st.snoozeSeconds ? "1" : "";
+  $("sys-paused").textContent = st.disabled ? "已停用"
+    : st.snoozeSeconds ? `静音中（剩余 ${Math.ceil(st.snoozeSeconds / 60)} 分钟）`
+    : st.paused ? `已暂停（${st.paused === "day" ? "日" : "小时"}上限，至 ${st.pausedUntil}）`
+    : st.offSchedule ? "非活跃时段" : "-";
+  const m = st.machine;
+  $("machine-counters").textContent = m
+    ? `${m.onCounter} / ${m.offCounter}${m.waitingReverse ? "（等待反向）" : ""}${m.pending ? `（待确认 ${m.pending}）` : ""}`
+    : "-";
+  const today = st.stats?.today;
+  $("stats-today").textContent = today
+    ? `${today.triggers} / ${today.hits} / ${today.misses}（${(today.hitRate * 100).toFixed(1)}%）`
+    : "-";
+  $("stats-streak").textContent = st.stats
+    ? `${st.stats.longestOnStreak} / ${st.stats.longestOffStreak}`
+    : "-";
+  renderBlocks(st.blocks || []);
+}
+
+function renderBlocks(blocks) {
+  const tbody = $("block-list");
+  tbody.textContent = "";
+  for (const b of blocks) {
+    const tr = document.createElement("tr");
+    const cells = [
+      String(b.height),
+      b.hash ? b.hash.slice(0, 8) + "…" + b.hash.slice(-6) : "-",
+      (b.state || "-") + (b.shadow ? " / 影子 " + b.shadow : ""),
+      b.time || "-",
+    ];
+    cells.forEach((text, i) => {
+      const td = document.createElement("td");
+      td.textContent = text;
+      if (i === 2 && (b.state === "ON" || b.state === "OFF")) td.className = b.state === "ON" ? "st-on" : "st-off";
+      tr.appendChild(td);
+    });
+    tbody.appendChild(tr);
+  }
 }
 
 async function loadStatus() {
   try {
-    const st = await apiGet("/api/status");
+    const st = await apiGet("api/status");
     renderStatus(st);
   } catch (e) {
     // likely not logged in
   }
 }
 
+let sseOpen = false;
+let sseStatus = null;
+
 function startSSE() {
-  const es = new EventSource("/sse/status");
+  const es = new EventSource("sse/status?delta=1");
+  es.onopen = () => (sseOpen = true);
   es.addEventListener("status", (ev) => {
     try {
-      const st = JSON.parse(ev.data);
-      renderStatus(st);
+      sseStatus = JSON.parse(ev.data);
+      renderStatus(sseStatus);
+    } catch {}
+  });
+  es.addEventListener("delta", (ev) => {
+    if (!sseStatus) return;
+    try {
+      const d = JSON.parse(ev.data);
+      Object.assign(sseStatus, d.changed || {});
+      for (const k of d.removed || []) delete sseStatus[k];
+      if (d.blocksAdded) {
+        const blocks = sseStatus.blocks || [];
+        sseStatus.blocks = d.blocksAdded.concat(blocks).slice(0, Math.max(blocks.length, 50));
+      }
+      renderStatus(sseStatus);
     } catch {}
   });
   es.onerror = () => {
-    // EventSource will auto-reconnect
+    // EventSource will auto-reconnect; poll until it does
+    sseOpen = false;
   };
 }
 
@@ -127,16 +1022,64 @@ function init() {
   bindRange("on-threshold", "on-threshold-val");
   bindRange("off-threshold", "off-threshold-val");
   bindRange("hit-offset", "hit-offset-val");
+  bindRange("judge-last", "judge-last-val");
+  bindRange("judge-pos", "judge-pos-val");
+  bindRange("judge-width", "judge-width-val");
+  bindRange("judge-digits", "judge-digits-val");
+  bindRange("judge-sum", "judge-sum-val");
+  bindRange("judge-atleast", "judge-atleast-val");
+  bindRange("hit-window", "hit-window-val");
 
   $("btn-save-apikey").addEventListener("click", saveAPIKeys);
   $("btn-save-rules").addEventListener("click", saveRules);
+  $("btn-save-judge").addEventListener("click", saveJudge);
+  $("btn-preview-judge").addEventListener("click", previewJudge);
+  $("judge-type").addEventListener("change", syncJudgeFields);
+  $("btn-save-webhook").addEventListener("click", saveWebhook);
+  $("btn-save-webhook-endpoints").addEventListener("click", saveWebhookEndpoints);
+  $("btn-webhook-deliveries").addEventListener("click", loadWebhookDeliveries);
+  $("btn-retry-deliveries").addEventListener("click", retryDeliveries);
+  $("btn-preview-template").addEventListener("click", previewWebhookTemplate);
+  $("btn-signals").addEventListener("click", loadSignals);
+  $("btn-save-ws").addEventListener("click", saveWS);
+  $("btn-save-mqtt").addEventListener("click", saveMQTT);
+  $("btn-save-nats").addEventListener("click", saveNATS);
+  $("btn-save-kafka").addEventListener("click", saveKafka);
+  $("btn-save-discord").addEventListener("click", saveDiscord);
+  $("btn-save-slack").addEventListener("click", saveSlack);
+  $("btn-save-email").addEventListener("click", saveEmail);
+  $("btn-test-email").addEventListener("click", testEmail);
+  $("btn-save-sms").addEventListener("click", saveSMS);
+  $("btn-save-push").addEventListener("click", savePush);
+  $("btn-ws-clients").addEventListener("click", loadWSClients);
+  $("btn-create-token").addEventListener("click", createToken);
+  $("btn-create-user").addEventListener("click", createUser);
+  $("btn-logins").addEventListener("click", loadLogins);
+  $("btn-save-ws-bans").addEventListener("click", saveWSBans);
+  $("btn-machine-toggle").addEventListener("click", toggleMachine);
+  $("btn-snooze").addEventListener("click", toggleSnooze);
 
   loadAPIKeys();
+  loadTokens();
+  loadMe();
+  loadUsers();
   loadRules();
+  loadJudge();
+  loadWebhook();
+  loadWebhookEndpoints();
+  loadWebhookDeliveries();
+  loadSignals();
+  loadWS();
+  loadMQTT();
+  loadNATS();
+  loadWSClients();
+  loadWSBans();
   loadStatus();
   startSSE();
 
-  setInterval(loadStatus, 3000);
+  setInterval(() => {
+    if (!sseOpen) loadStatus();
+  }, 3000);
 }
 
 window.addEventListener("DOMContentLoaded", init);
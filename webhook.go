@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ---------- Signal webhook ----------
+
+// HTTP endpoints that receive signals as the same JSON the WS clients get.
+// Delivery is asynchronous (the engine never waits on it): each endpoint has its
+// own queue and worker, so a slow endpoint only delays itself, and failures are
+// retried with exponential backoff. What still fails, or finds the endpoint's
+// queue full, is parked in the outbox and sent later (outbox.go).
+//
+// The plain Webhook.URL is kept as the endpoint "default" (every type, unsigned).
+// Endpoints added via /api/webhook/endpoints can subscribe to a subset of types
+// and carry a secret; the body is then signed with HMAC-SHA256 and sent as
+//
+//	X-Tron-Signal-Signature: sha256=<hex>
+//
+// next to X-Tron-Signal-Delivery (<endpoint>-<seq>, stable across retries). The
+// outcome of the last webhookLogSize deliveries is kept for
+// /api/webhook/deliveries.
+
+const (
+	webhookQueueSize    = 256
+	webhookAttempts     = 5
+	webhookBackoff      = time.Second // doubled after every failed attempt
+	webhookTimeout      = 5 * time.Second
+	webhookLogSize      = 500
+	maxWebhookEndpoints = 16
+)
+
+type WebhookConfig struct {
+	URL string `json:"url"` // empty = disabled
+}
+
+type WebhookEndpoint struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Types  []string `json:"types,omitempty"` // empty = every type
+	// kept in the list but not sent to
+	Disabled bool `json:"disabled,omitempty"`
+	// body template replacing the signal JSON, and its content type (payloadtmpl.go)
+	Template    string `json:"template,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type webhookTarget struct {
+	id          string
+	url         string
+	secret      string
+	types       map[string]bool
+	tmpl        *template.Template
+	contentType string
+}
+
+// webhookTargets returns where signals go right now.
+func webhookTargets() []webhookTarget {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	var out []webhookTarget
+	if cfg.Webhook.URL != "" {
+		out = append(out, webhookTarget{id: "default", url: cfg.Webhook.URL})
+	}
+	for _, ep := range cfg.WebhookEndpoints {
+		if ep.Disabled {
+			continue
+		}
+		t := webhookTarget{id: ep.ID, url: ep.URL, secret: ep.Secret, types: parseTypes(ep.Types)}
+		if ep.Template != "" {
+			// validated when saved
+			t.tmpl, _ = parsePayloadTemplate(ep.Template)
+			t.contentType = ep.ContentType
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+func webhookTargetByID(id string) (webhookTarget, bool) {
+	for _, t := range webhookTargets() {
+		if t.id == id {
+			return t, true
+		}
+	}
+	return webhookTarget{}, false
+}
+
+var webhookC = make(chan Signal, webhookQueueSize)
+
+func enqueueWebhook(s Signal) {
+	select {
+	case webhookC <- s:
+	default:
+		logger.Printf("WEBHOOK_DROP type=%s height=%d (queue full)", s.Type, s.Height)
+	}
+}
+
+// webhookLoop fans signals out to one worker per endpoint.
+func webhookLoop() {
+	client := &http.Client{Timeout: webhookTimeout}
+	workers := map[string]chan Signal{}
+	for s := range webhookC {
+		targets := webhookTargets()
+		live := map[string]bool{}
+		for _, t := range targets {
+			live[t.id] = true
+		}
+		for id, ch := range workers {
+			if !live[id] {
+				close(ch)
+				delete(workers, id)
+			}
+		}
+		for _, t := range targets {
+			if len(t.types) > 0 && !t.types[s.Type] {
+				continue
+			}
+			ch := workers[t.id]
+			if ch == nil {
+				ch = make(chan Signal, webhookQueueSize)
+				workers[t.id] = ch
+				go webhookWorker(client, t.id, ch)
+			}
+			select {
+			case ch <- s:
+			default:
+				logger.Printf("WEBHOOK_PARKED endpoint=%s type=%s height=%d (queue full)", t.id, s.Type, s.Height)
+				if body, ct, err := webhookBody(t, s); err == nil {
+					outboxPut(newOutboxItem(t.id, s, body, ct))
+				}
+			}
+		}
+	}
+}
+
+func webhookWorker(client *http.Client, id string, ch chan Signal) {
+	for s := range ch {
+		// re-read so a changed url/secret applies to what is still queued
+		t, ok := webhookTargetByID(id)
+		if !ok {
+			continue
+		}
+		body, ct, err := webhookBody(t, s)
+		if err != nil {
+			logger.Printf("WEBHOOK_TEMPLATE_ERROR endpoint=%s type=%s height=%d: %v", id, s.Type, s.Height, err)
+			continue
+		}
+		if outboxPending(id) > 0 {
+			// keep order behind what is parked; outboxLoop sends it
+			outboxPut(newOutboxItem(id, s, body, ct))
+			continue
+		}
+		d := WebhookDelivery{
+			ID:       id + "-" + strconv.FormatUint(s.Seq, 10),
+			Endpoint: id,
+			Seq:      s.Seq,
+			Type:     s.Type,
+			Height:   s.Height,
+			TimeISO:  time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		start := time.Now()
+		backoff := webhookBackoff
+		var lastErr error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			d.Attempts = attempt
+			d.Status, lastErr = postWebhook(client, t, d.ID, ct, body)
+			if lastErr == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+		d.DurationMs = time.Since(start).Milliseconds()
+		d.OK = lastErr == nil
+		if lastErr != nil {
+			d.Error = lastErr.Error()
+			logger.Printf("WEBHOOK_ERROR endpoint=%s type=%s height=%d attempts=%d: %v", id, s.Type, s.Height, d.Attempts, lastErr)
+			it := newOutboxItem(id, s, body, ct)
+			it.Attempts, it.LastError = d.Attempts, d.Error
+			outboxPut(it)
+		}
+		webhookLog.add(d)
+	}
+}
+
+// webhookBody is what t gets for s: the signal JSON, or t's template rendered.
+func webhookBody(t webhookTarget, s Signal) ([]byte, string, error) {
+	if t.tmpl != nil {
+		return renderPayload(t.tmpl, t.contentType, s)
+	}
+	b, err := json.Marshal(s)
+	return b, "application/json", err
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends one attempt and returns the HTTP status (0 when there was none).
+func postWebhook(client *http.Client, t webhookTarget, deliveryID, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Tron-Signal-Delivery", deliveryID)
+	if t.secret != "" {
+		req.Header.Set("X-Tron-Signal-Signature", signWebhook(t.secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, &httpStatusError{Code: resp.StatusCode}
+	}
+	return resp.StatusCode, nil
+}
+
+// ---------- Webhook delivery log ----------
+
+type WebhookDelivery struct {
+	ID         string `json:"id"`
+	Endpoint   string `json:"endpoint"`
+	Seq        uint64 `json:"seq"`
+	Type       string `json:"type"`
+	Height     int64  `json:"height"`
+	Attempts   int    `json:"attempts"`
+	Status     int    `json:"status,omitempty"` // last HTTP status; 0 = no response
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	TimeISO    string `json:"time"` // first attempt
+	DurationMs int64  `json:"durationMs"`
+}
+
+type deliveryLog struct {
+	mu   sync.Mutex
+	list []WebhookDelivery // oldest first
+}
+
+var webhookLog deliveryLog
+
+func (l *deliveryLog) add(d WebhookDelivery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list, d)
+	if len(l.list) > webhookLogSize {
+		l.list = l.list[len(l.list)-webhookLogSize:]
+	}
+}
+
+// apiWebhookDeliveries: GET /api/webhook/deliveries?endpoint=&failed=1&limit=
+// (newest first).
+func apiWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	endpoint := q.Get("endpoint")
+	failed := q.Get("failed") == "1"
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, webhookLogSize)
+	}
+
+	webhookLog.mu.Lock()
+	out := []WebhookDelivery{}
+	for i := len(webhookLog.list) - 1; i >= 0 && len(out) < limit; i-- {
+		d := webhookLog.list[i]
+		if (endpoint != "" && d.Endpoint != endpoint) || (failed && d.OK) {
+			continue
+		}
+		out = append(out, d)
+	}
+	webhookLog.mu.Unlock()
+	mustJSON(w, 200, map[string]any{"deliveries": out})
+}
+
+// ---------- Webhook settings ----------
+
+func validateWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("webhook url must be http(s)://host/...")
+	}
+	return u.String(), nil
+}
+
+func apiGetWebhook(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	mustJSON(w, 200, cfg.Webhook)
+}
+
+func apiSetWebhook(w http.ResponseWriter, r *http.Request) {
+	var wc WebhookConfig
+	if err := readJSON(r, &wc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := validateWebhookURL(wc.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wc.URL = u
+
+	cfgMu.Lock()
+	prev := cfg.Webhook
+	cfg.Webhook = wc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.Webhook = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("WEBHOOK_SET enabled=%v", wc.URL != "")
+	mustJSON(w, 200, map[string]any{"ok": true, "webhook": wc})
+}
+
+var webhookIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func normalizeWebhookEndpoints(eps []WebhookEndpoint) error {
+	if len(eps) > maxWebhookEndpoints {
+		return fmt.Errorf("at most %d endpoints", maxWebhookEndpoints)
+	}
+	seen := map[string]bool{}
+	for i := range eps {
+		ep := &eps[i]
+		ep.ID = strings.TrimSpace(ep.ID)
+		if ep.ID == "" {
+			id, err := randHex(4)
+			if err != nil {
+				return err
+			}
+			ep.ID = id
+		}
+		if !webhookIDRe.MatchString(ep.ID) || ep.ID == "default" {
+			return fmt.Errorf("endpoint id %q: 1-32 of [A-Za-z0-9_-], not \"default\"", ep.ID)
+		}
+		if seen[ep.ID] {
+			return fmt.Errorf("duplicate endpoint id %q", ep.ID)
+		}
+		seen[ep.ID] = true
+		u, err := validateWebhookURL(ep.URL)
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %v", ep.ID, err)
+		}
+		if u == "" {
+			return fmt.Errorf("endpoint %s: url required", ep.ID)
+		}
+		ep.URL = u
+		ep.ContentType = strings.TrimSpace(ep.ContentType)
+		if ep.Template == "" {
+			ep.ContentType = ""
+		} else if _, err := parsePayloadTemplate(ep.Template); err != nil {
+			return fmt.Errorf("endpoint %s: %v", ep.ID, err)
+		}
+		types := parseTypes(ep.Types)
+		ep.Types = nil
+		for t := range types {
+			ep.Types = append(ep.Types, t)
+		}
+		sort.Strings(ep.Types)
+	}
+	return nil
+}
+
+func maskWebhookSecrets(eps []WebhookEndpoint) []WebhookEndpoint {
+	out := make([]WebhookEndpoint, len(eps))
+	copy(out, eps)
+	for i := range out {
+		if out[i].Secret != "" {
+			out[i].Secret = "****"
+		}
+	}
+	return out
+}
+
+func apiGetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	eps := maskWebhookSecrets(cfg.WebhookEndpoints)
+	cfgMu.RUnlock()
+	mustJSON(w, 200, map[string]any{"endpoints": eps})
+}
+
+// apiSetWebhookEndpoints replaces the whole list.
+func apiSetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Endpoints []WebhookEndpoint `json:"endpoints"`
+	}
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalizeWebhookEndpoints(in.Endpoints); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.WebhookEndpoints
+	for i, ep := range in.Endpoints {
+		if ep.Secret != "****" {
+			continue
+		}
+		// "****" is what GET showed: keep the stored secret
+		in.Endpoints[i].Secret = ""
+		for _, p := range prev {
+			if p.ID == ep.ID {
+				in.Endpoints[i].Secret = p.Secret
+			}
+		}
+	}
+	cfg.WebhookEndpoints = in.Endpoints
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.WebhookEndpoints = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("WEBHOOK_ENDPOINTS_SET count=%d", len(in.Endpoints))
+	mustJSON(w, 200, map[string]any{"ok": true, "endpoints": maskWebhookSecrets(in.Endpoints)})
+}
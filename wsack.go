@@ -0,0 +1,98 @@
+package main
+
+import "time"
+
+// ---------- WS acknowledgements ----------
+
+// A client that connects with /ws?ack=1 confirms each signal it gets by sending
+//
+//	{"op":"ack","seq":12}
+//
+// Signals it hasn't confirmed within wsAckTimeout are sent again (same JSON, same
+// seq, so the client can drop duplicates), up to WSConfig.AckRetries times; after
+// that they are given up with a WS_ACK_EXPIRED log line. Events and simulated
+// signals carry no seq and are never tracked. GET /api/ws/clients shows each
+// client's unacknowledged count.
+
+const (
+	wsAckTimeout        = 5 * time.Second
+	wsAckRetriesDefault = 3
+	wsAckRetriesMax     = 10
+	wsAckMaxOutstanding = wsSendQueue
+	wsAckCheckInterval  = time.Second
+)
+
+type pendingAck struct {
+	msg      wsOut
+	sent     time.Time
+	attempts int
+}
+
+// track remembers a signal sent to an ack client.
+func (c *wsConn) track(seq uint64, m wsOut) {
+	if !c.ack || seq == 0 {
+		return
+	}
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	if len(c.unacked) >= wsAckMaxOutstanding {
+		c.evict("too many unacknowledged signals")
+		return
+	}
+	c.unacked[seq] = &pendingAck{msg: m, sent: time.Now(), attempts: 1}
+}
+
+func (c *wsConn) acknowledge(seq uint64) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	if _, ok := c.unacked[seq]; ok {
+		delete(c.unacked, seq)
+		c.acked++
+	}
+}
+
+func (c *wsConn) unackedCount() int {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	return len(c.unacked)
+}
+
+func ackRetries() int {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	if cfg.WS.AckRetries <= 0 {
+		return wsAckRetriesDefault
+	}
+	return cfg.WS.AckRetries
+}
+
+// ackLoop resends overdue signals until the connection closes.
+func (c *wsConn) ackLoop() {
+	t := time.NewTicker(wsAckCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-t.C:
+			retries := ackRetries()
+			c.ackMu.Lock()
+			for seq, p := range c.unacked {
+				if now.Sub(p.sent) < wsAckTimeout {
+					continue
+				}
+				if p.attempts > retries {
+					delete(c.unacked, seq)
+					c.expired++
+					logger.Printf("WS_ACK_EXPIRED remote=%s seq=%d attempts=%d", c.remote, seq, p.attempts)
+					continue
+				}
+				p.attempts++
+				p.sent = now
+				c.retransmits++
+				c.enqueue(p.msg)
+			}
+			c.ackMu.Unlock()
+		}
+	}
+}
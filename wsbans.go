@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ---------- WS kick / ban ----------
+
+// POST /api/ws/clients/{id}/kick closes one connection right away. The ban list
+// (IPs and access tokens) refuses new connections with 403 and, when it is saved,
+// closes the connected clients it matches, so a revoked consumer is cut off at
+// once rather than on its next reconnect.
+
+const maxWSBans = 256
+
+type WSBanList struct {
+	IPs    []string `json:"ips"`
+	Tokens []string `json:"tokens"`
+}
+
+func (b WSBanList) match(ip, token string) string {
+	for _, x := range b.IPs {
+		if x == ip {
+			return "ip"
+		}
+	}
+	if token == "" {
+		return ""
+	}
+	for _, x := range b.Tokens {
+		if x == token {
+			return "token"
+		}
+	}
+	return ""
+}
+
+// wsBanned reports why the upgrade request r is refused ("" when it isn't).
+func wsBanned(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	tok, _ := tokenOK(r)
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg.WSBans.match(ip, tok)
+}
+
+func normalizeBanList(in []string, ips bool) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, x := range in {
+		x = strings.TrimSpace(x)
+		if x == "" || seen[x] {
+			continue
+		}
+		if ips {
+			ip := net.ParseIP(x)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip %q", x)
+			}
+			x = ip.String()
+		}
+		seen[x] = true
+		out = append(out, x)
+	}
+	if len(out) > maxWSBans {
+		return nil, fmt.Errorf("at most %d entries per list", maxWSBans)
+	}
+	return out, nil
+}
+
+func apiGetWSBans(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	mustJSON(w, 200, cfg.WSBans)
+}
+
+func apiSetWSBans(w http.ResponseWriter, r *http.Request) {
+	var bl WSBanList
+	if err := readJSON(r, &bl); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if bl.IPs, err = normalizeBanList(bl.IPs, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bl.Tokens, err = normalizeBanList(bl.Tokens, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfgMu.Lock()
+	prev := cfg.WSBans
+	cfg.WSBans = bl
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.WSBans = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	kicked := 0
+	wsMu.Lock()
+	for c := range wsClients {
+		if reason := bl.match(c.ip, c.token); reason != "" {
+			c.kick("banned " + reason)
+			kicked++
+		}
+	}
+	wsMu.Unlock()
+
+	logger.Printf("WS_BANS_SET ips=%d tokens=%d kicked=%d", len(bl.IPs), len(bl.Tokens), kicked)
+	mustJSON(w, 200, map[string]any{"ok": true, "bans": bl, "kicked": kicked})
+}
+
+// apiKickWSClient: POST /api/ws/clients/{id}/kick
+func apiKickWSClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	wsMu.Lock()
+	var found *wsConn
+	for c := range wsClients {
+		if c.id == id {
+			found = c
+			break
+		}
+	}
+	wsMu.Unlock()
+	if found == nil {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	reason := "operator"
+	if u := requestUser(r); u != "" {
+		reason += " " + u
+	}
+	found.kick(reason)
+	mustJSON(w, 200, map[string]any{"ok": true, "id": id})
+}
+
+// kick closes c on an operator's request.
+func (c *wsConn) kick(reason string) {
+	if c.dead.Load() {
+		return
+	}
+	logger.Printf("WS_KICKED id=%d remote=%s reason=%q", c.id, c.remote, reason)
+	c.Close()
+}
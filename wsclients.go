@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ---------- WS client listing ----------
+
+// Each connection gets an ID and keeps who opened it (IP, web session user, the
+// access token if one was passed as X-Token / ?token=) next to its traffic
+// counters, so operators can see who is consuming signals. The token is kept as
+// presented (for the ban list) and only shown masked.
+
+var wsNextID atomic.Uint64
+
+// identify fills in c's metadata from the upgrade request.
+func (c *wsConn) identify(r *http.Request) {
+	c.id = wsNextID.Add(1)
+	c.ip = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		c.ip = host
+	}
+	c.user = requestUser(r)
+	c.token, _ = tokenOK(r)
+}
+
+type WSClientInfo struct {
+	ID          uint64   `json:"id"`
+	IP          string   `json:"ip"`
+	Remote      string   `json:"remote"`
+	User        string   `json:"user,omitempty"`  // web session the client connected with
+	Token       string   `json:"token,omitempty"` // access token it presented, masked
+	Connected   string   `json:"connected"`
+	LastPong    string   `json:"lastPong,omitempty"`
+	Types       []string `json:"types,omitempty"`
+	MinSeverity string   `json:"minSeverity,omitempty"`
+	Queued      int      `json:"queued"`
+	Sent        uint64   `json:"sent"`
+	Dropped     uint64   `json:"dropped"`
+	Binary      bool     `json:"binary,omitempty"`
+	// ack clients only (see wsack.go)
+	Ack         bool   `json:"ack,omitempty"`
+	Unacked     int    `json:"unacked,omitempty"`
+	Acked       uint64 `json:"acked,omitempty"`
+	Retransmits uint64 `json:"retransmits,omitempty"`
+	Expired     uint64 `json:"expired,omitempty"`
+}
+
+// apiWSClients: GET /api/ws/clients, oldest connection first
+func apiWSClients(w http.ResponseWriter, r *http.Request) {
+	wsMu.Lock()
+	out := make([]WSClientInfo, 0, len(wsClients))
+	for c := range wsClients {
+		info := WSClientInfo{
+			ID:          c.id,
+			IP:          c.ip,
+			Remote:      c.remote,
+			User:        c.user,
+			Token:       maskToken(c.token),
+			Connected:   c.connected.UTC().Format(time.RFC3339),
+			Queued:      len(c.send),
+			Sent:        c.sent.Load(),
+			Dropped:     c.dropped.Load(),
+			Ack:         c.ack,
+			Binary:      c.binary,
+			MinSeverity: c.minSeverity,
+		}
+		if t := c.lastPong.Load(); t != 0 {
+			info.LastPong = time.Unix(0, t).UTC().Format(time.RFC3339)
+		}
+		if c.ack {
+			c.ackMu.Lock()
+			info.Unacked, info.Acked = len(c.unacked), c.acked
+			info.Retransmits, info.Expired = c.retransmits, c.expired
+			c.ackMu.Unlock()
+		}
+		for t := range c.types {
+			info.Types = append(info.Types, t)
+		}
+		sort.Strings(info.Types)
+		out = append(out, info)
+	}
+	wsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	mustJSON(w, 200, map[string]any{
+		"clients":     out,
+		"queueSize":   wsSendQueue,
+		"dropped":     wsDropped.Load(),
+		"slowEvicted": wsSlowEvicted.Load(),
+		"evicted":     wsEvictedTotal.Load(),
+	})
+}
+
+func maskToken(tok string) string {
+	if tok == "" {
+		return ""
+	}
+	if len(tok) <= 8 {
+		return "****"
+	}
+	return tok[:4] + "…" + tok[len(tok)-4:]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ---------- WS heartbeat ----------
+
+// The server pings every client every wsPingInterval. Any frame from the client
+// (pong, ping, message) pushes its read deadline wsPongWait ahead; a client that
+// stays silent past it, or whose socket won't take a frame within wsWriteTimeout,
+// is dropped with a WS_EVICTED log line. Browsers answer pings on their own.
+
+const (
+	wsPingInterval = 20 * time.Second
+	wsPongWait     = 45 * time.Second
+	wsWriteTimeout = 2 * time.Second
+)
+
+// ws opcodes
+const (
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+)
+
+// writeFrame sends one frame to c, giving up after wsWriteTimeout.
+func (c *wsConn) writeFrame(op byte, msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return wsWriteFrame(c.c, op, msg)
+}
+
+// evict drops an unresponsive client.
+func (c *wsConn) evict(reason string) {
+	if c.dead.Load() {
+		return
+	}
+	wsEvictedTotal.Add(1)
+	logger.Printf("WS_EVICTED remote=%s reason=%q", c.remote, reason)
+	c.Close()
+}
+
+// extendRead moves the read deadline after hearing from the client.
+func (c *wsConn) extendRead() {
+	_ = c.c.SetReadDeadline(time.Now().Add(wsPongWait))
+}
+
+func (c *wsConn) pingLoop() {
+	t := time.NewTicker(wsPingInterval)
+	defer t.Stop()
+	for range t.C {
+		if c.dead.Load() {
+			return
+		}
+		if err := c.writeFrame(wsOpPing, nil); err != nil {
+			c.evict("ping: " + err.Error())
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+)
+
+// ---------- Binary WS encoding ----------
+
+// A client that offers the WebSocket subprotocol wsProtoBinary gets every message
+// as a binary frame holding one protobuf-encoded Frame (schema below, also served
+// at GET /api/ws/schema) instead of JSON text. Everything else — subscriptions,
+// replay, acks (still sent as JSON text) — works the same. The encoder is written
+// by hand to keep the binary free of dependencies; it only has to cover the few
+// scalar types below.
+
+const wsProtoBinary = "tron-signal.pb.v1"
+
+const wsProtoSchema = `syntax = "proto3";
+
+package tronsignal.v1;
+
+// One binary WebSocket frame (subprotocol "tron-signal.pb.v1").
+message Frame {
+  oneof msg {
+    Signal signal = 1;
+    Event event = 2;
+  }
+}
+
+message Signal {
+  string type = 1;        // ON, OFF, HIT, MISS, SEQ, ALT, PENDING, CANCELLED, MISS_STREAK
+  int64 height = 2;
+  int64 base_height = 3;
+  string state = 4;
+  string time = 5;        // RFC 3339
+  string instance = 6;
+  int32 offset = 7;
+  int32 streak = 8;
+  string expect = 9;
+  uint64 seq = 10;
+  bool replay = 11;       // resent on connect, see /ws?replay=N
+  string payload = 12;    // Rules.Payload as a JSON object, empty when unset
+  int64 expires_height = 13; // with Rules.TTL, see ttl.go
+  string expires_at = 14;
+  string severity = 15;   // info, normal, critical
+}
+
+message Event {
+  string type = 1;        // SOURCES_DOWN, SOURCES_RECOVERED, LIMIT_REACHED, SUBSCRIBED
+  string detail = 2;
+  string time = 3;
+  string instance = 4;
+}
+`
+
+// wsWantsBinary reports whether the handshake offers the binary subprotocol.
+func wsWantsBinary(r *http.Request) bool {
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if strings.TrimSpace(p) == wsProtoBinary {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func apiWSSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(wsProtoSchema))
+}
+
+func encodeSignalFrame(s Signal, replay bool) []byte {
+	var m []byte
+	m = pbString(m, 1, s.Type)
+	m = pbVarint(m, 2, uint64(s.Height))
+	m = pbVarint(m, 3, uint64(s.BaseHeight))
+	m = pbString(m, 4, s.State)
+	m = pbString(m, 5, s.TimeISO)
+	m = pbString(m, 6, s.Instance)
+	m = pbVarint(m, 7, uint64(int64(s.Offset)))
+	m = pbVarint(m, 8, uint64(int64(s.Streak)))
+	m = pbString(m, 9, s.Expect)
+	m = pbVarint(m, 10, s.Seq)
+	if replay {
+		m = pbVarint(m, 11, 1)
+	}
+	m = pbString(m, 12, s.Extra)
+	m = pbVarint(m, 13, uint64(s.ExpiresHeight))
+	m = pbString(m, 14, s.ExpiresAt)
+	m = pbString(m, 15, s.Severity)
+	return pbBytes(nil, 1, m)
+}
+
+func encodeEventFrame(e Event) []byte {
+	var m []byte
+	m = pbString(m, 1, e.Type)
+	m = pbString(m, 2, e.Detail)
+	m = pbString(m, 3, e.TimeISO)
+	m = pbString(m, 4, e.Instance)
+	return pbBytes(nil, 2, m)
+}
+
+// proto3 wire format: zero values are left out.
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func pbString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return pbBytes(b, field, []byte(s))
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
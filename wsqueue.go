@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ---------- WS send queues ----------
+
+// Broadcasts only queue the message for each client; every connection has its own
+// writer goroutine, so one slow socket can't hold up the others (or the engine).
+// A client whose queue is full when a message arrives loses that message and is
+// disconnected (WS_EVICTED) — it would be missing signals from then on anyway, and
+// can reconnect and catch up through replay or /api/signals. Drops are counted per
+// client and in total; GET /api/ws/clients shows them (wsclients.go).
+
+const wsSendQueue = 128 // >= wsReplayMax, so a full replay always fits
+
+// wsOut is one outgoing message in both encodings; the writer picks the one the
+// client negotiated (see wsproto.go).
+type wsOut struct {
+	text []byte
+	bin  []byte
+}
+
+var (
+	wsDropped      atomic.Uint64 // messages not queued because a queue was full
+	wsSlowEvicted  atomic.Uint64 // clients disconnected for it
+	wsEvictedTotal atomic.Uint64 // all WS_EVICTED disconnects
+)
+
+func newWSConn(conn net.Conn, r *http.Request) *wsConn {
+	c := &wsConn{
+		c:           conn,
+		remote:      r.RemoteAddr,
+		types:       queryTypes(r),
+		minSeverity: querySeverity(r),
+		send:        make(chan wsOut, wsSendQueue),
+		done:        make(chan struct{}),
+		connected:   time.Now(),
+		ack:         r.URL.Query().Get("ack") == "1",
+		binary:      wsWantsBinary(r),
+		unacked:     map[uint64]*pendingAck{},
+	}
+	c.identify(r)
+	return c
+}
+
+// enqueue queues a text message for c without blocking.
+func (c *wsConn) enqueue(m wsOut) {
+	if c.dead.Load() {
+		return
+	}
+	select {
+	case c.send <- m:
+	default:
+		c.dropped.Add(1)
+		wsDropped.Add(1)
+		wsSlowEvicted.Add(1)
+		c.evict("send queue full")
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	for {
+		select {
+		case m := <-c.send:
+			op, b := byte(wsOpText), m.text
+			if c.binary {
+				op, b = wsOpBinary, m.bin
+			}
+			if err := c.writeFrame(op, b); err != nil {
+				c.evict("write: " + err.Error())
+				return
+			}
+			c.sent.Add(1)
+		case <-c.done:
+			return
+		}
+	}
+}
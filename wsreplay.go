@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// ---------- WS replay on connect ----------
+
+// The last few signals sent over /ws are kept in memory; a client that connects
+// gets up to WSConfig.Replay of them first (oldest first, each with "replay":true)
+// so a reconnect after a short drop doesn't lose triggers. A client may ask for
+// fewer or more with /ws?replay=N (at most wsReplayMax). The buffer starts empty
+// at boot; /api/signals covers anything older.
+
+const wsReplayMax = 100
+
+type WSConfig struct {
+	Replay int `json:"replay"` // signals replayed on connect; 0 = off
+	// resends of an unacknowledged signal to ack clients; 0 = default (3)
+	AckRetries int `json:"ackRetries,omitempty"`
+}
+
+type recentSignal struct {
+	s Signal
+	b []byte // as sent
+}
+
+// recently broadcast signals, oldest first (guarded by wsMu)
+var wsRecent []recentSignal
+
+// rememberSignalLocked keeps s (marshalled as b) for replays. Caller holds wsMu.
+func rememberSignalLocked(s Signal, b []byte) {
+	if len(wsRecent) == wsReplayMax {
+		wsRecent = append(wsRecent[:0], wsRecent[1:]...)
+	}
+	wsRecent = append(wsRecent, recentSignal{s, b})
+}
+
+// replayCount is how many signals the connecting client r gets.
+func replayCount(r *http.Request) int {
+	if v := r.URL.Query().Get("replay"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return clamp(n, 0, wsReplayMax)
+		}
+	}
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg.WS.Replay
+}
+
+// replaySignalsLocked queues the last n signals c is subscribed to before it
+// joins the broadcast set, so nothing is missed or sent twice. Caller holds wsMu.
+func replaySignalsLocked(c *wsConn, n int) {
+	start := len(wsRecent)
+	for start > 0 && n > 0 {
+		start--
+		if c.wants(wsRecent[start].s.Type, wsRecent[start].s.Severity) {
+			n--
+		}
+	}
+	for _, rs := range wsRecent[start:] {
+		if !c.wants(rs.s.Type, rs.s.Severity) {
+			continue
+		}
+		m := wsOut{text: markReplay(rs.b), bin: encodeSignalFrame(rs.s, true)}
+		c.enqueue(m)
+		c.track(rs.s.Seq, m)
+	}
+}
+
+// markReplay adds "replay":true to a marshalled signal.
+func markReplay(b []byte) []byte {
+	b = bytes.TrimRight(b, " \n")
+	out := make([]byte, 0, len(b)+15)
+	out = append(out, b[:len(b)-1]...)
+	return append(out, `,"replay":true}`...)
+}
+
+func apiGetWS(w http.ResponseWriter, r *http.Request) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	mustJSON(w, 200, cfg.WS)
+}
+
+func apiSetWS(w http.ResponseWriter, r *http.Request) {
+	var wc WSConfig
+	if err := readJSON(r, &wc); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wc.Replay = clamp(wc.Replay, 0, wsReplayMax)
+	wc.AckRetries = clamp(wc.AckRetries, 0, wsAckRetriesMax)
+
+	cfgMu.Lock()
+	prev := cfg.WS
+	cfg.WS = wc
+	if err := saveConfigLocked(cfg); err != nil {
+		cfg.WS = prev
+		cfgMu.Unlock()
+		writeSaveError(w, err)
+		return
+	}
+	cfgMu.Unlock()
+
+	logger.Printf("WS_CONFIG_SET replay=%d ackRetries=%d", wc.Replay, wc.AckRetries)
+	mustJSON(w, 200, map[string]any{"ok": true, "ws": wc})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------- WS subscriptions ----------
+
+// A client can narrow the signals it gets to some types and a minimum severity,
+// either when it connects (/ws?types=ON,HIT&severity=critical) or at any time by
+// sending
+//
+//	{"op":"subscribe","types":["ON","HIT"],"minSeverity":"critical"}
+//
+// An empty list means every type again, an empty minSeverity every severity. The
+// server answers with a SUBSCRIBED event listing the types in effect, followed by
+// ";severity>=<level>" when a minimum is set. Events (SOURCES_DOWN, LIMIT_REACHED, ...) are not
+// filtered. Each instance runs a single machine, so there are no machine IDs to
+// pick from; clients watching several deployments filter on "instance".
+
+type wsClientMsg struct {
+	Op    string   `json:"op"` // "subscribe" | "ack" (wsack.go)
+	Types []string `json:"types"`
+	Seq   uint64   `json:"seq"`
+	// subscribe only; see severity.go
+	MinSeverity string `json:"minSeverity"`
+}
+
+// parseTypes turns a type list into a filter; nil when it lets everything through.
+func parseTypes(list []string) map[string]bool {
+	var out map[string]bool
+	for _, t := range list {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			if out == nil {
+				out = map[string]bool{}
+			}
+			out[t] = true
+		}
+	}
+	return out
+}
+
+func queryTypes(r *http.Request) map[string]bool {
+	return parseTypes(strings.Split(r.URL.Query().Get("types"), ","))
+}
+
+// querySeverity reads ?severity=; an unknown level means no minimum.
+func querySeverity(r *http.Request) string {
+	sev := r.URL.Query().Get("severity")
+	if normalizeSeverity(&sev) != nil {
+		return ""
+	}
+	return sev
+}
+
+// wants reports whether c is subscribed to signals of type typ and severity sev.
+// Caller holds wsMu.
+func (c *wsConn) wants(typ, sev string) bool {
+	return (len(c.types) == 0 || c.types[typ]) && severityAtLeast(sev, c.minSeverity)
+}
+
+// handleClientMessage applies one text frame sent by c.
+func handleClientMessage(c *wsConn, msg []byte) {
+	var m wsClientMsg
+	if json.Unmarshal(msg, &m) != nil {
+		return
+	}
+	if m.Op == "ack" {
+		c.acknowledge(m.Seq)
+		return
+	}
+	if m.Op != "subscribe" {
+		return
+	}
+	types := parseTypes(m.Types)
+	if normalizeSeverity(&m.MinSeverity) != nil {
+		m.MinSeverity = ""
+	}
+	wsMu.Lock()
+	c.types, c.minSeverity = types, m.MinSeverity
+	wsMu.Unlock()
+
+	names := make([]string, 0, len(types))
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	detail := strings.Join(names, ",")
+	if m.MinSeverity != "" {
+		detail += ";severity>=" + m.MinSeverity
+	}
+	e := Event{
+		Type:     "SUBSCRIBED",
+		Detail:   detail,
+		TimeISO:  time.Now().UTC().Format(time.RFC3339Nano),
+		Instance: instanceName,
+	}
+	b, _ := json.Marshal(e)
+	c.enqueue(wsOut{text: b, bin: encodeEventFrame(e)})
+}